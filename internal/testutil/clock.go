@@ -0,0 +1,36 @@
+// clock.go - A clock for tests that controls the passing of time.
+
+// Package testutil holds helpers shared by the tests of the packages
+// of the payment server.
+package testutil
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a clock that stands still until it is advanced. It
+// serves as the Clock of a server under test.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock showing now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the time the FakeClock shows.
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+// Advance moves the FakeClock on by d.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+}
@@ -0,0 +1,395 @@
+// amount.go - A decimal safe monetary amount.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/mgo.v2/bson"
+	"math/big"
+	"strings"
+)
+
+// amountMaxScale is the largest number of decimal places an Amount
+// will accept.
+const amountMaxScale = 18
+
+// amountMinScale is the number of decimal places an Amount is always
+// rendered with. Amounts with more significant decimal places are
+// rendered with as many as required.
+const amountMinScale = 2
+
+// Amount is a decimal monetary amount held as an integer number of
+// minor units together with the number of decimal places (the scale)
+// those units represent. Amounts are exchanged, in both JSON and
+// bson, in their canonical string form (i.e. "100.20") and are never
+// converted through floating point.
+type Amount struct {
+	units int64
+	scale int
+}
+
+// AmountError is the error returned when a string cannot be parsed as
+// an Amount, or an Amount is not acceptable. Value holds the offending
+// input and Reason, if set, why it is not acceptable. Attribute, if
+// set, is the json name of the attribute holding the amount.
+type AmountError struct {
+	Value     string
+	Reason    string
+	Attribute string
+}
+
+// Error returns the reason the amount in AmountError is invalid.
+func (e *AmountError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("Invalid amount %q: %s", e.Value, e.Reason)
+	}
+	return fmt.Sprintf("Invalid amount %q", e.Value)
+}
+
+// ParseAmount converts the string in s to an Amount. The string must
+// be a plain decimal number: an optional leading minus sign, one or
+// more digits and optionally a decimal point followed by one or more
+// digits. Exponents, thousands separators, leading plus signs and
+// surrounding whitespace are rejected. An empty string parses to the
+// zero Amount.
+func ParseAmount(s string) (Amount, error) {
+	if s == "" {
+		return Amount{}, nil
+	}
+
+	digits := s
+	negative := false
+	if strings.HasPrefix(digits, "-") {
+		negative = true
+		digits = digits[1:]
+	}
+
+	whole, fraction := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		whole, fraction = digits[:i], digits[i+1:]
+		if fraction == "" {
+			return Amount{}, &AmountError{Value: s}
+		}
+	}
+	if whole == "" || !isDigits(whole) || !isDigits(fraction) {
+		return Amount{}, &AmountError{Value: s}
+	}
+
+	// Trailing zeros beyond the minimum scale carry no value, and
+	// the fraction is padded out to the minimum scale.
+	for len(fraction) > amountMinScale && fraction[len(fraction)-1] == '0' {
+		fraction = fraction[:len(fraction)-1]
+	}
+	for len(fraction) < amountMinScale {
+		fraction += "0"
+	}
+	if len(fraction) > amountMaxScale {
+		return Amount{}, &AmountError{Value: s}
+	}
+
+	units, ok := new(big.Int).SetString(whole+fraction, 10)
+	if !ok || !units.IsInt64() {
+		return Amount{}, &AmountError{Value: s}
+	}
+	if negative {
+		units.Neg(units)
+	}
+
+	return newAmount(units, len(fraction)), nil
+}
+
+// parseAmountInput is like ParseAmount for an amount sent by a client
+// in s, which may also be written loosely but unambiguously: with
+// surrounding whitespace, a leading plus sign, or without digits on one
+// side of the decimal point, such as " 100", "+100", "100." or ".5".
+// Such amounts are read as the plain decimal they stand for, so that
+// they are stored in canonical form like any other rather than refused,
+// and a blank amount is zero. Exponents, separators and anything else
+// that is not a decimal number are still refused, naming the amount as
+// sent.
+func parseAmountInput(s string) (Amount, error) {
+	digits := strings.TrimSpace(s)
+	if digits == "" {
+		return Amount{}, nil
+	}
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	} else {
+		digits = strings.TrimPrefix(digits, "+")
+	}
+	if digits != "." {
+		if strings.HasPrefix(digits, ".") {
+			digits = "0" + digits
+		}
+		if strings.HasSuffix(digits, ".") {
+			digits += "0"
+		}
+	}
+	if digits == "" || !isDigits(digits[:1]) {
+		return Amount{}, &AmountError{Value: s}
+	}
+	amount, err := ParseAmount(sign + digits)
+	if err != nil {
+		return Amount{}, &AmountError{Value: s}
+	}
+	return amount, nil
+}
+
+// MustParseAmount is like ParseAmount but panics if s is not a valid
+// amount. It is intended for constants and tests.
+func MustParseAmount(s string) Amount {
+	a, err := ParseAmount(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// String returns the canonical decimal form of the Amount, always
+// with at least two decimal places.
+func (a Amount) String() string {
+	a = a.normalize()
+	digits := new(big.Int).Abs(big.NewInt(a.units)).String()
+	for len(digits) <= a.scale {
+		digits = "0" + digits
+	}
+
+	sign := ""
+	if a.units < 0 {
+		sign = "-"
+	}
+	point := len(digits) - a.scale
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+// Add returns the sum of the Amount and b. The result has the larger
+// of the two scales.
+func (a Amount) Add(b Amount) Amount {
+	scale := a.scale
+	if b.scale > scale {
+		scale = b.scale
+	}
+	return newAmount(new(big.Int).Add(a.rescale(scale), b.rescale(scale)), scale)
+}
+
+// Cmp compares the Amount with b and returns -1 if the Amount is less
+// than b, 0 if they are equal and +1 if the Amount is greater than b.
+func (a Amount) Cmp(b Amount) int {
+	scale := a.scale
+	if b.scale > scale {
+		scale = b.scale
+	}
+	return a.rescale(scale).Cmp(b.rescale(scale))
+}
+
+// Equal returns true if the Amount and b represent the same value,
+// regardless of scale.
+func (a Amount) Equal(b Amount) bool {
+	return a.Cmp(b) == 0
+}
+
+// Sign returns -1, 0 or +1 depending on whether the Amount is
+// negative, zero or positive.
+func (a Amount) Sign() int {
+	switch {
+	case a.units < 0:
+		return -1
+	case a.units > 0:
+		return 1
+	}
+	return 0
+}
+
+// Rat returns the Amount as an exact rational number.
+func (a Amount) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(a.units),
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(a.scale)), nil))
+}
+
+// Decimals returns the number of decimal places of the Amount in
+// canonical form.
+func (a Amount) Decimals() int {
+	return a.normalize().scale
+}
+
+// SignificantDecimals returns the number of decimal places of the
+// Amount without its trailing zeros, none for a whole amount such as
+// "100.00".
+func (a Amount) SignificantDecimals() int {
+	units, scale := a.units, a.scale
+	for scale > 0 && units%10 == 0 {
+		units /= 10
+		scale--
+	}
+	return scale
+}
+
+// MinorUnits returns the Amount as a whole number of hundredths, the
+// minor units of most currencies, and false if the Amount has more
+// than two decimal places or is too large to be held that way.
+func (a Amount) MinorUnits() (int64, bool) {
+	if a.scale > amountMinScale {
+		return 0, false
+	}
+	units := a.rescale(amountMinScale)
+	if !units.IsInt64() {
+		return 0, false
+	}
+	return units.Int64(), true
+}
+
+// IsZero returns true if the Amount is zero.
+func (a Amount) IsZero() bool {
+	return a.units == 0
+}
+
+// MarshalJSON emits the Amount as a JSON string in canonical form.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON parses a JSON string into the Amount, accepting the
+// loose forms clients write amounts in (see parseAmountInput). JSON
+// numbers are rejected to avoid floating point conversion by clients,
+// and a JSON null leaves the Amount untouched.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return &AmountError{Value: string(data)}
+	}
+	parsed, err := parseAmountInput(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// EncodeMsgpack emits the Amount as a MessagePack string in canonical
+// form, as MarshalJSON does in JSON.
+func (a Amount) EncodeMsgpack(encoder *msgpack.Encoder) error {
+	return encoder.EncodeString(a.String())
+}
+
+// DecodeMsgpack parses a MessagePack string into the Amount. As with
+// UnmarshalJSON numbers are rejected, and nil leaves the Amount
+// untouched.
+func (a *Amount) DecodeMsgpack(decoder *msgpack.Decoder) error {
+	value, err := decoder.DecodeInterface()
+	if err != nil || value == nil {
+		return err
+	}
+	s, ok := value.(string)
+	if !ok {
+		return &AmountError{Value: fmt.Sprint(value)}
+	}
+	parsed, err := parseAmountInput(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// GetBSON stores the Amount in the backing store as a string in
+// canonical form.
+func (a Amount) GetBSON() (interface{}, error) {
+	return a.String(), nil
+}
+
+// SetBSON parses an Amount stored as a string in the backing store.
+func (a *Amount) SetBSON(raw bson.Raw) error {
+	var s string
+	if err := raw.Unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// newAmount is a convenience function that builds an Amount from
+// units at the scale in scale. Every zero amount is represented by
+// the zero Amount, whatever its scale, so that equal amounts always
+// have equal representations.
+func newAmount(units *big.Int, scale int) Amount {
+	if units.Sign() == 0 {
+		return Amount{}
+	}
+	return Amount{units: units.Int64(), scale: scale}
+}
+
+// roundAmount is a convenience function that returns the Amount
+// nearest the rational number in r with no more than decimals decimal
+// places, rounding halves away from zero, so that a conversion is
+// rounded once, at the end, rather than at each step. false is
+// returned if the Amount cannot hold it.
+func roundAmount(r *big.Rat, decimals int) (Amount, bool) {
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(factor))
+	units, remainder := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	if new(big.Int).Abs(remainder.Lsh(remainder, 1)).Cmp(scaled.Denom()) >= 0 {
+		units.Add(units, big.NewInt(int64(scaled.Sign())))
+	}
+	if !units.IsInt64() {
+		return Amount{}, false
+	}
+	return newAmount(units, decimals), true
+}
+
+// normalize raises the scale of the Amount to the minimum scale.
+func (a Amount) normalize() Amount {
+	if a.scale >= amountMinScale {
+		return a
+	}
+	return Amount{units: a.rescale(amountMinScale).Int64(), scale: amountMinScale}
+}
+
+// rescale returns the units of the Amount expressed at the scale in
+// scale, which must not be lower than the Amount's own scale.
+func (a Amount) rescale(scale int) *big.Int {
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-a.scale)), nil)
+	return factor.Mul(factor, big.NewInt(a.units))
+}
+
+// isDigits is a convenience function that returns true if every
+// character in s is an ASCII digit.
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseAmountLimits parses the per currency amount limits in limits, a
+// comma separated list of currency=amount pairs. An empty list imposes
+// no limits.
+func ParseAmountLimits(limits string) (map[string]Amount, error) {
+	parsed := map[string]Amount{}
+	for _, pair := range strings.Split(limits, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid amount limit %q", pair)
+		}
+		amount, err := ParseAmount(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, err
+		}
+		parsed[strings.TrimSpace(fields[0])] = amount
+	}
+	return parsed, nil
+}
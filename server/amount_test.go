@@ -0,0 +1,169 @@
+// amount_test.go
+
+package server
+
+import (
+	"encoding/json"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+// Test parsing of valid amounts. Each input should parse without
+// error and render back in canonical form.
+func TestParseAmountCanonical(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"100", "100.00"},
+		{"100.2", "100.20"},
+		{"100.21", "100.21"},
+		{"0100.20", "100.20"},
+		{"100.20000", "100.20"},
+		{"100.205", "100.205"},
+		{"0", "0.00"},
+		{"0.00", "0.00"},
+		{"-0", "0.00"},
+		{"0.5", "0.50"},
+		{"0.001", "0.001"},
+		{"-5.1", "-5.10"},
+		{"", "0.00"},
+		{"92233720368547758.07", "92233720368547758.07"},
+	}
+	for _, c := range cases {
+		a, err := ParseAmount(c.in)
+		if err != nil {
+			t.Errorf("ParseAmount(%q) returned error %v", c.in, err)
+			continue
+		}
+		if a.String() != c.want {
+			t.Errorf("ParseAmount(%q) = %s, expected %s", c.in, a, c.want)
+		}
+	}
+}
+
+// Test parsing of invalid amounts. Each input should be rejected
+// with an AmountError.
+func TestParseAmountRejected(t *testing.T) {
+	cases := []string{
+		"1e2",
+		"1E2",
+		"+100",
+		" 100",
+		"100 ",
+		"1,000.00",
+		"100.",
+		".5",
+		"-",
+		"--1",
+		"abc",
+		"0x10",
+		"NaN",
+		"Inf",
+		"1.2.3",
+		"92233720368547758.08",
+		"1.0000000000000000001",
+	}
+	for _, in := range cases {
+		_, err := ParseAmount(in)
+		if err == nil {
+			t.Errorf("ParseAmount(%q) expected an error", in)
+			continue
+		}
+		if _, ok := err.(*AmountError); !ok {
+			t.Errorf("ParseAmount(%q) returned %T, expected *AmountError", in, err)
+		}
+	}
+}
+
+// Test JSON round-tripping of amounts. Marshalling a decoded amount
+// should always produce the canonical string.
+func TestAmountJSONRoundTrip(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{`"100"`, `"100.00"`},
+		{`"100.2"`, `"100.20"`},
+		{`"0100.20"`, `"100.20"`},
+		{`"5.00"`, `"5.00"`},
+		{`" 100.5 "`, `"100.50"`},
+		{`"+100"`, `"100.00"`},
+		{`".5"`, `"0.50"`},
+		{`"-.5"`, `"-0.50"`},
+		{`"100."`, `"100.00"`},
+	}
+	for _, c := range cases {
+		var a Amount
+		if err := json.Unmarshal([]byte(c.in), &a); err != nil {
+			t.Errorf("Unmarshal(%s) returned error %v", c.in, err)
+			continue
+		}
+		out, _ := json.Marshal(a)
+		if string(out) != c.want {
+			t.Errorf("Marshal(Unmarshal(%s)) = %s, expected %s", c.in, out, c.want)
+		}
+	}
+
+	for _, in := range []string{`"1e2"`, `100`, `100.2`, `true`, `{}`, `"."`, `"+-1"`, `"-+1"`,
+		`"1 000"`} {
+		var a Amount
+		if err := json.Unmarshal([]byte(in), &a); err == nil {
+			t.Errorf("Unmarshal(%s) expected an error", in)
+		}
+	}
+}
+
+// Test bson round-tripping of amounts. The amount should be stored
+// as a canonical string and decode to an equal amount.
+func TestAmountBSONRoundTrip(t *testing.T) {
+	type doc struct {
+		Amount Amount `bson:"amount"`
+	}
+	for _, in := range []string{"100", "100.2", "0100.20", "0", "-3.125"} {
+		before := doc{Amount: MustParseAmount(in)}
+		data, err := bson.Marshal(before)
+		if err != nil {
+			t.Errorf("bson.Marshal(%q) returned error %v", in, err)
+			continue
+		}
+		var raw bson.M
+		bson.Unmarshal(data, &raw)
+		if raw["amount"] != before.Amount.String() {
+			t.Errorf("bson stored %v, expected %q", raw["amount"], before.Amount.String())
+		}
+		var after doc
+		if err := bson.Unmarshal(data, &after); err != nil {
+			t.Errorf("bson.Unmarshal(%q) returned error %v", in, err)
+			continue
+		}
+		if after != before {
+			t.Errorf("bson round trip of %q gave %s", in, after.Amount)
+		}
+	}
+}
+
+// Test amount arithmetic and comparison across differing scales.
+func TestAmountArithmetic(t *testing.T) {
+	sum := MustParseAmount("100.2").Add(MustParseAmount("0.005"))
+	if sum.String() != "100.205" {
+		t.Errorf("Add gave %s, expected 100.205", sum)
+	}
+	sum = MustParseAmount("-5.00").Add(MustParseAmount("5"))
+	if sum != (Amount{}) || !sum.IsZero() {
+		t.Errorf("Add gave %#v, expected the zero Amount", sum)
+	}
+	if !MustParseAmount("100").Equal(MustParseAmount("100.000")) {
+		t.Error("100 and 100.000 should be equal")
+	}
+	if MustParseAmount("100.01").Cmp(MustParseAmount("100.001")) != 1 {
+		t.Error("100.01 should compare greater than 100.001")
+	}
+	if MustParseAmount("-1").Cmp(MustParseAmount("0")) != -1 {
+		t.Error("-1 should compare less than 0")
+	}
+	if MustParseAmount("-1").Sign() != -1 || MustParseAmount("0").Sign() != 0 ||
+		MustParseAmount("1").Sign() != 1 {
+		t.Error("Sign returned an unexpected value")
+	}
+}
@@ -0,0 +1,136 @@
+// anonymise.go - Irreversible erasure of the personal data in payment
+// records.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"time"
+)
+
+// anonymisationsCollection is the name of the collection auditing the
+// anonymisation of payment records.
+const anonymisationsCollection = "anonymisations"
+
+// Anonymisation is the outcome of the anonymisation of a payment
+// record, and its audit record. Fields holds the stored names of the
+// personal fields that were blanked, none if the payment record had
+// already been anonymised. RequestedBy is the organisation of the API
+// key the anonymisation was requested with, if it is scoped to one.
+// Payment, the anonymised payment record, is returned but never
+// stored.
+type Anonymisation struct {
+	ID             bson.ObjectId `bson:"_id" json:"-"`
+	PaymentID      string        `bson:"payment_id" json:"id"`
+	OrganisationID string        `bson:"organisation_id" json:"organisation_id"`
+	Fields         []string      `bson:"fields" json:"fields"`
+	Archived       bool          `bson:"archived" json:"archived,omitempty"`
+	RequestedBy    string        `bson:"requested_by,omitempty" json:"-"`
+	AnonymisedAt   time.Time     `bson:"anonymised_at" json:"anonymised_at"`
+	Payment        *Payment      `bson:"-" json:"data"`
+}
+
+// anonymisePayment is a convenience function that blanks the personal
+// data of the parties of Payment, their names, addresses and account
+// numbers, and returns the stored names of the fields it blanked. The
+// amounts, currencies, dates, references and bank identifiers needed
+// for accounting are kept.
+func anonymisePayment(p *Payment) []string {
+	beneficiary, debtor := p.beneficiaryParty(), p.debtorParty()
+	personal := []struct {
+		name  string
+		value *string
+	}{
+		{"attributes.beneficiary_party.account_name", &beneficiary.AccountName},
+		{"attributes.beneficiary_party.account_number", (*string)(&beneficiary.AccountNumber)},
+		{"attributes.beneficiary_party.address", &beneficiary.Address},
+		{"attributes.beneficiary_party.name", &beneficiary.Name},
+		{"attributes.debtor_party.account_name", &debtor.AccountName},
+		{"attributes.debtor_party.account_number", (*string)(&debtor.AccountNumber)},
+		{"attributes.debtor_party.address", &debtor.Address},
+		{"attributes.debtor_party.name", &debtor.Name},
+		{"attributes.sponsor_party.account_number", (*string)(&p.sponsorParty().AccountNumber)},
+	}
+
+	fields := []string{}
+	for _, field := range personal {
+		if *field.value != "" {
+			*field.value = ""
+			fields = append(fields, field.name)
+		}
+	}
+	return fields
+}
+
+// anonymisePaymentRecord is the entry-point dispatcher for the
+// anonymisation of single payment records, for data subject erasure
+// requests. It responds to the URL payment/{id}/anonymise and an
+// appropriate POST request by blanking the personal data of the
+// payment record (see anonymisePayment), in the archive if it has been
+// archived, and responds with the Anonymisation. The erasure cannot be
+// undone: the blanked fields are overwritten in the backing store and
+// the duplicate detection fingerprint recomputed without them. Every
+// anonymisation is audited in the anonymisations collection along with
+// it, and is not made if it cannot be audited. Payment records of
+// other organisations than that of the API key are not found.
+func (server *Server) anonymisePaymentRecord(w http.ResponseWriter, r *http.Request) {
+	p := Payment{ID: mux.Vars(r)["id"], OrganisationID: callerOrganisation(r)}
+
+	count := -1 // a storage failure, unless the lookup runs
+	var payment Payment
+	err := server.storage(r.Context(), "getPayment", p.ID, func() (err error) {
+		count, payment, err = server.store.getPayment(&p)
+		return
+	})
+	if err != nil && count == 0 {
+		err = server.storage(r.Context(), "getArchivedPayment", p.ID, func() (err error) {
+			payment, err = p.modelGetArchivedPayment(server.mongo)
+			return
+		})
+		if err == mgo.ErrNotFound {
+			respondWithError(w, http.StatusNotFound, ErrPaymentNotFound.Error())
+			return
+		}
+	}
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := server.now().UTC()
+	anonymisation := Anonymisation{
+		ID:             bson.NewObjectId(),
+		PaymentID:      payment.ID,
+		OrganisationID: payment.OrganisationID,
+		Fields:         anonymisePayment(&payment),
+		Archived:       payment.Archived,
+		RequestedBy:    callerOrganisation(r),
+		AnonymisedAt:   now,
+	}
+	collection := server.Collection
+	if payment.Archived {
+		collection = server.mongo.archiveCollection()
+	}
+	err = server.storage(r.Context(), "anonymisePayment", p.ID, func() error {
+		return withTransaction(server.mongo, func(tx *transaction) error {
+			if err := tx.recordAnonymisation(anonymisation); err != nil {
+				return err
+			}
+			return payment.modelAnonymisePayment(tx.db, collection, anonymisation.Fields, now)
+		})
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	server.cache.invalidate(p.ID)
+	if !payment.Archived {
+		server.publishEvent(EventUpdated, payment)
+	}
+
+	anonymisation.Payment = &payment
+	respondWith(w, http.StatusOK, anonymisation, negotiatedType(w))
+}
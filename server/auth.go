@@ -0,0 +1,240 @@
+// auth.go - Client API keys scoping requests to an organisation and
+// role.
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+)
+
+// APIKey describes the client holding an API key. Every request made
+// with the key is scoped to the payment records of OrganisationID and
+// limited to the methods permitted by Role. A key without a Role is
+// RoleReadWrite. No more than DailyQuota payment records may be
+// created with the key per UTC day, if it is set (see reserveQuota).
+type APIKey struct {
+	OrganisationID string `json:"organisation_id"`
+	Role           string `json:"role"`
+	DailyQuota     int    `json:"daily_quota,omitempty"`
+	id             string
+}
+
+// The roles an APIKey may carry.
+const (
+	RoleReadOnly  = "read-only"
+	RoleReadWrite = "read-write"
+)
+
+// rolePermissions lists the methods of the routes each role may use.
+// A role missing from the table may use none.
+var rolePermissions = map[string][]string{
+	RoleReadOnly:  {"GET", "HEAD"},
+	RoleReadWrite: {"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+}
+
+// readRoutes lists the routes, by method and path template without
+// the prefix of its version, that only read payment records despite
+// their method. Every role may use them as it would a GET.
+var readRoutes = map[string]bool{
+	"POST /payments/search":    true,
+	"POST /payments/reconcile": true,
+}
+
+// apiKeyContextKey is the request context key under which the APIKey
+// of an authenticated request is stored.
+type apiKeyContextKey struct{}
+
+// authenticate wraps the handler in next so that, if any APIKeys are
+// configured, it is only invoked when the request carries one of them
+// or the AdminKey in the X-API-Key header. Otherwise
+// StatusUnauthorized is returned, and if the role of the APIKey does
+// not permit the method of the matched route StatusForbidden is
+// returned. The APIKey is made available to next through
+// callerOrganisation. Requests made with the AdminKey are neither
+// scoped to an organisation nor limited by role. If no APIKeys are
+// configured next is always invoked.
+func (server *Server) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(server.APIKeys) == 0 {
+			next(w, r)
+			return
+		}
+
+		apiKey, admin, ok := server.lookupAPIKey(r.Header.Get("X-API-Key"))
+		if admin {
+			next(w, r)
+			return
+		} else if !ok {
+			respondWithError(w, http.StatusUnauthorized, "A valid API key is required")
+			return
+		}
+		if !rolePermits(apiKey.Role, r) {
+			respondWithError(w, http.StatusForbidden,
+				"The API key's role does not permit this request")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, apiKey)))
+	}
+}
+
+// lookupAPIKey is a convenience function that returns the APIKey
+// matching the key in presented, or true for admin if it is the
+// AdminKey. If it is neither ok is false.
+func (server *Server) lookupAPIKey(presented string) (apiKey APIKey, admin bool, ok bool) {
+	if server.AdminKey != "" &&
+		subtle.ConstantTimeCompare([]byte(presented), []byte(server.AdminKey)) == 1 {
+		return APIKey{}, true, true
+	}
+	for key, candidate := range server.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(key)) == 1 {
+			candidate.id = apiKeyID(key)
+			return candidate, false, true
+		}
+	}
+	return APIKey{}, false, false
+}
+
+// rolePermits is a convenience function that returns true if the role
+// in role may use the route matched by the request in r, according to
+// rolePermissions and readRoutes. The empty role is RoleReadWrite.
+func rolePermits(role string, r *http.Request) bool {
+	if role == "" {
+		role = RoleReadWrite
+	}
+	methods := []string{r.Method}
+	template := ""
+	if route := mux.CurrentRoute(r); route != nil {
+		if routeMethods, err := route.GetMethods(); err == nil {
+			methods = routeMethods
+		}
+		template, _ = route.GetPathTemplate()
+	}
+	for _, method := range methods {
+		if readRoutes[method+" "+unversionedPath(template)] {
+			method = "GET"
+		}
+		if !roleAllows(role, method) {
+			return false
+		}
+	}
+	return true
+}
+
+// roleAllows is a convenience function that returns true if the role
+// in role may use the method in method, according to rolePermissions.
+func roleAllows(role string, method string) bool {
+	for _, allowed := range rolePermissions[role] {
+		if method == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// callerOrganisation is a convenience function that returns the
+// organisation the request in r is scoped to, or "" if the request is
+// not scoped to an organisation.
+func callerOrganisation(r *http.Request) string {
+	apiKey, _ := r.Context().Value(apiKeyContextKey{}).(APIKey)
+	return apiKey.OrganisationID
+}
+
+// checkPaymentVisible is a convenience function that ascertains the
+// payment record with the Payment ID in id belongs to the organisation
+// the request in r is scoped to. If it does not, as far as the caller
+// is concerned the payment record does not exist: StatusNotFound is
+// emitted to w and false returned. Requests not scoped to an
+// organisation can see every payment record.
+func (server *Server) checkPaymentVisible(w http.ResponseWriter, r *http.Request, id string) bool {
+	if code, err := server.paymentVisibleError(r, id); err != nil {
+		respondWithStorageError(w, r, code, err)
+		return false
+	}
+	return true
+}
+
+// paymentVisibleError is a convenience function that returns the error
+// checkPaymentVisible would emit for the payment record with the
+// Payment ID in id, along with its status, and nil if the payment
+// record is visible to the request in r.
+func (server *Server) paymentVisibleError(r *http.Request, id string) (int, error) {
+	organisation := callerOrganisation(r)
+	if organisation == "" {
+		return http.StatusOK, nil
+	}
+
+	p := Payment{ID: id, OrganisationID: organisation}
+	count := -1 // a storage failure, unless the lookup runs
+	err := server.storage(r.Context(), "getPayment", id, func() (err error) {
+		count, _, err = server.store.getPayment(&p)
+		return
+	})
+	if err != nil && count < 0 {
+		return http.StatusInternalServerError, err
+	} else if err != nil {
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, nil
+}
+
+// errForeignOrganisation is returned for payment records written for
+// an organisation other than that of the API key.
+var errForeignOrganisation = errors.New(
+	"Payments may only be written for the organisation of the API key")
+
+// checkPaymentOrganisation is a convenience function that ascertains
+// the payment record in p, as sent by the client, belongs to the
+// organisation the request in r is scoped to. If it does not
+// StatusForbidden is emitted to w and false returned.
+func checkPaymentOrganisation(w http.ResponseWriter, r *http.Request, p *Payment) bool {
+	if err := paymentOrganisationError(r, p); err != nil {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// paymentOrganisationError is a convenience function that returns
+// errForeignOrganisation if the payment record in p, as sent by the
+// client, does not belong to the organisation the request in r is
+// scoped to, and nil otherwise.
+func paymentOrganisationError(r *http.Request, p *Payment) error {
+	organisation := callerOrganisation(r)
+	if organisation != "" && p.OrganisationID != organisation {
+		return errForeignOrganisation
+	}
+	return nil
+}
+
+// LoadAPIKeys reads the client API keys from the JSON file named by
+// path. An empty path configures no API keys. Every key must carry a
+// known role, or none, and a quota that is not negative.
+func LoadAPIKeys(path string) (map[string]APIKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var apiKeys map[string]APIKey
+	if err := json.Unmarshal(data, &apiKeys); err != nil {
+		return nil, fmt.Errorf("Invalid API keys file %s: %s", path, err)
+	}
+	for _, apiKey := range apiKeys {
+		if _, ok := rolePermissions[apiKey.Role]; apiKey.Role != "" && !ok {
+			return nil, fmt.Errorf("Unknown API key role %q in %s", apiKey.Role, path)
+		}
+		if apiKey.DailyQuota < 0 {
+			return nil, fmt.Errorf("Negative API key quota %d in %s", apiKey.DailyQuota, path)
+		}
+	}
+	return apiKeys, nil
+}
@@ -0,0 +1,354 @@
+// batch.go - Batch creation, lookup and deletion of payment records
+// with per record results.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"net/http"
+)
+
+// The statuses a payment record of a batch may be given in its
+// BatchItemResult.
+const (
+	BatchCreated   = "created"
+	BatchConflict  = "conflict"
+	BatchInvalid   = "invalid"
+	BatchForbidden = "forbidden"
+	BatchFound     = "found"
+	BatchDeleted   = "deleted"
+	BatchNotFound  = "not_found"
+	BatchError     = "error"
+
+	BatchNotCommitted  = "not_committed"
+	BatchQuotaExceeded = "quota_exceeded"
+)
+
+// errBatchNotCommitted describes the payment records of an atomic
+// batch that were not created because another failed.
+var errBatchNotCommitted = errors.New("Not created, as another payment of the batch failed")
+
+// BatchResult is the outcome of a batch request, shared by every batch
+// endpoint. Results holds one BatchItemResult per payment record of
+// the batch, in the order of the request, and Succeeded and Failed
+// count them.
+type BatchResult struct {
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []BatchItemResult `json:"results"`
+}
+
+// BatchItemResult is the outcome for a single payment record of a
+// batch, identified by its position in the batch and its Payment ID.
+// Error describes why it failed, and Data holds the payment record
+// found by a lookup.
+type BatchItemResult struct {
+	Index  int      `json:"index"`
+	ID     string   `json:"id"`
+	Status string   `json:"status"`
+	Error  string   `json:"error,omitempty"`
+	Data   *Payment `json:"data,omitempty"`
+}
+
+// newBatchResult returns an empty BatchResult.
+func newBatchResult() *BatchResult {
+	return &BatchResult{Results: []BatchItemResult{}}
+}
+
+// succeed records the success of the payment record in item.
+func (batch *BatchResult) succeed(item BatchItemResult) {
+	batch.Succeeded++
+	batch.Results = append(batch.Results, item)
+}
+
+// fail records the failure of the payment record in item, described
+// by err.
+func (batch *BatchResult) fail(item BatchItemResult, err error) {
+	batch.Failed++
+	item.Error = err.Error()
+	batch.Results = append(batch.Results, item)
+}
+
+// abort records that no payment record of the batch was committed, as
+// it was rolled back: those that succeeded are given
+// BatchNotCommitted and counted as failed.
+func (batch *BatchResult) abort() {
+	for i := range batch.Results {
+		if batch.Results[i].Status == BatchCreated {
+			batch.Results[i].Status = BatchNotCommitted
+			batch.Results[i].Error = errBatchNotCommitted.Error()
+		}
+	}
+	batch.Succeeded, batch.Failed = 0, len(batch.Results)
+}
+
+// status returns the status of the response to the batch: code if
+// every payment record succeeded, otherwise StatusMultiStatus.
+func (batch *BatchResult) status(code int) int {
+	if batch.Failed > 0 {
+		return http.StatusMultiStatus
+	}
+	return code
+}
+
+// initializeBatchRoutes registers the batch URL on router, which
+// requires an API key if any are configured.
+func (server *Server) initializeBatchRoutes(router *mux.Router) {
+	router.HandleFunc("/payments/batch",
+		server.authenticate(server.acceptGzip(server.createPayments))).Methods("POST")
+	router.HandleFunc("/payments/batch",
+		server.authenticate(server.lookupPayments)).Methods("GET")
+	router.HandleFunc("/payments/batch",
+		server.authenticate(server.deletePaymentsByID)).Methods("DELETE")
+}
+
+// createPayments is the entry-point dispatcher for the creation of a
+// batch of payment records. It responds to the URL payments/batch and
+// an appropriate POST request carrying a payments collection of no
+// more than maxBatchSize payment records. Each payment record is
+// subjected to the same checks as createPayment and created on its
+// own, so that the failure of one does not prevent the creation of
+// the others. StatusCreated is returned if every payment record was
+// created, and StatusMultiStatus otherwise, along with a BatchResult.
+// Each payment record created is taken from the daily quota of the
+// API key, and those beyond it are given BatchQuotaExceeded.
+// With atomic=true the batch is created within a transaction instead:
+// once a payment record fails the others are only checked, the
+// payment records already created are removed again, and the status
+// createPayment would have returned for the first failure is returned
+// with the payment records that did not fail marked BatchNotCommitted.
+func (server *Server) createPayments(w http.ResponseWriter, r *http.Request) {
+	var envelope struct {
+		P []json.RawMessage `json:"data"`
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+		respondWithDecodeError(w, err, "Invalid payload request")
+		return
+	}
+	if len(envelope.P) > maxBatchSize {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("No more than %d payments may be sent in a batch", maxBatchSize))
+		return
+	}
+
+	atomic := r.FormValue("atomic") == "true"
+	batch := newBatchResult()
+	var created []Payment
+	failure := 0
+	var quota *QuotaStatus
+	err := withTransaction(server.mongo, func(tx *transaction) error {
+		seen := map[string]bool{}
+		for index, record := range envelope.P {
+			var p Payment
+			item := BatchItemResult{Index: index}
+			code, err := http.StatusBadRequest, json.Unmarshal(record, &p)
+			if err == nil {
+				server.assignID(&p)
+				server.normaliseText(&p)
+				item.ID = p.ID
+				code, err = server.checkNewPayment(r, &p)
+			}
+			if err == nil && seen[p.ID] {
+				code, err = http.StatusBadRequest, ErrPaymentExists
+			}
+			if err == nil && failure == 0 {
+				var reserved *QuotaStatus
+				if reserved, err = server.reserveQuota(r); reserved != nil {
+					quota = reserved
+				}
+				if err == ErrQuotaExceeded {
+					code = http.StatusTooManyRequests
+				} else if err != nil {
+					code = http.StatusInternalServerError
+				}
+			}
+			if err == nil && failure == 0 {
+				err = server.storage(r.Context(), "createPayment", p.ID, func() error {
+					return tx.createPayment(&p, server.now().UTC())
+				})
+				if err != nil {
+					server.releaseQuota(r, quota)
+				} else if quota != nil {
+					tx.onRollback(func(db *mongoStore) error {
+						server.releaseQuota(r, quota)
+						return nil
+					})
+				}
+				if mgo.IsDup(err) {
+					code, err = http.StatusBadRequest, ErrPaymentExists
+				} else if err != nil {
+					code = http.StatusInternalServerError
+				}
+			}
+			if err != nil {
+				err = publicError(r.Context(), err)
+				code = storageErrorStatus(err, code)
+				item.Status = batchCreateStatus(code, err)
+				batch.fail(item, err)
+				if atomic && failure == 0 {
+					failure = code
+				}
+				continue
+			}
+
+			seen[p.ID] = true
+			created = append(created, p)
+			server.cache.invalidate(p.ID)
+			item.Status = BatchCreated
+			batch.succeed(item)
+		}
+		if failure != 0 {
+			return errBatchNotCommitted
+		}
+		return nil
+	})
+
+	setQuotaHeaders(w, quota)
+	if failure != 0 {
+		for _, item := range batch.Results {
+			server.cache.invalidate(item.ID)
+		}
+		server.noteDeletion()
+		if err != errBatchNotCommitted {
+			respondWithStorageError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		batch.abort()
+		respondWith(w, failure, batch, negotiatedType(w))
+		return
+	}
+	for _, p := range created {
+		server.publishEvent(EventCreated, p)
+	}
+	respondWith(w, batch.status(http.StatusCreated), batch, negotiatedType(w))
+}
+
+// lookupPayments is the entry-point dispatcher for the retrieval of a
+// batch of payment records. It responds to the URL payments/batch and
+// an appropriate GET request with ids, a comma separated list of no
+// more than maxBatchSize Payment IDs. Payment records of other
+// organisations than that of the API key are not found. StatusOK is
+// returned if every payment record was found, and StatusMultiStatus
+// otherwise, along with a BatchResult holding the payment records.
+func (server *Server) lookupPayments(w http.ResponseWriter, r *http.Request) {
+	filter, ok := batchFilter(w, r)
+	if !ok {
+		return
+	}
+
+	var payments []Payment
+	ctx := withQueryFilter(r.Context(), filter)
+	err := server.storage(ctx, "getPayments", "", func() (err error) {
+		payments, err = filter.modelGetPayments(server.mongo)
+		return
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	byID := map[string]*Payment{}
+	for i := range payments {
+		byID[payments[i].ID] = &payments[i]
+	}
+	batch := newBatchResult()
+	for index, id := range filter.IDs {
+		item := BatchItemResult{Index: index, ID: id}
+		if payment, ok := byID[id]; ok {
+			item.Status, item.Data = BatchFound, payment
+			batch.succeed(item)
+		} else {
+			item.Status = BatchNotFound
+			batch.fail(item, ErrPaymentNotFound)
+		}
+	}
+
+	respondWith(w, batch.status(http.StatusOK), batch, negotiatedType(w))
+}
+
+// deletePaymentsByID is the entry-point dispatcher for the deletion of
+// a batch of payment records. It responds to the URL payments/batch
+// and an appropriate DELETE request with ids, a comma separated list
+// of no more than maxBatchSize Payment IDs. Payment records of other
+// organisations than that of the API key are not found. StatusOK is
+// returned if every payment record was deleted, and StatusMultiStatus
+// otherwise, along with a BatchResult.
+func (server *Server) deletePaymentsByID(w http.ResponseWriter, r *http.Request) {
+	filter, ok := batchFilter(w, r)
+	if !ok {
+		return
+	}
+
+	var payments []Payment
+	err := server.storage(r.Context(), "deletePayments", "", func() (err error) {
+		payments, err = filter.modelDeletePayments(server.mongo)
+		return
+	})
+	for _, id := range filter.IDs {
+		server.cache.invalidate(id)
+	}
+	server.noteDeletion()
+	deleted := map[string]bool{}
+	for _, payment := range payments {
+		deleted[payment.ID] = true
+		server.publishEvent(EventDeleted, payment)
+	}
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	batch := newBatchResult()
+	for index, id := range filter.IDs {
+		item := BatchItemResult{Index: index, ID: id}
+		if deleted[id] {
+			item.Status = BatchDeleted
+			batch.succeed(item)
+		} else {
+			item.Status = BatchNotFound
+			batch.fail(item, ErrPaymentNotFound)
+		}
+	}
+
+	respondWith(w, batch.status(http.StatusOK), batch, negotiatedType(w))
+}
+
+// batchFilter is a convenience function that returns the PaymentFilter
+// selecting the payment records named by ids in the request in r,
+// scoped to the organisation of the request. If no ids, or more than
+// maxBatchSize, are named StatusBadRequest is emitted to w and false
+// returned.
+func batchFilter(w http.ResponseWriter, r *http.Request) (PaymentFilter, bool) {
+	filter := PaymentFilter{
+		IDs:            requestedIDs(r.FormValue("ids")),
+		OrganisationID: callerOrganisation(r),
+	}
+	if len(filter.IDs) == 0 || len(filter.IDs) > maxBatchSize {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("Between 1 and %d ids must be requested", maxBatchSize))
+		return filter, false
+	}
+	return filter, true
+}
+
+// batchCreateStatus is a convenience function that returns the status
+// of a payment record of a batch whose creation failed with err, and
+// code the status createPayment would have returned.
+func batchCreateStatus(code int, err error) string {
+	switch {
+	case err == ErrPaymentExists || code == http.StatusConflict:
+		return BatchConflict
+	case code == http.StatusForbidden:
+		return BatchForbidden
+	case code == http.StatusTooManyRequests:
+		return BatchQuotaExceeded
+	case code >= http.StatusInternalServerError:
+		return BatchError
+	}
+	return BatchInvalid
+}
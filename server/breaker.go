@@ -0,0 +1,219 @@
+// breaker.go - A circuit breaker failing storage operations fast while
+// the backing store is unavailable.
+
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// breakerMetrics counts the times the circuit breakers of the process
+// opened and the storage operations they refused. It is published
+// through expvar.
+var breakerMetrics = expvar.NewMap("circuit_breaker")
+
+// The states of a circuit breaker. A closed breaker lets every storage
+// operation through, an open one refuses them all, and a half-open one
+// lets a single operation through to probe whether the backing store
+// has recovered.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// breakerCooldown is how long a circuit breaker stays open unless
+// configured otherwise.
+const breakerCooldown = 30 * time.Second
+
+// CircuitOpenError is the error of a storage operation refused by an
+// open circuit breaker. RetryAfter is the time left until the breaker
+// lets an operation through again.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+// Error describes the CircuitOpenError.
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("The database is unavailable, try again in %s",
+		e.RetryAfter.Round(time.Second))
+}
+
+// circuitBreaker stops storage operations reaching the backing store
+// once it fails repeatedly, so that requests fail promptly instead of
+// each waiting for its own timeout and adding to the load of a
+// struggling database. After threshold consecutive transient failures
+// (see isTransient) the breaker opens and refuses every operation with
+// a CircuitOpenError. Once cooldown has passed it half-opens and lets
+// a single operation through: if that succeeds the breaker closes,
+// otherwise it opens again. Operations failing with an error that is
+// not transient, such as a payment record not being found, show the
+// backing store is reachable and count as successes. A nil
+// circuitBreaker is valid and lets every operation through.
+type circuitBreaker struct {
+	mu         sync.Mutex
+	threshold  int
+	cooldown   time.Duration
+	failures   int
+	state      string
+	opened     time.Time
+	probing    bool
+	timeSource func() time.Time
+}
+
+// newCircuitBreaker returns a circuitBreaker opening after threshold
+// consecutive failures for cooldown, or breakerCooldown if cooldown is
+// not positive. If threshold is not positive nil is returned.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	if cooldown <= 0 {
+		cooldown = breakerCooldown
+	}
+	return &circuitBreaker{
+		threshold:  threshold,
+		cooldown:   cooldown,
+		state:      BreakerClosed,
+		timeSource: time.Now,
+	}
+}
+
+// do invokes operation unless the breaker is open, in which case a
+// CircuitOpenError is returned, and records its outcome.
+func (breaker *circuitBreaker) do(operation func() error) error {
+	if breaker == nil {
+		return operation()
+	}
+	if err := breaker.allow(); err != nil {
+		return err
+	}
+	err := operation()
+	breaker.record(isTransient(err))
+	return err
+}
+
+// allow returns a CircuitOpenError if the breaker refuses an operation
+// now, half-opening it once the cooldown has passed.
+func (breaker *circuitBreaker) allow() error {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if breaker.state == BreakerOpen {
+		if wait := breaker.opened.Add(breaker.cooldown).Sub(breaker.timeSource()); wait > 0 {
+			breakerMetrics.Add("rejected", 1)
+			return &CircuitOpenError{RetryAfter: wait}
+		}
+		breaker.state = BreakerHalfOpen
+	}
+	if breaker.state == BreakerHalfOpen {
+		if breaker.probing {
+			breakerMetrics.Add("rejected", 1)
+			return &CircuitOpenError{RetryAfter: time.Second}
+		}
+		breaker.probing = true
+	}
+	return nil
+}
+
+// record notes the outcome of an operation the breaker let through,
+// opening the breaker if it failed once too often or failed to probe
+// the backing store, and closing it if it succeeded.
+func (breaker *circuitBreaker) record(failed bool) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	probe := breaker.state == BreakerHalfOpen
+	breaker.probing = false
+	if !failed {
+		breaker.failures = 0
+		breaker.state = BreakerClosed
+		return
+	}
+	breaker.failures++
+	if probe || breaker.failures >= breaker.threshold {
+		if breaker.state == BreakerClosed {
+			breakerMetrics.Add("opened", 1)
+		}
+		breaker.state = BreakerOpen
+		breaker.opened = breaker.timeSource()
+	}
+}
+
+// currentState returns the state of the breaker. A nil breaker is
+// always closed.
+func (breaker *circuitBreaker) currentState() string {
+	if breaker == nil {
+		return BreakerClosed
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.state
+}
+
+// Health describes the state of the server: its Status is ok, or
+// degraded while the circuit breaker in front of the backing store is
+// not closed, and the Version of the build it runs.
+type Health struct {
+	Status  string  `json:"status"`
+	Breaker string  `json:"circuit_breaker"`
+	Version Version `json:"version"`
+}
+
+// storage invokes the storage operation in fn, named by operation and
+// concerning the payment record with the Payment ID in id if it is
+// populated, within a span of the trace in ctx and logged if it is
+// slow (see watchStorage), through the circuit breaker, retrying it
+// across transient failures (see retryPolicy) unless it is one of the
+// unretriedOperations. The operation is counted once by the breaker
+// however often it is tried.
+func (server *Server) storage(ctx context.Context, operation string, id string,
+	fn func() error) error {
+	return server.watchStorage(ctx, operation, id, func() error {
+		return server.breaker.do(func() error {
+			if unretriedOperations[operation] {
+				return fn()
+			}
+			return server.retry.do(ctx, fn)
+		})
+	})
+}
+
+// getHealth is the entry-point dispatcher for the health of the
+// server. It responds to the URL health and an appropriate GET request
+// with the Health of the server. No API key is required.
+func (server *Server) getHealth(w http.ResponseWriter, r *http.Request) {
+	health := Health{Status: "ok", Breaker: server.breaker.currentState(),
+		Version: currentVersion()}
+	if health.Breaker != BreakerClosed {
+		health.Status = "degraded"
+	}
+	respondWith(w, http.StatusOK, health, negotiatedType(w))
+}
+
+// respondWithStorageError is a convenience function that emits the
+// failure of a storage operation of the request in r in err with the
+// status in code, or StatusServiceUnavailable with a Retry-After header
+// if the circuit breaker refused it. Errors of the backing store are
+// emitted only as their StorageError, with its status (see
+// publicError).
+func respondWithStorageError(w http.ResponseWriter, r *http.Request, code int, err error) {
+	err = publicError(r.Context(), err)
+	if open, ok := err.(*CircuitOpenError); ok {
+		seconds := int(math.Ceil(open.RetryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		respondWithError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	respondWithInvalid(w, storageErrorStatus(err, code), err)
+}
@@ -0,0 +1,112 @@
+// breaker_test.go
+
+package server
+
+import (
+	"errors"
+	"github.com/DeltaPine/payment_server/internal/testutil"
+	"io"
+	"testing"
+	"time"
+)
+
+// failingStore is a backing store that fails with a transient error
+// while down is set, and counts the operations reaching it.
+type failingStore struct {
+	down  bool
+	calls int
+}
+
+// operation fails with io.EOF if the store is down.
+func (store *failingStore) operation() error {
+	store.calls++
+	if store.down {
+		return io.EOF
+	}
+	return nil
+}
+
+// Test the breaker opens after the configured number of consecutive
+// failures, fails fast while open, and half-opens after its cooldown
+// to let a single probe through.
+func TestCircuitBreaker(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2017, 1, 18, 9, 0, 0, 0, time.UTC))
+	breaker := newCircuitBreaker(3, time.Minute)
+	breaker.timeSource = clock.Now
+	store := &failingStore{down: true}
+
+	for i := 0; i < 2; i++ {
+		if err := breaker.do(store.operation); err != io.EOF {
+			t.Errorf("Expected the failure of the store. Got %v", err)
+		}
+	}
+	if err := breaker.do(func() error { return errors.New("not found") }); err == nil {
+		t.Errorf("Expected the error of the operation")
+	}
+	if state := breaker.currentState(); state != BreakerClosed {
+		t.Errorf("Expected an error that is not transient to reset the failures. Got %s", state)
+	}
+
+	for i := 0; i < 3; i++ {
+		breaker.do(store.operation)
+	}
+	if state := breaker.currentState(); state != BreakerOpen {
+		t.Fatalf("Expected the breaker to open after 3 failures. Got %s", state)
+	}
+
+	calls := store.calls
+	clock.Advance(20 * time.Second)
+	err := breaker.do(store.operation)
+	if open, ok := err.(*CircuitOpenError); !ok || open.RetryAfter != 40*time.Second {
+		t.Errorf("Expected the open breaker to refuse the operation for 40s. Got %v", err)
+	}
+	if store.calls != calls {
+		t.Errorf("Expected the open breaker not to reach the store")
+	}
+
+	clock.Advance(40 * time.Second)
+	if err := breaker.do(store.operation); err != io.EOF || store.calls != calls+1 {
+		t.Errorf("Expected the half-open breaker to let a probe through. Got %v", err)
+	}
+	if state := breaker.currentState(); state != BreakerOpen {
+		t.Errorf("Expected a failed probe to open the breaker again. Got %s", state)
+	}
+
+	clock.Advance(time.Minute)
+	store.down = false
+	probed := make(chan struct{})
+	resume := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- breaker.do(func() error {
+			close(probed)
+			<-resume
+			return store.operation()
+		})
+	}()
+	<-probed
+	if state := breaker.currentState(); state != BreakerHalfOpen {
+		t.Errorf("Expected the breaker to be half-open while probing. Got %s", state)
+	}
+	if _, ok := breaker.do(store.operation).(*CircuitOpenError); !ok {
+		t.Errorf("Expected the half-open breaker to refuse a second operation")
+	}
+	close(resume)
+	if err := <-done; err != nil {
+		t.Errorf("Expected the probe to succeed. Got %v", err)
+	}
+	if state := breaker.currentState(); state != BreakerClosed {
+		t.Errorf("Expected a successful probe to close the breaker. Got %s", state)
+	}
+	if err := breaker.do(store.operation); err != nil {
+		t.Errorf("Expected the closed breaker to let operations through. Got %v", err)
+	}
+
+	var unbroken *circuitBreaker
+	store.down = true
+	for i := 0; i < 10; i++ {
+		if err := unbroken.do(store.operation); err != io.EOF {
+			t.Errorf("Expected a nil breaker to let every operation through. Got %v", err)
+		}
+	}
+}
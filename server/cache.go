@@ -0,0 +1,162 @@
+// cache.go - An in-process LRU cache of single payment responses.
+
+package server
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// cacheMetrics counts the hits, misses and evictions of every payment
+// cache in the process. It is published through expvar.
+var cacheMetrics = expvar.NewMap("payment_cache")
+
+// cacheEntry is a cached payment record together with its marshalled
+// JSON representation and entity tag.
+type cacheEntry struct {
+	payment Payment
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// newCacheEntry is a convenience function that marshals the payment
+// record in payment into a cacheEntry.
+func newCacheEntry(payment Payment) *cacheEntry {
+	body, _ := json.Marshal(payment)
+	return &cacheEntry{payment: payment, body: body, etag: paymentETag(payment)}
+}
+
+// paymentCache is a size bounded least recently used cache of payment
+// records keyed by Payment ID, with an optional time to live. A nil
+// paymentCache is valid and caches nothing.
+//
+// Readers take a generation with generation before reading the
+// backing store and pass it to add. Any invalidation in between
+// advances the generation and the add is discarded, so a record read
+// before a concurrent write can never be cached after that write has
+// invalidated it.
+type paymentCache struct {
+	mu         sync.Mutex
+	size       int
+	ttl        time.Duration
+	gen        uint64
+	order      *list.List
+	elements   map[string]*list.Element
+	timeSource func() time.Time
+}
+
+// newPaymentCache returns a paymentCache holding at most size payment
+// records, each for at most ttl. A ttl of zero never expires records.
+// If size is not positive nil is returned.
+func newPaymentCache(size int, ttl time.Duration) *paymentCache {
+	if size <= 0 {
+		return nil
+	}
+	return &paymentCache{
+		size:       size,
+		ttl:        ttl,
+		order:      list.New(),
+		elements:   map[string]*list.Element{},
+		timeSource: time.Now,
+	}
+}
+
+// get returns the cached entry for the Payment ID in id, if present
+// and not expired.
+func (c *paymentCache) get(id string) (*cacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.elements[id]
+	if ok && c.ttl > 0 && c.timeSource().After(element.Value.(*cacheEntry).expires) {
+		c.remove(element)
+		ok = false
+	}
+	if !ok {
+		cacheMetrics.Add("misses", 1)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	cacheMetrics.Add("hits", 1)
+	return element.Value.(*cacheEntry), true
+}
+
+// generation returns the current invalidation generation, to be
+// passed to add once the payment record has been read.
+func (c *paymentCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// add caches the entry in entry, evicting the least recently used
+// entry if the cache is full. The entry is discarded if the cache has
+// been invalidated since gen was taken.
+func (c *paymentCache) add(entry *cacheEntry, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	entry.expires = c.timeSource().Add(c.ttl)
+	if element, ok := c.elements[entry.payment.ID]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.elements[entry.payment.ID] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		cacheMetrics.Add("evictions", 1)
+	}
+}
+
+// invalidate removes the Payment ID in id from the cache and advances
+// the generation.
+func (c *paymentCache) invalidate(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	if element, ok := c.elements[id]; ok {
+		c.remove(element)
+	}
+}
+
+// purge removes every entry from the cache and advances the
+// generation.
+func (c *paymentCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.order.Init()
+	c.elements = map[string]*list.Element{}
+}
+
+// remove unlinks the element in element. The caller must hold the
+// lock.
+func (c *paymentCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.elements, element.Value.(*cacheEntry).payment.ID)
+}
@@ -0,0 +1,81 @@
+// cache_test.go
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// Test the cache evicts the least recently used payment record once
+// it is full.
+func TestPaymentCacheEviction(t *testing.T) {
+	cache := newPaymentCache(2, 0)
+	cache.add(newCacheEntry(Payment{ID: "a"}), cache.generation())
+	cache.add(newCacheEntry(Payment{ID: "b"}), cache.generation())
+	if _, ok := cache.get("a"); !ok {
+		t.Error("Expected a to be cached")
+	}
+	cache.add(newCacheEntry(Payment{ID: "c"}), cache.generation())
+	if _, ok := cache.get("b"); ok {
+		t.Error("Expected b to be evicted as least recently used")
+	}
+	for _, id := range []string{"a", "c"} {
+		if _, ok := cache.get(id); !ok {
+			t.Errorf("Expected %s to be cached", id)
+		}
+	}
+}
+
+// Test cached payment records expire once their time to live has
+// passed.
+func TestPaymentCacheTTL(t *testing.T) {
+	now := time.Date(2018, 1, 18, 0, 0, 0, 0, time.UTC)
+	cache := newPaymentCache(2, time.Minute)
+	cache.timeSource = func() time.Time { return now }
+	cache.add(newCacheEntry(Payment{ID: "a"}), cache.generation())
+
+	now = now.Add(59 * time.Second)
+	if _, ok := cache.get("a"); !ok {
+		t.Error("Expected a to be cached before its TTL")
+	}
+	now = now.Add(2 * time.Second)
+	if _, ok := cache.get("a"); ok {
+		t.Error("Expected a to expire after its TTL")
+	}
+}
+
+// Test a payment record read before an invalidation is never cached
+// after it, and that invalidation removes cached payment records.
+func TestPaymentCacheInvalidation(t *testing.T) {
+	cache := newPaymentCache(2, 0)
+	gen := cache.generation()
+	cache.invalidate("a")
+	cache.add(newCacheEntry(Payment{ID: "a"}), gen)
+	if _, ok := cache.get("a"); ok {
+		t.Error("Expected a stale read not to be cached")
+	}
+
+	cache.add(newCacheEntry(Payment{ID: "a"}), cache.generation())
+	cache.invalidate("a")
+	if _, ok := cache.get("a"); ok {
+		t.Error("Expected a to be invalidated")
+	}
+
+	cache.add(newCacheEntry(Payment{ID: "b"}), cache.generation())
+	cache.purge()
+	if _, ok := cache.get("b"); ok {
+		t.Error("Expected b to be purged")
+	}
+}
+
+// Test a nil cache, as used when caching is disabled, caches nothing.
+func TestPaymentCacheDisabled(t *testing.T) {
+	cache := newPaymentCache(0, 0)
+	cache.add(newCacheEntry(Payment{ID: "a"}), cache.generation())
+	cache.invalidate("a")
+	cache.purge()
+	if _, ok := cache.get("a"); ok {
+		t.Error("Expected a disabled cache to cache nothing")
+	}
+}
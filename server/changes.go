@@ -0,0 +1,137 @@
+// changes.go - The feed of the payment records created or updated since
+// a client last polled it, for clients keeping in sync without a change
+// stream.
+
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultChangeFeedLag is how long ago payment records must have been
+// written to be reported by the change feed, unless configured
+// otherwise.
+const defaultChangeFeedLag = 5 * time.Second
+
+// errInvalidChangeToken is returned for a since token that was not
+// issued by the change feed.
+var errInvalidChangeToken = errors.New("Invalid since token, use the next_token of the change feed")
+
+// ChangeFeed is a page of the payment records created or updated after
+// the since token it was requested with, in the order they were last
+// written. NextToken is the token to request the next page with, or to
+// poll for later changes once there are no more.
+type ChangeFeed struct {
+	P         []Payment `json:"data"`
+	NextToken string    `json:"next_token"`
+	More      bool      `json:"more"`
+	Links     struct {
+		Self string `json:"self"`
+		Next string `json:"next"`
+	} `json:"links"`
+}
+
+// changeToken is the high-watermark of the change feed: the time the
+// last payment record seen was written and its Payment ID, which
+// breaks the ties between those written at the same time.
+type changeToken struct {
+	UpdatedAt time.Time
+	ID        string
+}
+
+// String returns the opaque form of the changeToken given to clients.
+func (token changeToken) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(
+		strconv.FormatInt(token.UpdatedAt.UnixNano(), 10) + ":" + token.ID))
+}
+
+// parseChangeToken returns the changeToken of its opaque form in
+// value, or the zero changeToken, preceding every change, if value is
+// empty. errInvalidChangeToken is returned if it cannot be parsed.
+func parseChangeToken(value string) (changeToken, error) {
+	if value == "" {
+		return changeToken{}, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return changeToken{}, errInvalidChangeToken
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return changeToken{}, errInvalidChangeToken
+	}
+	return changeToken{UpdatedAt: time.Unix(0, nanos).UTC(), ID: parts[1]}, nil
+}
+
+// changeFeedLag is a convenience function that returns how long ago
+// payment records must have been written to be reported by the change
+// feed: ChangeFeedLag, defaultChangeFeedLag if it is zero, or zero if
+// it is negative.
+func (server *Server) changeFeedLag() time.Duration {
+	switch {
+	case server.ChangeFeedLag < 0:
+		return 0
+	case server.ChangeFeedLag == 0:
+		return defaultChangeFeedLag
+	}
+	return server.ChangeFeedLag
+}
+
+// getChanges is the entry-point dispatcher for the change feed. It
+// responds to the URL payments/changes and an appropriate GET request
+// with a ChangeFeed of the payment records created or updated after
+// the since token, or of every payment record without one, a page of
+// limit at a time. Clients keep in sync by polling it with the
+// next_token of the last ChangeFeed they received. Payment records
+// are only reported once they were written longer ago than the change
+// feed lag (see changeFeedLag), as the token moving past the time they
+// were stamped at would otherwise pass over those stamped earlier but
+// committed later, or stamped by an instance with its clock behind.
+// Deleted and archived payment records are not reported. Requests
+// scoped to an organisation only see the payment records of that
+// organisation.
+func (server *Server) getChanges(w http.ResponseWriter, r *http.Request) {
+	limit, err := server.pageLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	since, err := parseChangeToken(r.FormValue("since"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var feed ChangeFeed
+	until := server.now().UTC().Add(-server.changeFeedLag())
+	ctx := withQueryFilter(r.Context(), map[string]string{"organisation_id": callerOrganisation(r),
+		"since": r.FormValue("since")})
+	err = server.storage(ctx, "getChanges", "", func() (err error) {
+		feed.P, feed.More, err = modelGetChanges(server.mongo, callerOrganisation(r),
+			since.UpdatedAt, since.ID, until, limit)
+		return
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	next := since
+	if n := len(feed.P); n > 0 {
+		next = changeToken{UpdatedAt: feed.P[n-1].UpdatedAt, ID: feed.P[n-1].ID}
+	}
+	feed.NextToken = next.String()
+	feed.Links.Self = apiLink("/payments/changes")
+	query := url.Values{}
+	query.Set("since", feed.NextToken)
+	query.Set("limit", strconv.Itoa(limit))
+	feed.Links.Next = feed.Links.Self + "?" + query.Encode()
+	respondWith(w, http.StatusOK, feed, negotiatedType(w))
+}
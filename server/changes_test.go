@@ -0,0 +1,128 @@
+// changes_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/DeltaPine/payment_server/internal/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test the change feed returns every payment a page at a time, ties in
+// their modification time included, and then, polled with its next
+// token, only the payments created or updated after it.
+func TestChangeFeed(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	clock := testutil.NewFakeClock(time.Date(2017, 1, 11, 9, 0, 0, 0, time.UTC))
+	polling := newTestServer(t, func(x *Server) {
+		x.Clock = clock
+		x.ChangeFeedLag = -1
+	})
+	execute := func(method, url string, body []byte) *httptest.ResponseRecorder {
+		req, _ := newJSONRequest(method, url, bytes.NewBuffer(body))
+		return executeOn(polling, req)
+	}
+	poll := func(query string) ChangeFeed {
+		response := execute("GET", "/v1/payments/changes"+query, nil)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var feed ChangeFeed
+		json.Unmarshal(response.Body.Bytes(), &feed)
+		return feed
+	}
+	ids := func(feed ChangeFeed) []string {
+		var ids []string
+		for _, p := range feed.P {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	first := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	second := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec44"
+	third := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec45"
+	checkResponseCode(t, http.StatusCreated, execute("POST", "/v1/payment", payload).Code)
+	checkResponseCode(t, http.StatusCreated,
+		execute("POST", "/v1/payment", bytes.Replace(payload, []byte(first), []byte(second), 1)).Code)
+
+	page := poll("?limit=1")
+	if got := ids(page); len(got) != 1 || got[0] != first || !page.More {
+		t.Fatalf("Expected the first of the payments written at once. Got %v", got)
+	}
+	page = poll("?limit=1&since=" + page.NextToken)
+	if got := ids(page); len(got) != 1 || got[0] != second || page.More {
+		t.Fatalf("Expected the second of the payments written at once. Got %v", got)
+	}
+	token := page.NextToken
+	if got := ids(poll("?since=" + token)); len(got) != 0 {
+		t.Errorf("Expected no changes since the last poll. Got %v", got)
+	}
+
+	clock.Advance(time.Minute)
+	checkResponseCode(t, http.StatusOK, execute("PUT", "/v1/payment/"+first, payload).Code)
+	checkResponseCode(t, http.StatusCreated,
+		execute("POST", "/v1/payment", bytes.Replace(payload, []byte(first), []byte(third), 1)).Code)
+	page = poll("?since=" + token)
+	if got := ids(page); len(got) != 2 || got[0] != first || got[1] != third {
+		t.Errorf("Expected only the payments changed since the token. Got %v", got)
+	}
+	if page.NextToken == token {
+		t.Errorf("Expected the next token to move past the changes")
+	}
+	if got := ids(poll("?since=" + page.NextToken)); len(got) != 0 {
+		t.Errorf("Expected no changes since the next token. Got %v", got)
+	}
+	checkResponseCode(t, http.StatusBadRequest,
+		execute("GET", "/v1/payments/changes?since=yesterday", nil).Code)
+}
+
+// Test the change feed holds back the payments written within its lag,
+// so that a payment stamped before one already written but committed
+// after it is still reported once the lag has passed, in the order
+// they were stamped in, rather than passed over by the next token.
+func TestChangeFeedLag(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	clock := testutil.NewFakeClock(time.Date(2017, 1, 11, 9, 0, 0, 0, time.UTC))
+	polling := newTestServer(t, func(x *Server) {
+		x.Clock = clock
+	})
+	poll := func(since string) ChangeFeed {
+		req, _ := http.NewRequest("GET", "/v1/payments/changes?since="+since, nil)
+		response := executeOn(polling, req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var feed ChangeFeed
+		json.Unmarshal(response.Body.Bytes(), &feed)
+		return feed
+	}
+	write := func(id string, stamped time.Time) {
+		var p Payment
+		json.Unmarshal(payload, &p)
+		p.ID = id
+		if err := polling.store.createPayment(&p, stamped); err != nil {
+			t.Fatalf("Cannot create the payment %s: %v", id, err)
+		}
+	}
+
+	early := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	late := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec44"
+	write(late, clock.Now())
+	feed := poll("")
+	if len(feed.P) != 0 {
+		t.Fatalf("Expected the payment written within the lag held back. Got %v", feed.P)
+	}
+	write(early, clock.Now().Add(-time.Second))
+
+	clock.Advance(defaultChangeFeedLag)
+	feed = poll(feed.NextToken)
+	if len(feed.P) != 2 || feed.P[0].ID != early || feed.P[1].ID != late {
+		t.Fatalf("Expected both payments in the order they were stamped. Got %v", feed.P)
+	}
+	if feed = poll(feed.NextToken); len(feed.P) != 0 {
+		t.Errorf("Expected no changes since the next token. Got %v", feed.P)
+	}
+}
@@ -0,0 +1,134 @@
+// check.go - The self-test of the configuration of a server and its
+// access to the backing database, run before it is sent traffic.
+
+package server
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"time"
+)
+
+// selfTestCollection is the name of the collection the scratch
+// document written by Check is written to and removed from.
+const selfTestCollection = "self_test"
+
+// The statuses of a CheckResult.
+const (
+	CheckPassed  = "passed"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// errCheckSkipped is returned by a check of Check with nothing to
+// check, such as that of the credentials when there are none.
+var errCheckSkipped = errors.New("Nothing to check")
+
+// CheckResult is the outcome of a single check of Check: its Name, its
+// Status and, if it failed, the Error it failed with. Checks following
+// a failed one they depend on are skipped.
+type CheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CheckReport is the report of Check, which Passed if every one of its
+// Checks did.
+type CheckReport struct {
+	Passed bool          `json:"passed"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// Check runs the self-test of a server of config without starting it,
+// checking in turn that:
+//
+//   - config: the configuration is valid, as New requires;
+//   - dial: the backing database can be connected to;
+//   - auth: the credentials of the configuration are accepted, if it
+//     has any, and is skipped otherwise;
+//   - read: the payments collection can be read;
+//   - write: a scratch document can be written and removed;
+//   - indexes: the indexes New creates exist.
+//
+// Nothing but the scratch document is written, so indexes missing from
+// a database no server of this version has yet started on are
+// reported. The Collection of config is shared with the Servers of the
+// program, as by New.
+func Check(config Config) CheckReport {
+	server := &Server{Config: config}
+	var report CheckReport
+	var session *mgo.Session
+	var info *mgo.DialInfo
+	var mode mgo.Mode
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"config", func() (err error) {
+			info, mode, err = server.configure()
+			return
+		}},
+		{"dial", func() (err error) {
+			anonymous := *info
+			anonymous.Username, anonymous.Password = "", ""
+			if session, err = dialMongo(&anonymous); err == nil {
+				server.useSession(session, mode)
+			}
+			return
+		}},
+		{"auth", func() error {
+			if info.Username == "" {
+				return errCheckSkipped
+			}
+			return session.Login(&mgo.Credential{Username: info.Username, Password: info.Password,
+				Source: info.Source, Mechanism: info.Mechanism})
+		}},
+		{"read", func() error {
+			err := server.DB.C(server.Collection).Find(nil).Select(bson.M{"_id": 1}).One(&bson.M{})
+			if err == mgo.ErrNotFound {
+				return nil
+			}
+			return err
+		}},
+		{"write", func() error {
+			id := bson.NewObjectId()
+			err := server.DB.C(selfTestCollection).Insert(bson.M{"_id": id,
+				"checked_at": time.Now().UTC()})
+			if err != nil {
+				return err
+			}
+			return server.DB.C(selfTestCollection).RemoveId(id)
+		}},
+		{"indexes", func() error {
+			missing, err := modelMissingIndexes(server.mongo)
+			if err == nil && len(missing) > 0 {
+				err = errors.New("Missing indexes: " + strings.Join(missing, "; "))
+			}
+			return err
+		}},
+	}
+
+	failed := false
+	for _, step := range steps {
+		result := CheckResult{Name: step.name, Status: CheckSkipped}
+		if !failed {
+			switch err := step.run(); err {
+			case nil:
+				result.Status = CheckPassed
+			case errCheckSkipped:
+			default:
+				result.Status, result.Error = CheckFailed, err.Error()
+				failed = true
+			}
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	if session != nil {
+		session.Close()
+	}
+	report.Passed = !failed
+	return report
+}
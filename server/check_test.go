@@ -0,0 +1,43 @@
+// check_test.go
+
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test the self-test passes against the test database, skipping the
+// credentials it has none of, while against a host that does not exist
+// it fails to dial and skips the checks that depend on it, and with an
+// invalid configuration it fails before dialling.
+func TestCheck(t *testing.T) {
+	statuses := func(report CheckReport) string {
+		var names []string
+		for _, check := range report.Checks {
+			names = append(names, check.Name+"="+check.Status)
+		}
+		return strings.Join(names, " ")
+	}
+
+	report := Check(Config{Database: "test_v1"})
+	expected := "config=passed dial=passed auth=skipped read=passed write=passed indexes=passed"
+	if !report.Passed || statuses(report) != expected {
+		t.Errorf("Expected %s. Got %s: %+v", expected, statuses(report), report.Checks)
+	}
+
+	report = Check(Config{MongoURI: "payments.invalid:27017", Database: "test_v1"})
+	expected = "config=passed dial=failed auth=skipped read=skipped write=skipped indexes=skipped"
+	if report.Passed || statuses(report) != expected {
+		t.Errorf("Expected %s. Got %s", expected, statuses(report))
+	}
+	if dial := report.Checks[1]; !strings.Contains(dial.Error, "Cannot find the database") {
+		t.Errorf("Expected the database not to be found. Got %q", dial.Error)
+	}
+
+	report = Check(Config{Database: "test_v1", ConsistencyMode: "sometimes"})
+	if report.Passed || report.Checks[0].Status != CheckFailed ||
+		!strings.Contains(report.Checks[0].Error, "Unknown consistency mode") {
+		t.Errorf("Expected the configuration to be refused. Got %+v", report.Checks)
+	}
+}
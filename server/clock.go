@@ -0,0 +1,21 @@
+// clock.go - The source of the current time of the server.
+
+package server
+
+import (
+	"time"
+)
+
+// Clock is the source of the current time of the server, so that
+// tests can control the passing of time.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock of the system.
+type systemClock struct{}
+
+// Now returns the current time of the system.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
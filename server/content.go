@@ -0,0 +1,118 @@
+// content.go - Negotiation of the media type of payloads, JSON unless
+// the client asks for MessagePack.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// MsgpackMediaType is the media type of payloads encoded in
+// MessagePack, accepted in the request bodies of POST /payment and
+// PUT /payment/{id} and offered for responses to clients listing it in
+// their Accept header. The fields are named as in JSON and amounts are
+// strings in canonical form.
+const MsgpackMediaType = "application/msgpack"
+
+// payloadEncoders encodes the payloads of responses in each of the
+// media types they are offered in, keyed by the media type.
+var payloadEncoders = map[string]func(w io.Writer, payload interface{}) error{
+	"application/json": func(w io.Writer, payload interface{}) error {
+		return newJSONEncoder(w).Encode(payload)
+	},
+	MsgpackMediaType: func(w io.Writer, payload interface{}) error {
+		return newMsgpackEncoder(w).Encode(payload)
+	},
+}
+
+// newMsgpackEncoder is a convenience function that returns an encoder
+// of MessagePack to w naming the fields of structs by their json tags,
+// so that the same payload has the same fields in either media type.
+func newMsgpackEncoder(w io.Writer) *msgpack.Encoder {
+	encoder := msgpack.NewEncoder(w)
+	encoder.SetCustomStructTag("json")
+	return encoder
+}
+
+// newMsgpackDecoder is a convenience function that returns a decoder
+// of MessagePack from r naming the fields of structs by their json
+// tags, as newMsgpackEncoder does.
+func newMsgpackDecoder(r io.Reader) *msgpack.Decoder {
+	decoder := msgpack.NewDecoder(r)
+	decoder.SetCustomStructTag("json")
+	return decoder
+}
+
+// negotiatedWriter is the http.ResponseWriter of a request whose
+// responses are encoded in a media type other than JSON, carrying the
+// media type.
+type negotiatedWriter struct {
+	http.ResponseWriter
+	mediaType string
+}
+
+// Hijack hands the connection of the request over to the handler, such
+// as for a WebSocket.
+func (w *negotiatedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the http.ResponseWriter wrapped by the
+// negotiatedWriter.
+func (w *negotiatedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// negotiateContent is a middleware that has the responses of the
+// request encoded in the first media type listed in its Accept header
+// among payloadEncoders, or in JSON if it lists none of them or has no
+// Accept header. It must be installed outside problemDetails, as
+// problem details are always emitted in JSON.
+func negotiateContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			candidate, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+			if _, ok := payloadEncoders[candidate]; err == nil && ok {
+				if candidate != "application/json" {
+					w = &negotiatedWriter{ResponseWriter: w, mediaType: candidate}
+				}
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// negotiatedType returns the media type the responses written to w
+// are encoded in (see negotiateContent), JSON unless the request asked
+// for another.
+func negotiatedType(w http.ResponseWriter) string {
+	for {
+		switch writer := w.(type) {
+		case *negotiatedWriter:
+			return writer.mediaType
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return "application/json"
+		}
+	}
+}
+
+// decodePayload is a convenience function that decodes the body of the
+// request in r into v, in MessagePack if its Content-Type is
+// MsgpackMediaType and in JSON otherwise.
+func decodePayload(r *http.Request, v interface{}) error {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil &&
+		mediaType == MsgpackMediaType {
+		return newMsgpackDecoder(r.Body).Decode(v)
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
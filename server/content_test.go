@@ -0,0 +1,91 @@
+// content_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// Test a payment record posted in MessagePack reads back in JSON with
+// the same fields as one posted in JSON, and one posted in JSON reads
+// back in MessagePack with them too, while errors are emitted in the
+// negotiated media type and an unrecognised one falls back to JSON.
+func TestMsgpackRoundTrip(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	url := "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	canonical := func(p Payment) string {
+		var encoded bytes.Buffer
+		newJSONEncoder(&encoded).Encode(p)
+		return encoded.String()
+	}
+
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	req, _ = http.NewRequest("GET", url, nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var sent Payment
+	json.Unmarshal(response.Body.Bytes(), &sent)
+
+	req, _ = http.NewRequest("GET", url, nil)
+	req.Header.Set("Accept", MsgpackMediaType)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if contentType := response.Header().Get("Content-Type"); contentType != MsgpackMediaType {
+		t.Errorf("Expected MessagePack. Got %s", contentType)
+	}
+	var read Payment
+	if err := newMsgpackDecoder(response.Body).Decode(&read); err != nil {
+		t.Fatalf("Expected the payment record to decode. Got %s", err)
+	}
+	if canonical(read) != canonical(sent) {
+		t.Errorf("Expected %s in MessagePack. Got %s", canonical(sent), canonical(read))
+	}
+
+	clearTable()
+	var encoded bytes.Buffer
+	newMsgpackEncoder(&encoded).Encode(sent)
+	req, _ = http.NewRequest("POST", "/v1/payment", &encoded)
+	req.Header.Set("Content-Type", MsgpackMediaType)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	if contentType := response.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected JSON without an Accept header. Got %s", contentType)
+	}
+	req, _ = http.NewRequest("GET", url, nil)
+	req.Header.Set("Accept", "application/cbor")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var stored Payment
+	json.Unmarshal(response.Body.Bytes(), &stored)
+	if canonical(stored) != canonical(sent) {
+		t.Errorf("Expected %s in JSON. Got %s", canonical(sent), canonical(stored))
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/payment/00000000-0000-0000-0000-000000000000", nil)
+	req.Header.Set("Accept", MsgpackMediaType+", application/json")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+	var m map[string]string
+	if err := newMsgpackDecoder(response.Body).Decode(&m); err != nil || m["error"] == "" {
+		t.Errorf("Expected the error in MessagePack. Got %v (%v)", m, err)
+	}
+}
+
+// Benchmark encoding a collection of 10,000 payment records in
+// MessagePack, to compare with BenchmarkEncodePayments in JSON.
+func BenchmarkEncodePaymentsMsgpack(b *testing.B) {
+	payments := envelopeOf(10000)
+	var encoded bytes.Buffer
+	newMsgpackEncoder(&encoded).Encode(payments)
+	b.ReportMetric(float64(encoded.Len()), "encoded_bytes")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		newMsgpackEncoder(io.Discard).Encode(payments)
+	}
+}
@@ -0,0 +1,89 @@
+// convert.go - The amounts of payment records converted at the
+// exchange rate of their fx block.
+
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"math/big"
+	"net/http"
+)
+
+// Conversion is the amount of a payment record converted to another
+// currency, derived when requested and never stored. ExchangeRate is
+// the number of units of ConvertedCurrency per unit of Currency it was
+// converted at.
+type Conversion struct {
+	ID                string `json:"id"`
+	Amount            Amount `json:"amount"`
+	Currency          string `json:"currency"`
+	ConvertedAmount   Amount `json:"converted_amount"`
+	ConvertedCurrency string `json:"converted_currency"`
+	ExchangeRate      string `json:"exchange_rate"`
+}
+
+// convertPaymentAmount is a convenience function that returns the
+// amount of Payment converted to the currency in currency: at the
+// exchange rate of its fx block if currency is its original currency,
+// or unchanged if currency is that of the payment. The exact product
+// is rounded to the decimal places of currency (see currencyDecimals
+// and roundAmount). A ValidationError is returned if there is no rate
+// to convert at.
+func convertPaymentAmount(p *Payment, currency string) (Conversion, error) {
+	attributes := &p.Attributes
+	conversion := Conversion{ID: p.ID, Amount: attributes.Amount, Currency: attributes.Currency,
+		ConvertedCurrency: currency}
+	if currency == attributes.Currency {
+		conversion.ConvertedAmount, conversion.ExchangeRate = attributes.Amount, "1"
+		return conversion, nil
+	}
+
+	fx := p.fx()
+	if currency != fx.OriginalCurrency {
+		return conversion, &ValidationError{Attribute: "currency",
+			Reason: fmt.Sprintf("no exchange rate from %s to %s", attributes.Currency, currency)}
+	}
+	rate, err := ParseAmount(fx.ExchangeRate)
+	if err != nil || rate.Sign() <= 0 {
+		return conversion, &ValidationError{Attribute: "fx",
+			Reason: fmt.Sprintf("exchange_rate %q is not a positive decimal", fx.ExchangeRate)}
+	}
+	converted, ok := roundAmount(new(big.Rat).Mul(attributes.Amount.Rat(), rate.Rat()),
+		currencyDecimals(currency))
+	if !ok {
+		return conversion, &ValidationError{Attribute: "amount",
+			Reason: fmt.Sprintf("%s at exchange_rate %s cannot be held", attributes.Amount, fx.ExchangeRate)}
+	}
+	conversion.ConvertedAmount, conversion.ExchangeRate = converted, fx.ExchangeRate
+	return conversion, nil
+}
+
+// getConvertedPayment is the entry-point dispatcher for the amounts of
+// payment records converted to another currency. It responds to the
+// URL payment/{id}/converted and an appropriate GET request with the
+// Conversion of the amount of the payment record to the ISO 4217
+// currency in currency (see convertPaymentAmount). A currency that is
+// missing or not a currency code is refused with StatusBadRequest, and
+// one there is no rate for with StatusUnprocessableEntity. Payment
+// records of other organisations than that of the API key are not
+// found.
+func (server *Server) getConvertedPayment(w http.ResponseWriter, r *http.Request) {
+	currency := r.FormValue("currency")
+	if !currencyCodePattern.MatchString(currency) {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("Invalid currency %q, use an ISO 4217 currency code", currency))
+		return
+	}
+	payment, ok := server.findPayment(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	conversion, err := convertPaymentAmount(&payment, currency)
+	if err != nil {
+		respondWithInvalid(w, http.StatusUnprocessableEntity, collectValidationErrors(err))
+		return
+	}
+	respondWith(w, http.StatusOK, conversion, negotiatedType(w))
+}
@@ -0,0 +1,69 @@
+// convert_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"testing"
+)
+
+// Test the amount of a payment converts to the original currency of
+// its fx block at its exchange rate, and to its own currency
+// unchanged, while a currency there is no rate for is refused.
+func TestConvertedPayment(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	url := "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43/converted"
+
+	for currency, expected := range map[string]string{"USD": "200.42", "GBP": "100.21"} {
+		req, _ = http.NewRequest("GET", url+"?currency="+currency, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var conversion Conversion
+		json.Unmarshal(response.Body.Bytes(), &conversion)
+		if conversion.ConvertedAmount.String() != expected || conversion.ConvertedCurrency != currency {
+			t.Errorf("Expected %s %s. Got %s", expected, currency, response.Body.String())
+		}
+	}
+
+	req, _ = http.NewRequest("GET", url+"?currency=EUR", nil)
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+	req, _ = http.NewRequest("GET", url+"?currency=usd", nil)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+	req, _ = http.NewRequest("GET", "/v1/payment/00000000-0000-0000-0000-000000000000/converted?currency=USD", nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+// Test conversions are rounded once, half away from zero, to the minor
+// unit of the currency converted to, none for JPY.
+func TestConversionRounding(t *testing.T) {
+	for _, c := range []struct {
+		amount, rate, currency, expected string
+	}{
+		{"100.21", "1.23456", "USD", "123.72"},
+		{"0.10", "0.05", "USD", "0.01"},
+		{"0.10", "0.04", "USD", "0.00"},
+		{"100.21", "151.5", "JPY", "15182.00"},
+		{"1.00", "0.125", "EUR", "0.13"},
+	} {
+		var p Payment
+		p.Attributes.Amount = MustParseAmount(c.amount)
+		p.Attributes.Currency = "GBP"
+		p.Attributes.Fx = &Fx{ExchangeRate: c.rate, OriginalCurrency: c.currency}
+		conversion, err := convertPaymentAmount(&p, c.currency)
+		if err != nil || conversion.ConvertedAmount.String() != c.expected {
+			t.Errorf("Expected %s at %s to be %s %s. Got %s (%v)",
+				c.amount, c.rate, c.expected, c.currency, conversion.ConvertedAmount, err)
+		}
+	}
+	if _, ok := roundAmount(big.NewRat(-5, 1000), 2); !ok {
+		t.Errorf("Expected a negative amount to round")
+	} else if rounded, _ := roundAmount(big.NewRat(-5, 1000), 2); rounded.String() != "-0.01" {
+		t.Errorf("Expected -0.005 to round away from zero. Got %s", rounded)
+	}
+}
@@ -0,0 +1,35 @@
+// currency.go - The minor units of the currencies of payments.
+
+package server
+
+import (
+	"regexp"
+	"strings"
+)
+
+// currencyExponents are the exponents of ISO 4217, the number of
+// decimal places of the minor unit, of the currencies whose minor unit
+// is not a hundredth, the exponent of every other currency.
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0,
+	"XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// currencyDecimals returns the number of decimal places amounts in the
+// currency with the ISO 4217 code in currency may have: the exponent
+// of the currency, but no more than the two of the hundredths amounts
+// are stored in (see Amount.MinorUnits). Codes are not case sensitive.
+func currencyDecimals(currency string) int {
+	exponent, ok := currencyExponents[strings.ToUpper(currency)]
+	if !ok || exponent > amountMinScale {
+		return amountMinScale
+	}
+	return exponent
+}
+
+// currencyCodePattern matches the form of ISO 4217 currency codes,
+// three upper case letters.
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
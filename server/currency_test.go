@@ -0,0 +1,49 @@
+// currency_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Test the precision of amounts follows their currency: a JPY amount
+// with decimals is refused, a whole one accepted, and three decimal
+// currencies are held to the two decimals amounts are stored in.
+func TestCurrencyPrecision(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	yen := bytes.Replace(payload, []byte(`"currency":"GBP","debtor_party"`),
+		[]byte(`"currency":"JPY","debtor_party"`), 1)
+
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(yen))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	var m struct {
+		Errors []FieldError `json:"errors"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if len(m.Errors) != 1 || m.Errors[0].Field != "amount" ||
+		!strings.Contains(m.Errors[0].Message, "JPY has no minor units") {
+		t.Errorf("Expected the JPY amount to be refused. Got %s", response.Body.String())
+	}
+
+	whole := bytes.Replace(yen, []byte(`"amount":"100.21"`), []byte(`"amount":"100"`), 1)
+	whole = bytes.Replace(whole, []byte(`"original_amount":"200.42"`), []byte(`"original_amount":"200.00"`), 1)
+	req, _ = newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(whole))
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	for currency, decimals := range map[string]int{"JPY": 0, "jpy": 0, "GBP": 2, "KWD": 2, "": 2} {
+		if got := currencyDecimals(currency); got != decimals {
+			t.Errorf("Expected %q to have %d decimals. Got %d", currency, decimals, got)
+		}
+	}
+	for amount, decimals := range map[string]int{"100": 0, "100.00": 0, "100.20": 1, "0.125": 3} {
+		if got := MustParseAmount(amount).SignificantDecimals(); got != decimals {
+			t.Errorf("Expected %s to have %d significant decimals. Got %d", amount, decimals, got)
+		}
+	}
+}
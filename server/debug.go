@@ -0,0 +1,85 @@
+// debug.go - Runtime profiling and diagnostics endpoints.
+
+package server
+
+import (
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// DebugVars is the runtime state of the server returned to clients of
+// the debug vars endpoint. Mongo socket counts are only gathered if
+// the debug endpoints were enabled before the database was
+// initialized, and are zero otherwise.
+type DebugVars struct {
+	Goroutines int `json:"goroutines"`
+	Heap       struct {
+		Alloc        uint64 `json:"alloc"`
+		Sys          uint64 `json:"sys"`
+		HeapInuse    uint64 `json:"heap_inuse"`
+		HeapIdle     uint64 `json:"heap_idle"`
+		HeapObjects  uint64 `json:"heap_objects"`
+		NumGC        uint32 `json:"num_gc"`
+		PauseTotalNs uint64 `json:"pause_total_ns"`
+	} `json:"heap"`
+	Mongo struct {
+		MasterConns  int `json:"master_conns"`
+		SlaveConns   int `json:"slave_conns"`
+		SocketsAlive int `json:"sockets_alive"`
+		SocketsInUse int `json:"sockets_in_use"`
+		SocketRefs   int `json:"socket_refs"`
+	} `json:"mongo"`
+}
+
+// initializeDebugRoutes registers the net/http/pprof handlers under
+// the debug/pprof URL and the debug vars URL, each requiring the
+// AdminKey. The handlers are registered on the Dispatcher directly,
+// never on http.DefaultServeMux.
+func (server *Server) initializeDebugRoutes() {
+	server.Dispatch.HandleFunc("/debug/pprof/",
+		server.requireAdmin(pprof.Index)).Methods("GET")
+	server.Dispatch.HandleFunc("/debug/pprof/cmdline",
+		server.requireAdmin(pprof.Cmdline)).Methods("GET")
+	server.Dispatch.HandleFunc("/debug/pprof/profile",
+		server.requireAdmin(pprof.Profile)).Methods("GET")
+	server.Dispatch.HandleFunc("/debug/pprof/symbol",
+		server.requireAdmin(pprof.Symbol)).Methods("GET", "POST")
+	server.Dispatch.HandleFunc("/debug/pprof/trace",
+		server.requireAdmin(pprof.Trace)).Methods("GET")
+	server.Dispatch.HandleFunc("/debug/pprof/{profile}",
+		server.requireAdmin(pprof.Index)).Methods("GET")
+	server.Dispatch.HandleFunc("/debug/vars",
+		server.requireAdmin(server.getDebugVars)).Methods("GET")
+}
+
+// getDebugVars is the entry-point dispatcher for the runtime state of
+// the server. It responds to the URL debug/vars and an appropriate GET
+// request with the goroutine count, heap statistics and Mongo socket
+// counts.
+func (server *Server) getDebugVars(w http.ResponseWriter, r *http.Request) {
+	var vars DebugVars
+	var memStats runtime.MemStats
+
+	runtime.ReadMemStats(&memStats)
+	vars.Goroutines = runtime.NumGoroutine()
+	vars.Heap.Alloc = memStats.Alloc
+	vars.Heap.Sys = memStats.Sys
+	vars.Heap.HeapInuse = memStats.HeapInuse
+	vars.Heap.HeapIdle = memStats.HeapIdle
+	vars.Heap.HeapObjects = memStats.HeapObjects
+	vars.Heap.NumGC = memStats.NumGC
+	vars.Heap.PauseTotalNs = memStats.PauseTotalNs
+
+	if server.mongoStats {
+		stats := mgo.GetStats()
+		vars.Mongo.MasterConns = stats.MasterConns
+		vars.Mongo.SlaveConns = stats.SlaveConns
+		vars.Mongo.SocketsAlive = stats.SocketsAlive
+		vars.Mongo.SocketsInUse = stats.SocketsInUse
+		vars.Mongo.SocketRefs = stats.SocketRefs
+	}
+
+	respondWith(w, http.StatusOK, vars, negotiatedType(w))
+}
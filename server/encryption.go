@@ -0,0 +1,393 @@
+// encryption.go - Field level encryption of account numbers at rest.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"os"
+	"strings"
+)
+
+// accountParties are the parties of a payment record with an account
+// number, by their json name.
+var accountParties = []string{"beneficiary_party", "debtor_party", "sponsor_party"}
+
+// ErrNoEncryptionKey is the error returned when an encrypted account
+// number is read without an encryption key configured.
+var ErrNoEncryptionKey = errors.New("Cannot decrypt an account number without an encryption key")
+
+// AccountNumber is an account number, including an IBAN, held in the
+// clear in memory and exchanged in the clear in JSON, but stored
+// encrypted in the backing store if an encryption key is configured
+// (see newAccountKeyring). Account numbers stored in the clear, before
+// the key was configured, are read as they are and encrypted when
+// their payment record is next written or re-encrypted (see
+// modelReencryptPayments). The keys are those of the backing store,
+// so an AccountNumber read from it is held sealed until its payment
+// record is opened, and is sealed before it is written (see
+// openPayment and sealPayment).
+type AccountNumber string
+
+// sealedAccountPrefix starts the AccountNumber holding a sealedValue
+// read from the backing store, followed by the sealedValue as stored.
+const sealedAccountPrefix = "\x00sealed:"
+
+// errSealedAccountNumber is returned for a payment record written with
+// an account number that is still sealed, which is not one a client
+// can send.
+var errSealedAccountNumber = errors.New("Invalid account number")
+
+// sealedValue is the envelope an encrypted value is stored in: the
+// AES-GCM ciphertext, the nonce it was sealed with, the ID of the key
+// that sealed it (see accountKeyID), and the blind index of the value
+// under that key, so that it can be looked up without decrypting it
+// (see blindIndex). Values sealed before keys had IDs have neither.
+type sealedValue struct {
+	Ciphertext []byte `bson:"ciphertext"`
+	Nonce      []byte `bson:"nonce"`
+	KeyID      string `bson:"key_id,omitempty"`
+	Index      string `bson:"index,omitempty"`
+}
+
+// accountKeyring is the current key account numbers are sealed with
+// and the retired keys they may still be sealed with, until they are
+// re-encrypted, each by its key ID.
+type accountKeyring struct {
+	current   string
+	ids       []string
+	ciphers   map[string]cipher.AEAD
+	indexKeys map[string][]byte
+}
+
+// newAccountCipher returns the AES-GCM cipher encrypting account
+// numbers with the base64 encoded AES key in key, of 16, 24 or 32
+// bytes, along with the ID of the key.
+func newAccountCipher(key string) (cipher.AEAD, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid encryption key: %s", err)
+	}
+	block, err := aes.NewCipher(decoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid encryption key: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, accountKeyID(decoded), err
+}
+
+// accountKeyID is a convenience function that returns the ID of the
+// AES key in key stored along with the values it seals: a short digest
+// of the key, which does not disclose it.
+func accountKeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("account key id:"), key...))
+	return hex.EncodeToString(sum[:4])
+}
+
+// newAccountKeyring returns the accountKeyring sealing account numbers
+// with the base64 encoded AES key in key and opening those sealed with
+// it or with any of the retired keys in retired, or nil if key is
+// empty. Empty retired keys are ignored.
+func newAccountKeyring(key string, retired []string) (*accountKeyring, error) {
+	if key == "" {
+		return nil, nil
+	}
+	keyring := &accountKeyring{ciphers: map[string]cipher.AEAD{}, indexKeys: map[string][]byte{}}
+	for i, encoded := range append([]string{key}, retired...) {
+		if encoded = strings.TrimSpace(encoded); encoded == "" {
+			continue
+		}
+		aead, id, err := newAccountCipher(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			keyring.current = id
+		}
+		if keyring.ciphers[id] == nil {
+			decoded, _ := base64.StdEncoding.DecodeString(encoded)
+			index := hmac.New(sha256.New, decoded)
+			index.Write([]byte("account number blind index"))
+			keyring.ids = append(keyring.ids, id)
+			keyring.ciphers[id], keyring.indexKeys[id] = aead, index.Sum(nil)
+		}
+	}
+	return keyring, nil
+}
+
+// LoadEncryptionKeys reads the base64 encoded AES keys of the account
+// numbers from the file named by path, such as one mounted by a key
+// management service, one a line: the current key first, followed by
+// the retired keys still needed to read what they sealed. Blank lines
+// and lines starting with # are ignored. An empty path loads no keys.
+func LoadEncryptionKeys(path string) (string, []string, error) {
+	if path == "" {
+		return "", nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	if len(keys) == 0 {
+		return "", nil, fmt.Errorf("No encryption keys in %s", path)
+	}
+	return keys[0], keys[1:], nil
+}
+
+// blindIndex returns the blind index of the account number in number
+// under the key with the ID in id: an HMAC of the account number,
+// without its spaces and in upper case, keyed by a key derived from
+// that key. The same account number always has the same blind index
+// under the same key, so that it can be looked up while stored
+// encrypted with a fresh nonce.
+func (keyring *accountKeyring) blindIndex(id string, number string) string {
+	index := hmac.New(sha256.New, keyring.indexKeys[id])
+	index.Write([]byte(strings.ToUpper(strings.Replace(number, " ", "", -1))))
+	return base64.StdEncoding.EncodeToString(index.Sum(nil))
+}
+
+// blindIndexes returns the blind indexes of the account number in
+// number under every key of the keyring, the current one first, or
+// none if the keyring is nil.
+func (keyring *accountKeyring) blindIndexes(number string) []string {
+	if keyring == nil {
+		return nil
+	}
+	var indexes []string
+	for _, id := range keyring.ids {
+		indexes = append(indexes, keyring.blindIndex(id, number))
+	}
+	return indexes
+}
+
+// seal returns the sealedValue of the plaintext in plaintext,
+// encrypted with the current key and a fresh nonce.
+func (keyring *accountKeyring) seal(plaintext string) (sealedValue, error) {
+	aead := keyring.ciphers[keyring.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return sealedValue{}, err
+	}
+	return sealedValue{
+		Ciphertext: aead.Seal(nil, nonce, []byte(plaintext), nil),
+		Nonce:      nonce,
+		KeyID:      keyring.current,
+		Index:      keyring.blindIndex(keyring.current, plaintext),
+	}, nil
+}
+
+// open returns the plaintext of the sealedValue in sealed, decrypted
+// with the key it was sealed with, or with each key in turn if it does
+// not name one.
+func (keyring *accountKeyring) open(sealed sealedValue) (string, error) {
+	ids := keyring.ids
+	if sealed.KeyID != "" {
+		if keyring.ciphers[sealed.KeyID] == nil {
+			return "", fmt.Errorf("Cannot decrypt an account number: unknown key %s", sealed.KeyID)
+		}
+		ids = []string{sealed.KeyID}
+	}
+	err := errors.New("invalid nonce")
+	for _, id := range ids {
+		aead := keyring.ciphers[id]
+		if len(sealed.Nonce) != aead.NonceSize() {
+			continue
+		}
+		var plaintext []byte
+		if plaintext, err = aead.Open(nil, sealed.Nonce, sealed.Ciphertext, nil); err == nil {
+			return string(plaintext), nil
+		}
+	}
+	return "", fmt.Errorf("Cannot decrypt an account number: %s", err)
+}
+
+// stale returns true if the account number stored in raw is not sealed
+// with the current key of the keyring, along with its blind index: it
+// is stored in the clear or sealed with another key. Missing and empty
+// account numbers are never stale.
+func (keyring *accountKeyring) stale(raw bson.Raw) bool {
+	switch raw.Kind {
+	case 0x02:
+		var s string
+		return raw.Unmarshal(&s) == nil && s != ""
+	case 0x03:
+		var sealed sealedValue
+		return raw.Unmarshal(&sealed) == nil &&
+			(sealed.KeyID != keyring.current || sealed.Index == "")
+	}
+	return false
+}
+
+// accountNumberClauses is a convenience function that returns the
+// clauses of a query matching the payment records one of whose parties
+// has the account number in number, whether stored in the clear or
+// encrypted under any key of keys, by its blind index.
+func accountNumberClauses(keys *accountKeyring, number string) []bson.M {
+	var clauses []bson.M
+	indexes := keys.blindIndexes(number)
+	for _, party := range accountParties {
+		field := "attributes." + party + ".account_number"
+		clauses = append(clauses, bson.M{field: number})
+		if len(indexes) > 0 {
+			clauses = append(clauses, bson.M{field + ".index": bson.M{"$in": indexes}})
+		}
+	}
+	return clauses
+}
+
+// sealedValue returns the sealedValue an AccountNumber read from the
+// backing store holds, and false if it is held in the clear.
+func (a AccountNumber) sealedValue() (sealedValue, bool) {
+	var sealed sealedValue
+	if !strings.HasPrefix(string(a), sealedAccountPrefix) {
+		return sealed, false
+	}
+	return sealed, bson.Unmarshal([]byte(a[len(sealedAccountPrefix):]), &sealed) == nil
+}
+
+// GetBSON stores the AccountNumber in the backing store as it is held:
+// in a sealedValue if it is sealed, and otherwise in the clear.
+func (a AccountNumber) GetBSON() (interface{}, error) {
+	if sealed, ok := a.sealedValue(); ok {
+		return sealed, nil
+	}
+	return string(a), nil
+}
+
+// SetBSON reads an AccountNumber stored in the clear in the backing
+// store, or holds one stored in a sealedValue sealed, until it is
+// opened (see openPayment).
+func (a *AccountNumber) SetBSON(raw bson.Raw) error {
+	if raw.Kind == 0x02 {
+		var s string
+		if err := raw.Unmarshal(&s); err != nil {
+			return err
+		}
+		*a = AccountNumber(s)
+		return nil
+	}
+	var sealed sealedValue
+	if err := raw.Unmarshal(&sealed); err != nil {
+		return err
+	}
+	*a = AccountNumber(sealedAccountPrefix + string(raw.Data))
+	return nil
+}
+
+// accountNumbers is a convenience function that returns the account
+// numbers of the parties of the payment record in p that it has.
+func accountNumbers(p *Payment) []*AccountNumber {
+	var numbers []*AccountNumber
+	if party := p.Attributes.BeneficiaryParty; party != nil {
+		numbers = append(numbers, &party.AccountNumber)
+	}
+	if party := p.Attributes.DebtorParty; party != nil {
+		numbers = append(numbers, &party.AccountNumber)
+	}
+	if party := p.Attributes.SponsorParty; party != nil {
+		numbers = append(numbers, &party.AccountNumber)
+	}
+	return numbers
+}
+
+// openAccountNumber returns the account number in a, decrypted with
+// the key it was sealed with if it is sealed. ErrNoEncryptionKey is
+// returned for a sealed one if the keyring is nil.
+func (keyring *accountKeyring) openAccountNumber(a AccountNumber) (AccountNumber, error) {
+	sealed, ok := a.sealedValue()
+	if !ok {
+		return a, nil
+	}
+	if keyring == nil {
+		return "", ErrNoEncryptionKey
+	}
+	plaintext, err := keyring.open(sealed)
+	return AccountNumber(plaintext), err
+}
+
+// sealAccountNumber returns the account number in a sealed with the
+// current key, or as it is if the keyring is nil or a is empty.
+func (keyring *accountKeyring) sealAccountNumber(a AccountNumber) (AccountNumber, error) {
+	if strings.HasPrefix(string(a), sealedAccountPrefix) {
+		return "", errSealedAccountNumber
+	}
+	if keyring == nil || a == "" {
+		return a, nil
+	}
+	sealed, err := keyring.seal(string(a))
+	if err != nil {
+		return "", err
+	}
+	data, err := bson.Marshal(sealed)
+	return AccountNumber(sealedAccountPrefix + string(data)), err
+}
+
+// openPayment opens the sealed account numbers of the payment record
+// in p as read from the backing store, in place. The error of the
+// first that cannot be decrypted is returned, such as
+// ErrNoEncryptionKey if the keyring is nil or one naming the key if it
+// is no longer in the keyring.
+func (keyring *accountKeyring) openPayment(p *Payment) error {
+	for _, number := range accountNumbers(p) {
+		opened, err := keyring.openAccountNumber(*number)
+		if err != nil {
+			return err
+		}
+		*number = opened
+	}
+	return nil
+}
+
+// openPayments is openPayment for each of the payment records in
+// payments.
+func (keyring *accountKeyring) openPayments(payments []Payment) error {
+	for i := range payments {
+		if err := keyring.openPayment(&payments[i]); err != nil {
+			return fmt.Errorf("Payment %s: %s", payments[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// sealPayment returns a copy of the payment record in p to be written
+// to the backing store, its account numbers sealed with the current
+// key (see sealAccountNumber). p itself is left in the clear.
+func (keyring *accountKeyring) sealPayment(p *Payment) (*Payment, error) {
+	sealed := *p
+	if party := p.Attributes.BeneficiaryParty; party != nil {
+		copied := *party
+		sealed.Attributes.BeneficiaryParty = &copied
+	}
+	if party := p.Attributes.DebtorParty; party != nil {
+		copied := *party
+		sealed.Attributes.DebtorParty = &copied
+	}
+	if party := p.Attributes.SponsorParty; party != nil {
+		copied := *party
+		sealed.Attributes.SponsorParty = &copied
+	}
+	for _, number := range accountNumbers(&sealed) {
+		var err error
+		if *number, err = keyring.sealAccountNumber(*number); err != nil {
+			return nil, err
+		}
+	}
+	return &sealed, nil
+}
@@ -0,0 +1,304 @@
+// encryption_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The AES-256 keys of the encryption tests: the current one, and the
+// one it replaced.
+const (
+	encryptionKey        = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	retiredEncryptionKey = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+// newEncryptingServer returns a copy of the test server sharing its
+// database but sealing account numbers with the base64 encoded AES key
+// in key, and opening those sealed with it or with the retired keys in
+// retired. Without a key account numbers are stored in the clear.
+func newEncryptingServer(t testing.TB, key string, retired ...string) *Server {
+	t.Helper()
+	keys, err := newAccountKeyring(key, retired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestServer(t, func(x *Server) {
+		x.EncryptionKey, x.RetiredEncryptionKeys, x.keys = key, retired, keys
+		x.mongo = &mongoStore{Database: x.DB, collection: x.Collection, keys: keys}
+		x.store = x.mongo
+	})
+}
+
+// Test a payment is returned with its account numbers in the clear
+// while the stored payment record holds them only encrypted, and that
+// account numbers stored in the clear before a key was configured are
+// still read.
+func TestAccountNumberEncryption(t *testing.T) {
+	sealing := newEncryptingServer(t, encryptionKey)
+
+	clearTable()
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+	checkResponseCode(t, http.StatusCreated, executeOn(sealing, req).Code)
+	req, _ = http.NewRequest("GET", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
+	response := executeOn(sealing, req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var payment Payment
+	json.Unmarshal(response.Body.Bytes(), &payment)
+	if payment.Attributes.DebtorParty.AccountNumber != "GB29XABC10161234567801" ||
+		payment.Attributes.BeneficiaryParty.AccountNumber != "31926819" {
+		t.Errorf("Expected the account numbers in the clear. Got %s", response.Body.String())
+	}
+
+	var raw bson.M
+	server.DB.C(server.Collection).FindId("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43").One(&raw)
+	stored, _ := json.Marshal(raw)
+	for _, clear := range []string{"GB29XABC10161234567801", "31926819", "56781234"} {
+		if strings.Contains(string(stored), clear) {
+			t.Errorf("Expected %s to be stored encrypted. Got %s", clear, stored)
+		}
+	}
+	debtor := raw["attributes"].(bson.M)["debtor_party"].(bson.M)
+	if sealed, ok := debtor["account_number"].(bson.M); !ok || sealed["ciphertext"] == nil ||
+		sealed["nonce"] == nil || sealed["key_id"] != sealing.keys.current || sealed["index"] == nil {
+		t.Errorf("Expected a ciphertext, nonce, key ID and blind index envelope. Got %v",
+			debtor["account_number"])
+	}
+
+	server.DB.C(server.Collection).UpdateId("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43",
+		bson.M{"$set": bson.M{"attributes.debtor_party.account_number": "12345678"}})
+	var legacy Payment
+	server.DB.C(server.Collection).FindId("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43").One(&legacy)
+	if err := sealing.keys.openPayment(&legacy); err != nil ||
+		legacy.Attributes.DebtorParty.AccountNumber != "12345678" {
+		t.Errorf("Expected an account number stored in the clear to be read. Got %v",
+			legacy.Attributes.DebtorParty.AccountNumber)
+	}
+
+	sealing = newEncryptingServer(t, "")
+	server.DB.C(server.Collection).FindId("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43").One(&legacy)
+	if err := sealing.keys.openPayment(&legacy); err != ErrNoEncryptionKey {
+		t.Errorf("Expected encrypted account numbers to be unreadable without the key. Got %v", err)
+	}
+	for _, key := range []string{"not base64!", "c2hvcnQ="} {
+		if _, err := newAccountKeyring(key, nil); err == nil {
+			t.Errorf("Expected the encryption key %q to be refused", key)
+		}
+	}
+}
+
+// Test a payment whose account numbers cannot be decrypted, as the key
+// is not configured, is a storage failure for GET and PATCH rather than
+// returned or patched with blank account numbers, and that its stored
+// account numbers are left sealed.
+func TestUnreadableAccountNumbers(t *testing.T) {
+	sealing := newEncryptingServer(t, encryptionKey)
+	clearTable()
+	defer clearTable()
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+	checkResponseCode(t, http.StatusCreated, executeOn(sealing, req).Code)
+
+	sealing = newEncryptingServer(t, "")
+	req, _ = http.NewRequest("GET", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
+	checkResponseCode(t, http.StatusInternalServerError, executeOn(sealing, req).Code)
+	req, _ = http.NewRequest("PATCH", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43",
+		bytes.NewBufferString(`{"attributes":{"reference":"Blanked"}}`))
+	req.Header.Set("Content-Type", MergePatchMediaType)
+	checkResponseCode(t, http.StatusInternalServerError, executeOn(sealing, req).Code)
+
+	var raw bson.M
+	server.DB.C(server.Collection).FindId("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43").One(&raw)
+	attributes := raw["attributes"].(bson.M)
+	if sealed, ok := attributes["debtor_party"].(bson.M)["account_number"].(bson.M); !ok ||
+		sealed["ciphertext"] == nil || attributes["reference"] == "Blanked" {
+		t.Errorf("Expected the stored payment to be left sealed and unpatched. Got %v", raw)
+	}
+}
+
+// Test payments are found by the account number of any of their
+// parties, whether it is stored encrypted, through its blind index
+// regardless of spacing and case, or in the clear.
+func TestAccountNumberLookup(t *testing.T) {
+	sealing := newEncryptingServer(t, encryptionKey)
+	clearTable()
+	defer clearTable()
+
+	legacy := "216d4da9-e59a-4cc6-8df3-3da6e7580b77"
+	for _, body := range [][]byte{payload,
+		bytes.Replace(payload, []byte("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"), []byte(legacy), 1)} {
+		req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(body))
+		checkResponseCode(t, http.StatusCreated, executeOn(sealing, req).Code)
+	}
+	server.DB.C(server.Collection).UpdateId(legacy,
+		bson.M{"$set": bson.M{"attributes.debtor_party.account_number": "12345678"}})
+
+	for number, expected := range map[string][]string{
+		"31926819":                    {legacy, "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"},
+		"gb29+xabc+1016+1234+5678+01": {"4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"},
+		"12345678":                    {legacy},
+		"00000000":                    {},
+	} {
+		req, _ := http.NewRequest("GET", "/v1/payments?account_number="+number, nil)
+		response := executeOn(sealing, req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var payments Payments
+		json.Unmarshal(response.Body.Bytes(), &payments)
+		var found []string
+		for _, p := range payments.P {
+			found = append(found, p.ID)
+		}
+		if strings.Join(found, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected account number %s to find %v. Got %v", number, expected, found)
+		}
+	}
+}
+
+// Test the account numbers sealed with a retired key, or stored in the
+// clear, are still read and looked up until they are re-encrypted with
+// the current key, after which the retired key is no longer needed.
+func TestReencryptPayments(t *testing.T) {
+	sealing := newEncryptingServer(t, retiredEncryptionKey)
+	clearTable()
+	defer clearTable()
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+	checkResponseCode(t, http.StatusCreated, executeOn(sealing, req).Code)
+	server.DB.C(server.Collection).UpdateId("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43",
+		bson.M{"$set": bson.M{"attributes.sponsor_party.account_number": "56781234"}})
+
+	reencrypt := func() (int, int) {
+		req, _ := http.NewRequest("POST", "/v1/admin/reencrypt", nil)
+		req.Header.Set("X-API-Key", adminKey)
+		response := executeOn(sealing, req)
+		var result map[string]int
+		json.Unmarshal(response.Body.Bytes(), &result)
+		return response.Code, result["reencrypted"]
+	}
+	found := func(number string) bool {
+		req, _ := http.NewRequest("GET", "/v1/payments?account_number="+number, nil)
+		response := executeOn(sealing, req)
+		var payments Payments
+		json.Unmarshal(response.Body.Bytes(), &payments)
+		return len(payments.P) == 1 &&
+			payments.P[0].Attributes.DebtorParty.AccountNumber == "GB29XABC10161234567801" &&
+			payments.P[0].Attributes.SponsorParty.AccountNumber == "56781234"
+	}
+
+	sealing = newEncryptingServer(t, encryptionKey, retiredEncryptionKey)
+	if !found("31926819") || !found("56781234") {
+		t.Errorf("Expected the payment to be read and found before its re-encryption")
+	}
+	if code, reencrypted := reencrypt(); code != http.StatusOK || reencrypted != 1 {
+		t.Errorf("Expected the payment to be re-encrypted. Got %d, %d", code, reencrypted)
+	}
+	var raw bson.M
+	server.DB.C(server.Collection).FindId("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43").One(&raw)
+	for _, party := range accountParties {
+		sealed, _ := raw["attributes"].(bson.M)[party].(bson.M)["account_number"].(bson.M)
+		if sealed["key_id"] != sealing.keys.current {
+			t.Errorf("Expected the %s account number sealed with the current key. Got %v", party, sealed)
+		}
+	}
+	if _, reencrypted := reencrypt(); reencrypted != 0 {
+		t.Errorf("Expected nothing left to re-encrypt. Got %d", reencrypted)
+	}
+
+	sealing = newEncryptingServer(t, encryptionKey)
+	if !found("31926819") || !found("56781234") {
+		t.Errorf("Expected the payment to be read and found without the retired key")
+	}
+	sealing = newEncryptingServer(t, "")
+	if code, _ := reencrypt(); code != http.StatusConflict {
+		t.Errorf("Expected re-encryption without a key to be refused. Got %d", code)
+	}
+}
+
+// Test a payment sealed with a key since dropped from the keyring,
+// rather than re-encrypted first, is a storage failure for GET and
+// cannot be re-encrypted, rather than read with blank account numbers.
+func TestDroppedEncryptionKey(t *testing.T) {
+	sealing := newEncryptingServer(t, retiredEncryptionKey)
+	clearTable()
+	defer clearTable()
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+	checkResponseCode(t, http.StatusCreated, executeOn(sealing, req).Code)
+
+	sealing = newEncryptingServer(t, encryptionKey)
+	req, _ = http.NewRequest("GET", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
+	checkResponseCode(t, http.StatusInternalServerError, executeOn(sealing, req).Code)
+	var legacy Payment
+	server.DB.C(server.Collection).FindId("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43").One(&legacy)
+	if err := sealing.keys.openPayment(&legacy); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("Expected the payment to be unreadable under an unknown key. Got %v", err)
+	}
+	req, _ = http.NewRequest("POST", "/v1/admin/reencrypt", nil)
+	req.Header.Set("X-API-Key", adminKey)
+	checkResponseCode(t, http.StatusInternalServerError, executeOn(sealing, req).Code)
+}
+
+// Test a payment sealed for the backing store leaves the payment in
+// the clear, is stored with its account numbers in sealedValues and
+// read back sealed until opened with a keyring holding its key, and
+// that an account number sent sealed is refused.
+func TestSealPayment(t *testing.T) {
+	keys, err := newAccountKeyring(encryptionKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Payment
+	json.Unmarshal(payload, &p)
+	sealed, err := keys.sealPayment(&p)
+	if err != nil || p.Attributes.DebtorParty.AccountNumber != "GB29XABC10161234567801" {
+		t.Fatalf("Expected the payment to be left in the clear. Got %v, %v",
+			p.Attributes.DebtorParty.AccountNumber, err)
+	}
+	data, _ := bson.Marshal(sealed)
+	var raw bson.M
+	bson.Unmarshal(data, &raw)
+	if _, ok := raw["attributes"].(bson.M)["debtor_party"].(bson.M)["account_number"].(bson.M); !ok {
+		t.Errorf("Expected the account number stored in a sealedValue. Got %v", raw)
+	}
+
+	var stored Payment
+	bson.Unmarshal(data, &stored)
+	if _, ok := stored.Attributes.DebtorParty.AccountNumber.sealedValue(); !ok {
+		t.Errorf("Expected the account number read back sealed")
+	}
+	unopened := stored
+	if err := (*accountKeyring)(nil).openPayment(&unopened); err != ErrNoEncryptionKey {
+		t.Errorf("Expected the payment not to open without a key. Got %v", err)
+	}
+	if err := keys.openPayment(&stored); err != nil ||
+		stored.Attributes.DebtorParty.AccountNumber != "GB29XABC10161234567801" ||
+		stored.Attributes.SponsorParty.AccountNumber != "56781234" {
+		t.Errorf("Expected the payment opened in the clear. Got %+v, %v", stored.Attributes, err)
+	}
+
+	p.Attributes.DebtorParty.AccountNumber = AccountNumber(sealedAccountPrefix + "forged")
+	for _, keyring := range []*accountKeyring{keys, nil} {
+		if _, err := keyring.sealPayment(&p); err != errSealedAccountNumber {
+			t.Errorf("Expected an account number sent sealed to be refused. Got %v", err)
+		}
+	}
+}
+
+// Test the encryption keys are loaded from a file, the current key
+// first, skipping blank lines and comments.
+func TestLoadEncryptionKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(path, []byte("# rotated 2026-10-01\n"+encryptionKey+"\n\n"+retiredEncryptionKey+"\n"), 0600)
+	current, retired, err := LoadEncryptionKeys(path)
+	if err != nil || current != encryptionKey || len(retired) != 1 || retired[0] != retiredEncryptionKey {
+		t.Errorf("Expected the current and retired keys. Got %q, %q, %v", current, retired, err)
+	}
+	os.WriteFile(path, []byte("# none yet\n"), 0600)
+	if _, _, err := LoadEncryptionKeys(path); err == nil {
+		t.Errorf("Expected a file without keys to be refused")
+	}
+}
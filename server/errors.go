@@ -0,0 +1,123 @@
+// errors.go - The errors of the backing store as clients are told of
+// them.
+
+package server
+
+import (
+	"context"
+	"gopkg.in/mgo.v2"
+	"net/http"
+)
+
+// StorageErrorKind is the category of a failed storage operation,
+// which is all a client is told of the failure.
+type StorageErrorKind int
+
+// The categories of failed storage operations.
+const (
+	StorageInternal StorageErrorKind = iota
+	StorageNotFound
+	StorageDuplicate
+	StorageTransient
+)
+
+// storageErrorMessages are the messages emitted for each
+// StorageErrorKind in place of the error of the backing store.
+var storageErrorMessages = map[StorageErrorKind]string{
+	StorageInternal:  "The payment store failed to serve the request",
+	StorageNotFound:  "The requested record was not found",
+	StorageDuplicate: "A record with the same identity already exists",
+	StorageTransient: "The payment store is temporarily unavailable, try again later",
+}
+
+// storageErrorStatuses are the statuses emitted for each
+// StorageErrorKind, whatever the status the handler responds with.
+var storageErrorStatuses = map[StorageErrorKind]int{
+	StorageInternal:  http.StatusInternalServerError,
+	StorageNotFound:  http.StatusNotFound,
+	StorageDuplicate: http.StatusConflict,
+	StorageTransient: http.StatusServiceUnavailable,
+}
+
+// StorageError is the error of the backing store in Err, of the
+// category in Kind. Its message is the canned message of Kind, so that
+// nothing of Err, such as the queries, hosts or data it names, is
+// disclosed to clients.
+type StorageError struct {
+	Kind StorageErrorKind
+	Err  error
+}
+
+// Error describes the category of the failure.
+func (e *StorageError) Error() string {
+	return storageErrorMessages[e.Kind]
+}
+
+// Unwrap returns the error of the backing store.
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// publicErrors are the errors the server raises itself, whose messages
+// are meant for clients.
+var publicErrors = map[error]bool{
+	ErrPaymentExists:       true,
+	ErrPaymentNotFound:     true,
+	ErrQuotaExceeded:       true,
+	ErrMigrationsLocked:    true,
+	ErrPaymentLocked:       true,
+	errForeignOrganisation: true,
+	errBatchNotCommitted:   true,
+}
+
+// classifyStorageError returns the StorageError of the error of the
+// backing store in err: StorageNotFound if no document matched,
+// StorageDuplicate if a unique index refused a write, StorageTransient
+// if retrying may succeed (see isTransient) and StorageInternal
+// otherwise.
+func classifyStorageError(err error) *StorageError {
+	kind := StorageInternal
+	switch {
+	case err == mgo.ErrNotFound:
+		kind = StorageNotFound
+	case mgo.IsDup(err):
+		kind = StorageDuplicate
+	case isTransient(err):
+		kind = StorageTransient
+	}
+	return &StorageError{Kind: kind, Err: err}
+}
+
+// publicError returns the error in err as the client of the request of
+// ctx may be told of it. The errors the server raises about the
+// request, such as a ValidationError, are returned as they are. Any
+// other error is of the backing store: its StorageError is returned
+// and err is logged by the logger of the request, along with its ID
+// (see withRequestLogger), for the failure to be traced from what the
+// client was told.
+func publicError(ctx context.Context, err error) error {
+	switch err.(type) {
+	case nil, *StorageError, *ValidationError, *ValidationErrors, *AmountError,
+		*MissingAttributesError, *DuplicatePaymentError, *PaymentIDError, *CircuitOpenError:
+		return err
+	}
+	if publicErrors[err] {
+		return err
+	}
+	storageErr := classifyStorageError(err)
+	requestLogger(ctx).Error().Err(err).Msg("Storage error")
+	return storageErr
+}
+
+// storageErrorStatus is a convenience function that returns the status
+// of the StorageError in err, StatusConflict if err is a
+// DuplicatePaymentError, or the status in code otherwise.
+func storageErrorStatus(err error, code int) int {
+	switch e := err.(type) {
+	case *StorageError:
+		return storageErrorStatuses[e.Kind]
+	case *DuplicatePaymentError:
+		return http.StatusConflict
+	}
+	return code
+}
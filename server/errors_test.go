@@ -0,0 +1,40 @@
+// errors_test.go
+
+package server
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/mgo.v2"
+	"testing"
+)
+
+// Test errors of the backing store are categorised, and errors the
+// server raises about a request are left as they are.
+func TestPublicError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind StorageErrorKind
+	}{
+		{mgo.ErrNotFound, StorageNotFound},
+		{&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error index: test_v1.payments.$id_1"}, StorageDuplicate},
+		{errors.New("no reachable servers"), StorageTransient},
+		{errors.New("Cannot decrypt an account number: cipher: message authentication failed"), StorageInternal},
+	}
+	for _, test := range tests {
+		storageErr, ok := publicError(context.Background(), test.err).(*StorageError)
+		if !ok || storageErr.Kind != test.kind || storageErr.Err != test.err {
+			t.Errorf("Expected %v to be of kind %d. Got %#v", test.err, test.kind, storageErr)
+		} else if storageErr.Error() != storageErrorMessages[test.kind] {
+			t.Errorf("Expected only the message of kind %d. Got %q", test.kind, storageErr.Error())
+		}
+	}
+
+	for _, err := range []error{ErrPaymentNotFound, ErrQuotaExceeded,
+		&ValidationError{Attribute: "amount", Reason: "negative"},
+		&PaymentIDError{Reason: "No Payment ID specified"}} {
+		if public := publicError(context.Background(), err); public != err {
+			t.Errorf("Expected %v to be told to clients. Got %v", err, public)
+		}
+	}
+}
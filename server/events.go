@@ -0,0 +1,168 @@
+// events.go - Events of the changes to payment records, published to
+// their subscribers.
+
+package server
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// The types of a PaymentEvent.
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+)
+
+// eventTypes are the types of PaymentEvent, which subscribers may
+// filter their events by.
+var eventTypes = []string{EventCreated, EventUpdated, EventDeleted}
+
+// eventQueueSize is the number of events queued for a subscriber that
+// has yet to take them. A subscriber falling further behind is evicted
+// rather than hold up the others.
+const eventQueueSize = 64
+
+// eventMetrics counts the events published and the subscribers evicted
+// for falling behind, published through expvar as "events".
+var eventMetrics = expvar.NewMap("events")
+
+// PaymentEvent describes a change to a payment record: its Type, the
+// Payment ID and organisation of the payment record and when it
+// changed. Payment is the payment record as created or updated, or as
+// it was when it was deleted.
+type PaymentEvent struct {
+	Type           string    `json:"type"`
+	ID             string    `json:"id"`
+	OrganisationID string    `json:"organisation_id"`
+	Time           time.Time `json:"time"`
+	Payment        *Payment  `json:"data,omitempty"`
+}
+
+// eventSubscriber is a subscriber to the events of an eventHub. It is
+// only sent the events of the organisation in scope, that of its API
+// key, if set, and further only those of the organisation in
+// organisation if that is set, and of the types in types if it has
+// any. Its events are closed once it is unsubscribed, evicted for
+// falling behind, or the hub is closed.
+type eventSubscriber struct {
+	events       chan PaymentEvent
+	scope        string
+	organisation string
+	types        map[string]bool
+	evicted      bool
+}
+
+// eventHub publishes the events of the changes to payment records to
+// its subscribers. A nil eventHub publishes nothing and takes no
+// subscribers.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]bool
+	closed      bool
+}
+
+// newEventHub returns an eventHub without subscribers.
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: map[*eventSubscriber]bool{}}
+}
+
+// subscribe returns a new subscriber to the events of the organisation
+// in scope, or of every organisation if it is empty. Nil is returned
+// if the hub does not take subscribers.
+func (hub *eventHub) subscribe(scope string) *eventSubscriber {
+	if hub == nil {
+		return nil
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.closed {
+		return nil
+	}
+	subscriber := &eventSubscriber{events: make(chan PaymentEvent, eventQueueSize), scope: scope}
+	hub.subscribers[subscriber] = true
+	return subscriber
+}
+
+// filter restricts the events sent to subscriber to those of the
+// organisation in organisation and of the types in types, lifting
+// either restriction if it is empty.
+func (hub *eventHub) filter(subscriber *eventSubscriber, organisation string, types []string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	subscriber.organisation = organisation
+	subscriber.types = map[string]bool{}
+	for _, eventType := range types {
+		subscriber.types[eventType] = true
+	}
+}
+
+// unsubscribe stops sending events to subscriber and closes its
+// events, unless that has already happened.
+func (hub *eventHub) unsubscribe(subscriber *eventSubscriber) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.subscribers[subscriber] {
+		delete(hub.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// publish sends the event in event to every subscriber it concerns.
+// Subscribers whose queue of events is full are evicted, rather than
+// wait for them.
+func (hub *eventHub) publish(event PaymentEvent) {
+	if hub == nil {
+		return
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	eventMetrics.Add("published", 1)
+	for subscriber := range hub.subscribers {
+		if (subscriber.scope != "" && subscriber.scope != event.OrganisationID) ||
+			(subscriber.organisation != "" && subscriber.organisation != event.OrganisationID) ||
+			(len(subscriber.types) > 0 && !subscriber.types[event.Type]) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			eventMetrics.Add("evicted", 1)
+			subscriber.evicted = true
+			delete(hub.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+}
+
+// close unsubscribes every subscriber, and refuses further ones.
+func (hub *eventHub) close() {
+	if hub == nil {
+		return
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.closed = true
+	for subscriber := range hub.subscribers {
+		delete(hub.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// publishEvent is a convenience function that publishes the change of
+// the type in eventType to the payment record in payment to the
+// subscribers of the server.
+func (server *Server) publishEvent(eventType string, payment Payment) {
+	server.events.publish(PaymentEvent{
+		Type:           eventType,
+		ID:             payment.ID,
+		OrganisationID: payment.OrganisationID,
+		Time:           server.now().UTC(),
+		Payment:        &payment,
+	})
+}
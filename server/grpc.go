@@ -0,0 +1,299 @@
+// grpc.go - The gRPC PaymentService, served alongside the REST API.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/DeltaPine/payment_server/paymentpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// grpcMethods maps the methods of the PaymentService to the HTTP
+// method of their REST counterpart, which the role of an API key must
+// permit.
+var grpcMethods = map[string]string{
+	paymentpb.PaymentService_GetPayment_FullMethodName:    "GET",
+	paymentpb.PaymentService_ListPayments_FullMethodName:  "GET",
+	paymentpb.PaymentService_CreatePayment_FullMethodName: "POST",
+	paymentpb.PaymentService_UpdatePayment_FullMethodName: "PUT",
+	paymentpb.PaymentService_DeletePayment_FullMethodName: "DELETE",
+}
+
+// grpcCodes maps the statuses the REST API responds with to the
+// canonical gRPC codes. Any other status is codes.Internal.
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.AlreadyExists,
+	http.StatusLocked:              codes.FailedPrecondition,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+}
+
+// paymentService serves the PaymentService on the payment records of
+// server, with the checks of the REST API.
+type paymentService struct {
+	paymentpb.UnimplementedPaymentServiceServer
+	server *Server
+}
+
+// grpcServer returns the gRPC server of the PaymentService,
+// authenticating calls with authenticateGRPC.
+func (server *Server) grpcServer() *grpc.Server {
+	rpc := grpc.NewServer(grpc.UnaryInterceptor(server.authenticateGRPC))
+	paymentpb.RegisterPaymentServiceServer(rpc, &paymentService{server: server})
+	return rpc
+}
+
+// authenticateGRPC is a unary interceptor that authenticates calls as
+// authenticate does requests, taking the API key from the x-api-key
+// metadata and the role from the REST counterpart of the method (see
+// grpcMethods). Calls without a valid API key fail with
+// codes.Unauthenticated and calls the role does not permit with
+// codes.PermissionDenied. The ID of the call, which its failures are
+// logged with, is returned in the x-request-id header.
+func (server *Server) authenticateGRPC(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, id := withRequestID(ctx)
+	ctx = server.withRequestLogger(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(requestIDHeader), id))
+	if len(server.APIKeys) == 0 {
+		return handler(ctx, req)
+	}
+
+	presented := ""
+	if values := metadata.ValueFromIncomingContext(ctx, "x-api-key"); len(values) > 0 {
+		presented = values[0]
+	}
+	apiKey, admin, ok := server.lookupAPIKey(presented)
+	if admin {
+		return handler(ctx, req)
+	} else if !ok {
+		return nil, status.Error(codes.Unauthenticated, "A valid API key is required")
+	}
+	role := apiKey.Role
+	if role == "" {
+		role = RoleReadWrite
+	}
+	if !roleAllows(role, grpcMethods[info.FullMethod]) {
+		return nil, status.Error(codes.PermissionDenied,
+			"The API key's role does not permit this call")
+	}
+	return handler(context.WithValue(ctx, apiKeyContextKey{}, apiKey), req)
+}
+
+// grpcRequest is a convenience function that returns a request
+// standing in for the call of ctx in the checks shared with the REST
+// API, which take the request they check: it carries the APIKey of the
+// call, the lock token of its x-lock-token metadata in the
+// LockTokenHeader, and an X-Allow-Duplicate header of true if
+// allowDuplicate is set.
+func grpcRequest(ctx context.Context, allowDuplicate bool) *http.Request {
+	r := (&http.Request{Method: "POST", Header: http.Header{}}).WithContext(ctx)
+	if allowDuplicate {
+		r.Header.Set("X-Allow-Duplicate", "true")
+	}
+	if values := metadata.ValueFromIncomingContext(ctx, "x-lock-token"); len(values) > 0 {
+		r.Header.Set(LockTokenHeader, values[0])
+	}
+	return r
+}
+
+// grpcError is a convenience function that returns the gRPC status
+// error for the error in err of the call of ctx, raised where the REST
+// API responds with the status in code. Payment records that already
+// exist are codes.AlreadyExists, and storage operations refused by the
+// circuit breaker codes.Unavailable, whatever the status. Errors of the
+// backing store are returned only as their StorageError, as the REST
+// API emits them (see publicError).
+func grpcError(ctx context.Context, code int, err error) error {
+	err = publicError(ctx, err)
+	code = storageErrorStatus(err, code)
+	var open *CircuitOpenError
+	var duplicate *DuplicatePaymentError
+	switch {
+	case errors.As(err, &open):
+		code = http.StatusServiceUnavailable
+	case err == ErrPaymentExists, errors.As(err, &duplicate):
+		code = http.StatusConflict
+	}
+	grpcCode, ok := grpcCodes[code]
+	if !ok {
+		grpcCode = codes.Internal
+	}
+	return status.Error(grpcCode, err.Error())
+}
+
+// paymentFromProto is a convenience function that converts the Payment
+// message in m to a payment record through their common JSON form.
+func paymentFromProto(m *paymentpb.Payment) (Payment, error) {
+	var p Payment
+	document, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(m)
+	if err == nil {
+		err = json.Unmarshal(document, &p)
+	}
+	if err != nil {
+		return p, status.Error(codes.InvalidArgument, "Invalid payment: "+err.Error())
+	}
+	return p, nil
+}
+
+// paymentToProto is a convenience function that converts the payment
+// record in p to a Payment message through their common JSON form.
+func paymentToProto(p Payment) (*paymentpb.Payment, error) {
+	m := &paymentpb.Payment{}
+	document, err := json.Marshal(p)
+	if err == nil {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(document, m)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return m, nil
+}
+
+// GetPayment returns the payment record with the Payment ID of req, as
+// getPayment does. A payment record of an organisation other than that
+// of the API key is not found.
+func (s *paymentService) GetPayment(ctx context.Context,
+	req *paymentpb.GetPaymentRequest) (*paymentpb.Payment, error) {
+	server := s.server
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "No Payment ID specified")
+	}
+	p := Payment{ID: req.GetId(), OrganisationID: callerOrganisation(grpcRequest(ctx, false))}
+
+	count := -1 // a storage failure, unless the lookup runs
+	var payment Payment
+	err := server.storage(ctx, "getPayment", p.ID, func() (err error) {
+		count, payment, err = server.store.getPayment(&p)
+		return
+	})
+	if err != nil && count < 0 {
+		return nil, grpcError(ctx, http.StatusInternalServerError, err)
+	} else if err != nil {
+		return nil, grpcError(ctx, http.StatusNotFound, err)
+	}
+	return paymentToProto(payment)
+}
+
+// ListPayments returns a page of the payment records, sorted by
+// Payment ID and restricted to the organisation of the API key if any.
+// The page token is the offset of the page, and a page size of zero is
+// that of a PaymentSearch.
+func (s *paymentService) ListPayments(ctx context.Context,
+	req *paymentpb.ListPaymentsRequest) (*paymentpb.ListPaymentsResponse, error) {
+	server := s.server
+	search := PaymentSearch{Limit: int(req.GetPageSize())}
+	if token := req.GetPageToken(); token != "" {
+		offset, err := strconv.Atoi(token)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Invalid page token "+token)
+		}
+		search.Offset = offset
+	}
+	if err := search.check(server.pageSizes()); err != nil {
+		return nil, grpcError(ctx, http.StatusBadRequest, err)
+	}
+
+	var payments []Payment
+	var total int
+	err := server.storage(ctx, "searchPayments", "", func() (err error) {
+		payments, total, err = search.modelSearchPayments(server.mongo,
+			callerOrganisation(grpcRequest(ctx, false)))
+		return
+	})
+	if err != nil {
+		return nil, grpcError(ctx, http.StatusInternalServerError, err)
+	}
+
+	page := &paymentpb.ListPaymentsResponse{Total: int32(total)}
+	for _, payment := range payments {
+		m, err := paymentToProto(payment)
+		if err != nil {
+			return nil, err
+		}
+		page.Payments = append(page.Payments, m)
+	}
+	if next := search.Offset + search.Limit; next < total {
+		page.NextPageToken = strconv.Itoa(next)
+	}
+	return page, nil
+}
+
+// CreatePayment creates the payment record of req, subject to the
+// checks and the quota of createPayment. A duplicate payment is
+// created only if allow_duplicate is set.
+func (s *paymentService) CreatePayment(ctx context.Context,
+	req *paymentpb.CreatePaymentRequest) (*paymentpb.Payment, error) {
+	server := s.server
+	r := grpcRequest(ctx, req.GetAllowDuplicate())
+	p, err := paymentFromProto(req.GetPayment())
+	if err != nil {
+		return nil, err
+	}
+	server.assignID(&p)
+	server.normaliseText(&p)
+	if code, err := server.checkNewPayment(r, &p); err != nil {
+		return nil, grpcError(ctx, code, err)
+	}
+
+	quota, err := server.reserveQuota(r)
+	if err == ErrQuotaExceeded {
+		return nil, grpcError(ctx, http.StatusTooManyRequests, err)
+	} else if err != nil {
+		return nil, grpcError(ctx, http.StatusInternalServerError, err)
+	}
+	if err := server.addPayment(ctx, &p); err != nil {
+		server.releaseQuota(r, quota)
+		return nil, grpcError(ctx, http.StatusInternalServerError, err)
+	}
+	return paymentToProto(p)
+}
+
+// UpdatePayment replaces the payment record with the Payment ID of the
+// payment of req, subject to the checks of updatePayment, keeping its
+// stored status. The token of a lock held on it is taken from the
+// x-lock-token metadata.
+func (s *paymentService) UpdatePayment(ctx context.Context,
+	req *paymentpb.UpdatePaymentRequest) (*paymentpb.Payment, error) {
+	server := s.server
+	r := grpcRequest(ctx, false)
+	p, err := paymentFromProto(req.GetPayment())
+	if err != nil {
+		return nil, err
+	}
+	if p.ID == "" {
+		return nil, status.Error(codes.InvalidArgument, "No Payment ID specified")
+	}
+	if code, err := server.checkUpdatedPayment(r, &p); err != nil {
+		return nil, grpcError(ctx, code, err)
+	}
+	if _, code, err := server.replacePayment(ctx, &p); err != nil {
+		return nil, grpcError(ctx, code, err)
+	}
+	return paymentToProto(p)
+}
+
+// DeletePayment removes the payment record with the Payment ID of req,
+// as deletePayment does.
+func (s *paymentService) DeletePayment(ctx context.Context,
+	req *paymentpb.DeletePaymentRequest) (*paymentpb.DeletePaymentResponse, error) {
+	server := s.server
+	if code, err := server.removePayment(grpcRequest(ctx, false), req.GetId()); err != nil {
+		return nil, grpcError(ctx, code, err)
+	}
+	return &paymentpb.DeletePaymentResponse{}, nil
+}
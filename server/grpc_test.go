@@ -0,0 +1,205 @@
+// grpc_test.go
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/DeltaPine/payment_server/paymentpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// Test a payment record created over gRPC is readable over REST and
+// one created over REST readable over gRPC, with the two servers
+// sharing their shutdown. Failures are reported with the canonical
+// gRPC codes, and calls are authenticated with the API keys.
+func TestGRPCService(t *testing.T) {
+	both := newTestServer(t, func(x *Server) {
+		x.APIKeys = map[string]APIKey{
+			"key-grpc":   {OrganisationID: "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"},
+			"key-reader": {OrganisationID: "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb", Role: RoleReadOnly},
+		}
+	})
+	web, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- both.serve(ctx, web, rpc) }()
+
+	conn, err := grpc.NewClient(rpc.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := paymentpb.NewPaymentServiceClient(conn)
+	call := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key-grpc")
+	rest := func(method string, path string, body []byte) *http.Response {
+		req, _ := newJSONRequest(method, "http://"+web.Addr().String()+path,
+			bytes.NewReader(body))
+		req.Header.Set("X-API-Key", "key-grpc")
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	clearTable()
+	var sent Payment
+	json.Unmarshal(payload, &sent)
+	m, _ := paymentToProto(sent)
+	if _, err := client.CreatePayment(call, &paymentpb.CreatePaymentRequest{Payment: m}); err != nil {
+		t.Fatalf("Expected the payment to be created over gRPC. Got %v", err)
+	}
+	response := rest("GET", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
+	var fetched Payment
+	json.NewDecoder(response.Body).Decode(&fetched)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || fetched.Attributes.DebtorParty.AccountNumber !=
+		sent.Attributes.DebtorParty.AccountNumber || fetched.Attributes.Amount != sent.Attributes.Amount {
+		t.Errorf("Expected the payment created over gRPC over REST. Got %d %+v",
+			response.StatusCode, fetched)
+	}
+
+	second := bytes.Replace(payload2, []byte("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"),
+		[]byte("216d4da9-e59a-4cc6-8df3-3da6e7580b77"), 1)
+	response = rest("POST", "/v1/payment", second)
+	response.Body.Close()
+	checkResponseCode(t, http.StatusCreated, response.StatusCode)
+	got, err := client.GetPayment(call, &paymentpb.GetPaymentRequest{Id: "216d4da9-e59a-4cc6-8df3-3da6e7580b77"})
+	if err != nil || got.GetAttributes().GetAmount() != "121.00" ||
+		got.GetAttributes().GetBeneficiaryParty().GetName() != "Wilfred Jeremiah Owens" {
+		t.Errorf("Expected the payment created over REST over gRPC. Got %v, %v", got, err)
+	}
+
+	page, err := client.ListPayments(call, &paymentpb.ListPaymentsRequest{PageSize: 1})
+	if err != nil || len(page.GetPayments()) != 1 || page.GetTotal() != 2 ||
+		page.GetPayments()[0].GetId() != "216d4da9-e59a-4cc6-8df3-3da6e7580b77" {
+		t.Fatalf("Expected the first page of payments. Got %v, %v", page, err)
+	}
+	page, err = client.ListPayments(call, &paymentpb.ListPaymentsRequest{PageSize: 1,
+		PageToken: page.GetNextPageToken()})
+	if err != nil || len(page.GetPayments()) != 1 || page.GetNextPageToken() != "" ||
+		page.GetPayments()[0].GetId() != "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43" {
+		t.Errorf("Expected the last page of payments. Got %v, %v", page, err)
+	}
+
+	got.Attributes.Reference = "Updated over gRPC"
+	if _, err := client.UpdatePayment(call, &paymentpb.UpdatePaymentRequest{Payment: got}); err != nil {
+		t.Errorf("Expected the payment to be updated. Got %v", err)
+	}
+	response = rest("GET", "/v1/payment/216d4da9-e59a-4cc6-8df3-3da6e7580b77", nil)
+	json.NewDecoder(response.Body).Decode(&fetched)
+	response.Body.Close()
+	if fetched.Attributes.Reference != "Updated over gRPC" {
+		t.Errorf("Expected the update over REST. Got %s", fetched.Attributes.Reference)
+	}
+	if _, err := client.DeletePayment(call, &paymentpb.DeletePaymentRequest{
+		Id: "216d4da9-e59a-4cc6-8df3-3da6e7580b77"}); err != nil {
+		t.Errorf("Expected the payment to be deleted. Got %v", err)
+	}
+
+	invalid, _ := paymentToProto(sent)
+	invalid.Id = "1f4ee2d5-34b3-4ba3-a1c8-cb1c1b29e0a8"
+	invalid.Attributes.Currency = ""
+	reader := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key-reader")
+	failures := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{"missing", func() error {
+			_, err := client.GetPayment(call, &paymentpb.GetPaymentRequest{Id: "216d4da9-e59a-4cc6-8df3-3da6e7580b77"})
+			return err
+		}(), codes.NotFound},
+		{"existing", func() error {
+			_, err := client.CreatePayment(call, &paymentpb.CreatePaymentRequest{Payment: m})
+			return err
+		}(), codes.AlreadyExists},
+		{"invalid", func() error {
+			_, err := client.CreatePayment(call, &paymentpb.CreatePaymentRequest{Payment: invalid})
+			return err
+		}(), codes.InvalidArgument},
+		{"unauthenticated", func() error {
+			_, err := client.ListPayments(context.Background(), &paymentpb.ListPaymentsRequest{})
+			return err
+		}(), codes.Unauthenticated},
+		{"read-only", func() error {
+			_, err := client.DeletePayment(reader, &paymentpb.DeletePaymentRequest{
+				Id: "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"})
+			return err
+		}(), codes.PermissionDenied},
+	}
+	for _, failure := range failures {
+		if status.Code(failure.err) != failure.code {
+			t.Errorf("Expected the %s call to fail with %s. Got %v", failure.name, failure.code,
+				failure.err)
+		}
+	}
+
+	stop()
+	if err := <-served; err != nil {
+		t.Errorf("Expected both servers to shut down cleanly. Got %v", err)
+	}
+	if _, err := client.ListPayments(call, &paymentpb.ListPaymentsRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the gRPC server to be shut down. Got %v", err)
+	}
+}
+
+// Test the PaymentService reads and writes the payment records through
+// the store of the server, as the REST API does: a payment record is
+// created, updated, keeping its stored status, and deleted against the
+// memoryStore, and is then not found.
+func TestGRPCServiceWithMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+	service := &paymentService{server: newMemoryServer(t, store, nil)}
+	ctx := context.Background()
+	id := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+
+	var sent Payment
+	json.Unmarshal(payload, &sent)
+	m, _ := paymentToProto(sent)
+	if _, err := service.CreatePayment(ctx, &paymentpb.CreatePaymentRequest{Payment: m}); err != nil {
+		t.Fatalf("Expected the payment to be created in the store. Got %v", err)
+	}
+	scheduled := store.payments[id]
+	scheduled.Status = PaymentScheduled
+	store.payments[id] = scheduled
+
+	json.Unmarshal(payload2, &sent)
+	m, _ = paymentToProto(sent)
+	if _, err := service.UpdatePayment(ctx, &paymentpb.UpdatePaymentRequest{Payment: m}); err != nil {
+		t.Fatalf("Expected the payment to be updated in the store. Got %v", err)
+	}
+	if updated := store.payments[id]; updated.Attributes.Amount.String() != "121.00" ||
+		updated.Status != PaymentScheduled {
+		t.Errorf("Expected the update stored with the stored status. Got %+v", updated)
+	}
+
+	if _, err := service.DeletePayment(ctx, &paymentpb.DeletePaymentRequest{Id: id}); err != nil {
+		t.Fatalf("Expected the payment to be deleted from the store. Got %v", err)
+	}
+	_, err := service.GetPayment(ctx, &paymentpb.GetPaymentRequest{Id: id})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected the deleted payment not to be found. Got %v", err)
+	}
+	_, err = service.DeletePayment(ctx, &paymentpb.DeletePaymentRequest{Id: id})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected a second delete not to find the payment. Got %v", err)
+	}
+}
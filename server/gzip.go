@@ -0,0 +1,90 @@
+// gzip.go - Compressed request bodies for the write endpoints.
+
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// defaultMaxBodySize is the size in bytes request bodies are bounded
+// to, once decompressed, unless MaxBodySize is set.
+const defaultMaxBodySize = 32 << 20
+
+// gzipBody is the decompressed body of a request sent with a
+// Content-Encoding of gzip. Closing it closes the compressed body too.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// Close closes the gzip stream and the compressed body.
+func (body *gzipBody) Close() error {
+	body.Reader.Close()
+	return body.body.Close()
+}
+
+// maxBodySize returns the size in bytes request bodies are bounded to,
+// MaxBodySize or defaultMaxBodySize if it is not set.
+func (server *Server) maxBodySize() int64 {
+	if server.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return server.MaxBodySize
+}
+
+// acceptGzip wraps the handler in next so that request bodies sent
+// with a Content-Encoding of gzip are decompressed before they reach
+// it. A body that is not a gzip stream is refused with
+// StatusBadRequest, and any other encoding with
+// StatusUnsupportedMediaType. The body, decompressed or not, is
+// bounded to maxBodySize bytes, so that a small compressed body cannot
+// expand without limit; reading past it fails with an
+// http.MaxBytesError (see respondWithDecodeError).
+func (server *Server) acceptGzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Malformed gzip request body")
+				return
+			}
+			r.Body = &gzipBody{Reader: reader, body: r.Body}
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		default:
+			respondWithError(w, http.StatusUnsupportedMediaType,
+				fmt.Sprintf("Unsupported Content-Encoding %q, use gzip", encoding))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, server.maxBodySize())
+		next(w, r)
+	}
+}
+
+// limitBodies is a middleware that bounds the body of every request to
+// maxBodySize bytes, so that no handler reads a body without limit;
+// reading past it fails with an http.MaxBytesError (see
+// respondWithDecodeError). Compressed bodies are bounded again once
+// decompressed (see acceptGzip).
+func (server *Server) limitBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, server.maxBodySize())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyTooLarge reports whether err was raised by reading a request
+// body past the bound set by limitBodies or acceptGzip.
+func bodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
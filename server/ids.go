@@ -0,0 +1,158 @@
+// ids.go - Payment IDs generated by the server.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IDGenerator generates the Payment IDs of payments created without
+// one. Every ID it returns must be unique.
+type IDGenerator interface {
+	NewID() string
+}
+
+// The formats of the Payment IDs the server may generate: random
+// version 4 UUIDs, or ULIDs, which sort in the order they were
+// generated in.
+const (
+	IDFormatUUID = "uuid"
+	IDFormatULID = "ulid"
+)
+
+// newIDGenerator returns the IDGenerator of the IDs in format, one of
+// IDFormatUUID or IDFormatULID regardless of case, ULIDs being stamped
+// with the time of timeSource. An empty format returns nil, generating
+// no IDs.
+func newIDGenerator(format string, timeSource func() time.Time) (IDGenerator, error) {
+	switch strings.ToLower(format) {
+	case "":
+		return nil, nil
+	case IDFormatUUID:
+		return uuidGenerator{}, nil
+	case IDFormatULID:
+		return newULIDGenerator(timeSource), nil
+	}
+	return nil, fmt.Errorf("Unknown ID format %q, use uuid or ulid", format)
+}
+
+// uuidGenerator is the IDGenerator of random version 4 UUIDs, such as
+// "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43".
+type uuidGenerator struct{}
+
+// NewID returns a new random UUID.
+func (uuidGenerator) NewID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	encoded := hex.EncodeToString(id[:])
+	return encoded[:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" +
+		encoded[16:20] + "-" + encoded[20:]
+}
+
+// ulidAlphabet is the Crockford base32 alphabet of ULIDs, in ascending
+// order so that ULIDs sort as the values they encode.
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator is the IDGenerator of ULIDs, such as
+// "01ARZ3NDEKTSV4RRFFQ69G5FAV": a 48 bit millisecond timestamp followed
+// by 80 random bits. ULIDs generated within the same millisecond, or
+// while the time stands still or goes back, increment the random bits
+// of the last ULID rather than drawing new ones, so that every ULID
+// sorts after those generated before it.
+type ulidGenerator struct {
+	timeSource func() time.Time
+	mu         sync.Mutex
+	lastMillis uint64
+	lastRandom [10]byte
+}
+
+// newULIDGenerator returns a ulidGenerator stamping ULIDs with the
+// time of timeSource, or of the system clock if it is nil.
+func newULIDGenerator(timeSource func() time.Time) *ulidGenerator {
+	if timeSource == nil {
+		timeSource = systemClock{}.Now
+	}
+	return &ulidGenerator{timeSource: timeSource}
+}
+
+// NewID returns a new ULID, sorting after every ULID returned before.
+func (generator *ulidGenerator) NewID() string {
+	generator.mu.Lock()
+	defer generator.mu.Unlock()
+
+	millis := uint64(generator.timeSource().UnixMilli())
+	if millis > generator.lastMillis {
+		generator.lastMillis = millis
+		rand.Read(generator.lastRandom[:])
+	} else if !incrementBytes(generator.lastRandom[:]) {
+		// The random bits of this millisecond are exhausted.
+		generator.lastMillis++
+	}
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(generator.lastMillis >> uint(8*(5-i)))
+	}
+	copy(id[6:], generator.lastRandom[:])
+	return encodeULID(id)
+}
+
+// incrementBytes is a convenience function that adds one to the big
+// endian number in b, and reports whether it did not overflow.
+func incrementBytes(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID is a convenience function that returns the 128 bits of
+// id in the 26 characters of a ULID, five bits a character from the
+// most significant, the first character holding only three.
+func encodeULID(id [16]byte) string {
+	encoded := make([]byte, 26)
+	for i := range encoded {
+		value := 0
+		for bit := 5*i - 2; bit < 5*i+3; bit++ {
+			value <<= 1
+			if bit >= 0 {
+				value |= int(id[bit/8]>>uint(7-bit%8)) & 1
+			}
+		}
+		encoded[i] = ulidAlphabet[value]
+	}
+	return string(encoded)
+}
+
+// The forms of the Payment IDs accepted from clients when the server
+// generates IDs: a UUID, or a ULID in either case.
+var (
+	uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	ulidPattern = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Za-hjkmnp-tv-z]{25}$`)
+)
+
+// validID reports whether the Payment ID in id is a UUID or a ULID.
+func validID(id string) bool {
+	return uuidPattern.MatchString(id) || ulidPattern.MatchString(id)
+}
+
+// assignID is a convenience function that gives the payment record in
+// p, if it has no Payment ID, one from the IDGenerator of the server.
+// Payment records keep their Payment ID, and without an IDGenerator
+// are left without one to be refused.
+func (server *Server) assignID(p *Payment) {
+	if p.ID == "" && server.IDGenerator != nil {
+		p.ID = server.IDGenerator.NewID()
+	}
+}
@@ -0,0 +1,91 @@
+// ids_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/DeltaPine/payment_server/internal/testutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Test generated UUIDs and ULIDs are valid IDs and unique across a
+// burst, ULIDs sorting in the order they were generated in whether the
+// fake clock stands still or moves on.
+func TestIDGenerators(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2017, 1, 18, 9, 0, 0, 0, time.UTC))
+	uuids, _ := newIDGenerator("UUID", clock.Now)
+	ulids, _ := newIDGenerator("ulid", clock.Now)
+	for _, generator := range []IDGenerator{uuids, ulids} {
+		seen := map[string]bool{}
+		var ids []string
+		for i := 0; i < 1000; i++ {
+			if i%100 == 0 {
+				clock.Advance(time.Millisecond)
+			}
+			id := generator.NewID()
+			if !validID(id) || seen[id] {
+				t.Fatalf("Expected a new valid ID. Got %q", id)
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		if generator == ulids && !sort.StringsAreSorted(ids) {
+			t.Errorf("Expected ULIDs to sort in the order they were generated in")
+		}
+	}
+
+	var stamp [16]byte
+	millis := clock.Now().UnixMilli()
+	for i := 0; i < 6; i++ {
+		stamp[i] = byte(millis >> uint(8*(5-i)))
+	}
+	if id := ulids.NewID(); id[:10] != encodeULID(stamp)[:10] {
+		t.Errorf("Expected the ULID to be stamped with the time of the clock. Got %s", id)
+	}
+	for _, id := range []string{"", "1", "4ee3a8d8ca7b4290a52cdd5b6165ec43", "01ARZ3NDEKTSV4RRFFQ69G5FAVX",
+		"81ARZ3NDEKTSV4RRFFQ69G5FAV", "01ARZ3NDEKTSV4RRFFQ69G5FAU"} {
+		if validID(id) {
+			t.Errorf("Expected %q not to be a valid ID", id)
+		}
+	}
+	if generator, err := newIDGenerator("snowflake", clock.Now); err == nil {
+		t.Errorf("Expected an unknown ID format to be refused. Got %T", generator)
+	}
+}
+
+// Test payments created without an id are given a ULID by a server
+// generating them, each unique, while a client id that is neither a
+// UUID nor a ULID is refused.
+func TestCreatePaymentGeneratedID(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	generating := newTestServer(t, func(x *Server) {
+		x.IDGenerator = newULIDGenerator(testutil.NewFakeClock(time.Now()).Now)
+	})
+	execute := func(body []byte) *httptest.ResponseRecorder {
+		req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(body))
+		return executeOn(generating, req)
+	}
+
+	anonymous := bytes.Replace(payload, []byte(`"id":"4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43",`), nil, 1)
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		response := execute(anonymous)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+		var p Payment
+		json.Unmarshal(response.Body.Bytes(), &p)
+		if !ulidPattern.MatchString(p.ID) || seen[p.ID] {
+			t.Errorf("Expected a new ULID to be generated. Got %q", p.ID)
+		}
+		seen[p.ID] = true
+	}
+
+	checkResponseCode(t, http.StatusCreated, execute(payload).Code)
+	invalid := bytes.Replace(payload, []byte("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"), []byte("1"), 1)
+	checkResponseCode(t, http.StatusBadRequest, execute(invalid).Code)
+}
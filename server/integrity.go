@@ -0,0 +1,225 @@
+// integrity.go - The integrity check of the stored payment records,
+// reporting those the valid checks would now refuse and applying the
+// normalisations that are safe to apply to them.
+
+package server
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IntegrityRecord is a stored payment record the integrity check found
+// problems with, the Payment ID in ID and the problems as Violations.
+type IntegrityRecord struct {
+	ID         string       `json:"id"`
+	Violations []FieldError `json:"violations"`
+}
+
+// IntegrityReport is the outcome of the integrity check: the number of
+// payment records Scanned, the number of them found Violating the
+// valid checks along with the number of Violations in all, listed by
+// payment record in Records, and the number of payment records
+// Normalised.
+type IntegrityReport struct {
+	Scanned    int               `json:"scanned"`
+	Violating  int               `json:"violating"`
+	Violations int               `json:"violations"`
+	Normalised int               `json:"normalised"`
+	Records    []IntegrityRecord `json:"records"`
+}
+
+// storedAmounts are the stored names of the amounts among the
+// attributes of payment records, held in their canonical string form
+// (see Amount.GetBSON).
+var storedAmounts = map[string]bool{"amount": true, "original_amount": true,
+	"receiver_charges_amount": true}
+
+// normaliseStoredValues is a convenience function that normalises the
+// strings of the stored document in document, found at the dotted
+// path in path, and of the documents and arrays within it: their outer
+// whitespace is trimmed and amounts that parse are rewritten in their
+// canonical form. No string is otherwise touched. Each value changed
+// is replaced in document and set in set by its dotted path.
+func normaliseStoredValues(document bson.M, path string, set bson.M) {
+	for key, value := range document {
+		document[key] = normaliseStoredValue(value, path+key, storedAmounts[key], set)
+	}
+}
+
+// normaliseStoredValue is a convenience function that returns the
+// stored value in value, found at the dotted path in path, normalised
+// as by normaliseStoredValues, as an amount if amount is set.
+func normaliseStoredValue(value interface{}, path string, amount bool, set bson.M) interface{} {
+	switch value := value.(type) {
+	case bson.M:
+		normaliseStoredValues(value, path+".", set)
+	case []interface{}:
+		for i, element := range value {
+			value[i] = normaliseStoredValue(element, path+"."+strconv.Itoa(i), false, set)
+		}
+	case string:
+		normalised := strings.TrimSpace(value)
+		if parsed, err := ParseAmount(normalised); amount && normalised != "" && err == nil {
+			normalised = parsed.String()
+		}
+		if normalised != value {
+			set[path] = normalised
+			return normalised
+		}
+	}
+	return value
+}
+
+// checkEmptySenderCharges is a convenience function that ascertains no
+// sender charge of Payment is empty, with neither an amount nor a
+// currency, as left by clients sending placeholder entries. A
+// ValidationError is collected for each empty sender charge.
+func checkEmptySenderCharges(p *Payment) error {
+	var errs []error
+	for i, charge := range p.chargesInformation().SenderCharges {
+		if charge == (SenderCharge{}) {
+			errs = append(errs, &ValidationError{Attribute: fmt.Sprintf("sender_charges[%d]", i),
+				Reason: "the entry is empty"})
+		}
+	}
+	return collectValidationErrors(errs...)
+}
+
+// storedViolations is a convenience function that returns the problems
+// the valid checks of createPayment that do not depend on other
+// payment records find with the stored payment record in document,
+// along with its empty sender charges (see checkEmptySenderCharges). A
+// stored payment record that cannot be read as a Payment, such as one
+// holding an amount that does not parse or account numbers that cannot
+// be decrypted, is reported as such.
+func (server *Server) storedViolations(document bson.M) []FieldError {
+	p, err := server.storedPayment(document)
+	if err != nil {
+		return []FieldError{{Field: "attributes", Code: FieldInvalid,
+			Message: "Cannot read the stored payment: " + err.Error()}}
+	}
+
+	var missingErr error
+	if missing := checkRequiredAttributes(&p); len(missing) > 0 {
+		missingErr = &MissingAttributesError{Attributes: missing}
+	}
+	err = collectValidationErrors(missingErr, checkPaymentValues(&p), checkEmptySenderCharges(&p),
+		server.checkSchemeTypes(&p), server.checkText(&p))
+	if collected, ok := err.(*ValidationErrors); ok {
+		return collected.Errors
+	}
+	return nil
+}
+
+// storedPayment is a convenience function that returns the stored
+// payment record in document read as a Payment, its account numbers
+// decrypted.
+func (server *Server) storedPayment(document bson.M) (Payment, error) {
+	var p Payment
+	data, err := bson.Marshal(document)
+	if err == nil {
+		err = bson.Unmarshal(data, &p)
+	}
+	if err == nil {
+		err = server.keys.openPayment(&p)
+	}
+	return p, err
+}
+
+// scanIntegrity subjects every stored payment record matched by filter
+// to the integrity check (see storedViolations) and returns its
+// IntegrityReport. If normalise is set each payment record is first
+// normalised (see normaliseStoredValues) and those changed written
+// back, stamped now (see stampPayment), unless they have been updated
+// meanwhile.
+func (server *Server) scanIntegrity(filter *PaymentFilter, normalise bool) (IntegrityReport, error) {
+	report := IntegrityReport{Records: []IntegrityRecord{}}
+	iter := filter.modelScanPayments(server.mongo)
+	for {
+		var document bson.M
+		if !iter.Next(&document) {
+			break
+		}
+		report.Scanned++
+		id, _ := document["_id"].(string)
+		if attributes, ok := document["attributes"].(bson.M); normalise && ok {
+			set := bson.M{}
+			normaliseStoredValues(attributes, "attributes.", set)
+			if len(set) > 0 {
+				now := server.now().UTC()
+				if p, err := server.storedPayment(document); err == nil {
+					stampPayment(&p, now)
+					set["fingerprint"] = p.Fingerprint
+				}
+				updatedAt, _ := document["updated_at"].(time.Time)
+				err := modelNormalisePayment(server.mongo, id, updatedAt, set, now)
+				if err == nil {
+					report.Normalised++
+				} else if err != mgo.ErrNotFound {
+					iter.Close()
+					return report, err
+				}
+			}
+		}
+
+		if violations := server.storedViolations(document); len(violations) > 0 {
+			report.Violating++
+			report.Violations += len(violations)
+			report.Records = append(report.Records, IntegrityRecord{ID: id, Violations: violations})
+		}
+	}
+	return report, iter.Close()
+}
+
+// checkIntegrity is the entry-point dispatcher for the integrity check
+// of the payment records in the backing store. It responds to the URL
+// admin/integrity and an appropriate GET request with an
+// IntegrityReport of the stored payment records the valid checks would
+// now refuse, such as those written before a check was introduced. The
+// check may be restricted to the payment records of organisation_id
+// and to those processed from processing_date_from and to
+// processing_date_to, both YYYY-MM-DD. With fix=normalize the stored
+// payment records are normalised before they are checked, trimming the
+// outer whitespace of their values and rewriting their amounts in
+// canonical form, and the number of payment records changed is
+// reported. The check can be repeated safely.
+func (server *Server) checkIntegrity(w http.ResponseWriter, r *http.Request) {
+	fix := r.FormValue("fix")
+	if fix != "" && fix != "normalize" {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown fix %q, use normalize", fix))
+		return
+	}
+	filter := PaymentFilter{
+		OrganisationID:     r.FormValue("organisation_id"),
+		ProcessingDateFrom: r.FormValue("processing_date_from"),
+		ProcessingDateTo:   r.FormValue("processing_date_to"),
+	}
+	for _, date := range []string{filter.ProcessingDateFrom, filter.ProcessingDateTo} {
+		if _, err := time.Parse(ProcessingDateLayout, date); date != "" && err != nil {
+			respondWithError(w, http.StatusBadRequest,
+				"Invalid processing date "+date+", use YYYY-MM-DD")
+			return
+		}
+	}
+
+	var report IntegrityReport
+	err := server.storage(r.Context(), "checkIntegrity", "", func() (err error) {
+		report, err = server.scanIntegrity(&filter, fix == "normalize")
+		return
+	})
+	if report.Normalised > 0 {
+		server.cache.purge()
+	}
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondWith(w, http.StatusOK, report, negotiatedType(w))
+}
@@ -0,0 +1,112 @@
+// integrity_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"testing"
+)
+
+// Test the integrity check reports the stored payments the valid
+// checks would refuse, and only those, and that fix=normalize rewrites
+// their padded values and non-canonical amounts as updated now, with
+// their fingerprint, last in the change feed, leaving the problems it
+// cannot fix reported.
+func TestIntegrityCheck(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	clean := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	padded := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec44"
+	broken := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec45"
+	for _, id := range []string{clean, padded, broken} {
+		req, _ := newJSONRequest("POST", "/v1/payment",
+			bytes.NewBuffer(bytes.Replace(payload, []byte(clean), []byte(id), 1)))
+		checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	}
+	server.DB.C(server.Collection).UpdateId(padded, bson.M{"$set": bson.M{
+		"attributes.amount": "100.21 ",
+		"attributes.charges_information.receiver_charges_amount": "1",
+		"attributes.reference":            "  Padded reference ",
+		"attributes.end_to_end_reference": "Wil piano Jan ",
+		"fingerprint":                     "stale",
+	}})
+	server.DB.C(server.Collection).UpdateId(broken, bson.M{"$set": bson.M{
+		"attributes.fx": bson.M{"original_currency": "USD"},
+		"attributes.charges_information.sender_charges": []bson.M{{},
+			{"amount": "5.00", "currency": "GBP"}},
+	}})
+	check := func(query string) IntegrityReport {
+		req, _ := http.NewRequest("GET", "/v1/admin/integrity"+query, nil)
+		req.Header.Set("X-API-Key", adminKey)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var report IntegrityReport
+		json.Unmarshal(response.Body.Bytes(), &report)
+		return report
+	}
+	fields := func(record IntegrityRecord) map[string]bool {
+		found := map[string]bool{}
+		for _, violation := range record.Violations {
+			found[violation.Field] = true
+		}
+		return found
+	}
+
+	report := check("")
+	if report.Scanned != 3 || report.Violating != 2 || report.Normalised != 0 || len(report.Records) != 2 {
+		t.Fatalf("Expected the two corrupt payments reported. Got %+v", report)
+	}
+	if record := report.Records[0]; record.ID != padded || !fields(record)["attributes"] {
+		t.Errorf("Expected the unreadable amount reported. Got %+v", record)
+	}
+	if record := report.Records[1]; record.ID != broken || !fields(record)["fx"] ||
+		!fields(record)["sender_charges[0]"] {
+		t.Errorf("Expected the half-filled fx and the empty charge reported. Got %+v", record)
+	}
+	if report := check("?organisation_id=unknown"); report.Scanned != 0 || len(report.Records) != 0 {
+		t.Errorf("Expected no payments of another organisation scanned. Got %+v", report)
+	}
+	if report := check("?processing_date_from=2017-01-19"); report.Scanned != 0 {
+		t.Errorf("Expected no payments processed after the range scanned. Got %+v", report)
+	}
+
+	report = check("?fix=normalize")
+	if report.Scanned != 3 || report.Normalised != 1 || report.Violating != 1 ||
+		report.Records[0].ID != broken {
+		t.Fatalf("Expected the padded payment normalised. Got %+v", report)
+	}
+	var stored bson.M
+	server.DB.C(server.Collection).FindId(padded).One(&stored)
+	attributes := stored["attributes"].(bson.M)
+	charges := attributes["charges_information"].(bson.M)
+	if attributes["amount"] != "100.21" || charges["receiver_charges_amount"] != "1.00" ||
+		attributes["reference"] != "Padded reference" {
+		t.Errorf("Expected the values and amounts normalised. Got %v", attributes)
+	}
+	var original bson.M
+	server.DB.C(server.Collection).FindId(clean).One(&original)
+	if stored["fingerprint"] != original["fingerprint"] {
+		t.Errorf("Expected the fingerprint of the normalised values. Got %v", stored["fingerprint"])
+	}
+	req, _ := http.NewRequest("GET", "/v1/payments/changes", nil)
+	response := executeOn(newTestServer(t, func(x *Server) { x.ChangeFeedLag = -1 }), req)
+	var feed ChangeFeed
+	json.Unmarshal(response.Body.Bytes(), &feed)
+	if n := len(feed.P); n != 3 || feed.P[n-1].ID != padded {
+		t.Errorf("Expected the normalised payment last in the change feed. Got %s", response.Body.String())
+	}
+	if report := check("?fix=normalize"); report.Normalised != 0 || report.Violating != 1 {
+		t.Errorf("Expected nothing left to normalise. Got %+v", report)
+	}
+
+	for _, query := range []string{"?fix=everything", "?processing_date_to=tomorrow"} {
+		req, _ := http.NewRequest("GET", "/v1/admin/integrity"+query, nil)
+		req.Header.Set("X-API-Key", adminKey)
+		checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+	}
+	req, _ = http.NewRequest("GET", "/v1/admin/integrity", nil)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+}
@@ -0,0 +1,138 @@
+// limiter.go - A bound on the number of requests served at once.
+
+package server
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// limiterMetrics counts the requests the request limiters of the
+// process have refused, in total as rejected and by limiter as
+// <name>_rejected, along with the requests each is serving as
+// <name>_in_flight. It is published through expvar.
+var limiterMetrics = expvar.NewMap("request_limiter")
+
+// limiterRetryAfter is the number of seconds clients refused by a
+// requestLimiter are told to wait before trying again.
+const limiterRetryAfter = 1
+
+// requestLimiter bounds the number of requests in flight, so that a
+// surge of clients is refused promptly rather than piling up
+// goroutines and connections to the backing store. Each request holds
+// a slot of a buffered channel while it is served, waiting up to wait
+// for one to be freed if none is. A nil requestLimiter is valid and
+// serves every request.
+type requestLimiter struct {
+	name  string
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// newRequestLimiter returns a requestLimiter, named name in
+// limiterMetrics, serving at most max requests at once and queuing
+// further requests for up to wait. If max is not positive nil is
+// returned.
+func newRequestLimiter(name string, max int, wait time.Duration) *requestLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &requestLimiter{name: name, slots: make(chan struct{}, max), wait: wait}
+}
+
+// acquire takes a slot for the request of context ctx, waiting for
+// one to be freed for no longer than the wait of the limiter or the
+// request, and reports whether it got one.
+func (limiter *requestLimiter) acquire(ctx context.Context) bool {
+	if limiter == nil {
+		return true
+	}
+	select {
+	case limiter.slots <- struct{}{}:
+		limiterMetrics.Add(limiter.name+"_in_flight", 1)
+		return true
+	default:
+	}
+
+	if limiter.wait > 0 {
+		timer := time.NewTimer(limiter.wait)
+		defer timer.Stop()
+		select {
+		case limiter.slots <- struct{}{}:
+			limiterMetrics.Add(limiter.name+"_in_flight", 1)
+			return true
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	limiterMetrics.Add("rejected", 1)
+	limiterMetrics.Add(limiter.name+"_rejected", 1)
+	return false
+}
+
+// release frees the slot taken by acquire.
+func (limiter *requestLimiter) release() {
+	if limiter != nil {
+		<-limiter.slots
+		limiterMetrics.Add(limiter.name+"_in_flight", -1)
+	}
+}
+
+// readMethods are the methods of requests that only read, bounded by
+// the reads limiter rather than the writes limiter.
+var readMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true}
+
+// subscriptionPath is the path, below the prefix of the version of
+// the web API, of WebSocket subscriptions to payment events (see
+// subscribePayments).
+const subscriptionPath = "/payments/ws"
+
+// limitRequests is a middleware that refuses requests with
+// StatusServiceUnavailable and a Retry-After header while
+// MaxInFlight requests are already being served, or MaxInFlightReads
+// reads or MaxInFlightWrites writes as the request is one or the
+// other, once none is freed within InFlightWait. WebSocket
+// subscriptions last as long as their subscribers, so rather than
+// holding slots of those limiters they are refused at once while
+// MaxSubscriptions are open.
+func (server *Server) limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, subscriptionPath) {
+			if !server.subscribers.acquire(r.Context()) {
+				respondWithShed(w)
+				return
+			}
+			defer server.subscribers.release()
+			next.ServeHTTP(w, r)
+			return
+		}
+		methodLimiter := server.writeLimiter
+		if readMethods[r.Method] {
+			methodLimiter = server.readLimiter
+		}
+		if !methodLimiter.acquire(r.Context()) {
+			respondWithShed(w)
+			return
+		}
+		defer methodLimiter.release()
+		if !server.limiter.acquire(r.Context()) {
+			respondWithShed(w)
+			return
+		}
+		defer server.limiter.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// respondWithShed is a convenience function that refuses a request
+// beyond the bounds of the request limiters with
+// StatusServiceUnavailable, telling the client when to try again.
+func respondWithShed(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(limiterRetryAfter))
+	respondWithError(w, http.StatusServiceUnavailable,
+		"Too many requests in flight, try again later")
+}
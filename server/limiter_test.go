@@ -0,0 +1,212 @@
+// limiter_test.go
+
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// limiterRejections returns the number of requests refused by request
+// limiters.
+func limiterRejections() int64 {
+	if count, ok := limiterMetrics.Get("rejected").(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+// Test a saturated limiter refuses further requests with a Retry-After
+// header, and serves them again once a request in flight completes.
+func TestRequestLimiter(t *testing.T) {
+	limited := Server{limiter: newRequestLimiter("all", 2, 0)}
+	entered := make(chan struct{})
+	proceed := make(chan struct{})
+	handler := limited.limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-proceed
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	done := make(chan int)
+	for i := 0; i < 2; i++ {
+		go func() { done <- serve("/slow").Code }()
+		<-entered
+	}
+
+	rejected := limiterRejections()
+	response := serve("/fast")
+	if response.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the overflow request to be refused. Got %d", response.Code)
+	}
+	if retry := response.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("Expected a Retry-After of 1 second. Got %q", retry)
+	}
+	if count := limiterRejections(); count != rejected+1 {
+		t.Errorf("Expected the refused request to be counted. Got %d", count-rejected)
+	}
+
+	proceed <- struct{}{}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected the request in flight to be served. Got %d", code)
+	}
+	if code := serve("/fast").Code; code != http.StatusOK {
+		t.Errorf("Expected a request to be served once a slot is freed. Got %d", code)
+	}
+	proceed <- struct{}{}
+	<-done
+
+	unlimited := Server{}
+	handler = unlimited.limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	if code := serve("/fast").Code; code != http.StatusOK {
+		t.Errorf("Expected a server without a limit to serve every request. Got %d", code)
+	}
+}
+
+// limiterMetric returns the value of the metric named name of the
+// request limiters.
+func limiterMetric(name string) int64 {
+	if count, ok := limiterMetrics.Get(name).(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+// Test reads and writes are limited separately, requests beyond a
+// limit waiting for a slot to be freed and being shed once the wait
+// is over, while the requests already in flight are served. Every
+// request is held by a slow store until released.
+func TestRequestLimiterReadsAndWrites(t *testing.T) {
+	const wait = 50 * time.Millisecond
+	limited := Server{readLimiter: newRequestLimiter("reads", 2, wait),
+		writeLimiter: newRequestLimiter("writes", 1, wait)}
+	entered := make(chan struct{}, 16)
+	store := make(chan struct{})
+	handler := limited.limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-store
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/v1/payments", nil)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	var served sync.WaitGroup
+	codes := make(chan int, 3)
+	for _, method := range []string{"GET", "GET", "POST"} {
+		served.Add(1)
+		go func(method string) {
+			defer served.Done()
+			codes <- serve(method).Code
+		}(method)
+		<-entered
+	}
+	if in := limiterMetric("reads_in_flight"); in != 2 {
+		t.Errorf("Expected 2 reads in flight. Got %d", in)
+	}
+
+	shed := limiterMetric("reads_rejected") + limiterMetric("writes_rejected")
+	for _, method := range []string{"GET", "HEAD", "DELETE"} {
+		start := time.Now()
+		response := serve(method)
+		if response.Code != http.StatusServiceUnavailable ||
+			response.Header().Get("Retry-After") != "1" {
+			t.Errorf("Expected the %s beyond the limit to be shed. Got %d", method, response.Code)
+		}
+		if waited := time.Since(start); waited < wait {
+			t.Errorf("Expected the %s to wait %s for a slot. Waited %s", method, wait, waited)
+		}
+	}
+	if count := limiterMetric("reads_rejected") + limiterMetric("writes_rejected"); count != shed+3 {
+		t.Errorf("Expected 3 requests to be counted as shed. Got %d", count-shed)
+	}
+
+	queued := make(chan int)
+	go func() { queued <- serve("PUT").Code }()
+	time.Sleep(wait / 5)
+	for i := 0; i < 3; i++ {
+		store <- struct{}{}
+	}
+	<-entered
+	store <- struct{}{}
+	served.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Expected the requests in flight to complete. Got %d", code)
+		}
+	}
+	if code := <-queued; code != http.StatusOK {
+		t.Errorf("Expected the queued write to be served once a slot was freed. Got %d", code)
+	}
+	if in := limiterMetric("reads_in_flight") + limiterMetric("writes_in_flight"); in != 0 {
+		t.Errorf("Expected no requests in flight. Got %d", in)
+	}
+}
+
+// Test WebSocket subscriptions hold no slot of the in-flight limiters,
+// so that open subscriptions leave other requests served, and that
+// subscriptions beyond MaxSubscriptions are refused at once.
+func TestSubscriptionLimiter(t *testing.T) {
+	limited := Server{limiter: newRequestLimiter("all", 1, 0),
+		readLimiter: newRequestLimiter("reads", 1, 0),
+		subscribers: newRequestLimiter("subscriptions", 2, 0)}
+	entered := make(chan struct{})
+	closed := make(chan struct{})
+	handler := limited.limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/payments/ws" {
+			entered <- struct{}{}
+			<-closed
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	done := make(chan int)
+	for i := 0; i < 2; i++ {
+		go func() { done <- serve("/v1/payments/ws").Code }()
+		<-entered
+	}
+	if code := serve("/v1/payments").Code; code != http.StatusOK {
+		t.Errorf("Expected a request to be served while subscriptions are open. Got %d", code)
+	}
+	response := serve("/v1/payments/ws")
+	if response.Code != http.StatusServiceUnavailable || response.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected the subscription beyond the limit to be refused. Got %d", response.Code)
+	}
+	if in := limiterMetric("subscriptions_in_flight"); in != 2 {
+		t.Errorf("Expected 2 subscriptions open. Got %d", in)
+	}
+
+	close(closed)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("Expected the open subscriptions to complete. Got %d", code)
+		}
+	}
+	if in := limiterMetric("subscriptions_in_flight"); in != 0 {
+		t.Errorf("Expected no subscriptions open. Got %d", in)
+	}
+}
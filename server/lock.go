@@ -0,0 +1,203 @@
+// lock.go - Advisory locks held on payment records by clients updating
+// them, so that their updates are not interleaved with those of others.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LockTokenHeader is the request header carrying the token of the lock
+// held on a payment record by the client updating it.
+const LockTokenHeader = "X-Lock-Token"
+
+// defaultLockTTL is how long a lock is held unless the client asks for
+// another time to live, and maxLockTTL the longest it may ask for.
+const (
+	defaultLockTTL = 30 * time.Second
+	maxLockTTL     = 10 * time.Minute
+)
+
+// ErrPaymentLocked is returned when a payment record is locked by
+// another client than that of the request.
+var ErrPaymentLocked = errors.New("Payment is locked by another client")
+
+// ErrLockNotFound is returned when no lock is held on the payment
+// record.
+var ErrLockNotFound = errors.New("Lock not found")
+
+// locksCollection returns the name of the collection the locks on
+// payment records are kept in.
+func (db *mongoStore) locksCollection() string {
+	return db.collection + "_locks"
+}
+
+// PaymentLock is an advisory lock on a payment record, held by the
+// client given its Token until it is released or it expires. While it
+// is held the payment record may only be updated with the token in the
+// LockTokenHeader of the request, and is read as it would be otherwise.
+// Expired locks are removed from the backing store by its TTL index,
+// but are not honoured meanwhile.
+type PaymentLock struct {
+	PaymentID      string    `bson:"_id" json:"payment_id"`
+	OrganisationID string    `bson:"organisation_id" json:"-"`
+	Token          string    `bson:"token" json:"token"`
+	ExpiresAt      time.Time `bson:"expires_at" json:"expires_at"`
+	TTL            int       `bson:"-" json:"ttl"`
+}
+
+// newLockToken is a convenience function that returns a fresh random
+// lock token.
+func newLockToken() string {
+	var token [16]byte
+	rand.Read(token[:])
+	return hex.EncodeToString(token[:])
+}
+
+// lockTTL is a convenience function that returns the time to live of
+// the lock asked for by the request in r with its ttl query parameter,
+// in seconds, or defaultLockTTL if it has none.
+func lockTTL(r *http.Request) (time.Duration, error) {
+	value := r.FormValue("ttl")
+	if value == "" {
+		return defaultLockTTL, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxLockTTL {
+		return 0, fmt.Errorf("Invalid ttl %s, use between 1 and %d seconds",
+			value, int(maxLockTTL/time.Second))
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// initializeLockRoutes sets up the URLs of the locks on payment
+// records on router, which require an API key if any are configured.
+func (server *Server) initializeLockRoutes(router *mux.Router) {
+	router.HandleFunc("/payment/{id}/lock",
+		server.authenticate(server.lockPayment)).Methods("POST")
+	router.HandleFunc("/payment/{id}/lock",
+		server.authenticate(server.unlockPayment)).Methods("DELETE")
+}
+
+// checkLock is a convenience function that ascertains the payment
+// record with the Payment ID in id may be updated by the request in r:
+// it is not locked, or the request carries the token of its lock in
+// the LockTokenHeader. If it may not StatusLocked is emitted to w, or
+// the error of the backing store, and false returned.
+func (server *Server) checkLock(w http.ResponseWriter, r *http.Request, id string) bool {
+	if code, err := server.lockError(r, id); err != nil {
+		respondWithStorageError(w, r, code, err)
+		return false
+	}
+	return true
+}
+
+// lockError is a convenience function that returns the error checkLock
+// would emit for the payment record with the Payment ID in id, along
+// with its status, and nil if the request in r may update it. Locks
+// that have expired are not honoured, whether or not the backing store
+// has removed them yet.
+func (server *Server) lockError(r *http.Request, id string) (int, error) {
+	var lock PaymentLock
+	err := server.storage(r.Context(), "getLock", id, func() (err error) {
+		lock, err = server.store.getLock(id, server.now().UTC())
+		return
+	})
+	if err == mgo.ErrNotFound {
+		return http.StatusOK, nil
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if r.Header.Get(LockTokenHeader) != lock.Token {
+		return http.StatusLocked, ErrPaymentLocked
+	}
+	return http.StatusOK, nil
+}
+
+// lockPayment is the entry-point dispatcher for the locks taken on
+// payment records. It responds to the URL payment/{id}/lock and an
+// appropriate POST request by locking the payment record for the ttl
+// query parameter in seconds, or defaultLockTTL, and emits the
+// PaymentLock with its token. Tokens are always generated by the
+// server: a lock already held is renewed for the request carrying its
+// token in the LockTokenHeader, and refused with StatusLocked for any
+// other, while a token that holds no lock is ignored. Payment records
+// of other organisations than that of the API key are not found.
+func (server *Server) lockPayment(w http.ResponseWriter, r *http.Request) {
+	ttl, err := lockTTL(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	payment, ok := server.findPayment(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	now := server.now().UTC()
+	lock := PaymentLock{PaymentID: payment.ID, OrganisationID: payment.OrganisationID,
+		Token: newLockToken(), ExpiresAt: now.Add(ttl), TTL: int(ttl / time.Second)}
+	err = server.storage(r.Context(), "lockPayment", payment.ID, func() error {
+		if token := r.Header.Get(LockTokenHeader); token != "" {
+			renewed := lock
+			renewed.Token = token
+			if err := renewed.modelRenewLock(server.mongo, now); err != mgo.ErrNotFound {
+				if err == nil {
+					lock = renewed
+				}
+				return err
+			}
+		}
+		return lock.modelLockPayment(server.mongo, now)
+	})
+	if err == ErrPaymentLocked {
+		respondWithError(w, http.StatusLocked, err.Error())
+		return
+	} else if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respondWith(w, http.StatusOK, lock, negotiatedType(w))
+}
+
+// unlockPayment is the entry-point dispatcher for the release of the
+// locks on payment records. It responds to the URL payment/{id}/lock
+// and an appropriate DELETE request carrying the token of the lock in
+// the LockTokenHeader. A lock held with another token is refused with
+// StatusLocked, and one that is not held, or has expired, is not
+// found. Payment records of other organisations than that of the API
+// key are not found.
+func (server *Server) unlockPayment(w http.ResponseWriter, r *http.Request) {
+	payment, ok := server.findPayment(w, r, mux.Vars(r)["id"])
+	if !ok || !server.checkLock(w, r, payment.ID) {
+		return
+	}
+
+	attempt := 0
+	err := server.storage(r.Context(), "unlockPayment", payment.ID, func() error {
+		attempt++
+		err := modelUnlockPayment(server.mongo, payment.ID, r.Header.Get(LockTokenHeader),
+			server.now().UTC())
+		if err == mgo.ErrNotFound && attempt > 1 {
+			// An earlier attempt released it, but its reply was lost.
+			return nil
+		}
+		return err
+	})
+	if err == mgo.ErrNotFound {
+		respondWithError(w, http.StatusNotFound, ErrLockNotFound.Error())
+		return
+	} else if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respondWith(w, http.StatusOK, map[string]string{"result": "success"}, negotiatedType(w))
+}
@@ -0,0 +1,100 @@
+// lock_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/DeltaPine/payment_server/internal/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test a lock taken on a payment refuses the updates of other clients
+// with StatusLocked, and through the URL of another payment too, but
+// not its reads, lets through those carrying its token, is refused to
+// other clients while held, is never held with a token the client
+// chose, and is released on request or once the fake clock passes its
+// expiry.
+func TestPaymentLocks(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	clock := testutil.NewFakeClock(time.Date(2017, 1, 11, 9, 0, 0, 0, time.UTC))
+	locking := newTestServer(t, func(x *Server) {
+		x.Clock = clock
+	})
+	execute := func(method, url, token, contentType string, body []byte) *httptest.ResponseRecorder {
+		req, _ := newJSONRequest(method, url, bytes.NewBuffer(body))
+		if token != "" {
+			req.Header.Set(LockTokenHeader, token)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return executeOn(locking, req)
+	}
+	lock := func(token string, query string) (PaymentLock, int) {
+		response := execute("POST", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43/lock"+query,
+			token, "", nil)
+		var l PaymentLock
+		json.Unmarshal(response.Body.Bytes(), &l)
+		return l, response.Code
+	}
+	url := "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	patch := []byte(`{"attributes":{"reference":"Locked"}}`)
+
+	checkResponseCode(t, http.StatusCreated, execute("POST", "/v1/payment", "", "", payload).Code)
+	held, code := lock("", "?ttl=60")
+	checkResponseCode(t, http.StatusOK, code)
+	if held.Token == "" || held.TTL != 60 || !held.ExpiresAt.Equal(clock.Now().Add(time.Minute)) {
+		t.Fatalf("Expected a token held for 60 seconds. Got %+v", held)
+	}
+	checkResponseCode(t, http.StatusBadRequest, execute("POST", url+"/lock?ttl=0", "", "", nil).Code)
+
+	checkResponseCode(t, http.StatusOK, execute("GET", url, "", "", nil).Code)
+	checkResponseCode(t, http.StatusLocked, execute("PUT", url, "", "", payload).Code)
+	checkResponseCode(t, http.StatusLocked, execute("PUT", url, "stolen", "", payload).Code)
+	unlocked := bytes.Replace(payload, []byte("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"),
+		[]byte("5ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"), 1)
+	checkResponseCode(t, http.StatusCreated, execute("POST", "/v1/payment", "", "", unlocked).Code)
+	checkResponseCode(t, http.StatusBadRequest,
+		execute("PUT", "/v1/payment/5ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", "", "", payload).Code)
+	checkResponseCode(t, http.StatusLocked,
+		execute("PATCH", url, "", MergePatchMediaType, patch).Code)
+	if _, code := lock("", ""); code != http.StatusLocked {
+		t.Errorf("Expected a held lock to be refused to another client. Got %d", code)
+	}
+	checkResponseCode(t, http.StatusLocked, execute("DELETE", url+"/lock", "stolen", "", nil).Code)
+
+	checkResponseCode(t, http.StatusOK, execute("PUT", url, held.Token, "", payload).Code)
+	response := execute("PATCH", url, held.Token, MergePatchMediaType, patch)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var p Payment
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Attributes.Reference != "Locked" {
+		t.Errorf("Expected the patch of the lock holder to apply. Got %s", response.Body.String())
+	}
+
+	checkResponseCode(t, http.StatusOK, execute("DELETE", url+"/lock", held.Token, "", nil).Code)
+	checkResponseCode(t, http.StatusNotFound, execute("DELETE", url+"/lock", held.Token, "", nil).Code)
+	checkResponseCode(t, http.StatusOK, execute("PUT", url, "", "", payload).Code)
+
+	held, code = lock("chosen", "")
+	checkResponseCode(t, http.StatusOK, code)
+	if held.Token == "" || held.Token == "chosen" {
+		t.Fatalf("Expected the token generated by the server. Got %+v", held)
+	}
+	clock.Advance(defaultLockTTL - time.Second)
+	if renewed, code := lock(held.Token, ""); code != http.StatusOK || renewed.Token != held.Token {
+		t.Errorf("Expected the lock holder to renew its lock. Got %d %+v", code, renewed)
+	}
+	clock.Advance(defaultLockTTL - time.Second)
+	checkResponseCode(t, http.StatusLocked, execute("PUT", url, "", "", payload).Code)
+	clock.Advance(2 * time.Second)
+	checkResponseCode(t, http.StatusOK, execute("PUT", url, "", "", payload).Code)
+	if _, code := lock("", ""); code != http.StatusOK {
+		t.Errorf("Expected an expired lock to be taken by another client. Got %d", code)
+	}
+}
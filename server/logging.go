@@ -0,0 +1,140 @@
+// logging.go - The structured log of the server and its requests.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The formats of the log: LogFormatText, the default, for people to
+// read and LogFormatJSON, one JSON object a record, for log pipelines.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logLevels are the levels the log may be set to, by name.
+var logLevels = map[string]zerolog.Level{
+	"debug": zerolog.DebugLevel,
+	"info":  zerolog.InfoLevel,
+	"warn":  zerolog.WarnLevel,
+	"error": zerolog.ErrorLevel,
+}
+
+// defaultLogger is the logger of servers without a Logger, and of the
+// configuration of the server before its Logger is set up: records at
+// info and above, as text, to standard error.
+var defaultLogger = newLogger(os.Stderr, zerolog.InfoLevel, LogFormatText)
+
+// NewLogger returns a logger writing the records of level, one of
+// debug, info (the default), warn or error, and above to out in
+// format, LogFormatText (the default) or LogFormatJSON. Names are not
+// case sensitive.
+func NewLogger(out io.Writer, level string, format string) (zerolog.Logger, error) {
+	parsed := zerolog.InfoLevel
+	if level != "" {
+		var ok bool
+		if parsed, ok = logLevels[strings.ToLower(level)]; !ok {
+			return zerolog.Nop(), fmt.Errorf(
+				"Unknown log level %q, use debug, info, warn or error", level)
+		}
+	}
+	format = strings.ToLower(format)
+	if format != "" && format != LogFormatText && format != LogFormatJSON {
+		return zerolog.Nop(), fmt.Errorf("Unknown log format %q, use text or json", format)
+	}
+	return newLogger(out, parsed, format), nil
+}
+
+// newLogger is a convenience function that returns a logger writing
+// the records of level and above to out in format, timestamped.
+func newLogger(out io.Writer, level zerolog.Level, format string) zerolog.Logger {
+	if format != LogFormatJSON {
+		out = zerolog.ConsoleWriter{Out: out, NoColor: true, TimeFormat: time.RFC3339}
+	}
+	return zerolog.New(out).Level(level).With().Timestamp().Logger()
+}
+
+// logger returns the logger of the server, Logger or defaultLogger if
+// it is not set.
+func (server *Server) logger() *zerolog.Logger {
+	if server.Logger != nil {
+		return server.Logger
+	}
+	return &defaultLogger
+}
+
+// withRequestLogger returns a copy of ctx carrying the logger of the
+// server, recording the ID of the request of ctx with every record.
+func (server *Server) withRequestLogger(ctx context.Context) context.Context {
+	return server.logger().With().Str("request_id", requestID(ctx)).Logger().WithContext(ctx)
+}
+
+// requestLogger returns the logger of the request of ctx, or
+// defaultLogger if it has none (see withRequestLogger).
+func requestLogger(ctx context.Context) *zerolog.Logger {
+	if logger := zerolog.Ctx(ctx); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &defaultLogger
+}
+
+// responseLogger returns the logger of the request whose response is
+// written to w, for the helpers emitting responses without the request
+// at hand, or defaultLogger if the request is not logged.
+func responseLogger(w http.ResponseWriter) *zerolog.Logger {
+	for {
+		switch writer := w.(type) {
+		case *tracedWriter:
+			if writer.logger != nil {
+				return writer.logger
+			}
+			return &defaultLogger
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return &defaultLogger
+		}
+	}
+}
+
+// logRequests is a middleware that serves every request with the
+// logger of the server in its context (see withRequestLogger), and
+// logs it once served: at debug level if it succeeded, at warn level
+// if the client was at fault and at error level if the server was. It
+// must be installed within traceRequests, which records the ID and
+// status of the request.
+func (server *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := server.withRequestLogger(r.Context())
+		if traced, ok := w.(*tracedWriter); ok {
+			traced.logger = requestLogger(ctx)
+		}
+		start := time.Now()
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+		status := http.StatusOK
+		if traced, ok := w.(*tracedWriter); ok && traced.status != 0 {
+			status = traced.status
+		}
+		level := zerolog.DebugLevel
+		if status >= http.StatusInternalServerError {
+			level = zerolog.ErrorLevel
+		} else if status >= http.StatusBadRequest {
+			level = zerolog.WarnLevel
+		}
+		requestLogger(ctx).WithLevel(level).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Int("status", status).
+			Dur("duration", time.Since(start)).
+			Msg("Request served")
+	})
+}
@@ -0,0 +1,84 @@
+// logging_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Test the log level and format are parsed regardless of case, with
+// info and text by default, and unknown ones refused.
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		level  string
+		format string
+		ok     bool
+	}{
+		{"", "", true},
+		{"debug", "json", true},
+		{"WARN", "Text", true},
+		{"error", "", true},
+		{"verbose", "", false},
+		{"info", "xml", false},
+	}
+	for _, test := range tests {
+		var logged bytes.Buffer
+		logger, err := NewLogger(&logged, test.level, test.format)
+		if (err == nil) != test.ok {
+			t.Errorf("Expected level %q and format %q to be accepted: %t. Got %v",
+				test.level, test.format, test.ok, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		logger.Error().Msg("Logged")
+		isJSON := json.Valid(bytes.TrimSpace(logged.Bytes()))
+		if isJSON != (strings.ToLower(test.format) == LogFormatJSON) {
+			t.Errorf("Expected format %q. Got %s", test.format, logged.String())
+		}
+		if test.level == "" && logger.GetLevel() != zerolog.InfoLevel {
+			t.Errorf("Expected the info level by default. Got %s", logger.GetLevel())
+		}
+	}
+}
+
+// Test a bad request is logged at warn level with its ID and status,
+// and that a successful request is not logged at the info level.
+func TestBadRequestLogged(t *testing.T) {
+	var logged bytes.Buffer
+	logger := newLogger(&logged, zerolog.InfoLevel, LogFormatJSON)
+	server.Logger = &logger
+	defer func() { server.Logger = nil }()
+
+	req, _ := http.NewRequest("GET", "/v1/payments", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	if logged.Len() != 0 {
+		t.Errorf("Expected a successful request not to be logged at info level. Got %s", logged.String())
+	}
+
+	req, _ = newJSONRequest("POST", "/v1/payment", strings.NewReader("{not json"))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+	var record struct {
+		Level     string `json:"level"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+		Method    string `json:"method"`
+		Path      string `json:"path"`
+		Status    int    `json:"status"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(logged.Bytes()), &record); err != nil {
+		t.Fatalf("Expected a single JSON record. Got %s", logged.String())
+	}
+	if record.Level != "warn" || record.Status != http.StatusBadRequest ||
+		record.Method != "POST" || record.Path != "/v1/payment" ||
+		record.RequestID != response.Header().Get(requestIDHeader) {
+		t.Errorf("Expected the bad request to be logged at warn level. Got %+v", record)
+	}
+}
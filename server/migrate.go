@@ -0,0 +1,146 @@
+// migrate.go - Migrations of the schema and data of the backing store,
+// applied at start up.
+
+package server
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// migration is a change to the schema or data of the backing data
+// store, applied once by the first instance to start after it is
+// released. Apply returns the number of payment records it changed,
+// and must be safe to run again, as an instance may stop after
+// applying a migration but before recording it.
+type migration struct {
+	version int
+	name    string
+	apply   func(db *mongoStore) (int, error)
+}
+
+// migrations are the migrations of the backing data store. Once a
+// migration is released its version must never be reused, and new
+// migrations take the next version.
+var migrations = []migration{
+	{1, "Backfill the modification time of payments", modelBackfillUpdatedAt},
+	{2, "Backfill the amount of payments in minor units", modelBackfillAmountMinorUnits},
+	{3, "Remove the empty sections of payments", modelCompactPayments},
+}
+
+// The time the migration lock is held for before another instance may
+// take it over, should its owner have stopped, and how often an
+// instance waiting for the lock tries to take it.
+const (
+	migrationLockLease = 5 * time.Minute
+	migrationLockPoll  = time.Second
+)
+
+// runMigrations applies the migrations in pending that are not yet
+// recorded as applied to the backing data store in db, in the order of
+// their versions, recording each as it is applied. The migration lock
+// is held for owner meanwhile, and ErrMigrationsLocked returned
+// without applying any migration if another instance holds it. As the
+// lock is shared with other instances its lease is timed by the system
+// clock. The records of the applied migrations are returned.
+func runMigrations(db *mongoStore, pending []migration, owner string) ([]MigrationRecord, error) {
+	if err := modelLockMigrations(db, owner, time.Now().UTC(), migrationLockLease); err != nil {
+		return nil, err
+	}
+	defer modelUnlockMigrations(db, owner)
+
+	records, err := modelGetMigrationRecords(db)
+	if err != nil {
+		return nil, err
+	}
+	done := map[int]bool{}
+	for _, record := range records {
+		done[record.Version] = true
+	}
+
+	ordered := append([]migration(nil), pending...)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].version < ordered[j].version })
+	var applied []MigrationRecord
+	for _, m := range ordered {
+		if done[m.version] {
+			continue
+		}
+		affected, err := m.apply(db)
+		if err != nil {
+			return applied, fmt.Errorf("Migration %d (%s) failed: %s", m.version, m.name, err)
+		}
+
+		now := time.Now().UTC()
+		record := MigrationRecord{Version: m.version, Name: m.name, AppliedAt: &now,
+			Affected: affected}
+		if err := modelRecordMigration(db, record); err != nil {
+			return applied, err
+		}
+		applied = append(applied, record)
+		if err := modelLockMigrations(db, owner, now, migrationLockLease); err != nil {
+			return applied, err
+		}
+	}
+	return applied, nil
+}
+
+// migrate is a convenience function that applies the pending
+// migrations to the backing data store in db, waiting for any other
+// instance applying them to finish first, and logs those applied to
+// logger.
+func migrate(db *mongoStore, logger *zerolog.Logger) error {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s/%d", hostname, os.Getpid())
+	for {
+		applied, err := runMigrations(db, migrations, owner)
+		if err == ErrMigrationsLocked {
+			logger.Info().Msg("Waiting for another instance to apply the migrations")
+			time.Sleep(migrationLockPoll)
+			continue
+		}
+		for _, record := range applied {
+			logger.Info().Int("version", record.Version).Str("name", record.Name).
+				Int("payments", record.Affected).Msg("Applied migration")
+		}
+		return err
+	}
+}
+
+// MigrationReport lists the migrations applied to the backing store
+// and those still pending.
+type MigrationReport struct {
+	Applied []MigrationRecord `json:"applied"`
+	Pending []MigrationRecord `json:"pending"`
+}
+
+// getMigrations is the entry-point dispatcher for the state of the
+// migrations of the backing store. It responds to the URL
+// admin/migrations and an appropriate GET request with a
+// MigrationReport.
+func (server *Server) getMigrations(w http.ResponseWriter, r *http.Request) {
+	report := MigrationReport{Pending: []MigrationRecord{}}
+	err := server.storage(r.Context(), "getMigrations", "", func() (err error) {
+		report.Applied, err = modelGetMigrationRecords(server.mongo)
+		return
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	done := map[int]bool{}
+	for _, record := range report.Applied {
+		done[record.Version] = true
+	}
+	for _, m := range migrations {
+		if !done[m.version] {
+			report.Pending = append(report.Pending,
+				MigrationRecord{Version: m.version, Name: m.name})
+		}
+	}
+	respondWith(w, http.StatusOK, report, negotiatedType(w))
+}
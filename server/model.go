@@ -0,0 +1,2322 @@
+// model.go - The modelled json payment transaction.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Payment is the main payment record structure with annotated bson and
+// json tags. CreatedAt, UpdatedAt, Fingerprint and AmountMinorUnits are
+// maintained by the server and are not part of the json representation.
+// AmountMinorUnits shadows the amount, which is stored as a string, so
+// that amounts can be compared in queries. Archived is set on payment
+// records retrieved from the archive and is never stored. The account
+// numbers of the parties are stored encrypted if an encryption key is
+// configured (see AccountNumber). Status is maintained by the server
+// for payment records held until their processing date, and is
+// otherwise empty (see schedulePayment). The parties, charges
+// information and fx of the attributes are sections that are nil, and
+// absent from both representations, unless they are populated (see
+// compactPayment).
+type Payment struct {
+	Type             string    `bson:"type" json:"type"`
+	ID               string    `bson:"_id" json:"id"`
+	Version          int       `bson:"version" json:"version"`
+	OrganisationID   string    `bson:"organisation_id" json:"organisation_id"`
+	Status           string    `bson:"status,omitempty" json:"status,omitempty"`
+	CreatedAt        time.Time `bson:"created_at" json:"-"`
+	UpdatedAt        time.Time `bson:"updated_at" json:"-"`
+	Fingerprint      string    `bson:"fingerprint" json:"-"`
+	AmountMinorUnits int64     `bson:"amount_minor_units" json:"-"`
+	Archived         bool      `bson:"-" json:"archived,omitempty"`
+	Attributes       struct {
+		Amount               Amount              `bson:"amount" json:"amount"`
+		BeneficiaryParty     *BeneficiaryParty   `bson:"beneficiary_party,omitempty" json:"beneficiary_party,omitempty"`
+		ChargesInformation   *ChargesInformation `bson:"charges_information,omitempty" json:"charges_information,omitempty"`
+		Currency             string              `bson:"currency" json:"currency"`
+		DebtorParty          *DebtorParty        `bson:"debtor_party,omitempty" json:"debtor_party,omitempty"`
+		EndToEndReference    string              `bson:"end_to_end_reference" json:"end_to_end_reference"`
+		Fx                   *Fx                 `bson:"fx,omitempty" json:"fx,omitempty"`
+		NumericReference     string              `bson:"numeric_reference" json:"numeric_reference"`
+		PaymentID            string              `bson:"payment_id" json:"payment_id"`
+		PaymentPurpose       string              `bson:"payment_purpose" json:"payment_purpose"`
+		PaymentScheme        string              `bson:"payment_scheme" json:"payment_scheme"`
+		PaymentType          string              `bson:"payment_type" json:"payment_type"`
+		ProcessingDate       string              `bson:"processing_date" json:"processing_date"`
+		Reference            string              `bson:"reference" json:"reference"`
+		SchemePaymentSubType string              `bson:"scheme_payment_sub_type" json:"scheme_payment_sub_type"`
+		SchemePaymentType    string              `bson:"scheme_payment_type" json:"scheme_payment_type"`
+		SponsorParty         *SponsorParty       `bson:"sponsor_party,omitempty" json:"sponsor_party,omitempty"`
+	} `bson:"attributes" json:"attributes"`
+}
+
+// BeneficiaryParty is the party a payment is made to.
+type BeneficiaryParty struct {
+	AccountName       string        `bson:"account_name" json:"account_name"`
+	AccountNumber     AccountNumber `bson:"account_number" json:"account_number"`
+	AccountNumberCode string        `bson:"account_number_code" json:"account_number_code"`
+	AccountType       int           `bson:"account_type" json:"account_type"`
+	Address           string        `bson:"address" json:"address"`
+	BankID            string        `bson:"bank_id" json:"bank_id"`
+	BankIDCode        string        `bson:"bank_id_code" json:"bank_id_code"`
+	Name              string        `bson:"name" json:"name"`
+}
+
+// DebtorParty is the party a payment is made from.
+type DebtorParty struct {
+	AccountName       string        `bson:"account_name" json:"account_name"`
+	AccountNumber     AccountNumber `bson:"account_number" json:"account_number"`
+	AccountNumberCode string        `bson:"account_number_code" json:"account_number_code"`
+	Address           string        `bson:"address" json:"address"`
+	BankID            string        `bson:"bank_id" json:"bank_id"`
+	BankIDCode        string        `bson:"bank_id_code" json:"bank_id_code"`
+	Name              string        `bson:"name" json:"name"`
+}
+
+// SponsorParty is the party sponsoring the debtor of a payment into
+// the payment scheme.
+type SponsorParty struct {
+	AccountNumber AccountNumber `bson:"account_number" json:"account_number"`
+	BankID        string        `bson:"bank_id" json:"bank_id"`
+	BankIDCode    string        `bson:"bank_id_code" json:"bank_id_code"`
+}
+
+// ChargesInformation is who bears the charges of a payment and what
+// the sender and the receiver are charged.
+type ChargesInformation struct {
+	BearerCode              string         `bson:"bearer_code" json:"bearer_code"`
+	SenderCharges           []SenderCharge `bson:"sender_charges,omitempty" json:"sender_charges,omitempty"`
+	ReceiverChargesAmount   Amount         `bson:"receiver_charges_amount" json:"receiver_charges_amount"`
+	ReceiverChargesCurrency string         `bson:"receiver_charges_currency" json:"receiver_charges_currency"`
+}
+
+// SenderCharge is a charge to the sender of a payment in one currency.
+type SenderCharge struct {
+	Amount   Amount `bson:"amount" json:"amount"`
+	Currency string `bson:"currency" json:"currency"`
+}
+
+// Fx is the foreign exchange a payment is made with: the amount in the
+// original currency it was converted from, and the rate it was
+// converted at.
+type Fx struct {
+	ContractReference string `bson:"contract_reference" json:"contract_reference"`
+	ExchangeRate      string `bson:"exchange_rate" json:"exchange_rate"`
+	OriginalAmount    Amount `bson:"original_amount" json:"original_amount"`
+	OriginalCurrency  string `bson:"original_currency" json:"original_currency"`
+}
+
+// Payments is collection appropriate payment record structure. When
+// payment records are requested by Payment ID, Missing lists those
+// that were not found. Paged collections describe the page in Meta and
+// link to their next page.
+type Payments struct {
+	P       []Payment `json:"data"`
+	Missing []string  `json:"missing,omitempty"`
+	Meta    *PageMeta `json:"meta,omitempty"`
+	Links   struct {
+		Self string `json:"self"`
+		Next string `json:"next,omitempty"`
+	} `json:"links"`
+}
+
+// PageMeta describes a page of a paged collection: the Limit on its
+// size in effect, whether asked for or the default, and the number of
+// items before it if the collection is paged by Offset. Collections
+// paged by Offset also count the items of every page in TotalCount,
+// and number the page, from 1, among the TotalPages of PageSize items
+// (see newPageMeta).
+type PageMeta struct {
+	Limit      int  `json:"limit"`
+	Offset     int  `json:"offset,omitempty"`
+	TotalCount *int `json:"total_count,omitempty"`
+	Page       int  `json:"page,omitempty"`
+	PageSize   int  `json:"page_size,omitempty"`
+	TotalPages int  `json:"total_pages,omitempty"`
+}
+
+// newPageMeta returns the PageMeta of the page of a collection of
+// total items paged by offset, holding up to limit items from offset.
+// A page starting part way through a page of limit items is numbered
+// as that page.
+func newPageMeta(limit int, offset int, total int) *PageMeta {
+	return &PageMeta{Limit: limit, Offset: offset, TotalCount: &total,
+		Page: offset/limit + 1, PageSize: limit, TotalPages: (total + limit - 1) / limit}
+}
+
+// PaymentEnvelope is the single payment record structure matching
+// the shape of the Payments collection.
+type PaymentEnvelope struct {
+	P     Payment `json:"data"`
+	Links struct {
+		Self string `json:"self"`
+	} `json:"links"`
+}
+
+// PaymentChanges is an updated payment record along with the changes
+// the update made to it, reported when requested with
+// include_changes=true (see paymentChanges).
+type PaymentChanges struct {
+	Payment
+	Changes []Change `json:"changes"`
+}
+
+// paymentChanges is a convenience function that returns the changes
+// made to the json representation of the payment record in before by
+// its update to after, at the JSON Pointers of the changed values (see
+// diffJSON).
+func paymentChanges(before *Payment, after *Payment) []Change {
+	var old, new interface{}
+	document, _ := json.Marshal(before)
+	json.Unmarshal(document, &old)
+	document, _ = json.Marshal(after)
+	json.Unmarshal(document, &new)
+	return diffJSON(old, new)
+}
+
+// Organisation is an organisation with payment records in the backing
+// store, along with the number of them if they were counted.
+type Organisation struct {
+	ID           string `bson:"_id" json:"organisation_id"`
+	PaymentCount int    `bson:"count" json:"payment_count,omitempty"`
+}
+
+// Organisations is a page of the organisations with payment records.
+// The next link, if any, retrieves the following page.
+type Organisations struct {
+	O     []Organisation `json:"data"`
+	Meta  *PageMeta      `json:"meta,omitempty"`
+	Links struct {
+		Self string `json:"self"`
+		Next string `json:"next,omitempty"`
+	} `json:"links"`
+}
+
+// ImportSummary is the outcome of an import of payment records.
+type ImportSummary struct {
+	Imported          int             `json:"imported"`
+	SkippedDuplicates int             `json:"skipped_duplicates"`
+	Failed            []ImportFailure `json:"failed"`
+}
+
+// ImportFailure describes a payment record, identified by its
+// position in the import, that could not be imported.
+type ImportFailure struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// PaymentFilter selects payment records by Payment ID, by organisation,
+// by an inclusive range of processing dates in YYYY-MM-DD form, by
+// currency, by an inclusive range of amounts of no more than two
+// decimal places and by the payment_id assigned by the payment scheme,
+// by the AccountNumber of any of its parties (see
+// accountNumberClauses), and by Status. Scheduled payment records are
+// left out if HideScheduled is set. Fields that are not populated do
+// not restrict the selection. Sort lists the fields the payment records
+// selected are sorted by, as for a PaymentSearch, before their Payment
+// IDs.
+type PaymentFilter struct {
+	IDs                []string `json:"ids,omitempty"`
+	OrganisationID     string   `json:"organisation_id,omitempty"`
+	ProcessingDateFrom string   `json:"processing_date_from,omitempty"`
+	ProcessingDateTo   string   `json:"processing_date_to,omitempty"`
+	Currency           string   `json:"currency,omitempty"`
+	MinAmount          *Amount  `json:"min_amount,omitempty"`
+	MaxAmount          *Amount  `json:"max_amount,omitempty"`
+	SchemePaymentID    string   `json:"scheme_payment_id,omitempty"`
+	AccountNumber      string   `json:"account_number,omitempty"`
+	Status             string   `json:"status,omitempty"`
+	HideScheduled      bool     `json:"hide_scheduled,omitempty"`
+	Sort               []string `json:"sort,omitempty"`
+}
+
+// MissingAttributesError is returned by the create checks when
+// required attributes of a payment record are not populated.
+// Attributes holds the json names of the missing attributes.
+type MissingAttributesError struct {
+	Attributes []string
+}
+
+// Error lists the attributes missing from the payment record.
+func (e *MissingAttributesError) Error() string {
+	return "Missing required attributes: " + strings.Join(e.Attributes, ", ")
+}
+
+// ValidationError is returned by the valid checks when an attribute of
+// a payment record is populated but not acceptable. Attribute holds
+// the json name of the attribute and Reason why it is not acceptable.
+type ValidationError struct {
+	Attribute string
+	Reason    string
+}
+
+// Error describes the invalid attribute.
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid %s: %s", e.Attribute, e.Reason)
+}
+
+// PaymentIDError is returned by the valid checks when a request is
+// refused because of the Payment ID of its payment record: it has
+// none, or no payment record has it. Reason describes which.
+type PaymentIDError struct {
+	Reason string
+}
+
+// Error describes why the Payment ID is refused.
+func (e *PaymentIDError) Error() string {
+	return e.Reason
+}
+
+// The codes of a FieldError: a required attribute is not populated, or
+// an attribute is populated with a value that is not acceptable.
+const (
+	FieldMissing = "missing"
+	FieldInvalid = "invalid"
+)
+
+// FieldError is a single problem found by the valid checks with the
+// attribute of a payment record of json name Field. Code is one of
+// FieldMissing or FieldInvalid and Message describes the problem.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is returned by the valid checks with every problem
+// they found with a payment record, rather than the first, as Errors in
+// the order of the checks. Its message is those of the errors of the
+// checks it collects, so that a single problem reads as the error of
+// its check would.
+type ValidationErrors struct {
+	Errors   []FieldError
+	messages []string
+}
+
+// Error describes every problem found, in order.
+func (e *ValidationErrors) Error() string {
+	return strings.Join(e.messages, "; ")
+}
+
+// add records the problems described by the error in err of a valid
+// check, a MissingAttributesError, ValidationError, AmountError or
+// ValidationErrors. Any other error is recorded as invalid attributes.
+func (e *ValidationErrors) add(err error) {
+	switch err := err.(type) {
+	case *ValidationErrors:
+		e.Errors = append(e.Errors, err.Errors...)
+		e.messages = append(e.messages, err.messages...)
+		return
+	case *MissingAttributesError:
+		for _, attribute := range err.Attributes {
+			e.Errors = append(e.Errors, FieldError{Field: attribute, Code: FieldMissing,
+				Message: "Missing required attribute: " + attribute})
+		}
+	case *ValidationError:
+		e.Errors = append(e.Errors, FieldError{Field: err.Attribute, Code: FieldInvalid,
+			Message: err.Error()})
+	case *AmountError:
+		field := err.Attribute
+		if field == "" {
+			field = "amount"
+		}
+		e.Errors = append(e.Errors, FieldError{Field: field, Code: FieldInvalid,
+			Message: err.Error()})
+	default:
+		e.Errors = append(e.Errors, FieldError{Field: "attributes", Code: FieldInvalid,
+			Message: err.Error()})
+	}
+	e.messages = append(e.messages, err.Error())
+}
+
+// collectValidationErrors is a convenience function that returns the
+// ValidationErrors collecting the errors of valid checks in errs that
+// are not nil, or nil if they all are.
+func collectValidationErrors(errs ...error) error {
+	collected := &ValidationErrors{}
+	for _, err := range errs {
+		if err != nil {
+			collected.add(err)
+		}
+	}
+	if len(collected.Errors) == 0 {
+		return nil
+	}
+	return collected
+}
+
+// ErrPaymentExists is returned by the create checks when a payment
+// record with the same Payment ID is already in the backing store.
+var ErrPaymentExists = errors.New("A payment with this Payment ID already exists")
+
+// ErrPaymentNotFound is returned when no payment record with the
+// requested Payment ID is in the backing store.
+var ErrPaymentNotFound = errors.New("Payment not found")
+
+// DuplicatePaymentError is returned by the duplicate check when a
+// payment record with a different Payment ID but the same fingerprint
+// is already in the backing store, or by the scheme payment_id check
+// when one with the same payment_id, SchemePaymentID, is. ID holds the
+// Payment ID of that payment record.
+type DuplicatePaymentError struct {
+	ID              string
+	SchemePaymentID string
+}
+
+// Error names the payment record the payment duplicates.
+func (e *DuplicatePaymentError) Error() string {
+	if e.SchemePaymentID != "" {
+		return fmt.Sprintf("A payment with the payment_id %s already exists: %s",
+			e.SchemePaymentID, e.ID)
+	}
+	return "A payment with the same details already exists: " + e.ID
+}
+
+// modelGetPayments will retrieve all payment records from the backing
+// data store, sorted by Payment ID in ascending order so that the
+// order is deterministic regardless of the storage engine. If the
+// OrganisationID in Payment is populated only the payment records of
+// that organisation are retrieved.
+func (p *Payment) modelGetPayments(db *mongoStore) ([]Payment, error) {
+	filter := PaymentFilter{OrganisationID: p.OrganisationID}
+	return filter.modelGetPayments(db)
+}
+
+// modelGetPayment, given the element ID in Payment, will retrieve
+// the corresponding payment record from the backing
+// data store. If the OrganisationID in Payment is populated a payment
+// record of another organisation is not found. A payment record that
+// cannot be read, such as one whose account numbers cannot be
+// decrypted, is a storage failure rather than read in part.
+func (p *Payment) modelGetPayment(db *mongoStore) (int, Payment, error) {
+	var payment Payment
+	var count = 0
+
+	if checkEmptyPaymentID(p) == true {
+		return -1, payment, &PaymentIDError{Reason: "No Payment ID specified"}
+	}
+	query, count, err := returnPaymentCountAndQuery(db, p)
+	if err != nil {
+		return -1, payment, err
+	} else if count == 0 {
+		return count, payment, ErrPaymentNotFound
+	} else if count > 1 {
+		return -1, payment, errors.New("More than one payment returned per ID")
+	}
+	if err = query.One(&payment); err == nil {
+		err = db.keys.openPayment(&payment)
+	}
+	if err != nil {
+		return -1, payment, err
+	}
+
+	return count, payment, nil
+}
+
+// modelGetArchivedPayment, given the element ID in Payment, will
+// retrieve the corresponding payment record from the archive, marked
+// as archived. If the OrganisationID in Payment is populated a payment
+// record of another organisation is not found. mgo.ErrNotFound is
+// returned if there is no such payment record.
+func (p *Payment) modelGetArchivedPayment(db *mongoStore) (Payment, error) {
+	var payment Payment
+	selector := bson.M{"_id": p.ID}
+	if p.OrganisationID != "" {
+		selector["organisation_id"] = p.OrganisationID
+	}
+	err := db.C(db.archiveCollection()).Find(selector).One(&payment)
+	if err == nil {
+		err = db.keys.openPayment(&payment)
+	}
+	payment.Archived = err == nil
+	return payment, err
+}
+
+// modelDeletePaymentValidCheck, given the element ID in Payment, will
+// return the corresponding validity of whether a payment record can
+// be deleted. If the payment record cannot be deleted, the function
+// raises an error with a 'reason' string, otherwise it returns nil if
+// a payment record can be deleted.
+func (p *Payment) modelDeletePaymentValidCheck(db *mongoStore) error {
+	if checkEmptyPaymentID(p) == true {
+		return &PaymentIDError{Reason: "Cannot delete a payment without a Payment ID specified"}
+	}
+
+	count, err := returnPaymentCount(db, p)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return &PaymentIDError{Reason: "A payment with this Payment ID doesn't exists"}
+	}
+	return nil
+}
+
+// modelDeletePayment, given the element ID in Payment, will
+// delete the corresponding payment record in the backing store, along
+// with its notes and lock, and return it as it was, less the account
+// numbers that cannot be decrypted. If an error occurs, an error will
+// be returned.
+func (p *Payment) modelDeletePayment(db *mongoStore) (Payment, error) {
+	var removed Payment
+	_, err := db.C(db.collection).FindId(p.ID).Apply(mgo.Change{Remove: true}, &removed)
+	if err != nil {
+		return removed, err
+	}
+	if db.keys.openPayment(&removed) != nil {
+		for _, number := range accountNumbers(&removed) {
+			if _, sealed := number.sealedValue(); sealed {
+				*number = ""
+			}
+		}
+	}
+	return removed, p.modelDeleteNotes(db)
+}
+
+// modelDeleteNotes, given the element ID in Payment, will remove the
+// notes and the lock on the corresponding payment record from the
+// backing store, once it is deleted.
+func (p *Payment) modelDeleteNotes(db *mongoStore) error {
+	if _, err := db.C(db.notesCollection()).RemoveAll(bson.M{"payment_id": p.ID}); err != nil {
+		return err
+	}
+	_, err := db.C(db.locksCollection()).RemoveAll(bson.M{"_id": p.ID})
+	return err
+}
+
+// modelPurgePayments will remove all payment records from the backing
+// data store, and the notes and locks on them. If the OrganisationID in
+// Payment is populated only the payment records of that organisation
+// are removed. The removed payment records are returned.
+func (p *Payment) modelPurgePayments(db *mongoStore) ([]Payment, error) {
+	selector := bson.M{}
+	if p.OrganisationID != "" {
+		selector["organisation_id"] = p.OrganisationID
+	}
+	payments, err := modelRemoveSelected(db, selector)
+	if err != nil {
+		return payments, err
+	}
+	if _, err = db.C(db.notesCollection()).RemoveAll(selector); err != nil {
+		return payments, err
+	}
+	_, err = db.C(db.locksCollection()).RemoveAll(selector)
+	return payments, err
+}
+
+// IsEmpty returns true if the PaymentFilter does not restrict the
+// selection at all.
+func (f *PaymentFilter) IsEmpty() bool {
+	return len(f.IDs) == 0 && f.OrganisationID == "" &&
+		f.ProcessingDateFrom == "" && f.ProcessingDateTo == "" &&
+		f.Currency == "" && f.MinAmount == nil && f.MaxAmount == nil &&
+		f.SchemePaymentID == "" && f.AccountNumber == "" && f.Status == ""
+}
+
+// selector returns the query selecting the payment records matched by
+// the PaymentFilter, their account numbers sealed with keys. Processing
+// dates in YYYY-MM-DD form order lexically, so their range is a string
+// comparison, whereas amounts do not and their range is over the
+// amount in minor units.
+func (f *PaymentFilter) selector(keys *accountKeyring) bson.M {
+	selector := bson.M{}
+	if len(f.IDs) > 0 {
+		selector["_id"] = bson.M{"$in": f.IDs}
+	}
+	if f.OrganisationID != "" {
+		selector["organisation_id"] = f.OrganisationID
+	}
+	dates := bson.M{}
+	if f.ProcessingDateFrom != "" {
+		dates["$gte"] = f.ProcessingDateFrom
+	}
+	if f.ProcessingDateTo != "" {
+		dates["$lte"] = f.ProcessingDateTo
+	}
+	if len(dates) > 0 {
+		selector["attributes.processing_date"] = dates
+	}
+	if f.Currency != "" {
+		selector["attributes.currency"] = f.Currency
+	}
+	amounts := bson.M{}
+	if f.MinAmount != nil {
+		amounts["$gte"], _ = f.MinAmount.MinorUnits()
+	}
+	if f.MaxAmount != nil {
+		amounts["$lte"], _ = f.MaxAmount.MinorUnits()
+	}
+	if len(amounts) > 0 {
+		selector["amount_minor_units"] = amounts
+	}
+	if f.SchemePaymentID != "" {
+		selector["attributes.payment_id"] = f.SchemePaymentID
+	}
+	if f.AccountNumber != "" {
+		selector["$or"] = accountNumberClauses(keys, f.AccountNumber)
+	}
+	if f.Status != "" {
+		selector["status"] = f.Status
+	} else if f.HideScheduled {
+		selector["status"] = bson.M{"$ne": PaymentScheduled}
+	}
+	return selector
+}
+
+// modelGetPayments will retrieve the payment records matched by the
+// PaymentFilter from the backing data store, sorted by its Sort fields
+// and finally by Payment ID in ascending order (see sortFields).
+func (f *PaymentFilter) modelGetPayments(db *mongoStore) ([]Payment, error) {
+	payments := []Payment{}
+	err := db.C(db.collection).Find(f.selector(db.keys)).Sort(sortFields(f.Sort)...).All(&payments)
+	if err == nil {
+		err = db.keys.openPayments(payments)
+	}
+	return payments, err
+}
+
+// modelGetPaymentsPage will retrieve the page of no more than limit
+// payment records matched by the PaymentFilter from the backing data
+// store, starting at offset in the order of modelGetPayments. The
+// total number of payment records matched is also returned.
+func (f *PaymentFilter) modelGetPaymentsPage(db *mongoStore, offset int, limit int) ([]Payment, int, error) {
+	return f.modelGetPageOf(db, db.collection, offset, limit)
+}
+
+// modelGetArchivedPaymentsPage will retrieve the page of payment
+// records matched by the PaymentFilter from the archive as
+// modelGetPaymentsPage does from the backing data store, marked as
+// archived.
+func (f *PaymentFilter) modelGetArchivedPaymentsPage(db *mongoStore, offset int, limit int) ([]Payment, int, error) {
+	payments, total, err := f.modelGetPageOf(db, db.archiveCollection(), offset, limit)
+	for i := range payments {
+		payments[i].Archived = true
+	}
+	return payments, total, err
+}
+
+// modelGetPaymentsWithArchive will retrieve the page of payment
+// records matched by the PaymentFilter from the backing data store and
+// the archive together, as modelGetPaymentsPage does from one of them.
+// No more than offset+limit payment records are retrieved from each,
+// which are merged in order before the page is taken from them.
+func (f *PaymentFilter) modelGetPaymentsWithArchive(db *mongoStore, offset int, limit int) ([]Payment, int, error) {
+	payments, total, err := f.modelGetPaymentsPage(db, 0, offset+limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	archived, archivedTotal, err := f.modelGetArchivedPaymentsPage(db, 0, offset+limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	payments = append(payments, archived...)
+	sortPayments(payments, f.Sort)
+	start := min(offset, len(payments))
+	return payments[start:min(start+limit, len(payments))], total + archivedTotal, nil
+}
+
+// modelGetPageOf will retrieve the page of payment records matched by
+// the PaymentFilter from the collection of the backing data store
+// named by collection, as modelGetPaymentsPage does.
+func (f *PaymentFilter) modelGetPageOf(db *mongoStore, collection string, offset int,
+	limit int) ([]Payment, int, error) {
+	payments := []Payment{}
+	query := db.C(collection).Find(f.selector(db.keys))
+	total, err := query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	err = query.Sort(sortFields(f.Sort)...).Skip(offset).Limit(limit).All(&payments)
+	if err == nil {
+		err = db.keys.openPayments(payments)
+	}
+	return payments, total, err
+}
+
+// modelGetArchivedPayments will retrieve the payment records matched
+// by the PaymentFilter from the archive, sorted as by modelGetPayments
+// and marked as archived.
+func (f *PaymentFilter) modelGetArchivedPayments(db *mongoStore) ([]Payment, error) {
+	payments := []Payment{}
+	err := db.C(db.archiveCollection()).Find(f.selector(db.keys)).Sort(sortFields(f.Sort)...).All(&payments)
+	if err == nil {
+		err = db.keys.openPayments(payments)
+	}
+	for i := range payments {
+		payments[i].Archived = true
+	}
+	return payments, err
+}
+
+// modelCountPayments will return the number of payment records in the
+// backing data store matched by the PaymentFilter.
+func (f *PaymentFilter) modelCountPayments(db *mongoStore) (int, error) {
+	return db.C(db.collection).Find(f.selector(db.keys)).Count()
+}
+
+// modelCountArchivedPayments will return the number of payment records
+// in the archive matched by the PaymentFilter.
+func (f *PaymentFilter) modelCountArchivedPayments(db *mongoStore) (int, error) {
+	return db.C(db.archiveCollection()).Find(f.selector(db.keys)).Count()
+}
+
+// modelDeletePayments will remove the payment records matched by the
+// PaymentFilter from the backing data store, and the notes and locks
+// on them. The removed payment records are returned.
+func (f *PaymentFilter) modelDeletePayments(db *mongoStore) ([]Payment, error) {
+	return modelDeleteSelected(db, f.selector(db.keys))
+}
+
+// modelDeleteExpiredPayments will remove the payment records expired
+// by the YYYY-MM-DD date in cutoff and the time in before (see
+// expiredSelector) from the backing data store, and the notes and
+// locks on them. The removed payment records are returned.
+func modelDeleteExpiredPayments(db *mongoStore, cutoff string, before time.Time) ([]Payment, error) {
+	return modelDeleteSelected(db, expiredSelector(cutoff, before))
+}
+
+// modelDeleteSelected will remove the payment records matched by the
+// query in selector from the backing data store, and the notes and
+// locks on them. The removed payment records are returned.
+func modelDeleteSelected(db *mongoStore, selector bson.M) ([]Payment, error) {
+	payments, err := modelRemoveSelected(db, selector)
+	if err != nil || len(payments) == 0 {
+		return payments, err
+	}
+	ids := make([]string, len(payments))
+	for i, payment := range payments {
+		ids[i] = payment.ID
+	}
+	_, err = db.C(db.notesCollection()).RemoveAll(bson.M{"payment_id": bson.M{"$in": ids}})
+	if err != nil {
+		return payments, err
+	}
+	_, err = db.C(db.locksCollection()).RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	return payments, err
+}
+
+// modelRemoveSelected will remove the payment records matched by the
+// query in selector from the backing data store, leaving the notes and
+// locks on them. The removed payment records are returned as they were
+// when matched; those changed meanwhile to no longer match are left.
+func modelRemoveSelected(db *mongoStore, selector bson.M) ([]Payment, error) {
+	var matched []Payment
+	if err := db.C(db.collection).Find(selector).All(&matched); err != nil {
+		return nil, err
+	}
+	if len(matched) == 0 {
+		return nil, nil
+	}
+	if err := db.keys.openPayments(matched); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(matched))
+	for i, payment := range matched {
+		ids[i] = payment.ID
+	}
+	if _, err := db.C(db.collection).RemoveAll(bson.M{
+		"$and": []bson.M{selector, {"_id": bson.M{"$in": ids}}},
+	}); err != nil {
+		return nil, err
+	}
+	var remaining []struct {
+		ID string `bson:"_id"`
+	}
+	err := db.C(db.collection).Find(bson.M{"_id": bson.M{"$in": ids}}).
+		Select(bson.M{"_id": 1}).All(&remaining)
+	if err != nil {
+		return nil, err
+	}
+	left := map[string]bool{}
+	for _, payment := range remaining {
+		left[payment.ID] = true
+	}
+	payments := []Payment{}
+	for _, payment := range matched {
+		if !left[payment.ID] {
+			payments = append(payments, payment)
+		}
+	}
+	return payments, nil
+}
+
+// modelSearchPayments will retrieve the page of payment records in the
+// backing data store matched by the PaymentSearch, restricted to the
+// organisation in organisation if it is populated. The total number of
+// payment records matched is also returned.
+func (search *PaymentSearch) modelSearchPayments(db *mongoStore, organisation string) ([]Payment, int, error) {
+	payments := []Payment{}
+	query := db.C(db.collection).Find(search.selector(db.keys, organisation))
+	total, err := query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	err = query.Sort(search.sortFields()...).Skip(search.Offset).
+		Limit(search.Limit).All(&payments)
+	if err == nil {
+		err = db.keys.openPayments(payments)
+	}
+	return payments, total, err
+}
+
+// modelGetOrganisations will retrieve the distinct organisations of
+// the payment records in the backing data store, sorted in ascending
+// order, starting after the organisation in after and no more than
+// limit of them, grouped and paged in a single aggregation. If
+// organisation is populated no other organisation is retrieved.
+// Whether more organisations follow is also returned.
+func modelGetOrganisations(db *mongoStore, organisation string, after string, limit int) ([]Organisation, bool, error) {
+	selector := bson.M{"$gt": after}
+	if organisation != "" {
+		selector["$in"] = []string{organisation}
+	}
+	organisations := []Organisation{}
+	err := db.C(db.collection).Pipe([]bson.M{
+		{"$match": bson.M{"organisation_id": selector}},
+		{"$group": bson.M{"_id": "$organisation_id"}},
+		{"$sort": bson.M{"_id": 1}},
+		{"$limit": limit + 1},
+	}).All(&organisations)
+	if err != nil {
+		return nil, false, err
+	}
+
+	more := len(organisations) > limit
+	if more {
+		organisations = organisations[:limit]
+	}
+	return organisations, more, nil
+}
+
+// modelGetChanges will retrieve the payment records in the backing
+// data store written after the time in since, or at that time with a
+// Payment ID after that in afterID, and no later than the time in
+// until, in the order they were written and no more than limit of
+// them. If organisation is populated no payment records of other
+// organisations are retrieved. Whether more payment records follow is
+// also returned.
+func modelGetChanges(db *mongoStore, organisation string, since time.Time, afterID string,
+	until time.Time, limit int) ([]Payment, bool, error) {
+	selector := bson.M{"$or": []bson.M{
+		{"updated_at": bson.M{"$gt": since}},
+		{"updated_at": since, "_id": bson.M{"$gt": afterID}},
+	}, "updated_at": bson.M{"$lte": until}}
+	if organisation != "" {
+		selector["organisation_id"] = organisation
+	}
+	payments := []Payment{}
+	err := db.C(db.collection).Find(selector).Sort("updated_at", "_id").Limit(limit + 1).All(&payments)
+	if err == nil {
+		err = db.keys.openPayments(payments)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	more := len(payments) > limit
+	if more {
+		payments = payments[:limit]
+	}
+	return payments, more, nil
+}
+
+// modelCountOrganisationPayments will populate the number of payment
+// records in the backing data store of each of the organisations in
+// organisations, counted in a single aggregation.
+func modelCountOrganisationPayments(db *mongoStore, organisations []Organisation) error {
+	var counts []Organisation
+	ids := make([]string, len(organisations))
+	for i := range organisations {
+		ids[i] = organisations[i].ID
+	}
+	err := db.C(db.collection).Pipe([]bson.M{
+		{"$match": bson.M{"organisation_id": bson.M{"$in": ids}}},
+		{"$group": bson.M{"_id": "$organisation_id", "count": bson.M{"$sum": 1}}},
+	}).All(&counts)
+	if err != nil {
+		return err
+	}
+
+	byID := map[string]int{}
+	for _, count := range counts {
+		byID[count.ID] = count.PaymentCount
+	}
+	for i := range organisations {
+		organisations[i].PaymentCount = byID[organisations[i].ID]
+	}
+	return nil
+}
+
+// CurrencyTotal is the total Amount of the PaymentCount payment
+// records in Currency.
+type CurrencyTotal struct {
+	Currency     string `json:"currency"`
+	Amount       Amount `json:"amount"`
+	PaymentCount int    `json:"payment_count"`
+}
+
+// OrganisationSummary is an overview of the payment records of an
+// organisation: their number, their total amount in each currency,
+// the earliest and latest of their processing dates, and when the last
+// of them was created or updated. The dates and LastActivity are left
+// out when there are no payment records.
+type OrganisationSummary struct {
+	OrganisationID         string          `json:"organisation_id"`
+	PaymentCount           int             `json:"payment_count"`
+	Totals                 []CurrencyTotal `json:"totals"`
+	EarliestProcessingDate string          `json:"earliest_processing_date,omitempty"`
+	LatestProcessingDate   string          `json:"latest_processing_date,omitempty"`
+	LastActivity           *time.Time      `json:"last_activity,omitempty"`
+}
+
+// modelSummarisePayments will summarise the payment records in the
+// backing data store matched by the PaymentFilter in a single
+// aggregation, with Totals sorted by currency. The amounts are summed
+// as whole minor units, so that no floating point rounding creeps in,
+// and a total too large to be held that way is an error.
+func (f *PaymentFilter) modelSummarisePayments(db *mongoStore) (OrganisationSummary, error) {
+	summary := OrganisationSummary{OrganisationID: f.OrganisationID, Totals: []CurrencyTotal{}}
+	var groups []struct {
+		Currency     string      `bson:"_id"`
+		Units        interface{} `bson:"units"`
+		Count        int         `bson:"count"`
+		Earliest     string      `bson:"earliest"`
+		Latest       string      `bson:"latest"`
+		LastActivity time.Time   `bson:"last_activity"`
+	}
+	err := db.C(db.collection).Pipe([]bson.M{
+		{"$match": f.selector(db.keys)},
+		{"$group": bson.M{
+			"_id":           "$attributes.currency",
+			"units":         bson.M{"$sum": "$amount_minor_units"},
+			"count":         bson.M{"$sum": 1},
+			"earliest":      bson.M{"$min": "$attributes.processing_date"},
+			"latest":        bson.M{"$max": "$attributes.processing_date"},
+			"last_activity": bson.M{"$max": "$updated_at"},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}).All(&groups)
+	if err != nil {
+		return summary, err
+	}
+
+	for _, group := range groups {
+		var units int64
+		switch sum := group.Units.(type) {
+		case int:
+			units = int64(sum)
+		case int64:
+			units = sum
+		default:
+			// $sum overflows to a double.
+			return summary, fmt.Errorf("The total amount in %s is too large", group.Currency)
+		}
+		summary.Totals = append(summary.Totals, CurrencyTotal{Currency: group.Currency,
+			Amount: newAmount(big.NewInt(units), amountMinScale), PaymentCount: group.Count})
+		summary.PaymentCount += group.Count
+		if summary.EarliestProcessingDate == "" || group.Earliest < summary.EarliestProcessingDate {
+			summary.EarliestProcessingDate = group.Earliest
+		}
+		if group.Latest > summary.LatestProcessingDate {
+			summary.LatestProcessingDate = group.Latest
+		}
+		if summary.LastActivity == nil || group.LastActivity.After(*summary.LastActivity) {
+			lastActivity := group.LastActivity.UTC()
+			summary.LastActivity = &lastActivity
+		}
+	}
+	return summary, nil
+}
+
+// archiveBatchSize is the number of payment records moved to the
+// archive at a time.
+const archiveBatchSize = 1000
+
+// archiveCollection returns the name of the collection payment records
+// are archived to.
+func (db *mongoStore) archiveCollection() string {
+	return db.collection + "_archive"
+}
+
+// paymentIter iterates over payment records in the backing data store
+// as mgo.Iter does, opening each (see openPayment). Iteration stops at
+// the first that cannot be opened, and Close returns its error.
+type paymentIter struct {
+	*mgo.Iter
+	keys *accountKeyring
+	err  error
+}
+
+// Next reads the next payment record into p, returning false once
+// there are no more or reading one failed.
+func (iter *paymentIter) Next(p *Payment) bool {
+	if iter.err != nil || !iter.Iter.Next(p) {
+		return false
+	}
+	if iter.err = iter.keys.openPayment(p); iter.err != nil {
+		iter.err = fmt.Errorf("Payment %s: %s", p.ID, iter.err)
+		return false
+	}
+	return true
+}
+
+// Close closes the iterator, returning the first error met.
+func (iter *paymentIter) Close() error {
+	err := iter.Iter.Close()
+	if iter.err != nil {
+		return iter.err
+	}
+	return err
+}
+
+// modelOrganisationPayments will iterate over the payment records of
+// the organisation in organisation in the collection of the backing
+// data store named by collection, sorted by Payment ID in ascending
+// order.
+func modelOrganisationPayments(db *mongoStore, collection string, organisation string) *paymentIter {
+	iter := db.C(collection).Find(bson.M{"organisation_id": organisation}).Sort("_id").Iter()
+	return &paymentIter{Iter: iter, keys: db.keys}
+}
+
+// modelGetPaymentsByReference will retrieve the payment records whose
+// numeric or end to end reference is among references, sorted by
+// Payment ID in ascending order. If organisation is populated only the
+// payment records of that organisation are retrieved.
+func modelGetPaymentsByReference(db *mongoStore, organisation string, references []string) ([]Payment, error) {
+	selector := bson.M{"$or": []bson.M{
+		{"attributes.numeric_reference": bson.M{"$in": references}},
+		{"attributes.end_to_end_reference": bson.M{"$in": references}},
+	}}
+	if organisation != "" {
+		selector["organisation_id"] = organisation
+	}
+	payments := []Payment{}
+	err := db.C(db.collection).Find(selector).Sort("_id").All(&payments)
+	if err == nil {
+		err = db.keys.openPayments(payments)
+	}
+	return payments, err
+}
+
+// modelPaymentsProcessedBetween will iterate over the payment records
+// with a processing date within the inclusive range of YYYY-MM-DD dates
+// from and to, sorted by Payment ID in ascending order. If organisation
+// is populated only the payment records of that organisation are
+// iterated over.
+func modelPaymentsProcessedBetween(db *mongoStore, organisation string, from string, to string) *paymentIter {
+	selector := bson.M{"attributes.processing_date": bson.M{"$gte": from, "$lte": to}}
+	if organisation != "" {
+		selector["organisation_id"] = organisation
+	}
+	return &paymentIter{Iter: db.C(db.collection).Find(selector).Sort("_id").Iter(), keys: db.keys}
+}
+
+// integrityBatchSize is the number of stored payment records fetched
+// from the backing data store at a time by the integrity check.
+const integrityBatchSize = 500
+
+// modelScanPayments will iterate over the stored documents of the
+// payment records matched by the PaymentFilter, sorted by Payment ID
+// in ascending order and fetched integrityBatchSize at a time, so that
+// every payment record can be inspected as it is stored without
+// holding them all.
+func (f *PaymentFilter) modelScanPayments(db *mongoStore) *mgo.Iter {
+	return db.C(db.collection).Find(f.selector(db.keys)).Sort("_id").Batch(integrityBatchSize).Iter()
+}
+
+// modelNormalisePayment will set the stored values in set, keyed by
+// their dotted paths, of the payment record with the Payment ID in id
+// last updated at updatedAt, and its modification time to now, so that
+// the change is seen by the change feed and by conditional requests.
+// mgo.ErrNotFound is returned if it has been updated or removed
+// meanwhile.
+func modelNormalisePayment(db *mongoStore, id string, updatedAt time.Time, set bson.M,
+	now time.Time) error {
+	selector := bson.M{"_id": id, "updated_at": updatedAt}
+	if updatedAt.IsZero() {
+		selector["updated_at"] = bson.M{"$exists": false}
+	}
+	set["updated_at"] = now
+	return db.C(db.collection).Update(selector, bson.M{"$set": set})
+}
+
+// expiredSelector returns the query matching the payment records with
+// a processing date before the YYYY-MM-DD date in cutoff, and those
+// without a processing date created before the time in before.
+func expiredSelector(cutoff string, before time.Time) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"attributes.processing_date": bson.M{"$gt": "", "$lt": cutoff}},
+		{"attributes.processing_date": bson.M{"$in": []interface{}{"", nil}},
+			"created_at": bson.M{"$lt": before}},
+	}}
+}
+
+// modelArchivePayments will move the payment records expired by the
+// YYYY-MM-DD date in cutoff and the time in before (see
+// expiredSelector) from the backing data store to the archive,
+// archiveBatchSize at a time. Each batch is copied to the archive
+// before it is removed, replacing any copy left by an interrupted
+// earlier run, so that archiving can safely be repeated. The number of
+// moved payment records is returned.
+func modelArchivePayments(db *mongoStore, cutoff string, before time.Time) (int, error) {
+	selector := expiredSelector(cutoff, before)
+	moved := 0
+	for {
+		var documents []bson.M
+		err := db.C(db.collection).Find(selector).Sort("_id").
+			Limit(archiveBatchSize).All(&documents)
+		if err != nil || len(documents) == 0 {
+			return moved, err
+		}
+
+		bulk := db.C(db.archiveCollection()).Bulk()
+		ids := make([]interface{}, len(documents))
+		for i, document := range documents {
+			ids[i] = document["_id"]
+			bulk.Upsert(bson.M{"_id": ids[i]}, document)
+		}
+		if _, err := bulk.Run(); err != nil {
+			return moved, err
+		}
+		info, err := db.C(db.collection).RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return moved, err
+		}
+		moved += info.Removed
+	}
+}
+
+// modelGetDuePayments will retrieve the scheduled payment records
+// with a processing date no later than the YYYY-MM-DD date in today
+// from the backing data store, in the order of their processing dates.
+func modelGetDuePayments(db *mongoStore, today string) ([]Payment, error) {
+	payments := []Payment{}
+	err := db.C(db.collection).Find(bson.M{"status": PaymentScheduled,
+		"attributes.processing_date": bson.M{"$lte": today}}).
+		Sort("attributes.processing_date", "_id").All(&payments)
+	if err == nil {
+		err = db.keys.openPayments(payments)
+	}
+	return payments, err
+}
+
+// modelReleasePayment, given the scheduled Payment, will make the
+// corresponding payment record in the backing store pending, stamped
+// at now. mgo.ErrNotFound is returned if it is no longer scheduled.
+func (p *Payment) modelReleasePayment(db *mongoStore, now time.Time) error {
+	err := db.C(db.collection).Update(bson.M{"_id": p.ID, "status": PaymentScheduled},
+		bson.M{"$set": bson.M{"status": PaymentPending, "updated_at": now}})
+	if err == nil {
+		p.Status, p.UpdatedAt = PaymentPending, now
+	}
+	return err
+}
+
+// modelReencryptPayments will rewrite the account numbers of the
+// payment records in the collection of the backing data store named
+// by collection that are not sealed with the current key of db, such
+// as those stored in the clear or with a retired key, sealing them
+// with the current key. Payment records updated
+// meanwhile are skipped, as their update sealed them anew. The number
+// of payment records rewritten is returned.
+func modelReencryptPayments(db *mongoStore, collection string) (int, error) {
+	if db.keys == nil {
+		return 0, ErrNoEncryptionKey
+	}
+	fields := bson.M{"updated_at": 1}
+	for _, party := range accountParties {
+		fields["attributes."+party+".account_number"] = 1
+	}
+	type accountNumbers struct {
+		ID         string    `bson:"_id"`
+		UpdatedAt  time.Time `bson:"updated_at"`
+		Attributes map[string]struct {
+			AccountNumber bson.Raw `bson:"account_number"`
+		} `bson:"attributes"`
+	}
+	rewritten := 0
+	iter := db.C(collection).Find(nil).Select(fields).Iter()
+	for {
+		var document accountNumbers
+		if !iter.Next(&document) {
+			break
+		}
+		update := bson.M{}
+		for party, attributes := range document.Attributes {
+			if !db.keys.stale(attributes.AccountNumber) {
+				continue
+			}
+			var number AccountNumber
+			err := number.SetBSON(attributes.AccountNumber)
+			if err == nil {
+				number, err = db.keys.openAccountNumber(number)
+			}
+			if err == nil {
+				number, err = db.keys.sealAccountNumber(number)
+			}
+			if err != nil {
+				iter.Close()
+				return rewritten, fmt.Errorf("Payment %s: %s", document.ID, err)
+			}
+			update["attributes."+party+".account_number"] = number
+		}
+		if len(update) == 0 {
+			continue
+		}
+		selector := bson.M{"_id": document.ID, "updated_at": document.UpdatedAt}
+		if document.UpdatedAt.IsZero() {
+			selector["updated_at"] = bson.M{"$exists": false}
+		}
+		err := db.C(collection).Update(selector, bson.M{"$set": update})
+		if err == nil {
+			rewritten++
+		} else if err != mgo.ErrNotFound {
+			iter.Close()
+			return rewritten, err
+		}
+	}
+	return rewritten, iter.Close()
+}
+
+// modelCreatePaymentValidCheck, given the element ID in Payment, will
+// return the corresponding validity of whether a payment record can
+// be created in the backing store. If the payment record cannot be
+// created, the function raises an error with a 'reason' string,
+// otherwise it returns nil if a payment record can be created. A
+// payment record missing required attributes or holding unacceptable
+// values raises ValidationErrors listing all of them, naming only
+// attributes itself if the attributes object is missing or empty
+// altogether.
+func (p *Payment) modelCreatePaymentValidCheck(db *mongoStore) error {
+	if err := checkNewPaymentValues(p); err != nil {
+		return err
+	}
+
+	count, err := returnPaymentCount(db, p)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return ErrPaymentExists
+	}
+	return nil
+}
+
+// checkNewPaymentValues is the part of modelCreatePaymentValidCheck
+// that needs no backing store: the checks of the Payment ID, the
+// required attributes and their values.
+func checkNewPaymentValues(p *Payment) error {
+	if checkEmptyPaymentID(p) == true {
+		return &PaymentIDError{Reason: "Cannot add a payment without a Payment ID specified"}
+	}
+
+	if reflect.ValueOf(p.Attributes).IsZero() {
+		return collectValidationErrors(&MissingAttributesError{Attributes: []string{"attributes"}})
+	}
+	var missingErr error
+	if missing := checkRequiredAttributes(p); len(missing) > 0 {
+		missingErr = &MissingAttributesError{Attributes: missing}
+	}
+	return collectValidationErrors(missingErr, checkPaymentValues(p))
+}
+
+// modelFindDuplicatePayment, given the full population of Payment,
+// will look up a payment record of the same organisation with a
+// different Payment ID but the same fingerprint in the backing store.
+// If one exists a DuplicatePaymentError naming it is returned,
+// otherwise nil.
+func (p *Payment) modelFindDuplicatePayment(db *mongoStore) error {
+	var existing Payment
+	err := db.C(db.collection).Find(bson.M{
+		"organisation_id": p.OrganisationID,
+		"fingerprint":     paymentFingerprint(p),
+		"_id":             bson.M{"$ne": p.ID},
+	}).Select(bson.M{"_id": 1}).One(&existing)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return &DuplicatePaymentError{ID: existing.ID}
+}
+
+// modelFindSchemePaymentID, given the OrganisationID and payment_id
+// attribute in Payment, will look up a payment record of the same
+// organisation with a different Payment ID but the same payment_id in
+// the backing store. If one exists a DuplicatePaymentError naming it
+// is returned, otherwise nil. A Payment without a payment_id
+// duplicates none.
+func (p *Payment) modelFindSchemePaymentID(db *mongoStore) error {
+	if p.Attributes.PaymentID == "" {
+		return nil
+	}
+	var existing Payment
+	err := db.C(db.collection).Find(bson.M{
+		"organisation_id":       p.OrganisationID,
+		"attributes.payment_id": p.Attributes.PaymentID,
+		"_id":                   bson.M{"$ne": p.ID},
+	}).Select(bson.M{"_id": 1}).One(&existing)
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return &DuplicatePaymentError{ID: existing.ID, SchemePaymentID: p.Attributes.PaymentID}
+}
+
+// schemePaymentIDIndex is the name of the unique index refusing a
+// second payment record of an organisation with the same payment_id, if
+// the payment_ids of each organisation are unique (see modelIndexes).
+const schemePaymentIDIndex = "unique_scheme_payment_id"
+
+// schemePaymentIDConflict is a convenience function that returns the
+// DuplicatePaymentError naming the payment record of the organisation
+// of the Payment in p with its payment_id, if err is the refusal of
+// its write by the index of schemePaymentIDIndex, as when another
+// payment with the same payment_id was written since it was checked.
+// Any other err is returned as it is.
+func (p *Payment) schemePaymentIDConflict(db *mongoStore, err error) error {
+	if !mgo.IsDup(err) || !strings.Contains(err.Error(), schemePaymentIDIndex) {
+		return err
+	}
+	if found := p.modelFindSchemePaymentID(db); found != nil {
+		return found
+	}
+	return err
+}
+
+// modelIndex is an index of the backing data store and the collection
+// it is on. An index with a partial filter only holds the documents
+// matching it.
+type modelIndex struct {
+	collection string
+	index      mgo.Index
+	partial    bson.M
+}
+
+// modelIndexes returns the indexes the queries on the backing data
+// store in db rely on, that of the notes on payment records, and the
+// indexes expiring the quota counters of past days and the locks on
+// payment records. If the payment_ids of each organisation are unique
+// in db the index of schemePaymentIDIndex enforces it.
+func modelIndexes(db *mongoStore) []modelIndex {
+	var indexes []modelIndex
+	for _, key := range [][]string{
+		{"organisation_id", "fingerprint"},
+		{"amount_minor_units"},
+		{"attributes.currency", "amount_minor_units"},
+		{"attributes.payment_id"},
+		{"status", "attributes.processing_date"},
+		{"updated_at", "_id"},
+	} {
+		indexes = append(indexes, modelIndex{collection: db.collection, index: mgo.Index{Key: key}})
+	}
+	for _, party := range accountParties {
+		indexes = append(indexes, modelIndex{collection: db.collection, index: mgo.Index{
+			Key: []string{"attributes." + party + ".account_number.index"}, Sparse: true}})
+	}
+	if db.uniqueSchemePaymentIDs {
+		indexes = append(indexes, modelIndex{collection: db.collection, index: mgo.Index{
+			Key:    []string{"organisation_id", "attributes.payment_id"},
+			Unique: true, Name: schemePaymentIDIndex},
+			partial: bson.M{"attributes.payment_id": bson.M{"$gt": ""}}})
+	}
+	expiring := mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second}
+	return append(indexes,
+		modelIndex{collection: db.notesCollection(),
+			index: mgo.Index{Key: []string{"payment_id", "created_at"}}},
+		modelIndex{collection: quotasCollection, index: expiring},
+		modelIndex{collection: db.locksCollection(), index: expiring})
+}
+
+// modelEnsureIndexes will create the indexes of modelIndexes if they
+// do not already exist.
+func modelEnsureIndexes(db *mongoStore) error {
+	for _, index := range modelIndexes(db) {
+		var err error
+		if index.partial != nil {
+			err = modelEnsurePartialIndex(db, index)
+		} else {
+			err = db.C(index.collection).EnsureIndex(index.index)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modelEnsurePartialIndex will create the index in index with its
+// partial filter if it does not already exist, with the createIndexes
+// command as EnsureIndex has no partial filter.
+func modelEnsurePartialIndex(db *mongoStore, index modelIndex) error {
+	key := bson.D{}
+	for _, field := range index.index.Key {
+		key = append(key, bson.DocElem{Name: field, Value: 1})
+	}
+	return db.Run(bson.D{
+		{Name: "createIndexes", Value: index.collection},
+		{Name: "indexes", Value: []bson.M{{
+			"key":                     key,
+			"name":                    index.index.Name,
+			"unique":                  index.index.Unique,
+			"partialFilterExpression": index.partial,
+		}}},
+	}, nil)
+}
+
+// modelMissingIndexes will return the indexes of modelIndexes that do
+// not exist in the backing data store, each named by its collection
+// and key such as "payments (organisation_id, fingerprint)", without
+// creating them.
+func modelMissingIndexes(db *mongoStore) ([]string, error) {
+	listed, existing := map[string]bool{}, map[string]bool{}
+	var missing []string
+	for _, index := range modelIndexes(db) {
+		if !listed[index.collection] {
+			indexes, err := db.C(index.collection).Indexes()
+			if e, ok := err.(*mgo.QueryError); ok && e.Code == 26 {
+				err = nil // the collection does not exist yet, nor any of its indexes
+			}
+			if err != nil {
+				return nil, err
+			}
+			listed[index.collection] = true
+			for _, found := range indexes {
+				existing[index.collection+" ("+strings.Join(found.Key, ", ")+")"] = true
+			}
+		}
+		name := index.collection + " (" + strings.Join(index.index.Key, ", ") + ")"
+		if !existing[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+// modelBackfillAmountMinorUnits will populate the amount in minor
+// units of the payment records in the backing data store that were
+// written before it was maintained. Payment records with an amount
+// that cannot be held in minor units are left alone, and an error
+// naming them returned once the others are updated, rather than
+// being found by the wrong amount. The number of updated payment
+// records is returned.
+func modelBackfillAmountMinorUnits(db *mongoStore) (int, error) {
+	var payment Payment
+	var unrepresentable []string
+	updated := 0
+
+	iter := db.C(db.collection).Find(bson.M{
+		"amount_minor_units": bson.M{"$exists": false},
+	}).Iter()
+	for iter.Next(&payment) {
+		units, ok := payment.Attributes.Amount.MinorUnits()
+		if !ok {
+			unrepresentable = append(unrepresentable, payment.ID)
+			continue
+		}
+		err := db.C(db.collection).UpdateId(payment.ID,
+			bson.M{"$set": bson.M{"amount_minor_units": units}})
+		if err != nil {
+			iter.Close()
+			return updated, err
+		}
+		updated++
+	}
+	if err := iter.Close(); err != nil {
+		return updated, err
+	}
+	if len(unrepresentable) > 0 {
+		return updated, fmt.Errorf("The amount of payments %s cannot be held in minor units",
+			strings.Join(unrepresentable, ", "))
+	}
+	return updated, nil
+}
+
+// modelCompactPayments will remove the sections of the attributes of
+// the payment records in the backing data store and its archive that
+// are not populated (see compactPayment), such as those stored before
+// unpopulated sections were left out. Payment records updated meanwhile
+// are skipped, as their update left them out. The number of updated
+// payment records is returned.
+func modelCompactPayments(db *mongoStore) (int, error) {
+	fields := bson.M{"updated_at": 1}
+	for _, section := range []string{"beneficiary_party", "charges_information", "debtor_party",
+		"fx", "sponsor_party"} {
+		fields["attributes."+section] = 1
+	}
+	updated := 0
+	for _, collection := range []string{db.collection, db.archiveCollection()} {
+		iter := db.C(collection).Find(nil).Select(fields).Iter()
+		for {
+			var payment Payment
+			if !iter.Next(&payment) {
+				break
+			}
+			removed := compactPayment(&payment)
+			if len(removed) == 0 {
+				continue
+			}
+			unset := bson.M{}
+			for _, section := range removed {
+				unset[section] = ""
+			}
+			selector := bson.M{"_id": payment.ID, "updated_at": payment.UpdatedAt}
+			if payment.UpdatedAt.IsZero() {
+				selector["updated_at"] = bson.M{"$exists": false}
+			}
+			err := db.C(collection).Update(selector, bson.M{"$unset": unset})
+			if err == nil {
+				updated++
+			} else if err != mgo.ErrNotFound {
+				iter.Close()
+				return updated, err
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return updated, err
+		}
+	}
+	return updated, nil
+}
+
+// modelBackfillUpdatedAt will stamp the payment records in the
+// backing data store that were written before their modification time
+// was maintained with the current time, so that they take part in
+// conditional requests. The number of updated payment records is
+// returned.
+func modelBackfillUpdatedAt(db *mongoStore) (int, error) {
+	info, err := db.C(db.collection).UpdateAll(
+		bson.M{"updated_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"updated_at": time.Now().UTC()}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Updated, nil
+}
+
+// migrationsCollection is the name of the collection recording the
+// migrations applied to the backing data store, which also holds the
+// migration lock.
+const migrationsCollection = "schema_migrations"
+
+// migrationLockID is the ID of the migration lock document.
+const migrationLockID = "lock"
+
+// MigrationRecord records a migration of the backing data store by
+// its version and name, along with when it was applied and the number
+// of payment records it changed. Pending migrations carry no
+// AppliedAt.
+type MigrationRecord struct {
+	Version   int        `bson:"_id" json:"version"`
+	Name      string     `bson:"name" json:"name"`
+	AppliedAt *time.Time `bson:"applied_at" json:"applied_at,omitempty"`
+	Affected  int        `bson:"affected" json:"affected"`
+}
+
+// ErrMigrationsLocked is returned when another instance holds the
+// migration lock.
+var ErrMigrationsLocked = errors.New("Migrations are being applied by another instance")
+
+// modelLockMigrations will take the migration lock for owner until
+// lease after now, unless another owner holds a lock that has not yet
+// expired in which case ErrMigrationsLocked is returned. An owner
+// already holding the lock has it extended.
+func modelLockMigrations(db *mongoStore, owner string, now time.Time,
+	lease time.Duration) error {
+	lock := bson.M{"_id": migrationLockID, "owner": owner, "expires_at": now.Add(lease)}
+	err := db.C(migrationsCollection).Insert(lock)
+	if mgo.IsDup(err) {
+		err = db.C(migrationsCollection).Update(bson.M{
+			"_id": migrationLockID,
+			"$or": []bson.M{{"owner": owner}, {"expires_at": bson.M{"$lt": now}}},
+		}, lock)
+		if err == mgo.ErrNotFound {
+			return ErrMigrationsLocked
+		}
+	}
+	return err
+}
+
+// modelUnlockMigrations will release the migration lock if owner holds
+// it.
+func modelUnlockMigrations(db *mongoStore, owner string) error {
+	err := db.C(migrationsCollection).Remove(bson.M{"_id": migrationLockID, "owner": owner})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// modelGetMigrationRecords will retrieve the records of the migrations
+// applied to the backing data store, sorted by version.
+func modelGetMigrationRecords(db *mongoStore) ([]MigrationRecord, error) {
+	records := []MigrationRecord{}
+	err := db.C(migrationsCollection).Find(bson.M{"name": bson.M{"$exists": true}}).
+		Sort("_id").All(&records)
+	return records, err
+}
+
+// modelRecordMigration will record the migration in record as applied.
+func modelRecordMigration(db *mongoStore, record MigrationRecord) error {
+	_, err := db.C(migrationsCollection).UpsertId(record.Version, record)
+	return err
+}
+
+// quotasCollection is the name of the collection counting the payment
+// records created with each API key per day.
+const quotasCollection = "api_key_quotas"
+
+// ErrQuotaExceeded is returned when the daily quota of an API key is
+// exhausted.
+var ErrQuotaExceeded = errors.New("The daily quota of payments of the API key is exhausted")
+
+// quotaCounterID is a convenience function that returns the ID of the
+// counter of the payment records created with the API key identified
+// by key on the date in day.
+func quotaCounterID(key string, day string) string {
+	return key + "/" + day
+}
+
+// modelReserveQuota will take one payment record from the quota of
+// limit payment records of the API key identified by key on the date
+// in day, returning the number now taken. The counter is incremented
+// atomically and only while it is below limit, so concurrent requests
+// cannot overrun the quota. ErrQuotaExceeded is returned if the quota
+// is exhausted. Counters expire at expires, once their day is over.
+func modelReserveQuota(db *mongoStore, key string, day string, limit int,
+	expires time.Time) (int, error) {
+	var counter struct {
+		Count int `bson:"count"`
+	}
+	_, err := db.C(quotasCollection).Find(bson.M{
+		"_id":   quotaCounterID(key, day),
+		"count": bson.M{"$lt": limit},
+	}).Apply(mgo.Change{
+		Update: bson.M{
+			"$inc":         bson.M{"count": 1},
+			"$setOnInsert": bson.M{"key": key, "day": day, "expires_at": expires},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &counter)
+	if mgo.IsDup(err) {
+		// The counter exists but is at its limit, so the upsert collided.
+		return limit, ErrQuotaExceeded
+	}
+	return counter.Count, err
+}
+
+// modelReleaseQuota will give back a payment record taken from the
+// quota of the API key identified by key on the date in day by
+// modelReserveQuota, whose creation failed or was rolled back.
+func modelReleaseQuota(db *mongoStore, key string, day string) error {
+	return db.C(quotasCollection).UpdateId(quotaCounterID(key, day),
+		bson.M{"$inc": bson.M{"count": -1}})
+}
+
+// modelCreatePayment, given the full population of Payment, will
+// create the corresponding payment record in the backing store,
+// created and stamped at now (see stampPayment). If the payment_id of
+// another payment record of its organisation is refused by the index
+// of schemePaymentIDIndex a DuplicatePaymentError naming it is
+// returned. If an error occurs, an error will be returned.
+func (p *Payment) modelCreatePayment(db *mongoStore, now time.Time) error {
+	p.CreatedAt = now
+	stampPayment(p, now)
+	sealed, err := db.keys.sealPayment(p)
+	if err != nil {
+		return err
+	}
+	return p.schemePaymentIDConflict(db, db.C(db.collection).Insert(sealed))
+}
+
+// modelUpdatePaymentValidCheck, given the element ID in Payment, will
+// return the corresponding validity of whether a payment record can
+// be modified in the backing store. If the payment record cannot be
+// modified, the function raises an error with a 'reason' string,
+// otherwise it returns nil if a payment record can be modified.
+func (p *Payment) modelUpdatePaymentValidCheck(db *mongoStore) error {
+	if checkEmptyPaymentID(p) == true {
+		return &PaymentIDError{Reason: "Cannot update a payment without a Payment ID specified"}
+	}
+
+	if err := checkPaymentValues(p); err != nil {
+		return err
+	}
+
+	count, err := returnPaymentCount(db, p)
+
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return &PaymentIDError{Reason: "A payment with this Payment ID does not exist"}
+	}
+	return nil
+}
+
+// modelUpdatePayment, given the full population of Payment, will
+// update the corresponding payment record in the backing store,
+// stamped at now (see stampPayment). Every attribute but the creation
+// time and the status is replaced. Its payment_id is refused as by
+// modelCreatePayment. If an error occurs, an error will be returned.
+func (p *Payment) modelUpdatePayment(db *mongoStore, now time.Time) error {
+	stampPayment(p, now)
+	var fields bson.M
+	sealed, err := db.keys.sealPayment(p)
+	var document []byte
+	if err == nil {
+		document, err = bson.Marshal(sealed)
+	}
+	if err == nil {
+		err = bson.Unmarshal(document, &fields)
+	}
+	if err != nil {
+		return err
+	}
+	delete(fields, "_id")
+	delete(fields, "created_at")
+	delete(fields, "status")
+	err = db.C(db.collection).UpdateId(p.ID, bson.M{"$set": fields})
+	return p.schemePaymentIDConflict(db, err)
+}
+
+// modelAnonymisePayment, given the anonymised Payment, will blank the
+// fields of the corresponding payment record named in fields in the
+// collection of the backing data store named by collection, stamped at
+// now (see stampPayment). The sections left without a populated field
+// are removed instead (see compactPayment). If an error occurs, an
+// error will be returned.
+func (p *Payment) modelAnonymisePayment(db *mongoStore, collection string, fields []string,
+	now time.Time) error {
+	removed := compactPayment(p)
+	stampPayment(p, now)
+	blanked := bson.M{"updated_at": p.UpdatedAt, "fingerprint": p.Fingerprint}
+	unset := bson.M{}
+	for _, section := range removed {
+		unset[section] = ""
+	}
+	for _, field := range fields {
+		if _, ok := unset[field[:strings.LastIndex(field, ".")]]; !ok {
+			blanked[field] = ""
+		}
+	}
+	update := bson.M{"$set": blanked}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return db.C(collection).UpdateId(p.ID, update)
+}
+
+// checkEmptyPaymentID is a convenience function to ascertain whether
+// the ID field is populated. Currently the only check performed is
+// whether the ID = "" which the function defines as empty.
+func checkEmptyPaymentID(p *Payment) bool {
+	if p.ID == "" {
+		return true
+	}
+	return false
+}
+
+// checkRequiredAttributes is a convenience function that returns the
+// json names of the required attributes that are not populated in
+// Payment. A party is considered missing when none of its fields are
+// populated.
+func checkRequiredAttributes(p *Payment) []string {
+	attributes := &p.Attributes
+	required := []struct {
+		name    string
+		missing bool
+	}{
+		{"amount", attributes.Amount.IsZero()},
+		{"currency", attributes.Currency == ""},
+		{"debtor_party", *p.debtorParty() == (DebtorParty{})},
+		{"beneficiary_party", *p.beneficiaryParty() == (BeneficiaryParty{})},
+		{"payment_scheme", attributes.PaymentScheme == ""},
+		{"processing_date", attributes.ProcessingDate == ""},
+	}
+
+	missing := []string{}
+	for _, attribute := range required {
+		if attribute.missing {
+			missing = append(missing, attribute.name)
+		}
+	}
+	return missing
+}
+
+// compactPayment is a convenience function that removes the sections
+// of the attributes of Payment that are not populated, so that they are
+// neither stored nor emitted, and returns the stored names of those it
+// removed. A section is populated when any of its fields are.
+func compactPayment(p *Payment) []string {
+	attributes := &p.Attributes
+	var removed []string
+	if attributes.BeneficiaryParty != nil && *attributes.BeneficiaryParty == (BeneficiaryParty{}) {
+		attributes.BeneficiaryParty = nil
+		removed = append(removed, "attributes.beneficiary_party")
+	}
+	if charges := attributes.ChargesInformation; charges != nil && len(charges.SenderCharges) == 0 &&
+		charges.BearerCode == "" && charges.ReceiverChargesAmount.IsZero() &&
+		charges.ReceiverChargesCurrency == "" {
+		attributes.ChargesInformation = nil
+		removed = append(removed, "attributes.charges_information")
+	}
+	if attributes.DebtorParty != nil && *attributes.DebtorParty == (DebtorParty{}) {
+		attributes.DebtorParty = nil
+		removed = append(removed, "attributes.debtor_party")
+	}
+	if fx := attributes.Fx; fx != nil && fx.ContractReference == "" && fx.ExchangeRate == "" &&
+		fx.OriginalAmount.IsZero() && fx.OriginalCurrency == "" {
+		attributes.Fx = nil
+		removed = append(removed, "attributes.fx")
+	}
+	if attributes.SponsorParty != nil && *attributes.SponsorParty == (SponsorParty{}) {
+		attributes.SponsorParty = nil
+		removed = append(removed, "attributes.sponsor_party")
+	}
+	return removed
+}
+
+// beneficiaryParty is a convenience function that returns the
+// beneficiary party of Payment, or a blank one not attached to it if it
+// has none, so that it can be read without checking.
+func (p *Payment) beneficiaryParty() *BeneficiaryParty {
+	if p.Attributes.BeneficiaryParty == nil {
+		return &BeneficiaryParty{}
+	}
+	return p.Attributes.BeneficiaryParty
+}
+
+// debtorParty is a convenience function that returns the debtor party
+// of Payment, or a blank one not attached to it, as beneficiaryParty
+// does.
+func (p *Payment) debtorParty() *DebtorParty {
+	if p.Attributes.DebtorParty == nil {
+		return &DebtorParty{}
+	}
+	return p.Attributes.DebtorParty
+}
+
+// sponsorParty is a convenience function that returns the sponsor
+// party of Payment, or a blank one not attached to it, as
+// beneficiaryParty does.
+func (p *Payment) sponsorParty() *SponsorParty {
+	if p.Attributes.SponsorParty == nil {
+		return &SponsorParty{}
+	}
+	return p.Attributes.SponsorParty
+}
+
+// chargesInformation is a convenience function that returns the
+// charges information of Payment, or a blank one not attached to it,
+// as beneficiaryParty does.
+func (p *Payment) chargesInformation() *ChargesInformation {
+	if p.Attributes.ChargesInformation == nil {
+		return &ChargesInformation{}
+	}
+	return p.Attributes.ChargesInformation
+}
+
+// fx is a convenience function that returns the fx of Payment, or a
+// blank one not attached to it, as beneficiaryParty does.
+func (p *Payment) fx() *Fx {
+	if p.Attributes.Fx == nil {
+		return &Fx{}
+	}
+	return p.Attributes.Fx
+}
+
+// stampPayment is a convenience function that sets the attributes of
+// Payment maintained by the server: its modification time to now, its
+// fingerprint and its amount in minor units. The sections that are not
+// populated are removed first (see compactPayment).
+func stampPayment(p *Payment, now time.Time) {
+	compactPayment(p)
+	p.UpdatedAt = now
+	p.Fingerprint = paymentFingerprint(p)
+	p.AmountMinorUnits, _ = p.Attributes.Amount.MinorUnits()
+}
+
+// paymentFingerprint is a convenience function that returns a digest of
+// the attributes of Payment that identify a transfer: the debtor and
+// beneficiary accounts, the amount and currency, the end to end
+// reference and the processing date. Two payment records with the same
+// fingerprint are almost always an accidental double submission.
+func paymentFingerprint(p *Payment) string {
+	attributes := &p.Attributes
+	debtor, beneficiary := p.debtorParty(), p.beneficiaryParty()
+	fields, _ := json.Marshal([]string{
+		string(debtor.AccountNumber), debtor.AccountNumberCode, debtor.BankID, debtor.BankIDCode,
+		string(beneficiary.AccountNumber), beneficiary.AccountNumberCode,
+		beneficiary.BankID, beneficiary.BankIDCode,
+		attributes.Amount.String(), attributes.Currency,
+		attributes.EndToEndReference, attributes.ProcessingDate,
+	})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// paymentAmounts is a convenience function that returns every amount
+// held in Payment, mapped by the json name of its attribute: the
+// payment amount, the sender and receiver charges and the original fx
+// amount, in that order.
+func paymentAmounts(p *Payment) ([]string, []*Amount) {
+	charges := p.chargesInformation()
+	names, amounts := []string{"amount"}, []*Amount{&p.Attributes.Amount}
+	for i := range charges.SenderCharges {
+		names = append(names, fmt.Sprintf("sender_charges[%d].amount", i))
+		amounts = append(amounts, &charges.SenderCharges[i].Amount)
+	}
+	names = append(names, "receiver_charges_amount", "fx.original_amount")
+	return names, append(amounts, &charges.ReceiverChargesAmount,
+		&p.fx().OriginalAmount)
+}
+
+// amountCurrencies is a convenience function that returns the currency
+// of every amount held in Payment, in the order of paymentAmounts.
+func amountCurrencies(p *Payment) []string {
+	charges := p.chargesInformation()
+	currencies := []string{p.Attributes.Currency}
+	for _, charge := range charges.SenderCharges {
+		currencies = append(currencies, charge.Currency)
+	}
+	return append(currencies, charges.ReceiverChargesCurrency,
+		p.fx().OriginalCurrency)
+}
+
+// checkAmountPrecision is a convenience function that ascertains every
+// amount in Payment has no more decimal places than its currency has
+// (see currencyDecimals), none for currencies without minor units such
+// as JPY, so that all amounts are stored in the same two decimal form.
+// An AmountError is returned for the first amount that does not.
+func checkAmountPrecision(p *Payment) error {
+	names, amounts := paymentAmounts(p)
+	currencies := amountCurrencies(p)
+	for i, amount := range amounts {
+		decimals := currencyDecimals(currencies[i])
+		if amount.SignificantDecimals() <= decimals {
+			continue
+		}
+		reason := fmt.Sprintf("more than %d decimal places for %s", decimals, currencies[i])
+		if decimals == 0 {
+			reason = currencies[i] + " has no minor units"
+		} else if currencies[i] == "" {
+			reason = "more than two decimal places"
+		}
+		return &AmountError{Value: amount.String(), Reason: reason, Attribute: names[i]}
+	}
+	return nil
+}
+
+// checkAmountSigns is a convenience function that ascertains the
+// amount of Payment is positive and that none of its charges are
+// negative, although they may be zero. A ValidationError naming the
+// first unacceptable amount is returned.
+func checkAmountSigns(p *Payment) error {
+	attributes := &p.Attributes
+	if attributes.Amount.Sign() <= 0 {
+		return &ValidationError{Attribute: "amount",
+			Reason: fmt.Sprintf("%s is not positive", attributes.Amount)}
+	}
+	charges := p.chargesInformation()
+	for i, charge := range charges.SenderCharges {
+		if charge.Amount.Sign() < 0 {
+			return &ValidationError{Attribute: fmt.Sprintf("sender_charges[%d].amount", i),
+				Reason: fmt.Sprintf("%s is negative", charge.Amount)}
+		}
+	}
+	if charges.ReceiverChargesAmount.Sign() < 0 {
+		return &ValidationError{Attribute: "receiver_charges_amount",
+			Reason: fmt.Sprintf("%s is negative", charges.ReceiverChargesAmount)}
+	}
+	return nil
+}
+
+// checkPaymentValues is a convenience function that ascertains the
+// populated attributes of Payment hold acceptable values. It returns
+// the ValidationErrors of every check that found an unacceptable
+// value.
+func checkPaymentValues(p *Payment) error {
+	return collectValidationErrors(
+		checkAmountPrecision(p),
+		checkAmountSigns(p),
+		checkProcessingDate(p),
+		checkChargesInformation(p),
+		checkSenderCharges(p),
+		checkAccountType(p),
+		checkFxConsistency(p))
+}
+
+// The account types of the beneficiary party of a payment, the kind of
+// holder of the account of its account number. AccountTypePersonal,
+// the default, is an account held by an individual, and
+// AccountTypeBusiness one held by a company or other organisation.
+const (
+	AccountTypePersonal = 0
+	AccountTypeBusiness = 1
+)
+
+// checkAccountType is a convenience function that ascertains the
+// account type of the beneficiary party of Payment is one of the
+// account types, AccountTypePersonal to AccountTypeBusiness. A
+// ValidationError is returned if it is not.
+func checkAccountType(p *Payment) error {
+	accountType := p.beneficiaryParty().AccountType
+	if accountType < AccountTypePersonal || accountType > AccountTypeBusiness {
+		return &ValidationError{Attribute: "account_type",
+			Reason: fmt.Sprintf("%d is not one of %d (personal) or %d (business)",
+				accountType, AccountTypePersonal, AccountTypeBusiness)}
+	}
+	return nil
+}
+
+// bearerCodes are the scheme values of the bearer code of the charges
+// of a payment: the charges are shared between the debtor and the
+// beneficiary, borne by the debtor, or borne by the beneficiary.
+var bearerCodes = []string{"SHAR", "OUR", "BEN"}
+
+// checkChargesInformation is a convenience function that ascertains
+// the charges information of Payment is coherent. The bearer code, if
+// populated, must be one of bearerCodes. Charges shared with SHAR must
+// state the currency of every charge, that of each sender charge and
+// of the receiver charges amount. A ValidationError is returned
+// describing the first inconsistency found.
+func checkChargesInformation(p *Payment) error {
+	charges := p.chargesInformation()
+	if charges.BearerCode == "" {
+		return nil
+	}
+	if err := checkOneOf("bearer_code", charges.BearerCode, bearerCodes); err != nil {
+		return err
+	}
+
+	if charges.BearerCode != "SHAR" {
+		return nil
+	}
+	for i, charge := range charges.SenderCharges {
+		if !charge.Amount.IsZero() && charge.Currency == "" {
+			return &ValidationError{Attribute: fmt.Sprintf("sender_charges[%d].currency", i),
+				Reason: "required for shared charges"}
+		}
+	}
+	if !charges.ReceiverChargesAmount.IsZero() && charges.ReceiverChargesCurrency == "" {
+		return &ValidationError{Attribute: "receiver_charges_currency",
+			Reason: "required for shared charges"}
+	}
+	return nil
+}
+
+// checkSenderCharges is a convenience function that ascertains each
+// sender charge of Payment names its currency by an ISO 4217 code, if
+// it names one, and that no currency is charged more than once. Two
+// charges in the same currency are refused rather than summed, as
+// which of them the sender meant cannot be told. A ValidationError is
+// collected for each charge that is not acceptable.
+func checkSenderCharges(p *Payment) error {
+	var errs []error
+	charged := map[string]int{}
+	for i, charge := range p.chargesInformation().SenderCharges {
+		attribute := fmt.Sprintf("sender_charges[%d].currency", i)
+		if charge.Currency == "" {
+			continue
+		} else if !currencyCodePattern.MatchString(charge.Currency) {
+			errs = append(errs, &ValidationError{Attribute: attribute,
+				Reason: fmt.Sprintf("%q is not an ISO 4217 currency code", charge.Currency)})
+		} else if first, ok := charged[charge.Currency]; ok {
+			errs = append(errs, &ValidationError{Attribute: attribute,
+				Reason: fmt.Sprintf("%s is already charged by sender_charges[%d]", charge.Currency, first)})
+		} else {
+			charged[charge.Currency] = i
+		}
+	}
+	return collectValidationErrors(errs...)
+}
+
+// checkOneOf is a convenience function that ascertains the value in
+// value of the attribute named attribute is one of allowed. A
+// ValidationError listing them is returned if it is not.
+func checkOneOf(attribute string, value string, allowed []string) error {
+	for _, candidate := range allowed {
+		if value == candidate {
+			return nil
+		}
+	}
+	return &ValidationError{Attribute: attribute,
+		Reason: fmt.Sprintf("%q is not one of %s", value, strings.Join(allowed, ", "))}
+}
+
+// defaultSchemePaymentTypes are the scheme payment types a payment may
+// have unless others are configured: paid at once, on a later date, or
+// as part of a standing order.
+var defaultSchemePaymentTypes = []string{"ImmediatePayment", "ForwardDatedPayment", "StandingOrder"}
+
+// defaultSchemePaymentSubTypes are the scheme payment sub types, the
+// channels the payment was instructed through, a payment may have
+// unless others are configured.
+var defaultSchemePaymentSubTypes = []string{"TelephoneBanking", "InternetBanking",
+	"BranchInstruction", "Letter", "Email", "MobilePaymentsService"}
+
+// checkSchemePaymentTypes is a convenience function that ascertains the
+// scheme payment type and sub type of Payment, if populated, are among
+// those in types and subTypes. A ValidationError is returned if either
+// is not.
+func checkSchemePaymentTypes(p *Payment, types []string, subTypes []string) error {
+	attributes := &p.Attributes
+	if attributes.SchemePaymentType != "" {
+		if err := checkOneOf("scheme_payment_type", attributes.SchemePaymentType, types); err != nil {
+			return err
+		}
+	}
+	if attributes.SchemePaymentSubType != "" {
+		return checkOneOf("scheme_payment_sub_type", attributes.SchemePaymentSubType, subTypes)
+	}
+	return nil
+}
+
+// checkAmountLimit is a convenience function that ascertains the amount
+// of Payment does not exceed the limit for its currency in limits. The
+// limit for a currency without its own entry is that of the "*" entry,
+// and a payment with neither is unlimited. A ValidationError is
+// returned if the amount exceeds the limit.
+func checkAmountLimit(p *Payment, limits map[string]Amount) error {
+	attributes := &p.Attributes
+	limit, ok := limits[attributes.Currency]
+	if !ok {
+		if limit, ok = limits["*"]; !ok {
+			return nil
+		}
+	}
+	if attributes.Amount.Cmp(limit) > 0 {
+		return &ValidationError{Attribute: "amount",
+			Reason: fmt.Sprintf("%s %s exceeds the limit of %s",
+				attributes.Amount, attributes.Currency, limit)}
+	}
+	return nil
+}
+
+// ProcessingDateLayout is the layout, in the form understood by
+// time.Parse, of the processing date of a payment record.
+const ProcessingDateLayout = "2006-01-02"
+
+// checkProcessingDate is a convenience function that ascertains the
+// processing date of Payment, if populated, is a valid calendar date
+// in YYYY-MM-DD form. A ValidationError is returned if it is not.
+func checkProcessingDate(p *Payment) error {
+	date := p.Attributes.ProcessingDate
+	if date == "" {
+		return nil
+	}
+	if _, err := time.Parse(ProcessingDateLayout, date); err != nil {
+		return &ValidationError{Attribute: "processing_date",
+			Reason: fmt.Sprintf("%q is not a date in YYYY-MM-DD form", date)}
+	}
+	return nil
+}
+
+// checkProcessingDateWindow is a convenience function that ascertains
+// the processing date of Payment falls within the window allowed
+// relative to the date in today. If rejectPast is set dates before
+// today are refused, and if maxFutureDays is positive dates more than
+// that many days after today are refused. The processing date must
+// already have passed checkProcessingDate. A ValidationError is
+// returned if the date falls outside the window.
+func checkProcessingDateWindow(p *Payment, today time.Time, rejectPast bool, maxFutureDays int) error {
+	date, err := time.Parse(ProcessingDateLayout, p.Attributes.ProcessingDate)
+	if err != nil {
+		return nil
+	}
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+	if rejectPast && date.Before(today) {
+		return &ValidationError{Attribute: "processing_date",
+			Reason: fmt.Sprintf("%s is in the past", p.Attributes.ProcessingDate)}
+	}
+	if maxFutureDays > 0 && date.After(today.AddDate(0, 0, maxFutureDays)) {
+		return &ValidationError{Attribute: "processing_date",
+			Reason: fmt.Sprintf("%s is more than %d days in the future",
+				p.Attributes.ProcessingDate, maxFutureDays)}
+	}
+	return nil
+}
+
+// fxRelativeTolerance is the relative difference allowed between the
+// original fx amount and the payment amount converted at the exchange
+// rate, to allow for rounding of the exchange rate.
+var fxRelativeTolerance = big.NewRat(1, 10000)
+
+// fxMinimumTolerance is the smallest absolute difference allowed
+// between the original fx amount and the converted payment amount,
+// one minor unit.
+var fxMinimumTolerance = big.NewRat(1, 100)
+
+// checkFxConsistency is a convenience function that ascertains the fx
+// block of Payment is coherent. An entirely empty fx block is
+// acceptable. Otherwise the original currency must be given and differ
+// from the payment currency, the exchange rate must be a positive
+// decimal and the payment amount converted at the exchange rate must
+// match the original amount to within fxRelativeTolerance (or
+// fxMinimumTolerance if that is larger). The exchange rate is the
+// number of units of the original currency per unit of the payment
+// currency. A ValidationError is returned describing the first
+// inconsistency found.
+func checkFxConsistency(p *Payment) error {
+	fx := p.fx()
+	if fx.ContractReference == "" && fx.ExchangeRate == "" &&
+		fx.OriginalAmount.IsZero() && fx.OriginalCurrency == "" {
+		return nil
+	}
+
+	if fx.OriginalCurrency == "" {
+		return &ValidationError{Attribute: "fx", Reason: "original_currency is required"}
+	}
+	if fx.OriginalCurrency == p.Attributes.Currency {
+		return &ValidationError{Attribute: "fx",
+			Reason: "original_currency must differ from the payment currency"}
+	}
+
+	rate, err := ParseAmount(fx.ExchangeRate)
+	if err != nil || rate.Sign() <= 0 {
+		return &ValidationError{Attribute: "fx",
+			Reason: fmt.Sprintf("exchange_rate %q is not a positive decimal", fx.ExchangeRate)}
+	}
+
+	converted := new(big.Rat).Mul(p.Attributes.Amount.Rat(), rate.Rat())
+	difference := new(big.Rat).Sub(converted, fx.OriginalAmount.Rat())
+	tolerance := new(big.Rat).Mul(fx.OriginalAmount.Rat(), fxRelativeTolerance)
+	tolerance.Abs(tolerance)
+	if tolerance.Cmp(fxMinimumTolerance) < 0 {
+		tolerance = fxMinimumTolerance
+	}
+	if difference.Abs(difference).Cmp(tolerance) > 0 {
+		return &ValidationError{Attribute: "fx",
+			Reason: fmt.Sprintf("amount %s at exchange_rate %s is %s, not original_amount %s",
+				p.Attributes.Amount, fx.ExchangeRate, converted.FloatString(2),
+				fx.OriginalAmount)}
+	}
+	return nil
+}
+
+// returnPaymentCount is a convenience function to ascertain the number
+// of payment records defined by the Payment ID field. This function
+// should only return 0 or 1 in valid cases (though it makes no
+// distinction on validity). If -1 is returned an error occurred in
+// the query and the error is returned.
+func returnPaymentCount(db *mongoStore, p *Payment) (int, error) {
+	query := db.C(db.collection).Find(bson.M{"_id": p.ID})
+	count, err := query.Count()
+	if err != nil {
+		return -1, err
+	}
+	return count, nil
+}
+
+// returnPaymentCountAndQuery is a convenience function to ascertain the
+// number of payment records defined by the Payment ID field. This
+// function should only return 0 or 1 in valid cases (though it makes
+// no distinction on validity). If -1 is returned an error occurred in
+// the query and the error is returned. An additional object, if no
+// errors occur is returned: the Query object created by the function.
+// If the OrganisationID in Payment is populated only payment records of
+// that organisation are counted.
+func returnPaymentCountAndQuery(db *mongoStore, p *Payment) (*mgo.Query, int, error) {
+	selector := bson.M{"_id": p.ID}
+	if p.OrganisationID != "" {
+		selector["organisation_id"] = p.OrganisationID
+	}
+	query := db.C(db.collection).Find(selector)
+	count, err := query.Count()
+	if err != nil {
+		return nil, -1, err
+	}
+	return query, count, nil
+}
+
+// modelCreateNote will store the Note in the backing data store.
+func (note *Note) modelCreateNote(db *mongoStore) error {
+	return db.C(db.notesCollection()).Insert(note)
+}
+
+// modelGetNotes will retrieve the page of the notes on the payment
+// record with the Payment ID in paymentID from the backing data store,
+// in the order they were made, skipping offset of them and no more
+// than limit. The total number of notes on the payment record is also
+// returned.
+func modelGetNotes(db *mongoStore, paymentID string, offset int, limit int) ([]Note, int, error) {
+	notes := []Note{}
+	query := db.C(db.notesCollection()).Find(bson.M{"payment_id": paymentID})
+	total, err := query.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	err = query.Sort("created_at", "_id").Skip(offset).Limit(limit).All(&notes)
+	return notes, total, err
+}
+
+// modelDeleteNote will remove the note with the ID in id on the payment
+// record with the Payment ID in paymentID from the backing data store.
+// mgo.ErrNotFound is returned if there is no such note.
+func modelDeleteNote(db *mongoStore, paymentID string, id bson.ObjectId) error {
+	return db.C(db.notesCollection()).Remove(bson.M{"_id": id, "payment_id": paymentID})
+}
+
+// modelLockPayment will take the PaymentLock on its payment record in
+// the backing data store, unless a lock is held that has not expired
+// by now, in which case ErrPaymentLocked is returned.
+func (lock *PaymentLock) modelLockPayment(db *mongoStore, now time.Time) error {
+	err := db.C(db.locksCollection()).Insert(lock)
+	if mgo.IsDup(err) {
+		err = db.C(db.locksCollection()).Update(bson.M{
+			"_id": lock.PaymentID, "expires_at": bson.M{"$lte": now},
+		}, lock)
+		if err == mgo.ErrNotFound {
+			return ErrPaymentLocked
+		}
+	}
+	return err
+}
+
+// modelRenewLock will replace the lock held with the token of the
+// PaymentLock on its payment record in the backing data store by the
+// PaymentLock, unless it has expired by now. mgo.ErrNotFound is
+// returned if no such lock is held.
+func (lock *PaymentLock) modelRenewLock(db *mongoStore, now time.Time) error {
+	return db.C(db.locksCollection()).Update(bson.M{
+		"_id": lock.PaymentID, "token": lock.Token, "expires_at": bson.M{"$gt": now},
+	}, lock)
+}
+
+// modelGetLock will retrieve the lock held on the payment record with
+// the Payment ID in paymentID from the backing data store, unless it
+// has expired by now. mgo.ErrNotFound is returned if none is held.
+func modelGetLock(db *mongoStore, paymentID string, now time.Time) (PaymentLock, error) {
+	var lock PaymentLock
+	err := db.C(db.locksCollection()).Find(bson.M{
+		"_id": paymentID, "expires_at": bson.M{"$gt": now},
+	}).One(&lock)
+	return lock, err
+}
+
+// modelUnlockPayment will release the lock held with the token in
+// token on the payment record with the Payment ID in paymentID, unless
+// it has expired by now. mgo.ErrNotFound is returned if no such lock is
+// held.
+func modelUnlockPayment(db *mongoStore, paymentID string, token string, now time.Time) error {
+	return db.C(db.locksCollection()).Remove(bson.M{
+		"_id": paymentID, "token": token, "expires_at": bson.M{"$gt": now},
+	})
+}
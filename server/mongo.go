@@ -0,0 +1,242 @@
+// mongo.go - Connections to the backing MongoDB database, with
+// credentials and TLS.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MongoAuth holds the credentials and TLS settings of the connection
+// to the backing database, overriding those of a connection URI where
+// they are set. Source names the database the user is defined in. With
+// TLS set the connection is encrypted and the certificate of the
+// database verified, against the CA certificates of the PEM file named
+// by CAFile if it is set and otherwise those of the system.
+type MongoAuth struct {
+	Username string
+	Password string
+	Source   string
+	TLS      bool
+	CAFile   string
+}
+
+// mongoTLSOptions are the options of a connection URI enabling TLS.
+// mgo.ParseURL accepts neither, so they are taken out of the URI
+// first, along with tlsCAFile.
+var mongoTLSOptions = map[string]bool{"ssl": true, "tls": true}
+
+// mongoDialInfo returns the details of the connection to the backing
+// database given by host and auth. A host starting with mongodb:// is
+// a connection URI of the form
+// mongodb://[user:pass@]host1[:port1][,host2,...][/database][?options]
+// with the options mgo.ParseURL accepts, such as authSource and
+// replicaSet, as well as ssl or tls and tlsCAFile. Any other host is a
+// plain address:port, or a comma separated list of them, without
+// credentials. Errors never include the password.
+func mongoDialInfo(host string, auth MongoAuth) (*mgo.DialInfo, error) {
+	info := &mgo.DialInfo{Addrs: strings.Split(host, ",")}
+	if strings.HasPrefix(host, "mongodb://") {
+		uri, useTLS, caFile, err := extractTLSOptions(host)
+		if err != nil {
+			return nil, err
+		}
+		if info, err = mgo.ParseURL(uri); err != nil {
+			return nil, fmt.Errorf("Invalid MongoDB connection URI: %s", err)
+		}
+		auth.TLS = auth.TLS || useTLS
+		if auth.CAFile == "" {
+			auth.CAFile = caFile
+		}
+	}
+	info.Timeout = mongoDialTimeout
+
+	if auth.Username != "" {
+		info.Username, info.Password = auth.Username, auth.Password
+	}
+	if auth.Source != "" {
+		info.Source = auth.Source
+	}
+	if auth.TLS || auth.CAFile != "" {
+		config, err := mongoTLSConfig(auth.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: mongoDialTimeout}
+			return tls.DialWithDialer(dialer, "tcp", addr.String(), config)
+		}
+	}
+	return info, nil
+}
+
+// extractTLSOptions is a convenience function that takes the TLS
+// options out of the connection URI in uri, returning the URI without
+// them, whether they enable TLS and the CA file they name.
+func extractTLSOptions(uri string) (string, bool, string, error) {
+	query := strings.Index(uri, "?")
+	if query < 0 {
+		return uri, false, "", nil
+	}
+
+	useTLS, caFile := false, ""
+	var kept []string
+	for _, option := range strings.Split(uri[query+1:], "&") {
+		name, value, _ := strings.Cut(option, "=")
+		switch {
+		case mongoTLSOptions[name]:
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return "", false, "", fmt.Errorf(
+					"Invalid MongoDB connection URI: bad value for %s: %s", name, value)
+			}
+			useTLS = useTLS || enabled
+		case name == "tlsCAFile":
+			caFile = value
+		default:
+			kept = append(kept, option)
+		}
+	}
+	if len(kept) == 0 {
+		return uri[:query], useTLS, caFile, nil
+	}
+	return uri[:query+1] + strings.Join(kept, "&"), useTLS, caFile, nil
+}
+
+// mongoTLSConfig is a convenience function that returns the TLS
+// configuration of connections to the backing database, trusting the
+// CA certificates of the PEM file named by caFile, or those of the
+// system if it is empty.
+func mongoTLSConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the database CA file: %s", err)
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No CA certificates found in %s", caFile)
+	}
+	return config, nil
+}
+
+// dialMongo connects to the backing database described by info. If
+// the connection fails the error tells whether the database could not
+// be found, its TLS handshake or the authentication failed, rather
+// than only that no server was reachable.
+func dialMongo(info *mgo.DialInfo) (*mgo.Session, error) {
+	dial := info.DialServer
+	if dial == nil {
+		dial = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr.String(), mongoDialTimeout)
+		}
+	}
+	var mu sync.Mutex
+	var dialErr error
+	recorded := *info
+	recorded.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			mu.Lock()
+			dialErr = err
+			mu.Unlock()
+		}
+		return conn, err
+	}
+
+	session, err := mgo.DialWithInfo(&recorded)
+	if err != nil {
+		mu.Lock()
+		defer mu.Unlock()
+		return nil, describeMongoDialError(err, dialErr, info.Addrs)
+	}
+	return session, nil
+}
+
+// describeMongoDialError is a convenience function that returns the
+// error of a failed connection to the backing database at addrs, given
+// the error err of mgo and the last error in dialErr of connecting to
+// one of its servers, naming the aspect of the connection that failed.
+// mgo resolves the addresses of the servers itself, so a failed lookup
+// leaves dialErr empty and is found by looking the addresses up again.
+func describeMongoDialError(err error, dialErr error, addrs []string) error {
+	if isMongoAuthError(err) {
+		return fmt.Errorf("Authentication with the database failed: %s", err)
+	}
+	if dialErr == nil {
+		for _, addr := range addrs {
+			host, _, splitErr := net.SplitHostPort(addr)
+			if splitErr != nil {
+				host = addr
+			}
+			if _, lookupErr := net.LookupHost(host); lookupErr != nil {
+				dialErr = lookupErr
+				break
+			}
+		}
+	}
+
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case dialErr == nil:
+		return fmt.Errorf("Cannot connect to the database: %s", err)
+	case errors.As(dialErr, &dnsErr):
+		return fmt.Errorf("Cannot find the database: %s", dialErr)
+	case errors.As(dialErr, &recordErr), errors.As(dialErr, &unknownAuthority),
+		errors.As(dialErr, &hostnameErr), errors.As(dialErr, &invalidErr),
+		strings.HasPrefix(dialErr.Error(), "tls: "):
+		return fmt.Errorf("TLS handshake with the database failed: %s", dialErr)
+	}
+	return fmt.Errorf("Cannot connect to the database: %s", dialErr)
+}
+
+// isMongoAuthError is a convenience function that returns true if err
+// is the refusal of the credentials of a connection by the database.
+func isMongoAuthError(err error) bool {
+	if e, ok := err.(*mgo.QueryError); ok && e.Code == 18 {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "authentication failed") ||
+		strings.Contains(message, "sasl authentication")
+}
+
+// redactMongoURI is a convenience function that returns the
+// connection URI in uri with its password masked, fit to be logged.
+// Plain hosts carry no credentials and are returned as they are.
+func redactMongoURI(uri string) string {
+	scheme := strings.Index(uri, "://")
+	if scheme < 0 {
+		return uri
+	}
+	rest := uri[scheme+3:]
+	authority := len(rest)
+	if end := strings.IndexAny(rest, "/?"); end >= 0 {
+		authority = end
+	}
+	at := strings.LastIndex(rest[:authority], "@")
+	if at < 0 {
+		return uri
+	}
+	user, _, hasPassword := strings.Cut(rest[:at], ":")
+	if !hasPassword {
+		return uri
+	}
+	return uri[:scheme+3] + user + ":xxxxx" + rest[at:]
+}
@@ -0,0 +1,39 @@
+//go:build integration
+
+// mongo_integration_test.go - Run with go test -tags integration
+// against the database at PAYMENT_TEST_MONGO_URI, such as an
+// authenticated TLS cluster, with the credentials and TLS settings of
+// the PAYMENT_MONGO_* environment variables.
+
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+// Test the server connects and authenticates to the database.
+func TestMongoConnection(t *testing.T) {
+	uri := os.Getenv("PAYMENT_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("PAYMENT_TEST_MONGO_URI is not set")
+	}
+	info, err := mongoDialInfo(uri, MongoAuth{
+		Username: os.Getenv("PAYMENT_MONGO_USERNAME"),
+		Password: os.Getenv("PAYMENT_MONGO_PASSWORD"),
+		Source:   os.Getenv("PAYMENT_MONGO_AUTH_SOURCE"),
+		TLS:      os.Getenv("PAYMENT_MONGO_TLS") == "true",
+		CAFile:   os.Getenv("PAYMENT_MONGO_CA_FILE"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := dialMongo(info)
+	if err != nil {
+		t.Fatalf("Cannot connect to %s: %s", redactMongoURI(uri), err)
+	}
+	defer session.Close()
+	if err := session.Ping(); err != nil {
+		t.Errorf("Expected the database to answer. Got %s", err)
+	}
+}
@@ -0,0 +1,231 @@
+// notes.go - Free text investigation notes attached to payment records
+// without changing them.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNoteLength is the most characters the text of a note may hold.
+const maxNoteLength = 4000
+
+// ErrNoteNotFound is returned when no note with the requested ID is on
+// the payment record.
+var ErrNoteNotFound = errors.New("Note not found")
+
+// notesCollection returns the name of the collection the notes on
+// payment records are kept in.
+func (db *mongoStore) notesCollection() string {
+	return db.collection + "_notes"
+}
+
+// Note is a free text note on a payment record, such as made by
+// operations investigating it, kept apart from the payment record so
+// that it is not changed by the note and the note survives its
+// updates. Notes are removed along with the payment record they are on
+// when it is deleted.
+type Note struct {
+	ID             bson.ObjectId `bson:"_id" json:"id"`
+	PaymentID      string        `bson:"payment_id" json:"payment_id"`
+	OrganisationID string        `bson:"organisation_id" json:"-"`
+	Text           string        `bson:"text" json:"text"`
+	Author         string        `bson:"author" json:"author"`
+	CreatedAt      time.Time     `bson:"created_at" json:"created_at"`
+}
+
+// Notes is a page of the notes on a payment record, oldest first.
+type Notes struct {
+	N     []Note    `json:"data"`
+	Meta  *PageMeta `json:"meta,omitempty"`
+	Links struct {
+		Self string `json:"self"`
+		Next string `json:"next,omitempty"`
+	} `json:"links"`
+}
+
+// check ascertains the Note has a text of no more than maxNoteLength
+// characters and an author of no more than maxLength, holding only
+// characters that render, lines and tabs aside in the text. A
+// MissingAttributesError or ValidationError is collected for each that
+// does not.
+func (note *Note) check(maxLength int) error {
+	var errs []error
+	var missing []string
+	for _, attribute := range []struct {
+		name      string
+		value     string
+		maxLength int
+		allowed   string
+	}{{"text", note.Text, maxNoteLength, "\n\r\t"}, {"author", note.Author, maxLength, ""}} {
+		if strings.TrimSpace(attribute.value) == "" {
+			missing = append(missing, attribute.name)
+			continue
+		}
+		if length := utf8.RuneCountInString(attribute.value); length > attribute.maxLength {
+			errs = append(errs, &ValidationError{Attribute: attribute.name,
+				Reason: fmt.Sprintf("%d characters exceed the limit of %d", length, attribute.maxLength)})
+			continue
+		}
+		for _, r := range attribute.value {
+			if !unicode.IsGraphic(r) && !strings.ContainsRune(attribute.allowed, r) {
+				errs = append(errs, &ValidationError{Attribute: attribute.name,
+					Reason: fmt.Sprintf("the character %U is not allowed", r)})
+				break
+			}
+		}
+	}
+	if len(missing) > 0 {
+		errs = append([]error{&MissingAttributesError{Attributes: missing}}, errs...)
+	}
+	return collectValidationErrors(errs...)
+}
+
+// initializeNoteRoutes sets up the URLs of the notes on payment
+// records on router, which require an API key if any are configured.
+func (server *Server) initializeNoteRoutes(router *mux.Router) {
+	router.HandleFunc("/payment/{id}/notes",
+		server.authenticate(server.createNote)).Methods("POST")
+	router.HandleFunc("/payment/{id}/notes",
+		server.authenticate(server.getNotes)).Methods("GET")
+	router.HandleFunc("/payment/{id}/notes/{note_id}",
+		server.authenticate(server.deleteNote)).Methods("DELETE")
+}
+
+// createNote is the entry-point dispatcher for the notes made on
+// payment records. It responds to the URL payment/{id}/notes and an
+// appropriate POST request carrying the text and author of the note,
+// and emits the Note with StatusCreated. A note with fields other than
+// those, or without either, is refused. Notes on payment records that
+// do not exist, or of organisations other than that of the API key,
+// are not found.
+func (server *Server) createNote(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	defer r.Body.Close()
+
+	var body struct {
+		Text   string `json:"text"`
+		Author string `json:"author"`
+	}
+	if err := decoder.Decode(&body); err != nil {
+		respondWithDecodeError(w, err, "Invalid note request")
+		return
+	}
+	note := Note{Text: body.Text, Author: body.Author}
+	if err := note.check(server.maxTextLength()); err != nil {
+		respondWithInvalid(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	payment, ok := server.findPayment(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	note.ID = bson.NewObjectId()
+	note.PaymentID, note.OrganisationID = payment.ID, payment.OrganisationID
+	note.CreatedAt = server.now().UTC()
+	err := server.storage(r.Context(), "createNote", payment.ID, func() error {
+		return note.modelCreateNote(server.mongo)
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respondWith(w, http.StatusCreated, note, negotiatedType(w))
+}
+
+// getNotes is the entry-point dispatcher for the retrieval of the
+// notes on payment records. It responds to the URL payment/{id}/notes
+// and an appropriate GET request with the notes on the payment record
+// in the order they were made, paged with limit and offset as the
+// payments collection is (see getPayments). The notes on payment
+// records that do not exist, or of organisations other than that of
+// the API key, are not found.
+func (server *Server) getNotes(w http.ResponseWriter, r *http.Request) {
+	limit, err := server.pageLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset := 0
+	if value := r.FormValue("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest,
+				fmt.Sprintf("Invalid offset %s", value))
+			return
+		}
+	}
+	payment, ok := server.findPayment(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	var notes Notes
+	var total int
+	err = server.storage(r.Context(), "getNotes", payment.ID, func() (err error) {
+		notes.N, total, err = modelGetNotes(server.mongo, payment.ID, offset, limit)
+		return
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	notes.Meta = newPageMeta(limit, offset, total)
+	notes.Links.Self = apiLink("/payment/" + payment.ID + "/notes")
+	if end := offset + len(notes.N); end < total {
+		next := r.URL.Query()
+		next.Set("limit", strconv.Itoa(limit))
+		next.Set("offset", strconv.Itoa(end))
+		notes.Links.Next = notes.Links.Self + "?" + next.Encode()
+	}
+	respondWith(w, http.StatusOK, notes, negotiatedType(w))
+}
+
+// deleteNote is the entry-point dispatcher for the removal of notes on
+// payment records. It responds to the URL payment/{id}/notes/{note_id}
+// and an appropriate DELETE request. Notes that do not exist, or on
+// payment records of organisations other than that of the API key, are
+// not found.
+func (server *Server) deleteNote(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	payment, ok := server.findPayment(w, r, vars["id"])
+	if !ok {
+		return
+	}
+	if !bson.IsObjectIdHex(vars["note_id"]) {
+		respondWithError(w, http.StatusNotFound, ErrNoteNotFound.Error())
+		return
+	}
+
+	attempt := 0
+	err := server.storage(r.Context(), "deleteNote", payment.ID, func() error {
+		attempt++
+		err := modelDeleteNote(server.mongo, payment.ID, bson.ObjectIdHex(vars["note_id"]))
+		if err == mgo.ErrNotFound && attempt > 1 {
+			// An earlier attempt removed it, but its reply was lost.
+			return nil
+		}
+		return err
+	})
+	if err == mgo.ErrNotFound {
+		respondWithError(w, http.StatusNotFound, ErrNoteNotFound.Error())
+		return
+	} else if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respondWith(w, http.StatusOK, map[string]string{"result": "success"}, negotiatedType(w))
+}
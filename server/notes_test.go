@@ -0,0 +1,124 @@
+// notes_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Test notes are made on a payment, listed oldest first and paged,
+// survive updates of the payment and are removed one by one, while
+// notes on payments that do not exist are not found and notes without
+// an author refused.
+func TestNoteLifecycle(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	url := "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43/notes"
+	makeNote := func(t *testing.T, url string, body string) *httptest.ResponseRecorder {
+		req, _ := newJSONRequest("POST", url, strings.NewReader(body))
+		return executeRequest(req)
+	}
+	listNotes := func(t *testing.T, query string) Notes {
+		req, _ := http.NewRequest("GET", url+query, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var notes Notes
+		json.Unmarshal(response.Body.Bytes(), &notes)
+		return notes
+	}
+
+	response := makeNote(t, url, `{"text": "Chased the debtor bank", "author": "ops"}`)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	var made []Note
+	for _, text := range []string{"Chased the debtor bank", "Funds returned\nby the beneficiary bank"} {
+		response = makeNote(t, url, `{"text": `+strconv.Quote(text)+`, "author": "ops"}`)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+		var note Note
+		json.Unmarshal(response.Body.Bytes(), &note)
+		if note.Text != text || note.Author != "ops" || !note.ID.Valid() {
+			t.Errorf("Expected the note to be made. Got %s", response.Body.String())
+		}
+		made = append(made, note)
+	}
+	response = makeNote(t, url, `{"text": "Unsigned"}`)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	response = makeNote(t, url, `{"text": "Misplaced", "author": "ops", "amount": "1.00"}`)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req, _ = newJSONRequest("PUT", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", bytes.NewBuffer(payload))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	notes := listNotes(t, "")
+	if len(notes.N) != 2 || notes.N[0].ID != made[0].ID || notes.N[1].ID != made[1].ID {
+		t.Fatalf("Expected both notes oldest first after the update. Got %+v", notes.N)
+	}
+	notes = listNotes(t, "?limit=1")
+	if len(notes.N) != 1 || notes.N[0].ID != made[0].ID || notes.Links.Next == "" ||
+		notes.Meta == nil || notes.Meta.TotalCount == nil || *notes.Meta.TotalCount != 2 {
+		t.Errorf("Expected the first of two notes to be paged. Got %+v", notes)
+	}
+
+	req, _ = http.NewRequest("DELETE", url+"/"+made[0].ID.Hex(), nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	req, _ = http.NewRequest("DELETE", url+"/"+made[0].ID.Hex(), nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	req, _ = http.NewRequest("DELETE", url+"/not-a-note", nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	if notes = listNotes(t, ""); len(notes.N) != 1 || notes.N[0].ID != made[1].ID {
+		t.Errorf("Expected only the second note to remain. Got %+v", notes.N)
+	}
+}
+
+// Test the notes on a payment are removed when it is deleted, so that
+// a payment created again with the same Payment ID has none, and when
+// payments are purged.
+func TestNotesCascadeOnDelete(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	url := "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	create := func(t *testing.T) {
+		req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+		checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+		req, _ = newJSONRequest("POST", url+"/notes",
+			strings.NewReader(`{"text": "Held for review", "author": "ops"}`))
+		checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	}
+	count := func(t *testing.T) int {
+		n, err := server.DB.C(server.mongo.notesCollection()).Find(nil).Count()
+		if err != nil {
+			t.Fatalf("Counting the notes failed: %s", err)
+		}
+		return n
+	}
+
+	create(t)
+	req, _ := http.NewRequest("DELETE", url, nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	req, _ = http.NewRequest("GET", url+"/notes", nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	if n := count(t); n != 0 {
+		t.Errorf("Expected the notes to be removed with the payment. Got %d", n)
+	}
+
+	create(t)
+	req, _ = http.NewRequest("GET", url+"/notes", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var notes Notes
+	json.Unmarshal(response.Body.Bytes(), &notes)
+	if len(notes.N) != 1 {
+		t.Errorf("Expected only the note made since. Got %+v", notes.N)
+	}
+	clearTable()
+	if n := count(t); n != 0 {
+		t.Errorf("Expected the notes to be purged with the payments. Got %d", n)
+	}
+}
@@ -0,0 +1,82 @@
+// openapi.go - The OpenAPI description of the server and its Swagger
+// UI.
+
+package server
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI 3 document describing every route of the
+// server, embedded from openapi.json.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// swaggerUIRelease is the release of the swagger-ui-dist package the
+// Swagger UI assets are loaded from on unpkg, pinned so that the page
+// does not change with the releases of the package.
+const swaggerUIRelease = "5.17.14"
+
+// docsAssetsPath is the URL the Swagger UI assets are served from when
+// DocsAssetsDir is set.
+const docsAssetsPath = "/docs/assets/"
+
+// docsPage is the Swagger UI page rendering openAPISpec, with the
+// Swagger UI assets loaded from the URL %[1]s.
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Payment server API</title>
+<link rel="stylesheet" href="%[1]sswagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="%[1]sswagger-ui-bundle.js"></script>
+<script>
+window.ui = SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+// initializeOpenAPIRoutes registers the OpenAPI document URL and, if
+// DocsUI is set, the Swagger UI URL, along with that of its assets if
+// DocsAssetsDir is set. None requires an API key.
+func (server *Server) initializeOpenAPIRoutes() {
+	server.Dispatch.HandleFunc("/openapi.json", getOpenAPISpec).Methods("GET")
+	if !server.DocsUI {
+		return
+	}
+	assets := "https://unpkg.com/swagger-ui-dist@" + swaggerUIRelease + "/"
+	if server.DocsAssetsDir != "" {
+		assets = docsAssetsPath
+		server.Dispatch.PathPrefix(docsAssetsPath).Handler(http.StripPrefix(docsAssetsPath,
+			http.FileServer(http.Dir(server.DocsAssetsDir)))).Methods("GET")
+	}
+	page := []byte(fmt.Sprintf(docsPage, assets))
+	server.Dispatch.HandleFunc("/docs", func(w http.ResponseWriter, r *http.Request) {
+		getDocs(w, r, page)
+	}).Methods("GET")
+}
+
+// getOpenAPISpec is the entry-point dispatcher for the OpenAPI
+// document. It responds to the URL openapi.json and an appropriate GET
+// request.
+func getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+// getDocs is the entry-point dispatcher for the Swagger UI. It responds
+// to the URL docs and an appropriate GET request with the docsPage in
+// page.
+func getDocs(w http.ResponseWriter, r *http.Request, page []byte) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(page)
+}
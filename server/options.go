@@ -0,0 +1,146 @@
+// options.go - OPTIONS responses generated from the route table.
+
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// methodContentTypes lists the request content types accepted by each
+// method that takes a request body.
+var methodContentTypes = map[string][]string{
+	"POST":  {"application/json"},
+	"PUT":   {"application/json"},
+	"PATCH": {MergePatchMediaType, JSONPatchMediaType},
+}
+
+// routeContentTypes lists the request content types accepted by the
+// routes that accept others than their method, keyed by method and
+// path template without the prefix of its version.
+var routeContentTypes = map[string][]string{
+	"POST /admin/import":           {"application/json", "application/x-ndjson"},
+	"POST /payment":                {"application/json", MsgpackMediaType},
+	"POST /payment/{id}/anonymise": nil,
+	"POST /payment/{id}/lock":      nil,
+	"POST /payments/reconcile":     {"application/json", "text/csv"},
+	"PUT /payment/{id}":            {"application/json", MsgpackMediaType},
+}
+
+// acceptedContentTypes returns the request content types accepted by
+// the route of method and the path template in path, of any version,
+// or nil if it takes no request body.
+func acceptedContentTypes(method string, path string) []string {
+	if contentTypes, ok := routeContentTypes[method+" "+unversionedPath(path)]; ok {
+		return contentTypes
+	}
+	return methodContentTypes[method]
+}
+
+// routeQueryParameters documents the query parameters accepted by
+// each route, keyed by method and path template without the prefix of
+// its version.
+var routeQueryParameters = map[string][]string{
+	"GET /payments": {"ids", "currency", "min_amount", "max_amount",
+		"account_number", "status", "include_archived", "limit", "offset", "sort"},
+	"POST /payment":               {"hold_until_processing_date"},
+	"GET /payment/{id}":           {"include_archived"},
+	"GET /payment/{id}/converted": {"currency"},
+	"PUT /payment/{id}":           {"include_changes"},
+	"PATCH /payment/{id}":         {"include_changes"},
+	"GET /payment/{id}/notes":     {"limit", "offset"},
+	"POST /payment/{id}/lock":     {"ttl"},
+	"GET /payments/due":           {"date", "status", "limit", "offset", "sort"},
+	"GET /payments/changes":       {"since", "limit"},
+	"GET /payments/ws":            {"organisation_id", "event_types"},
+	"GET /organisations":          {"after", "limit", "counts"},
+	"GET /organisations/{org}/summary": {"processing_date_from",
+		"processing_date_to"},
+	"POST /payments/batch":   {"atomic", "hold_until_processing_date"},
+	"GET /payments/batch":    {"ids"},
+	"DELETE /payments/batch": {"ids"},
+	"DELETE /payments": {"organisation_id", "processing_date_from",
+		"processing_date_to", "dry_run"},
+	"DELETE /admin/payments": {"confirm", "organisation_id"},
+	"POST /admin/archive":    {"cutoff"},
+	"POST /admin/import":     {"strict"},
+	"GET /admin/export":      {"format"},
+	"GET /admin/integrity": {"organisation_id", "processing_date_from",
+		"processing_date_to", "fix"},
+}
+
+// Options is the description of a URL returned to JSON-aware clients
+// making an OPTIONS request.
+type Options struct {
+	Methods         []string            `json:"methods"`
+	ContentTypes    map[string][]string `json:"content_types"`
+	QueryParameters map[string][]string `json:"query_parameters"`
+}
+
+// initializeOptionsRoutes registers an OPTIONS method for every path
+// template already in the route table, on the router of the version
+// of the web API the path is served by, so that it is given the same
+// headers. It must be called after every other route has been
+// registered.
+func (server *Server) initializeOptionsRoutes() {
+	routers := map[string]*mux.Router{}
+	server.Dispatch.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if _, methodsErr := route.GetMethods(); err != nil || methodsErr != nil || routers[path] != nil {
+			return nil // a subrouter, or a path already seen
+		}
+		routers[path] = router
+		return nil
+	})
+	for path, router := range routers {
+		router.HandleFunc(unversionedPath(path), server.optionsHandler(path)).Methods("OPTIONS")
+	}
+}
+
+// optionsHandler returns the entry-point dispatcher for OPTIONS
+// requests to the path template in path. The methods registered for
+// the path are returned in the Allow header with StatusNoContent or,
+// if the client accepts JSON, described along with their accepted
+// content types and query parameters with StatusOK.
+func (server *Server) optionsHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		options := server.routeOptions(path)
+		w.Header().Set("Allow", strings.Join(options.Methods, ", "))
+		if !acceptsMediaType(r, "application/json") {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		respondWith(w, http.StatusOK, options, negotiatedType(w))
+	}
+}
+
+// routeOptions walks the route table and describes the methods
+// registered for the path template in path.
+func (server *Server) routeOptions(path string) Options {
+	options := Options{
+		Methods:         []string{},
+		ContentTypes:    map[string][]string{},
+		QueryParameters: map[string][]string{},
+	}
+	server.Dispatch.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || template != path {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			options.Methods = append(options.Methods, method)
+			if contentTypes := acceptedContentTypes(method, path); contentTypes != nil {
+				options.ContentTypes[method] = contentTypes
+			}
+			if parameters, ok := routeQueryParameters[method+" "+unversionedPath(path)]; ok {
+				options.QueryParameters[method] = parameters
+			}
+		}
+		return nil
+	})
+	sort.Strings(options.Methods)
+	return options
+}
@@ -0,0 +1,457 @@
+// patch.go - Partial modification of JSON documents.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MergePatchMediaType is the media type of an RFC 7396 JSON Merge
+// Patch document.
+const MergePatchMediaType = "application/merge-patch+json"
+
+// JSONPatchMediaType is the media type of an RFC 6902 JSON Patch
+// document.
+const JSONPatchMediaType = "application/json-patch+json"
+
+// errInvalidPatch is returned when a patch document is malformed.
+var errInvalidPatch = errors.New("Invalid patch document")
+
+// errPatchTestFailed is returned when a JSON Patch test operation does
+// not match the document.
+var errPatchTestFailed = errors.New("Patch test operation failed")
+
+// patchOperation is a single operation of a JSON Patch document. Value
+// is empty when the operation carries no value member.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyMergePatch applies the RFC 7396 JSON Merge Patch in patch to
+// the JSON document in document and returns the patched document.
+// Members of the patch set to null are removed from the document,
+// objects are merged recursively and any other value replaces the
+// corresponding member of the document.
+func applyMergePatch(document []byte, patch []byte) ([]byte, error) {
+	var target, merge interface{}
+	if err := json.Unmarshal(document, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &merge); err != nil {
+		return nil, errInvalidPatch
+	}
+	return json.Marshal(mergePatch(target, merge))
+}
+
+// mergePatch is the recursive MergePatch function of RFC 7396 over
+// decoded JSON values.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
+
+// applyJSONPatch applies the RFC 6902 JSON Patch in patch to the JSON
+// document in document and returns the patched document. The
+// operations are applied in order and the patch is atomic: if any
+// operation fails no patched document is returned. A malformed patch
+// returns errInvalidPatch, a failed test operation returns
+// errPatchTestFailed and any other error describes the operation that
+// could not be applied.
+func applyJSONPatch(document []byte, patch []byte) ([]byte, error) {
+	var target interface{}
+	var operations []patchOperation
+	if err := json.Unmarshal(document, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, errInvalidPatch
+	}
+
+	for index, operation := range operations {
+		var err error
+		target, err = applyPatchOperation(target, operation)
+		if err == errPatchTestFailed || err == errInvalidPatch {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Cannot apply patch operation %d (%s %s): %s",
+				index, operation.Op, operation.Path, err)
+		}
+	}
+	return json.Marshal(target)
+}
+
+// immutablePatchPaths are the members of a payment record a JSON Patch
+// may not modify: the Payment ID identifies the payment record, and
+// its status is only changed by the server (see schedulePayment).
+var immutablePatchPaths = []string{"/id", "/status"}
+
+// checkJSONPatchPaths ascertains no operation of the RFC 6902 JSON
+// Patch in patch modifies one of the members at paths, anything within
+// them, or anything holding them, such as the whole document. Test
+// operations, which modify nothing, and copies from them are allowed,
+// but a move from them is not. The error returned otherwise describes
+// the first operation that would. A malformed patch is left to
+// applyJSONPatch to refuse.
+func checkJSONPatchPaths(patch []byte, paths []string) error {
+	var operations []patchOperation
+	if json.Unmarshal(patch, &operations) != nil {
+		return nil
+	}
+	for index, operation := range operations {
+		touched := []string{operation.Path}
+		switch operation.Op {
+		case "test":
+			continue
+		case "move":
+			touched = append(touched, operation.From)
+		}
+		for _, pointer := range touched {
+			for _, path := range paths {
+				if pointer == path || strings.HasPrefix(pointer, path+"/") ||
+					strings.HasPrefix(path, pointer+"/") {
+					return fmt.Errorf("Cannot apply patch operation %d (%s %s): %s may not be modified",
+						index, operation.Op, operation.Path, path)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// applyPatchOperation applies the single JSON Patch operation in
+// operation to the decoded document in target and returns the
+// modified document.
+func applyPatchOperation(target interface{}, operation patchOperation) (interface{}, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, errInvalidPatch
+	}
+
+	var value interface{}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if len(operation.Value) == 0 {
+			return nil, errInvalidPatch
+		}
+		if err := json.Unmarshal(operation.Value, &value); err != nil {
+			return nil, errInvalidPatch
+		}
+	case "move", "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, errInvalidPatch
+		}
+		if value, err = pointerGet(target, from); err != nil {
+			return nil, err
+		}
+		if operation.Op == "move" {
+			if isPointerPrefix(from, path) && len(from) != len(path) {
+				return nil, errors.New("cannot move a value into itself")
+			}
+			if target, err = pointerRemove(target, from); err != nil {
+				return nil, err
+			}
+		} else {
+			value = copyJSONValue(value)
+		}
+		return pointerAdd(target, path, value)
+	}
+
+	switch operation.Op {
+	case "add":
+		return pointerAdd(target, path, value)
+	case "remove":
+		return pointerRemove(target, path)
+	case "replace":
+		return pointerReplace(target, path, value)
+	case "test":
+		current, err := pointerGet(target, path)
+		if err != nil || !reflect.DeepEqual(current, value) {
+			return nil, errPatchTestFailed
+		}
+		return target, nil
+	}
+	return nil, errInvalidPatch
+}
+
+// parsePointer splits the RFC 6901 JSON Pointer in pointer into its
+// unescaped reference tokens. The empty pointer refers to the whole
+// document and has no tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		token = strings.Replace(token, "~1", "/", -1)
+		tokens[i] = strings.Replace(token, "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// isPointerPrefix returns true if the tokens in prefix are a prefix of
+// the tokens in path.
+func isPointerPrefix(prefix []string, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pointerGet returns the value the tokens in path refer to in target.
+func pointerGet(target interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		var err error
+		if target, err = childGet(target, token); err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
+
+// pointerAdd adds value at the location the tokens in path refer to
+// in target. Members of objects are created or replaced, while values
+// are inserted into arrays, with "-" appending to the array.
+func pointerAdd(target interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(target, path, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			index := len(container)
+			if token != "-" {
+				var err error
+				if index, err = arrayIndex(token, len(container)+1); err != nil {
+					return nil, err
+				}
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+		return nil, fmt.Errorf("cannot add to a %T", parent)
+	})
+}
+
+// pointerRemove removes the value the tokens in path refer to in
+// target. The value must exist.
+func pointerRemove(target interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return pointerUpdate(target, path, func(parent interface{}, token string) (interface{}, error) {
+		if _, err := childGet(parent, token); err != nil {
+			return nil, err
+		}
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			index, _ := arrayIndex(token, len(container))
+			return append(container[:index], container[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove from a %T", parent)
+	})
+}
+
+// pointerReplace replaces the value the tokens in path refer to in
+// target with value. The value must exist.
+func pointerReplace(target interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(target, path, func(parent interface{}, token string) (interface{}, error) {
+		if _, err := childGet(parent, token); err != nil {
+			return nil, err
+		}
+		return childSet(parent, token, value)
+	})
+}
+
+// pointerUpdate walks target to the parent of the location the tokens
+// in path refer to, calls update with that parent and the final token,
+// and stores the returned parent back into target. The modified
+// target is returned.
+func pointerUpdate(target interface{}, path []string,
+	update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(target, path[0])
+	}
+	child, err := childGet(target, path[0])
+	if err != nil {
+		return nil, err
+	}
+	child, err = pointerUpdate(child, path[1:], update)
+	if err != nil {
+		return nil, err
+	}
+	return childSet(target, path[0], child)
+}
+
+// childGet returns the member or element of parent named by token.
+func childGet(parent interface{}, token string) (interface{}, error) {
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok {
+			return nil, fmt.Errorf("member %q not found", token)
+		}
+		return child, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(container))
+		if err != nil {
+			return nil, err
+		}
+		return container[index], nil
+	}
+	return nil, fmt.Errorf("cannot reference %q in a %T", token, parent)
+}
+
+// childSet replaces the member or element of parent named by token
+// with value and returns the modified parent.
+func childSet(parent interface{}, token string, value interface{}) (interface{}, error) {
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		container[token] = value
+		return container, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(container))
+		if err != nil {
+			return nil, err
+		}
+		container[index] = value
+		return container, nil
+	}
+	return nil, fmt.Errorf("cannot reference %q in a %T", token, parent)
+}
+
+// arrayIndex parses the array index in token, which must be a decimal
+// number without leading zeros that is less than length.
+func arrayIndex(token string, length int) (int, error) {
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || !isDigits(token) ||
+		(len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index >= length {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+// copyJSONValue returns a deep copy of the decoded JSON value in
+// value.
+func copyJSONValue(value interface{}) interface{} {
+	encoded, _ := json.Marshal(value)
+	var copied interface{}
+	json.Unmarshal(encoded, &copied)
+	return copied
+}
+
+// Change is a change to a JSON document: the RFC 6901 JSON Pointer to
+// the changed value in Path, and the value before and after the change
+// in Old and New, null where there was or is none.
+type Change struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// diffJSON returns the changes turning the decoded JSON document in
+// before into that in after. Objects are compared member by member, in
+// the order of their names, and arrays element by element, so that a
+// change is reported at the innermost value changed. The changes are
+// an empty slice rather than nil if the documents are equal.
+func diffJSON(before interface{}, after interface{}) []Change {
+	return diffValues("", before, after, []Change{})
+}
+
+// diffValues appends to changes the changes turning the decoded JSON
+// value in before into that in after, both at the JSON Pointer in
+// pointer, and returns the extended changes.
+func diffValues(pointer string, before interface{}, after interface{}, changes []Change) []Change {
+	switch container := before.(type) {
+	case map[string]interface{}:
+		if changed, ok := after.(map[string]interface{}); ok {
+			names := make([]string, 0, len(container))
+			for name := range container {
+				names = append(names, name)
+			}
+			for name := range changed {
+				if _, ok := container[name]; !ok {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				changes = diffValues(pointer+"/"+escapePointerToken(name),
+					container[name], changed[name], changes)
+			}
+			return changes
+		}
+	case []interface{}:
+		if changed, ok := after.([]interface{}); ok {
+			for index := 0; index < len(container) || index < len(changed); index++ {
+				var old, new interface{}
+				if index < len(container) {
+					old = container[index]
+				}
+				if index < len(changed) {
+					new = changed[index]
+				}
+				changes = diffValues(pointer+"/"+strconv.Itoa(index), old, new, changes)
+			}
+			return changes
+		}
+	}
+	if !reflect.DeepEqual(before, after) {
+		changes = append(changes, Change{Path: pointer, Old: before, New: after})
+	}
+	return changes
+}
+
+// escapePointerToken escapes the member name in token as a reference
+// token of an RFC 6901 JSON Pointer, the reverse of parsePointer.
+func escapePointerToken(token string) string {
+	token = strings.Replace(token, "~", "~0", -1)
+	return strings.Replace(token, "/", "~1", -1)
+}
@@ -0,0 +1,193 @@
+// patch_test.go
+
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Test JSON Merge Patch against the examples of RFC 7396 appendix A.
+func TestApplyMergePatch(t *testing.T) {
+	cases := []struct {
+		document string
+		patch    string
+		want     string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, c := range cases {
+		var got, want interface{}
+		result, err := applyMergePatch([]byte(c.document), []byte(c.patch))
+		if err != nil {
+			t.Errorf("applyMergePatch(%s, %s) returned error %v", c.document, c.patch, err)
+			continue
+		}
+		json.Unmarshal(result, &got)
+		json.Unmarshal([]byte(c.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("applyMergePatch(%s, %s) = %s, expected %s",
+				c.document, c.patch, result, c.want)
+		}
+	}
+}
+
+// Test JSON Patch operations, including the examples of RFC 6902
+// appendix A.
+func TestApplyJSONPatch(t *testing.T) {
+	cases := []struct {
+		document string
+		patch    string
+		want     string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`,
+			`{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			`{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`,
+			`{"foo":["bar",["abc"]]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`,
+			`{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`,
+			`{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			`{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`,
+			`[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`,
+			`{"foo":{"bar":1},"baz":{"bar":1}}`},
+		{`{"/":1,"~":2}`, `[{"op":"replace","path":"/~1","value":3},{"op":"remove","path":"/~0"}]`,
+			`{"/":3}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":null}]`,
+			`{"foo":"bar","child":null}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+	}
+	for _, c := range cases {
+		var got, want interface{}
+		result, err := applyJSONPatch([]byte(c.document), []byte(c.patch))
+		if err != nil {
+			t.Errorf("applyJSONPatch(%s, %s) returned error %v", c.document, c.patch, err)
+			continue
+		}
+		json.Unmarshal(result, &got)
+		json.Unmarshal([]byte(c.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("applyJSONPatch(%s, %s) = %s, expected %s",
+				c.document, c.patch, result, c.want)
+		}
+	}
+}
+
+// Test JSON Patch documents that cannot be applied are rejected with
+// the appropriate error.
+func TestApplyJSONPatchErrors(t *testing.T) {
+	cases := []struct {
+		patch string
+		want  error
+	}{
+		{`[{"op":"test","path":"/baz","value":"bar"}]`, errPatchTestFailed},
+		{`[{"op":"test","path":"/missing","value":"bar"}]`, errPatchTestFailed},
+		{`[{"op":"replace","path":"/baz","value":"x"},{"op":"test","path":"/baz","value":"qux"}]`,
+			errPatchTestFailed},
+		{`{"op":"add","path":"/a","value":1}`, errInvalidPatch},
+		{`[{"op":"frobnicate","path":"/baz"}]`, errInvalidPatch},
+		{`[{"op":"add","path":"/a"}]`, errInvalidPatch},
+		{`[{"op":"add","path":"baz","value":1}]`, errInvalidPatch},
+		{`[{"op":"remove","path":"/missing"}]`, nil},
+		{`[{"op":"replace","path":"/missing","value":1}]`, nil},
+		{`[{"op":"add","path":"/foo/5","value":1}]`, nil},
+		{`[{"op":"add","path":"/foo/01","value":1}]`, nil},
+		{`[{"op":"move","from":"/foo","path":"/foo/0"}]`, nil},
+	}
+	for _, c := range cases {
+		result, err := applyJSONPatch([]byte(`{"baz":"qux","foo":["a"]}`), []byte(c.patch))
+		if err == nil || result != nil {
+			t.Errorf("applyJSONPatch(%s) expected an error", c.patch)
+			continue
+		}
+		if c.want != nil && err != c.want {
+			t.Errorf("applyJSONPatch(%s) returned %v, expected %v", c.patch, err, c.want)
+		}
+	}
+}
+
+// Test JSON Patch operations modifying the immutable members of a
+// payment record, anything within them or the whole document are
+// refused.
+func TestCheckJSONPatchPaths(t *testing.T) {
+	cases := []struct {
+		patch   string
+		refused bool
+	}{
+		{`[{"op":"replace","path":"/id","value":"x"}]`, true},
+		{`[{"op":"remove","path":"/status"}]`, true},
+		{`[{"op":"add","path":"/id/0","value":"x"}]`, true},
+		{`[{"op":"move","from":"/id","path":"/reference"}]`, true},
+		{`[{"op":"copy","from":"/reference","path":"/status"}]`, true},
+		{`[{"op":"replace","path":"","value":{"id":"x"}}]`, true},
+		{`[{"op":"move","from":"/reference","path":""}]`, true},
+		{`[{"op":"test","path":"/status","value":"scheduled"}]`, false},
+		{`[{"op":"test","path":"","value":{}}]`, false},
+		{`[{"op":"replace","path":"/version","value":1}]`, false},
+		{`[{"op":"copy","from":"/id","path":"/reference"}]`, false},
+		{`[{"op":"replace","path":"/identifier","value":"x"}]`, false},
+		{`[{"op":"replace","path":"/attributes/id","value":"x"}]`, false},
+		{`{"op":"replace","path":"/id"}`, false},
+	}
+	for _, c := range cases {
+		err := checkJSONPatchPaths([]byte(c.patch), immutablePatchPaths)
+		if (err != nil) != c.refused {
+			t.Errorf("checkJSONPatchPaths(%s) returned %v, expected refused %t", c.patch, err, c.refused)
+		}
+	}
+}
+
+// Test documents are compared down to their innermost changed values,
+// with member names escaped in the pointers, elements added to or
+// removed from arrays reported whole and values changing type
+// reported whole.
+func TestDiffJSON(t *testing.T) {
+	cases := []struct {
+		before string
+		after  string
+		want   []Change
+	}{
+		{`{"a":{"b":1,"c":2}}`, `{"a":{"b":1,"c":3}}`, []Change{{"/a/c", 2.0, 3.0}}},
+		{`{"a/b":1,"m~n":2}`, `{"a/b":2,"m~n":1}`, []Change{{"/a~1b", 1.0, 2.0}, {"/m~0n", 2.0, 1.0}}},
+		{`{"a":[1,2]}`, `{"a":[1,3,{"b":4}]}`,
+			[]Change{{"/a/1", 2.0, 3.0}, {"/a/2", nil, map[string]interface{}{"b": 4.0}}}},
+		{`{"a":[1,2]}`, `{"a":[1]}`, []Change{{"/a/1", 2.0, nil}}},
+		{`{"a":{"b":1}}`, `{"a":"b"}`, []Change{{"/a", map[string]interface{}{"b": 1.0}, "b"}}},
+		{`{"a":1}`, `{"b":1}`, []Change{{"/a", 1.0, nil}, {"/b", nil, 1.0}}},
+		{`{"a":[1]}`, `{"a":[1]}`, []Change{}},
+	}
+	for _, c := range cases {
+		var before, after interface{}
+		json.Unmarshal([]byte(c.before), &before)
+		json.Unmarshal([]byte(c.after), &after)
+		if got := diffJSON(before, after); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("diffJSON(%s, %s) returned %v, expected %v", c.before, c.after, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// problem.go - Errors emitted as RFC 7807 problem details.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// ProblemMediaType is the media type of RFC 7807 problem details, which
+// clients list in their Accept header to receive errors as a Problem
+// rather than in the legacy {"error": "..."} form.
+const ProblemMediaType = "application/problem+json"
+
+// problemTypeBase is the prefix of the URIs identifying the types of
+// problem.
+const problemTypeBase = apiBaseURL + "/problems/"
+
+// The types of problem with a stable URI. Any other error is of type
+// ProblemBlank, titled by its status.
+const (
+	ProblemPaymentNotFound  = problemTypeBase + "payment-not-found"
+	ProblemDuplicatePayment = problemTypeBase + "duplicate-payment"
+	ProblemValidationFailed = problemTypeBase + "validation-failed"
+	ProblemForbidden        = problemTypeBase + "forbidden"
+	ProblemUnauthorized     = problemTypeBase + "unauthorized"
+	ProblemQuotaExceeded    = problemTypeBase + "quota-exceeded"
+	ProblemBlank            = "about:blank"
+)
+
+// problemTitles maps the types of problem with a stable URI to their
+// titles.
+var problemTitles = map[string]string{
+	ProblemPaymentNotFound:  "Payment not found",
+	ProblemDuplicatePayment: "Duplicate payment",
+	ProblemValidationFailed: "Validation failed",
+	ProblemForbidden:        "Forbidden",
+	ProblemUnauthorized:     "Unauthorized",
+	ProblemQuotaExceeded:    "Quota exceeded",
+}
+
+// Problem is an error described by RFC 7807 problem details. Type
+// identifies the kind of problem, Detail describes this occurrence and
+// Instance is the path of the request that raised it. ID names the
+// existing payment record of a duplicate payment, Errors lists the
+// problems of a payment record that failed validation, and QuotaStatus
+// describes the exhausted quota of a refused creation.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail"`
+	Instance string       `json:"instance"`
+	ID       string       `json:"id,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	*QuotaStatus
+}
+
+// newProblem returns the Problem for the error with the status in code
+// and the message in message, raised by the request for the path in
+// instance.
+func newProblem(code int, message string, instance string) Problem {
+	problem := Problem{Type: ProblemBlank, Title: http.StatusText(code),
+		Status: code, Detail: message, Instance: instance}
+	switch {
+	case code == http.StatusConflict || message == ErrPaymentExists.Error():
+		problem.Type = ProblemDuplicatePayment
+	case code == http.StatusNotFound:
+		problem.Type = ProblemPaymentNotFound
+	case code == http.StatusBadRequest || code == http.StatusUnprocessableEntity:
+		problem.Type = ProblemValidationFailed
+	case code == http.StatusForbidden:
+		problem.Type = ProblemForbidden
+	case code == http.StatusUnauthorized:
+		problem.Type = ProblemUnauthorized
+	case code == http.StatusTooManyRequests:
+		problem.Type = ProblemQuotaExceeded
+	}
+	if title, ok := problemTitles[problem.Type]; ok {
+		problem.Title = title
+	}
+	return problem
+}
+
+// problemWriter is the http.ResponseWriter of a request whose errors
+// are emitted as problem details, carrying the path of the request.
+type problemWriter struct {
+	http.ResponseWriter
+	instance string
+}
+
+// Hijack hands the connection of the request over to the handler, such
+// as for a WebSocket.
+func (w *problemWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the http.ResponseWriter wrapped by the problemWriter.
+func (w *problemWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// problemDetails is a middleware that has the errors of the request
+// emitted as problem details, rather than in the legacy form, if
+// ProblemDetails is set or the request accepts ProblemMediaType.
+func (server *Server) problemDetails(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.ProblemDetails || acceptsMediaType(r, ProblemMediaType) {
+			w = &problemWriter{ResponseWriter: w, instance: r.URL.Path}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// respondWithProblem is a convenience function that emits the Problem
+// in problem with its status.
+func respondWithProblem(w http.ResponseWriter, problem Problem) {
+	response, _ := json.Marshal(problem)
+	w.Header().Set("Content-Type", ProblemMediaType)
+	w.WriteHeader(problem.Status)
+	w.Write(response)
+}
@@ -0,0 +1,117 @@
+// quota.go - Daily quotas of the payment records created with each API
+// key.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// QuotaStatus describes the daily quota of an API key: its Limit, the
+// number of payment records that may still be created with the key
+// today, and when the quota is next reset.
+type QuotaStatus struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// apiKeyID is a convenience function that returns the identifier the
+// quota of the API key in key is counted under. It is a hash of the
+// key, so that keys are never written to the backing store.
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// quota is a convenience function that returns the API key of the
+// request in r and its QuotaStatus before any payment record of the
+// request is created, or false if the request is not subject to a
+// quota.
+func (server *Server) quota(r *http.Request) (APIKey, *QuotaStatus, bool) {
+	apiKey, _ := r.Context().Value(apiKeyContextKey{}).(APIKey)
+	if apiKey.DailyQuota <= 0 {
+		return apiKey, nil, false
+	}
+	now := server.now().UTC()
+	reset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return apiKey, &QuotaStatus{Limit: apiKey.DailyQuota, Reset: reset}, true
+}
+
+// reserveQuota takes one payment record from the daily quota of the
+// API key of the request in r, before it is created, and returns the
+// QuotaStatus after, or nil if the request is not subject to a quota.
+// ErrQuotaExceeded is returned along with the QuotaStatus if the quota
+// is exhausted.
+func (server *Server) reserveQuota(r *http.Request) (*QuotaStatus, error) {
+	apiKey, status, ok := server.quota(r)
+	if !ok {
+		return nil, nil
+	}
+	day := status.Reset.AddDate(0, 0, -1).Format(ProcessingDateLayout)
+	var used int
+	err := server.storage(r.Context(), "reserveQuota", "", func() (err error) {
+		used, err = modelReserveQuota(server.mongo, apiKey.id, day, status.Limit, status.Reset)
+		return
+	})
+	if err != nil && err != ErrQuotaExceeded {
+		return nil, err
+	}
+	status.Remaining = status.Limit - used
+	return status, err
+}
+
+// releaseQuota gives back a payment record reserved by reserveQuota
+// for the request in r once its creation failed or was rolled back,
+// counting it as remaining in the latest QuotaStatus of the request in
+// status.
+func (server *Server) releaseQuota(r *http.Request, status *QuotaStatus) {
+	apiKey, _, ok := server.quota(r)
+	if !ok || status == nil {
+		return
+	}
+	day := status.Reset.AddDate(0, 0, -1).Format(ProcessingDateLayout)
+	err := server.storage(r.Context(), "releaseQuota", "", func() error {
+		return modelReleaseQuota(server.mongo, apiKey.id, day)
+	})
+	if err == nil {
+		status.Remaining++
+	}
+}
+
+// setQuotaHeaders is a convenience function that describes the
+// QuotaStatus in status in the X-RateLimit headers of the response to
+// w: the limit, the number remaining and when it is reset, in seconds
+// since the epoch. Nothing is set if status is nil.
+func setQuotaHeaders(w http.ResponseWriter, status *QuotaStatus) {
+	if status == nil {
+		return
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(status.Reset.Unix(), 10))
+}
+
+// respondWithQuotaExceeded is a convenience function that emits
+// StatusTooManyRequests for the exhausted quota described by status,
+// stating its limit, the remaining zero and when it is reset.
+func respondWithQuotaExceeded(w http.ResponseWriter, status *QuotaStatus) {
+	setQuotaHeaders(w, status)
+	message := fmt.Sprintf("The daily quota of %d payments of the API key is exhausted "+
+		"until %s", status.Limit, status.Reset.Format(time.RFC3339))
+	if pw, ok := w.(*problemWriter); ok {
+		problem := newProblem(http.StatusTooManyRequests, message, pw.instance)
+		problem.QuotaStatus = status
+		respondWithProblem(w, problem)
+		return
+	}
+	respondWith(w, http.StatusTooManyRequests, struct {
+		Error string `json:"error"`
+		*QuotaStatus
+	}{message, status}, negotiatedType(w))
+}
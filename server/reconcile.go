@@ -0,0 +1,295 @@
+// reconcile.go - Reconciliation of bank statements against the payment
+// records.
+
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// reconcileBatchSize is the number of statement entries matched
+// against the payment records at a time.
+const reconcileBatchSize = 500
+
+// statementColumns are the columns a CSV statement must have, named in
+// its header row.
+var statementColumns = []string{"reference", "amount", "currency", "processing_date"}
+
+// StatementEntry is an entry of a bank statement, numbered by Row from
+// 1 in the order of the statement, not counting the header row of a
+// CSV statement. Reference is either the numeric or the end to end
+// reference of the payment.
+type StatementEntry struct {
+	Row            int    `json:"row"`
+	Reference      string `json:"reference"`
+	Amount         Amount `json:"amount"`
+	Currency       string `json:"currency"`
+	ProcessingDate string `json:"processing_date"`
+}
+
+// ReconciledEntry is a StatementEntry matched by the payment record
+// with the Payment ID in ID.
+type ReconciledEntry struct {
+	StatementEntry
+	ID string `json:"id"`
+}
+
+// Reconciliation is the outcome of the reconciliation of a statement
+// against the payment records: the entries matched by a payment
+// record, the entries no payment record matched, and the payment
+// records processed within the dates From and To of the statement that
+// no entry matched.
+type Reconciliation struct {
+	From                 string            `json:"from,omitempty"`
+	To                   string            `json:"to,omitempty"`
+	Matched              []ReconciledEntry `json:"matched"`
+	MissingFromStore     []StatementEntry  `json:"missing_from_store"`
+	MissingFromStatement []Payment         `json:"missing_from_statement"`
+}
+
+// statementReader reads the entries of a statement one at a time,
+// returning io.EOF after the last.
+type statementReader interface {
+	next() (StatementEntry, error)
+}
+
+// csvStatement reads a CSV statement, whose header row names the
+// columns in statementColumns, in any order, along with any others.
+type csvStatement struct {
+	reader  *csv.Reader
+	columns map[string]int
+	row     int
+}
+
+// jsonStatement reads a statement sent as a JSON array of entries.
+type jsonStatement struct {
+	decoder *json.Decoder
+	row     int
+}
+
+// newStatementReader returns the reader of the statement in the body of
+// the request in r, a CSV statement if it is sent as text/csv and a
+// JSON one otherwise.
+func newStatementReader(r *http.Request) (statementReader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/csv" {
+		decoder := json.NewDecoder(r.Body)
+		if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+			return nil, errors.New("Invalid statement: expected a JSON array of entries")
+		}
+		return &jsonStatement{decoder: decoder}, nil
+	}
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("Invalid statement: missing the header row")
+	}
+	statement := &csvStatement{reader: reader, columns: map[string]int{}}
+	for i, name := range header {
+		statement.columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range statementColumns {
+		if _, ok := statement.columns[name]; !ok {
+			return nil, fmt.Errorf("Invalid statement: missing the %s column", name)
+		}
+	}
+	return statement, nil
+}
+
+// next reads the next entry of the CSV statement.
+func (statement *csvStatement) next() (StatementEntry, error) {
+	record, err := statement.reader.Read()
+	if err != nil {
+		return StatementEntry{}, err
+	}
+	statement.row++
+	field := func(name string) string {
+		if i := statement.columns[name]; i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	entry := StatementEntry{Row: statement.row, Reference: field("reference"),
+		Currency: field("currency"), ProcessingDate: field("processing_date")}
+	amount, err := ParseAmount(field("amount"))
+	if err != nil {
+		return entry, fmt.Errorf("Invalid statement row %d: %s", entry.Row, err)
+	}
+	entry.Amount = amount
+	return entry, entry.check()
+}
+
+// next reads the next entry of the JSON statement.
+func (statement *jsonStatement) next() (StatementEntry, error) {
+	if !statement.decoder.More() {
+		return StatementEntry{}, io.EOF
+	}
+	statement.row++
+	var entry StatementEntry
+	if err := statement.decoder.Decode(&entry); err != nil {
+		return entry, fmt.Errorf("Invalid statement row %d: %w", statement.row, err)
+	}
+	entry.Row = statement.row
+	return entry, entry.check()
+}
+
+// check ascertains every field of the StatementEntry is populated and
+// that its processing date is a YYYY-MM-DD date. The error returned
+// otherwise names the row of the entry.
+func (entry *StatementEntry) check() error {
+	var err error
+	if entry.Reference == "" {
+		err = &ValidationError{Attribute: "reference", Reason: "missing"}
+	} else if entry.Amount == (Amount{}) {
+		err = &ValidationError{Attribute: "amount", Reason: "missing"}
+	} else if entry.Currency == "" {
+		err = &ValidationError{Attribute: "currency", Reason: "missing"}
+	} else if _, parseErr := time.Parse(ProcessingDateLayout, entry.ProcessingDate); parseErr != nil {
+		err = &ValidationError{Attribute: "processing_date",
+			Reason: fmt.Sprintf("%q is not a YYYY-MM-DD date", entry.ProcessingDate)}
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid statement row %d: %s", entry.Row, err)
+	}
+	return nil
+}
+
+// readStatementEntries is a convenience function that reads up to limit
+// entries of the statement in statement. Fewer are returned only at the
+// end of the statement.
+func readStatementEntries(statement statementReader, limit int) ([]StatementEntry, error) {
+	var entries []StatementEntry
+	for len(entries) < limit {
+		entry, err := statement.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// matchStatementEntry is a convenience function that returns the
+// payment record of candidates matching the statement entry in entry,
+// or nil if none does. A payment record matches if either of its
+// references is that of the entry and its amount and currency are
+// exactly those of the entry, and it has not already been matched.
+// Payment records processed on the date of the entry are preferred.
+func matchStatementEntry(entry StatementEntry, candidates []Payment, matched map[string]bool) *Payment {
+	var match *Payment
+	for i := range candidates {
+		attributes := &candidates[i].Attributes
+		if matched[candidates[i].ID] || attributes.Currency != entry.Currency ||
+			attributes.Amount.Cmp(entry.Amount) != 0 ||
+			(attributes.NumericReference != entry.Reference &&
+				attributes.EndToEndReference != entry.Reference) {
+			continue
+		}
+		if attributes.ProcessingDate == entry.ProcessingDate {
+			return &candidates[i]
+		}
+		if match == nil {
+			match = &candidates[i]
+		}
+	}
+	return match
+}
+
+// reconcilePayments is the entry-point dispatcher for the
+// reconciliation of bank statements against the payment records. It
+// responds to the URL payments/reconcile and an appropriate POST
+// request carrying a statement, as CSV (see csvStatement) or as a JSON
+// array of StatementEntry, with a Reconciliation. The statement is
+// read reconcileBatchSize entries at a time rather than as a whole,
+// and each entry is matched by at most one payment record (see
+// matchStatementEntry). A statement with an invalid entry is refused
+// with StatusBadRequest, and one larger than the bound on request
+// bodies with StatusRequestEntityTooLarge (see limitBodies). Only the
+// payment records of the organisation of the API key are reconciled,
+// if any.
+func (server *Server) reconcilePayments(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	statement, err := newStatementReader(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	organisation := callerOrganisation(r)
+	result := Reconciliation{Matched: []ReconciledEntry{}, MissingFromStore: []StatementEntry{},
+		MissingFromStatement: []Payment{}}
+	matched := map[string]bool{}
+	for {
+		entries, err := readStatementEntries(statement, reconcileBatchSize)
+		if bodyTooLarge(err) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Request payload too large")
+			return
+		} else if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		} else if len(entries) == 0 {
+			break
+		}
+
+		references := make([]string, len(entries))
+		for i, entry := range entries {
+			references[i] = entry.Reference
+		}
+		var candidates []Payment
+		err = server.storage(r.Context(), "reconcilePayments", "", func() (err error) {
+			candidates, err = modelGetPaymentsByReference(server.mongo, organisation, references)
+			return
+		})
+		if err != nil {
+			respondWithStorageError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		for _, entry := range entries {
+			if result.From == "" || entry.ProcessingDate < result.From {
+				result.From = entry.ProcessingDate
+			}
+			if entry.ProcessingDate > result.To {
+				result.To = entry.ProcessingDate
+			}
+			if payment := matchStatementEntry(entry, candidates, matched); payment != nil {
+				matched[payment.ID] = true
+				result.Matched = append(result.Matched, ReconciledEntry{entry, payment.ID})
+			} else {
+				result.MissingFromStore = append(result.MissingFromStore, entry)
+			}
+		}
+	}
+
+	if result.From != "" {
+		err = server.storage(r.Context(), "reconcileMissingPayments", "", func() error {
+			iter := modelPaymentsProcessedBetween(server.mongo, organisation, result.From, result.To)
+			var payment Payment
+			for iter.Next(&payment) {
+				if !matched[payment.ID] {
+					result.MissingFromStatement = append(result.MissingFromStatement, payment)
+				}
+				payment = Payment{}
+			}
+			return iter.Close()
+		})
+		if err != nil {
+			respondWithStorageError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	respondWith(w, http.StatusOK, result, negotiatedType(w))
+}
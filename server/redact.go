@@ -0,0 +1,118 @@
+// redact.go - Masking of account numbers and personal data in logs.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// alwaysMaskedFields are the fields masked in every logged value,
+// whatever else is configured, keeping their last four characters.
+var alwaysMaskedFields = []string{"account_number"}
+
+// ibanPattern matches an IBAN, without spaces: a country code, two
+// check digits and up to thirty alphanumerics. Such values are masked
+// wherever they appear in a logged value.
+var ibanPattern = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+
+// logMasker masks sensitive values before they are logged. Account
+// numbers and IBANs keep their last four characters, so that they can
+// still be told apart, and the values of the further fields names, such
+// as the names of the parties, are replaced by a short hash, so that
+// the same value can be followed across the log without being
+// disclosed. A nil logMasker masks account numbers and IBANs only.
+type logMasker struct {
+	names map[string]bool
+}
+
+// newLogMasker returns a logMasker masking account numbers, IBANs and
+// the values of the JSON fields named by fields, such as "name" or
+// "account_name".
+func newLogMasker(fields []string) *logMasker {
+	masker := &logMasker{names: map[string]bool{}}
+	for _, field := range fields {
+		if field = strings.TrimSpace(field); field != "" {
+			masker.names[field] = true
+		}
+	}
+	return masker
+}
+
+// mask returns the JSON form of the value in v, such as a Payment or a
+// request body already in JSON, with its sensitive values masked.
+// Values that cannot be rendered as JSON are omitted entirely, rather
+// than risk logging them in the clear.
+func (m *logMasker) mask(v interface{}) string {
+	data, ok := v.([]byte)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return "(unloggable value)"
+		}
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return "(unloggable value)"
+	}
+	masked, _ := json.Marshal(m.maskValue("", decoded))
+	return string(masked)
+}
+
+// maskValue returns the decoded JSON value in v of the field named by
+// field, and every value within it, masked as required.
+func (m *logMasker) maskValue(field string, v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for name, nested := range value {
+			value[name] = m.maskValue(name, nested)
+		}
+	case []interface{}:
+		for i, nested := range value {
+			value[i] = m.maskValue(field, nested)
+		}
+	case string:
+		if value == "" {
+			return value
+		}
+		for _, name := range alwaysMaskedFields {
+			if field == name {
+				return maskLastFour(value)
+			}
+		}
+		if ibanPattern.MatchString(strings.ToUpper(strings.Replace(value, " ", "", -1))) {
+			return maskLastFour(value)
+		}
+		if m != nil && m.names[field] {
+			return maskHash(value)
+		}
+	}
+	return v
+}
+
+// maskLastFour is a convenience function that masks all but the last
+// four characters of the value in s. Values of four characters or less
+// are masked entirely.
+func maskLastFour(s string) string {
+	s = strings.Replace(s, " ", "", -1)
+	if len(s) <= 4 {
+		return "****"
+	}
+	return "****" + s[len(s)-4:]
+}
+
+// maskHash is a convenience function that replaces the value in s by
+// a short hash of it.
+func maskHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// logMasked logs the message in message along with the value in v,
+// such as a Payment, masked by the logMasker of the server.
+func (server *Server) logMasked(message string, v interface{}) {
+	server.logger().Info().Msg(message + ": " + server.masker.mask(v))
+}
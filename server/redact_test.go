@@ -0,0 +1,58 @@
+// redact_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"strings"
+	"testing"
+)
+
+// Test a logged payment has its account numbers and IBANs masked to
+// their last four characters and the configured party names hashed,
+// leaving the rest of it as it is.
+func TestLogMasked(t *testing.T) {
+	var logged bytes.Buffer
+	logger := newLogger(&logged, zerolog.InfoLevel, LogFormatText)
+
+	var payment Payment
+	if err := json.Unmarshal(payload, &payment); err != nil {
+		t.Fatal(err)
+	}
+	masking := Server{Config: Config{Logger: &logger}, masker: newLogMasker([]string{"name", " account_name"})}
+	masking.logMasked("Created payment", payment)
+
+	output := logged.String()
+	for _, clear := range []string{"31926819", "GB29XABC10161234567801", "56781234",
+		"Wilfred Jeremiah Owens", "EJ Brown Black"} {
+		if strings.Contains(output, clear) {
+			t.Errorf("Expected %s to be masked. Got %s", clear, output)
+		}
+	}
+	for _, masked := range []string{`"account_number":"****6819"`, `"account_number":"****7801"`,
+		`"name":"` + maskHash("Wilfred Jeremiah Owens") + `"`, `"reference":"Payment for Em's piano lessons"`} {
+		if !strings.Contains(output, masked) {
+			t.Errorf("Expected %s to be logged. Got %s", masked, output)
+		}
+	}
+
+	tests := []struct {
+		masker *logMasker
+		value  string
+		masked string
+	}{
+		{nil, `{"account_number":"31926819","name":"W Owens"}`,
+			`{"account_number":"****6819","name":"W Owens"}`},
+		{nil, `{"notes":["GB29 XABC 1016 1234 5678 01","FX123"]}`,
+			`{"notes":["****7801","FX123"]}`},
+		{newLogMasker(nil), `{"account_number":"123"}`, `{"account_number":"****"}`},
+		{nil, `not json`, `(unloggable value)`},
+	}
+	for _, test := range tests {
+		if masked := test.masker.mask([]byte(test.value)); masked != test.masked {
+			t.Errorf("Expected %s to be masked as %s. Got %s", test.value, test.masked, masked)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// retention.go - The worker removing the payment records older than
+// the retention period, for data retention policies.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The actions taken on the payment records older than the retention
+// period: RetentionDelete, the default, removes them along with their
+// notes, and RetentionArchive moves them to the archive.
+const (
+	RetentionDelete  = "delete"
+	RetentionArchive = "archive"
+)
+
+// defaultRetentionInterval is how often the payment records older than
+// the retention period are removed, unless configured otherwise.
+const defaultRetentionInterval = time.Hour
+
+// checkRetentionAction is a convenience function that ascertains the
+// action in action is one of the retention actions, or empty for the
+// default.
+func checkRetentionAction(action string) error {
+	switch action {
+	case "", RetentionDelete, RetentionArchive:
+		return nil
+	}
+	return fmt.Errorf("Unknown retention action %q, use delete or archive", action)
+}
+
+// retentionInterval is a convenience function that returns how often
+// the payment records older than the retention period are removed:
+// RetentionInterval, or defaultRetentionInterval if it is not
+// positive.
+func (server *Server) retentionInterval() time.Duration {
+	if server.RetentionInterval <= 0 {
+		return defaultRetentionInterval
+	}
+	return server.RetentionInterval
+}
+
+// retentionCutoff is a convenience function that returns the earliest
+// YYYY-MM-DD processing date retained: RetentionDays days before today
+// in the Timezone of the server (see today).
+func (server *Server) retentionCutoff() string {
+	return server.retentionStart().Format(ProcessingDateLayout)
+}
+
+// retentionStart is a convenience function that returns the start of
+// the day of the retention cutoff (see retentionCutoff) in the
+// Timezone of the server, before which the payment records without a
+// processing date were created if they are expired.
+func (server *Server) retentionStart() time.Time {
+	location := server.Timezone
+	if location == nil {
+		location = time.UTC
+	}
+	day := server.now().In(location).AddDate(0, 0, -server.RetentionDays)
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, location)
+}
+
+// purgeExpiredPayments removes the payment records with a processing
+// date before the retention cutoff (see retentionCutoff), or without
+// one created before it, deleting them or moving them to the archive
+// as RetentionAction says, and returns the number removed along with
+// the cutoff. The deletion of each deleted payment record is
+// published. Removing them can be repeated safely.
+func (server *Server) purgeExpiredPayments(ctx context.Context) (int, string, error) {
+	start := server.retentionStart()
+	cutoff := start.Format(ProcessingDateLayout)
+	var removed int
+	var err error
+	var deleted []Payment
+	if server.RetentionAction == RetentionArchive {
+		err = server.storage(ctx, "archivePayments", "", func() (err error) {
+			removed, err = modelArchivePayments(server.mongo, cutoff, start)
+			return
+		})
+	} else {
+		err = server.storage(ctx, "deletePayments", "", func() (err error) {
+			deleted, err = modelDeleteExpiredPayments(server.mongo, cutoff, start)
+			removed = len(deleted)
+			return
+		})
+	}
+	server.cache.purge()
+	server.noteDeletion()
+	for _, payment := range deleted {
+		server.publishEvent(EventDeleted, payment)
+	}
+	return removed, cutoff, err
+}
+
+// runRetention removes the payment records older than the retention
+// period at once and then every retention interval (see
+// retentionInterval) until ctx is done, logging how many it removed.
+// Failures are logged and retried at the next interval. Nothing is
+// removed unless RetentionDays is positive.
+func (server *Server) runRetention(ctx context.Context) {
+	if server.RetentionDays <= 0 {
+		return
+	}
+	action := server.RetentionAction
+	if action == "" {
+		action = RetentionDelete
+	}
+	ticker := time.NewTicker(server.retentionInterval())
+	defer ticker.Stop()
+	for {
+		removed, cutoff, err := server.purgeExpiredPayments(ctx)
+		if err != nil {
+			server.logger().Warn().Err(err).Int("removed", removed).Str("action", action).
+				Str("cutoff", cutoff).Msg("Cannot remove expired payments")
+		} else if removed > 0 {
+			server.logger().Info().Int("removed", removed).Str("action", action).
+				Str("cutoff", cutoff).Msg("Removed expired payments")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// retention_test.go
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/DeltaPine/payment_server/internal/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test a purge pass removes the payments with a processing date before
+// the retention cutoff, or without one created before it, and keeps
+// the others, deleting them by default, publishing their deletion, and
+// archiving them when configured to, and that nothing is removed while
+// retention is disabled.
+func TestRetentionPurge(t *testing.T) {
+	clearTable()
+	server.DB.C(server.mongo.archiveCollection()).RemoveAll(nil)
+	defer server.DB.C(server.mongo.archiveCollection()).RemoveAll(nil)
+	defer clearTable()
+	retaining := newTestServer(t, func(x *Server) {
+		x.Clock = testutil.NewFakeClock(time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC))
+		x.RetentionDays = 30
+	})
+	execute := func(method, url string, body []byte) *httptest.ResponseRecorder {
+		req, _ := newJSONRequest(method, url, bytes.NewBuffer(body))
+		return executeOn(retaining, req)
+	}
+	create := func(id, date string) {
+		var p Payment
+		json.Unmarshal(payload, &p)
+		p.ID, p.Attributes.ProcessingDate = id, date
+		body, _ := json.Marshal(p)
+		checkResponseCode(t, http.StatusCreated, execute("POST", "/v1/payment", body).Code)
+	}
+
+	// Payments without a processing date, as written before it was
+	// required, are expired by their creation time instead.
+	undated := func(id string, created time.Time) {
+		var p Payment
+		json.Unmarshal(payload, &p)
+		p.ID, p.Attributes.ProcessingDate = id, ""
+		if err := server.mongo.createPayment(&p, created); err != nil {
+			t.Fatalf("Cannot create the undated payment %s: %v", id, err)
+		}
+	}
+
+	expired := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	retained := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec44"
+	ancient := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec45"
+	undatedOld := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec46"
+	undatedRecent := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec47"
+	create(expired, "2017-01-29")
+	create(retained, "2017-01-30")
+	undated(undatedOld, time.Date(2017, 1, 29, 23, 0, 0, 0, time.UTC))
+	undated(undatedRecent, time.Date(2017, 2, 28, 12, 0, 0, 0, time.UTC))
+	if cutoff := retaining.retentionCutoff(); cutoff != "2017-01-30" {
+		t.Fatalf("Expected the cutoff 30 days before today. Got %s", cutoff)
+	}
+	subscriber := retaining.events.subscribe("")
+	removed, _, err := retaining.purgeExpiredPayments(context.Background())
+	if err != nil || removed != 2 {
+		t.Fatalf("Expected the expired payments to be removed. Got %d, %v", removed, err)
+	}
+	retaining.events.unsubscribe(subscriber)
+	deleted := map[string]bool{}
+	for event := range subscriber.events {
+		if event.Type == EventDeleted {
+			deleted[event.ID] = true
+		}
+	}
+	if len(deleted) != 2 || !deleted[expired] || !deleted[undatedOld] {
+		t.Errorf("Expected the deletion of the expired payments to be published. Got %v", deleted)
+	}
+	checkResponseCode(t, http.StatusNotFound,
+		execute("GET", "/v1/payment/"+expired+"?include_archived=true", nil).Code)
+	checkResponseCode(t, http.StatusNotFound, execute("GET", "/v1/payment/"+undatedOld, nil).Code)
+	checkResponseCode(t, http.StatusOK, execute("GET", "/v1/payment/"+retained, nil).Code)
+	checkResponseCode(t, http.StatusOK, execute("GET", "/v1/payment/"+undatedRecent, nil).Code)
+
+	create(expired, "2017-01-29")
+	retaining.RetentionAction = RetentionArchive
+	if removed, _, err := retaining.purgeExpiredPayments(context.Background()); err != nil || removed != 1 {
+		t.Fatalf("Expected the expired payment to be archived. Got %d, %v", removed, err)
+	}
+	checkResponseCode(t, http.StatusNotFound, execute("GET", "/v1/payment/"+expired, nil).Code)
+	checkResponseCode(t, http.StatusOK,
+		execute("GET", "/v1/payment/"+expired+"?include_archived=true", nil).Code)
+
+	create(ancient, "2016-01-01")
+	retaining.RetentionDays = 0
+	ctx, stop := context.WithCancel(context.Background())
+	stop()
+	retaining.runRetention(ctx)
+	checkResponseCode(t, http.StatusOK, execute("GET", "/v1/payment/"+ancient, nil).Code)
+	if err := checkRetentionAction("shred"); err == nil {
+		t.Errorf("Expected an unknown retention action to be refused")
+	}
+}
@@ -0,0 +1,188 @@
+// retry.go - Retries of idempotent storage operations across transient
+// backing store failures.
+
+package server
+
+import (
+	"context"
+	"expvar"
+	"gopkg.in/mgo.v2"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// retryMetrics counts the retries of storage operations in the
+// process, those that recovered and those that ran out of attempts or
+// time. It is published through expvar.
+var retryMetrics = expvar.NewMap("storage_retries")
+
+// The delay before the first retry of a storage operation, doubled for
+// every further retry up to retryMaxBackoff.
+const (
+	retryBackoff    = 50 * time.Millisecond
+	retryMaxBackoff = time.Second
+)
+
+// transientErrorCodes are the MongoDB error codes raised while a
+// replica set elects a new primary or a node shuts down.
+var transientErrorCodes = map[int]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// transientErrorMessages are fragments of the messages of transient
+// errors that carry no code.
+var transientErrorMessages = []string{
+	"not master",
+	"node is recovering",
+	"connection reset",
+	"no reachable servers",
+}
+
+// unretriedOperations are the storage operations, by name, that are
+// attempted once whatever the retryPolicy: inserts, whose
+// acknowledgement may be lost once they are applied, counter
+// increments, and operations that write their results out or gather
+// them as they go.
+var unretriedOperations = map[string]bool{
+	"anonymisePayment":         true,
+	"archivePayments":          true,
+	"checkIntegrity":           true,
+	"createNote":               true,
+	"createPayment":            true,
+	"exportOrganisation":       true,
+	"lockPayment":              true,
+	"reconcileMissingPayments": true,
+	"reencryptPayments":        true,
+	"releaseQuota":             true,
+	"reserveQuota":             true,
+}
+
+// retryPolicy retries storage operations that fail with a transient
+// error, with jittered exponential backoff between attempts. A nil
+// retryPolicy is valid and attempts every operation once.
+//
+// Only idempotent operations may be retried: reads, deletes and whole
+// record updates by Payment ID. Inserts are never retried, as an
+// insert whose acknowledgement was lost would be repeated (see
+// unretriedOperations).
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+	refresh  func()
+	wait     func(ctx context.Context, delay time.Duration) error
+}
+
+// newRetryPolicy returns a retryPolicy retrying operations up to
+// retries times after their first attempt, calling refresh before each
+// retry so that the next attempt does not reuse a broken connection.
+// If retries is not positive nil is returned.
+func newRetryPolicy(retries int, refresh func()) *retryPolicy {
+	if retries <= 0 {
+		return nil
+	}
+	return &retryPolicy{
+		attempts: retries + 1,
+		backoff:  retryBackoff,
+		refresh:  refresh,
+		wait:     contextSleep,
+	}
+}
+
+// do invokes operation until it succeeds, fails with an error that is
+// not transient, runs out of attempts or ctx is done, and returns the
+// last error of operation.
+func (policy *retryPolicy) do(ctx context.Context, operation func() error) error {
+	if policy == nil {
+		return operation()
+	}
+
+	delay := policy.backoff
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil {
+			if attempt > 1 {
+				retryMetrics.Add("recovered", 1)
+			}
+			return nil
+		}
+		if !isTransient(err) {
+			return err
+		}
+		if attempt >= policy.attempts || policy.wait(ctx, jitter(delay)) != nil {
+			retryMetrics.Add("exhausted", 1)
+			return err
+		}
+
+		retryMetrics.Add("retries", 1)
+		if policy.refresh != nil {
+			policy.refresh()
+		}
+		if delay *= 2; delay > retryMaxBackoff {
+			delay = retryMaxBackoff
+		}
+	}
+}
+
+// isTransient is a convenience function that returns true if err is
+// likely to be a passing failure of the backing store, such as a lost
+// connection or a replica set without a primary.
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *mgo.QueryError:
+		if transientErrorCodes[e.Code] {
+			return true
+		}
+	case *mgo.LastError:
+		if transientErrorCodes[e.Code] {
+			return true
+		}
+	case net.Error:
+		return true
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, fragment := range transientErrorMessages {
+		if strings.Contains(message, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// jitter is a convenience function that returns a random delay
+// between half of delay and delay, so that clients failing together
+// do not retry together.
+func jitter(delay time.Duration) time.Duration {
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// contextSleep is a convenience function that waits for delay, or
+// until ctx is done in which case the error of ctx is returned.
+func contextSleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,184 @@
+// retry_test.go
+
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"gopkg.in/mgo.v2"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scriptedSession plays back a script of errors, one per operation,
+// and records the retry policy's refreshes and waits.
+type scriptedSession struct {
+	script    []error
+	calls     int
+	refreshes int
+	delays    []time.Duration
+}
+
+// operation returns the next error of the script, or nil once the
+// script is exhausted.
+func (session *scriptedSession) operation() error {
+	session.calls++
+	if len(session.script) == 0 {
+		return nil
+	}
+	err := session.script[0]
+	session.script = session.script[1:]
+	return err
+}
+
+// policy returns a retryPolicy of retries retries over the session
+// that records its waits instead of sleeping.
+func (session *scriptedSession) policy(retries int) *retryPolicy {
+	policy := newRetryPolicy(retries, func() { session.refreshes++ })
+	policy.wait = func(ctx context.Context, delay time.Duration) error {
+		session.delays = append(session.delays, delay)
+		return ctx.Err()
+	}
+	return policy
+}
+
+// retryCount returns the value of the storage retry metric in name.
+func retryCount(name string) int64 {
+	if count, ok := retryMetrics.Get(name).(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+var errNotMaster = &mgo.QueryError{Code: 10107, Message: "not master"}
+
+// Test an operation failing transiently is retried until it succeeds,
+// refreshing the session and backing off exponentially with jitter.
+func TestRetryRecovers(t *testing.T) {
+	retries, recovered := retryCount("retries"), retryCount("recovered")
+	session := &scriptedSession{script: []error{errNotMaster,
+		&net.OpError{Op: "read", Err: syscall.ECONNRESET}}}
+
+	if err := session.policy(3).do(context.Background(), session.operation); err != nil {
+		t.Errorf("Expected the operation to recover. Got %v", err)
+	}
+	if session.calls != 3 || session.refreshes != 2 {
+		t.Errorf("Expected 3 calls and 2 refreshes. Got %d and %d",
+			session.calls, session.refreshes)
+	}
+	for i, delay := range session.delays {
+		backoff := retryBackoff << uint(i)
+		if delay < backoff/2 || delay > backoff {
+			t.Errorf("Expected retry %d to wait between %s and %s. Got %s",
+				i, backoff/2, backoff, delay)
+		}
+	}
+	if retryCount("retries")-retries != 2 || retryCount("recovered")-recovered != 1 {
+		t.Error("Expected 2 retries and a recovery to be counted")
+	}
+}
+
+// Test an operation that keeps failing transiently is attempted once
+// plus the number of retries, and its last error returned.
+func TestRetryExhausted(t *testing.T) {
+	exhausted := retryCount("exhausted")
+	session := &scriptedSession{script: []error{errNotMaster, errNotMaster,
+		errNotMaster, errNotMaster}}
+
+	err := session.policy(2).do(context.Background(), session.operation)
+	if err != errNotMaster || session.calls != 3 {
+		t.Errorf("Expected not master after 3 calls. Got %v after %d", err, session.calls)
+	}
+	if retryCount("exhausted")-exhausted != 1 {
+		t.Error("Expected the exhausted retries to be counted")
+	}
+}
+
+// Test no retries are made once the request context is done.
+func TestRetryContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	session := &scriptedSession{script: []error{errNotMaster}}
+
+	err := session.policy(3).do(ctx, session.operation)
+	if err != errNotMaster || session.calls != 1 || session.refreshes != 0 {
+		t.Errorf("Expected a single call. Got %v after %d", err, session.calls)
+	}
+}
+
+// Test errors that are not transient are never retried, and that a
+// nil retryPolicy attempts operations once.
+func TestRetryNotRetryable(t *testing.T) {
+	for _, err := range []error{
+		mgo.ErrNotFound,
+		&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"},
+		&mgo.QueryError{Code: 2, Message: "bad query"},
+		errors.New("Payment not found"),
+	} {
+		session := &scriptedSession{script: []error{err}}
+		if got := session.policy(3).do(context.Background(), session.operation); got != err ||
+			session.calls != 1 {
+			t.Errorf("Expected %v not to be retried. Got %v after %d calls",
+				err, got, session.calls)
+		}
+	}
+
+	session := &scriptedSession{script: []error{errNotMaster}}
+	var policy *retryPolicy
+	if err := policy.do(context.Background(), session.operation); err != errNotMaster ||
+		session.calls != 1 {
+		t.Errorf("Expected a nil policy not to retry. Got %v after %d calls", err, session.calls)
+	}
+	if newRetryPolicy(0, nil) != nil {
+		t.Error("Expected no retry policy without retries")
+	}
+}
+
+// Test the classification of errors as transient.
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{errNotMaster, true},
+		{&mgo.LastError{Code: 11602, Err: "interrupted due to repl state change"}, true},
+		{&mgo.QueryError{Message: "node is recovering"}, true},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{io.EOF, true},
+		{errors.New("no reachable servers"), true},
+		{mgo.ErrNotFound, false},
+		{&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}, false},
+		{errors.New("Cannot delete a payment without a Payment ID specified"), false},
+	}
+	for _, test := range tests {
+		if isTransient(test.err) != test.transient {
+			t.Errorf("Expected %v to be transient: %t", test.err, test.transient)
+		}
+	}
+}
+
+// Test storage retries idempotent operations by itself, whichever
+// handler invokes them, while attempting the unretriedOperations once.
+func TestStorageRetriesIdempotentOperations(t *testing.T) {
+	session := &scriptedSession{script: []error{errNotMaster}}
+	retried := Server{retry: session.policy(3)}
+	err := retried.storage(context.Background(), "getPayment", "", session.operation)
+	if err != nil || session.calls != 2 {
+		t.Errorf("Expected a read to be retried. Got %v after %d calls", err, session.calls)
+	}
+
+	for _, operation := range []string{"createPayment", "lockPayment"} {
+		session = &scriptedSession{script: []error{errNotMaster}}
+		retried.retry = session.policy(3)
+		err = retried.storage(context.Background(), operation, "", session.operation)
+		if err != errNotMaster || session.calls != 1 {
+			t.Errorf("Expected the insert %s not to be retried. Got %v after %d calls",
+				operation, err, session.calls)
+		}
+	}
+}
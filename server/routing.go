@@ -0,0 +1,70 @@
+// routing.go - Requests routed despite the stray slashes of gateways,
+// and answered in JSON when they cannot be.
+
+package server
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// repeatedSlashes matches the runs of slashes of a malformed path.
+var repeatedSlashes = regexp.MustCompile(`//+`)
+
+// normalisePath is a middleware that routes the requests whose path has
+// repeated slashes, or a trailing slash no route has, as requests for
+// the path without them, such as those of clients behind gateways that
+// send /payments/ for /payments or /payment//{id} for /payment/{id}.
+// The request is served directly rather than redirected, so that the
+// body of a POST or PUT is not lost by a client following the
+// redirect with a GET. It must wrap the router, as the router answers
+// requests matching no route before any middleware installed on it.
+func (server *Server) normalisePath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := repeatedSlashes.ReplaceAllString(r.URL.Path, "/")
+		if trimmed := strings.TrimSuffix(path, "/"); trimmed != "" && trimmed != path &&
+			!server.routed(r, path) {
+			path = trimmed
+		}
+		if path != r.URL.Path {
+			normalised := *r
+			url := *r.URL
+			url.Path, url.RawPath = path, ""
+			normalised.URL = &url
+			r = &normalised
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routed is a convenience function that returns true if a route of the
+// server has the path in path, for the method of the request in r or
+// another, as /debug/pprof/ does with its trailing slash.
+func (server *Server) routed(r *http.Request, path string) bool {
+	candidate := *r
+	url := *r.URL
+	url.Path, url.RawPath = path, ""
+	candidate.URL = &url
+	var match mux.RouteMatch
+	server.Dispatch.Match(&candidate, &match)
+	return match.MatchErr == nil || match.MatchErr == mux.ErrMethodMismatch
+}
+
+// routeNotFound is the entry-point dispatcher for requests matching no
+// route, refused with StatusNotFound in JSON rather than the plain text
+// of the router.
+func routeNotFound(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, http.StatusNotFound, fmt.Sprintf("No such URL %s", r.URL.Path))
+}
+
+// methodNotAllowed is the entry-point dispatcher for requests for a
+// route with a method it does not accept, refused with
+// StatusMethodNotAllowed in JSON rather than the empty body of the
+// router.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, http.StatusMethodNotAllowed,
+		fmt.Sprintf("Method %s is not allowed for %s", r.Method, r.URL.Path))
+}
@@ -0,0 +1,49 @@
+// routing_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// Test requests with the trailing or repeated slashes of gateways are
+// served as those without, a POST directly rather than redirected, and
+// that requests matching no route are refused in JSON.
+func TestStraySlashes(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	checkJSON := func(t *testing.T, method string, path string, code int, body []byte) map[string]interface{} {
+		var req *http.Request
+		if body != nil {
+			req, _ = newJSONRequest(method, path, bytes.NewBuffer(body))
+		} else {
+			req, _ = http.NewRequest(method, path, nil)
+		}
+		response := executeRequest(req)
+		checkResponseCode(t, code, response.Code)
+		var m map[string]interface{}
+		if contentType := response.Header().Get("Content-Type"); contentType != "application/json" ||
+			json.Unmarshal(response.Body.Bytes(), &m) != nil {
+			t.Errorf("Expected JSON for %s %s. Got %s: %s", method, path, contentType, response.Body.String())
+		}
+		return m
+	}
+
+	checkJSON(t, "POST", "/v1/payment/", http.StatusCreated, payload)
+	if m := checkJSON(t, "GET", "/v1/payments/", http.StatusOK, nil); len(m["data"].([]interface{})) != 1 {
+		t.Errorf("Expected the payments collection. Got %v", m)
+	}
+	m := checkJSON(t, "GET", "/v1//payment//4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", http.StatusOK, nil)
+	if m["id"] != "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43" {
+		t.Errorf("Expected the payment. Got %v", m)
+	}
+	checkJSON(t, "PUT", "//v1/payment//4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43/", http.StatusOK, payload)
+
+	if m := checkJSON(t, "GET", "/no/such/url", http.StatusNotFound, nil); m["error"] == nil {
+		t.Errorf("Expected an error. Got %v", m)
+	}
+	checkJSON(t, "PATCH", "/v1/payments/", http.StatusMethodNotAllowed, nil)
+}
@@ -0,0 +1,166 @@
+// schedule.go - Payment records held until their processing date, and
+// the worker releasing them once it arrives.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"time"
+)
+
+// The statuses of the payment records created with
+// hold_until_processing_date=true. Other payment records have none.
+const (
+	PaymentScheduled = "scheduled"
+	PaymentPending   = "pending"
+)
+
+// defaultReleaseInterval is how often the scheduled payment records
+// whose processing date has arrived are released, unless configured
+// otherwise.
+const defaultReleaseInterval = time.Minute
+
+// ErrPaymentNotScheduled is returned when a payment record that is not
+// scheduled is released.
+var ErrPaymentNotScheduled = errors.New("Payment is not scheduled")
+
+// checkPaymentStatus is a convenience function that ascertains the
+// status in status, by which payment records are listed, is one of the
+// statuses of payment records, or is empty.
+func checkPaymentStatus(status string) error {
+	if status != "" && status != PaymentScheduled && status != PaymentPending {
+		return fmt.Errorf("Invalid status %s, use %s or %s", status, PaymentScheduled, PaymentPending)
+	}
+	return nil
+}
+
+// releaseInterval is a convenience function that returns how often the
+// scheduled payment records are released: ReleaseInterval, or
+// defaultReleaseInterval if it is not positive.
+func (server *Server) releaseInterval() time.Duration {
+	if server.ReleaseInterval <= 0 {
+		return defaultReleaseInterval
+	}
+	return server.ReleaseInterval
+}
+
+// schedulePayment assigns the status of the new payment record in p,
+// sent with the request in r: scheduled if the request asks for it to
+// be held with hold_until_processing_date=true and its processing date
+// is after today, pending if it asks but the date has arrived, and none
+// otherwise, whatever the client sent.
+func (server *Server) schedulePayment(r *http.Request, p *Payment) {
+	switch {
+	case r.FormValue("hold_until_processing_date") != "true":
+		p.Status = ""
+	case p.Attributes.ProcessingDate > server.today():
+		p.Status = PaymentScheduled
+	default:
+		p.Status = PaymentPending
+	}
+}
+
+// release makes the scheduled payment record in p pending (see
+// modelReleasePayment) and publishes its update. mgo.ErrNotFound is
+// returned if it is no longer scheduled.
+func (server *Server) release(ctx context.Context, p *Payment) error {
+	attempt := 0
+	err := server.storage(ctx, "releasePayment", p.ID, func() error {
+		attempt++
+		err := p.modelReleasePayment(server.mongo, server.now().UTC())
+		if err == mgo.ErrNotFound && attempt > 1 {
+			// An earlier attempt released it, but its reply was lost.
+			p.Status = PaymentPending
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	server.cache.invalidate(p.ID)
+	server.publishEvent(EventUpdated, *p)
+	return nil
+}
+
+// releaseDuePayments releases the scheduled payment records whose
+// processing date has arrived, today in the Timezone of the server
+// (see today). Those released or deleted meanwhile are skipped. The
+// number of payment records released is returned.
+func (server *Server) releaseDuePayments(ctx context.Context) (int, error) {
+	var due []Payment
+	err := server.storage(ctx, "getDuePayments", "", func() (err error) {
+		due, err = modelGetDuePayments(server.mongo, server.today())
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+	released := 0
+	for i := range due {
+		switch err := server.release(ctx, &due[i]); err {
+		case nil:
+			released++
+		case mgo.ErrNotFound:
+		default:
+			return released, err
+		}
+	}
+	return released, nil
+}
+
+// runReleases releases the scheduled payment records whose processing
+// date has arrived at once and then every release interval (see
+// releaseInterval) until ctx is done. Failures are logged and retried
+// at the next interval.
+func (server *Server) runReleases(ctx context.Context) {
+	ticker := time.NewTicker(server.releaseInterval())
+	defer ticker.Stop()
+	for {
+		released, err := server.releaseDuePayments(ctx)
+		if err != nil {
+			server.logger().Warn().Err(err).Int("released", released).
+				Msg("Cannot release scheduled payments")
+		} else if released > 0 {
+			server.logger().Info().Int("released", released).Msg("Released scheduled payments")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// releasePayment is the entry-point dispatcher for the early release
+// of scheduled payment records. It responds to the URL
+// payment/{id}/release and an appropriate POST request by making the
+// payment record pending at once, and emits the released payment
+// record. A payment record that is not scheduled is refused with
+// StatusConflict. Payment records of other organisations than that of
+// the API key are not found.
+func (server *Server) releasePayment(w http.ResponseWriter, r *http.Request) {
+	payment, ok := server.findPayment(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if payment.Status != PaymentScheduled || payment.Archived {
+		respondWithError(w, http.StatusConflict, ErrPaymentNotScheduled.Error())
+		return
+	}
+
+	err := server.release(r.Context(), &payment)
+	if err == mgo.ErrNotFound {
+		respondWithError(w, http.StatusConflict, ErrPaymentNotScheduled.Error())
+		return
+	} else if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respondWithPayment(w, r, http.StatusOK, payment)
+}
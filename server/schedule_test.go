@@ -0,0 +1,108 @@
+// schedule_test.go
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/DeltaPine/payment_server/internal/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test payments held until their processing date are scheduled and
+// left out of the payments listed by default, are released early only
+// on request, and are released by the worker once the fake clock
+// reaches their processing date, publishing their update.
+func TestScheduledPayments(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	clock := testutil.NewFakeClock(time.Date(2017, 1, 11, 9, 0, 0, 0, time.UTC))
+	scheduling := newTestServer(t, func(x *Server) {
+		x.Clock = clock
+		x.ReleaseInterval = 10 * time.Millisecond
+		x.events = newEventHub()
+	})
+	execute := func(method, url string, body []byte) *httptest.ResponseRecorder {
+		req, _ := newJSONRequest(method, url, bytes.NewBuffer(body))
+		return executeOn(scheduling, req)
+	}
+	status := func(response *httptest.ResponseRecorder) string {
+		var p Payment
+		json.Unmarshal(response.Body.Bytes(), &p)
+		return p.Status
+	}
+	listed := func(query string) int {
+		response := execute("GET", "/v1/payments"+query, nil)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var payments Payments
+		json.Unmarshal(response.Body.Bytes(), &payments)
+		return len(payments.P)
+	}
+
+	due := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	later := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec44"
+	immediate := "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec45"
+	response := execute("POST", "/v1/payment?hold_until_processing_date=true", payload)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	if status(response) != PaymentScheduled {
+		t.Errorf("Expected the held payment to be scheduled. Got %s", response.Body.String())
+	}
+	held := bytes.Replace(payload, []byte(due), []byte(later), 1)
+	held = bytes.Replace(held, []byte(`"processing_date":"2017-01-18"`),
+		[]byte(`"processing_date":"2017-01-25"`), 1)
+	checkResponseCode(t, http.StatusCreated,
+		execute("POST", "/v1/payment?hold_until_processing_date=true", held).Code)
+	response = execute("POST", "/v1/payment", bytes.Replace(payload, []byte(due), []byte(immediate), 1))
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	if status(response) != "" {
+		t.Errorf("Expected a payment that is not held to have no status. Got %s", response.Body.String())
+	}
+
+	if count := listed(""); count != 1 {
+		t.Errorf("Expected scheduled payments to be left out by default. Got %d payments", count)
+	}
+	if count := listed("?status=scheduled"); count != 2 {
+		t.Errorf("Expected the 2 scheduled payments. Got %d", count)
+	}
+	if count := listed("?ids=" + due); count != 1 {
+		t.Errorf("Expected a scheduled payment requested by Payment ID. Got %d payments", count)
+	}
+	checkResponseCode(t, http.StatusBadRequest, execute("GET", "/v1/payments?status=held", nil).Code)
+
+	response = execute("POST", "/v1/payment/"+later+"/release", nil)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if status(response) != PaymentPending {
+		t.Errorf("Expected the released payment to be pending. Got %s", response.Body.String())
+	}
+	checkResponseCode(t, http.StatusConflict, execute("POST", "/v1/payment/"+later+"/release", nil).Code)
+	checkResponseCode(t, http.StatusConflict, execute("POST", "/v1/payment/"+immediate+"/release", nil).Code)
+
+	subscriber := scheduling.events.subscribe("")
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go scheduling.runReleases(ctx)
+	time.Sleep(50 * time.Millisecond)
+	if status(execute("GET", "/v1/payment/"+due, nil)) != PaymentScheduled {
+		t.Fatalf("Expected the payment to stay scheduled until its processing date")
+	}
+
+	clock.Advance(7 * 24 * time.Hour)
+	select {
+	case event := <-subscriber.events:
+		if event.Type != EventUpdated || event.ID != due || event.Payment.Status != PaymentPending {
+			t.Errorf("Expected the release of %s to be published. Got %+v", due, event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the payment to be released once its processing date arrived")
+	}
+	if status(execute("GET", "/v1/payment/"+due, nil)) != PaymentPending {
+		t.Errorf("Expected the released payment to be pending")
+	}
+	if count := listed(""); count != 3 {
+		t.Errorf("Expected the released payments to be listed. Got %d payments", count)
+	}
+}
@@ -0,0 +1,410 @@
+// search.go - Structured searches of the payment records.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The number of items a page of a paged collection holds unless the
+// client asks otherwise, and the most a client may ask for, unless the
+// server is configured otherwise (see pageSizes).
+const (
+	defaultPageSize    = 100
+	defaultMaxPageSize = 1000
+)
+
+// searchSortFields maps the fields a search may be sorted by to the
+// attributes of the payment records they sort on. The amount sorts on
+// the amount in minor units maintained alongside it, as the amount is
+// stored as a string and would sort lexically, "100.00" before "9.00".
+var searchSortFields = map[string]string{
+	"id":              "_id",
+	"organisation_id": "organisation_id",
+	"amount":          "amount_minor_units",
+	"currency":        "attributes.currency",
+	"processing_date": "attributes.processing_date",
+}
+
+// sortComparisons compares payment records by each of the fields of
+// searchSortFields, for the collections sorted once read, such as those
+// merged with the archive.
+var sortComparisons = map[string]func(a, b *Payment) int{
+	"id":              func(a, b *Payment) int { return strings.Compare(a.ID, b.ID) },
+	"organisation_id": func(a, b *Payment) int { return strings.Compare(a.OrganisationID, b.OrganisationID) },
+	"amount":          func(a, b *Payment) int { return a.Attributes.Amount.Cmp(b.Attributes.Amount) },
+	"currency": func(a, b *Payment) int {
+		return strings.Compare(a.Attributes.Currency, b.Attributes.Currency)
+	},
+	"processing_date": func(a, b *Payment) int {
+		return strings.Compare(a.Attributes.ProcessingDate, b.Attributes.ProcessingDate)
+	},
+}
+
+// searchTextFields are the attributes of the payment records the text
+// of a search is looked for in.
+var searchTextFields = []string{
+	"attributes.reference",
+	"attributes.end_to_end_reference",
+	"attributes.numeric_reference",
+	"attributes.payment_purpose",
+	"attributes.debtor_party.name",
+	"attributes.beneficiary_party.name",
+}
+
+// PaymentSearch is a structured search of the payment records, as sent
+// by clients. Only the fields of PaymentSearch can be searched on, and
+// every value is matched literally, so that clients cannot inject
+// query operators. Fields that are not populated do not restrict the
+// search. Text is looked for, ignoring case, in the references,
+// purpose and party names of the payment records. Sort lists the
+// fields of searchSortFields to sort by, each optionally prefixed by
+// "-" for descending order, and the payment records are finally
+// sorted by Payment ID.
+type PaymentSearch struct {
+	OrganisationIDs []string `json:"organisation_ids"`
+	Currencies      []string `json:"currencies"`
+	Amount          struct {
+		Min *Amount `json:"min"`
+		Max *Amount `json:"max"`
+	} `json:"amount"`
+	ProcessingDate struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	} `json:"processing_date"`
+	Text   string   `json:"text"`
+	Sort   []string `json:"sort"`
+	Limit  int      `json:"limit"`
+	Offset int      `json:"offset"`
+
+	// status and hideScheduled select payment records by status, as
+	// in a PaymentFilter, for the listing of the payments due.
+	status        string
+	hideScheduled bool
+}
+
+// SearchResult is a page of the payment records found by a search,
+// along with the total number found.
+type SearchResult struct {
+	P      []Payment `json:"data"`
+	Total  int       `json:"total"`
+	Limit  int       `json:"limit"`
+	Offset int       `json:"offset"`
+}
+
+// check ascertains every field of the PaymentSearch holds an
+// acceptable value, and returns a ValidationError describing the first
+// that does not. The Limit may be no more than maxPageSize, and a Limit
+// of zero is replaced by pageSize.
+func (search *PaymentSearch) check(pageSize int, maxPageSize int) error {
+	for i, amount := range []*Amount{search.Amount.Min, search.Amount.Max} {
+		if amount == nil {
+			continue
+		}
+		if _, ok := amount.MinorUnits(); !ok {
+			return &ValidationError{Attribute: []string{"amount.min", "amount.max"}[i],
+				Reason: fmt.Sprintf("%s cannot be held in minor units", amount)}
+		}
+	}
+	for i, date := range []string{search.ProcessingDate.From, search.ProcessingDate.To} {
+		if _, err := time.Parse(ProcessingDateLayout, date); date != "" && err != nil {
+			return &ValidationError{
+				Attribute: []string{"processing_date.from", "processing_date.to"}[i],
+				Reason:    fmt.Sprintf("%s is not a YYYY-MM-DD date", date)}
+		}
+	}
+	if err := checkSortFields(search.Sort); err != nil {
+		return err
+	}
+	if search.Limit < 0 {
+		return &ValidationError{Attribute: "limit",
+			Reason: fmt.Sprintf("use 1 to %d", maxPageSize)}
+	}
+	if search.Limit > maxPageSize {
+		return &ValidationError{Attribute: "limit",
+			Reason: fmt.Sprintf("%d is above the maximum page size of %d", search.Limit, maxPageSize)}
+	}
+	if search.Offset < 0 {
+		return &ValidationError{Attribute: "offset", Reason: "cannot be negative"}
+	}
+	if search.Limit == 0 {
+		search.Limit = pageSize
+	}
+	return nil
+}
+
+// selector returns the query selecting the payment records matched by
+// the PaymentSearch, their account numbers sealed with keys, restricted
+// to the organisation in organisation if it is populated. The
+// PaymentSearch must have been checked.
+func (search *PaymentSearch) selector(keys *accountKeyring, organisation string) bson.M {
+	var clauses []bson.M
+	if organisation != "" {
+		clauses = append(clauses, bson.M{"organisation_id": organisation})
+	}
+	if len(search.OrganisationIDs) > 0 {
+		clauses = append(clauses,
+			bson.M{"organisation_id": bson.M{"$in": search.OrganisationIDs}})
+	}
+	if len(search.Currencies) > 0 {
+		clauses = append(clauses,
+			bson.M{"attributes.currency": bson.M{"$in": search.Currencies}})
+	}
+
+	filter := PaymentFilter{
+		ProcessingDateFrom: search.ProcessingDate.From,
+		ProcessingDateTo:   search.ProcessingDate.To,
+		MinAmount:          search.Amount.Min,
+		MaxAmount:          search.Amount.Max,
+		Status:             search.status,
+		HideScheduled:      search.hideScheduled,
+	}
+	if ranges := filter.selector(keys); len(ranges) > 0 {
+		clauses = append(clauses, ranges)
+	}
+
+	if search.Text != "" {
+		pattern := bson.RegEx{Pattern: regexp.QuoteMeta(search.Text), Options: "i"}
+		var text []bson.M
+		for _, field := range searchTextFields {
+			text = append(text, bson.M{field: pattern})
+		}
+		clauses = append(clauses, bson.M{"$or": text})
+	}
+
+	if len(clauses) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": clauses}
+}
+
+// checkSortFields is a convenience function that ascertains every
+// field of sort is among searchSortFields, optionally prefixed by "-",
+// and returns a ValidationError naming the first that is not.
+func checkSortFields(sort []string) error {
+	for _, field := range sort {
+		if _, ok := searchSortFields[strings.TrimPrefix(field, "-")]; !ok {
+			return &ValidationError{Attribute: "sort",
+				Reason: fmt.Sprintf("cannot sort by %q", field)}
+		}
+	}
+	return nil
+}
+
+// sortFields is a convenience function that returns the fields of the
+// backing store that payment records sorted by the fields of sort are
+// sorted by, in mgo's form, finally sorting by Payment ID so that the
+// order is the same on every read. The fields must have been checked.
+func sortFields(sort []string) []string {
+	var fields []string
+	for _, field := range sort {
+		order := ""
+		if strings.HasPrefix(field, "-") {
+			order = "-"
+		}
+		fields = append(fields, order+searchSortFields[strings.TrimPrefix(field, "-")])
+	}
+	return append(fields, "_id")
+}
+
+// sortPayments is a convenience function that sorts the payment
+// records in payments by the fields of sort, as sortFields does in the
+// backing store. The fields must have been checked.
+func sortPayments(payments []Payment, sort []string) {
+	slices.SortStableFunc(payments, func(a, b Payment) int {
+		for _, field := range sort {
+			order := 1
+			if strings.HasPrefix(field, "-") {
+				order = -1
+			}
+			if c := sortComparisons[strings.TrimPrefix(field, "-")](&a, &b); c != 0 {
+				return order * c
+			}
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+}
+
+// sortFields returns the fields of the backing store the payment
+// records found by the PaymentSearch are sorted by, in mgo's form.
+func (search *PaymentSearch) sortFields() []string {
+	return sortFields(search.Sort)
+}
+
+// searchPayments is the entry-point dispatcher for structured searches
+// of the payment records. It responds to the URL payments/search and
+// an appropriate POST request carrying a PaymentSearch. A search with
+// fields PaymentSearch does not have, or with unacceptable values, is
+// refused with StatusBadRequest. A page of the payment records found
+// is returned along with their total number. Searches scoped to an
+// organisation only find the payment records of that organisation.
+func (server *Server) searchPayments(w http.ResponseWriter, r *http.Request) {
+	var search PaymentSearch
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	defer r.Body.Close()
+
+	if err := decoder.Decode(&search); err != nil {
+		if bodyTooLarge(err) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Request payload too large")
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Invalid search request: "+err.Error())
+		return
+	}
+	if err := search.check(server.pageSizes()); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var result SearchResult
+	ctx := withQueryFilter(r.Context(), search)
+	err := server.storage(ctx, "searchPayments", "", func() (err error) {
+		result.P, result.Total, err = search.modelSearchPayments(server.mongo,
+			callerOrganisation(r))
+		return
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	result.Limit, result.Offset = search.Limit, search.Offset
+	respondWith(w, http.StatusOK, result, negotiatedType(w))
+}
+
+// getDuePayments is the entry-point dispatcher for the payment records
+// due for processing on a date. It responds to the URL payments/due
+// and an appropriate GET request with date, a YYYY-MM-DD date that
+// defaults to today in the Timezone of the server. Only the payment
+// records of status are returned if it is populated, and otherwise
+// those that are not scheduled, as they are not yet released for
+// processing. The payment records are paged with limit and offset, as
+// in a PaymentSearch, and sorted with sort, a comma separated list of
+// the fields a PaymentSearch may be sorted by. They are returned in a
+// payments collection linking to the next page if there is one. Only
+// the payment records of the organisation of the API key are returned,
+// if any.
+func (server *Server) getDuePayments(w http.ResponseWriter, r *http.Request) {
+	date := r.FormValue("date")
+	if date == "" {
+		date = server.today()
+	} else if _, err := time.Parse(ProcessingDateLayout, date); err != nil {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("Invalid date %s, use YYYY-MM-DD", date))
+		return
+	}
+
+	status := r.FormValue("status")
+	if err := checkPaymentStatus(status); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	search := PaymentSearch{Sort: requestedIDs(r.FormValue("sort")), status: status,
+		hideScheduled: status == ""}
+	search.ProcessingDate.From, search.ProcessingDate.To = date, date
+	parameters := []struct {
+		name  string
+		value *int
+	}{{"limit", &search.Limit}, {"offset", &search.Offset}}
+	for _, parameter := range parameters {
+		if value := r.FormValue(parameter.name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest,
+					fmt.Sprintf("Invalid %s %s", parameter.name, value))
+				return
+			}
+			*parameter.value = parsed
+		}
+	}
+	if err := search.check(server.pageSizes()); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var payments Payments
+	var total int
+	ctx := withQueryFilter(r.Context(), search)
+	err := server.storage(ctx, "searchPayments", "", func() (err error) {
+		payments.P, total, err = search.modelSearchPayments(server.mongo, callerOrganisation(r))
+		return
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	payments.Meta = newPageMeta(search.Limit, search.Offset, total)
+	payments.Links.Self = duePaymentsLink(date, &search, search.Offset)
+	if next := search.Offset + search.Limit; next < total {
+		payments.Links.Next = duePaymentsLink(date, &search, next)
+	}
+	respondWith(w, http.StatusOK, payments, negotiatedType(w))
+}
+
+// pageSizes returns the number of items a page of a paged collection
+// holds unless the client asks otherwise, DefaultPageSize or
+// defaultPageSize if it is not set, and the most a client may ask for,
+// MaxPageSize or defaultMaxPageSize if it is not set. The first never
+// exceeds the second.
+func (server *Server) pageSizes() (int, int) {
+	pageSize, maxPageSize := server.DefaultPageSize, server.MaxPageSize
+	if maxPageSize <= 0 {
+		maxPageSize = defaultMaxPageSize
+	}
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	return pageSize, maxPageSize
+}
+
+// pageLimit is a convenience function that returns the size of the
+// page of a paged collection requested by the limit of the request in
+// r, or the default page size if it has none (see pageSizes). A limit
+// that is not a number from 1 to the maximum page size is refused with
+// an error explaining why.
+func (server *Server) pageLimit(r *http.Request) (int, error) {
+	pageSize, maxPageSize := server.pageSizes()
+	value := r.FormValue("limit")
+	if value == "" {
+		return pageSize, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("Invalid limit %s, use 1 to %d", value, maxPageSize)
+	} else if limit > maxPageSize {
+		return 0, fmt.Errorf("Invalid limit %d, above the maximum page size of %d", limit, maxPageSize)
+	}
+	return limit, nil
+}
+
+// duePaymentsLink is a convenience function that returns the link to
+// the page starting at offset of the payment records due on date,
+// selected, paged and sorted as in search.
+func duePaymentsLink(date string, search *PaymentSearch, offset int) string {
+	query := url.Values{}
+	query.Set("date", date)
+	if search.status != "" {
+		query.Set("status", search.status)
+	}
+	query.Set("limit", strconv.Itoa(search.Limit))
+	query.Set("offset", strconv.Itoa(offset))
+	if len(search.Sort) > 0 {
+		query.Set("sort", strings.Join(search.Sort, ","))
+	}
+	return apiLink("/payments/due?" + query.Encode())
+}
@@ -0,0 +1,74 @@
+// security.go - The security headers of responses, hardening browsers
+// against the misuse of the API.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// securityHeaders are the security headers a response may carry and
+// their values: its Content-Type is not to be sniffed, it is not to be
+// framed, no referrer is to be sent from it, and, over TLS, the server
+// is only to be reached over TLS for the next two years.
+var securityHeaders = map[string]string{
+	"X-Content-Type-Options":    "nosniff",
+	"X-Frame-Options":           "DENY",
+	"Referrer-Policy":           "no-referrer",
+	"Strict-Transport-Security": "max-age=63072000; includeSubDomains",
+}
+
+// tlsOnlyHeaders are the securityHeaders only sent on responses over
+// TLS, or over TLS terminated by a proxy.
+var tlsOnlyHeaders = map[string]bool{"Strict-Transport-Security": true}
+
+// ParseSecurityHeaders parses the comma separated list of security
+// headers in list, such as "X-Content-Type-Options,X-Frame-Options".
+// An empty list selects every security header, and "none" none of
+// them. Names are not case sensitive, and unknown names are refused.
+func ParseSecurityHeaders(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	names := []string{}
+	if strings.EqualFold(strings.TrimSpace(list), "none") {
+		return names, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := securityHeaders[name]; !ok {
+			return nil, fmt.Errorf("Unknown security header %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// addSecurityHeaders is a middleware that sets the security headers of
+// SecurityHeaders on every response, or all of securityHeaders if it is
+// nil. Those of tlsOnlyHeaders are only set if the request came over
+// TLS, directly or through a proxy reporting it in X-Forwarded-Proto.
+func (server *Server) addSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tls := r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+		set := func(name string) {
+			if value, ok := securityHeaders[name]; ok && (tls || !tlsOnlyHeaders[name]) {
+				w.Header().Set(name, value)
+			}
+		}
+		if server.SecurityHeaders == nil {
+			for name := range securityHeaders {
+				set(name)
+			}
+		}
+		for _, name := range server.SecurityHeaders {
+			set(name)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,65 @@
+// security_test.go
+
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Test every security header appears on responses by default, those
+// to requests the router refuses included, with
+// Strict-Transport-Security only over TLS, and that a trimmed set of
+// headers sends only those.
+func TestSecurityHeaders(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/v1/payments", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	expected := map[string]string{
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "no-referrer",
+		"Strict-Transport-Security": "",
+	}
+	for name, value := range expected {
+		if got := response.Header().Get(name); got != value {
+			t.Errorf("Expected %s to be %q. Got %q", name, value, got)
+		}
+	}
+
+	for _, refused := range []struct{ method, url string }{
+		{"GET", "/v1/nowhere"}, {"TRACE", "/v1/payments"},
+	} {
+		req, _ := http.NewRequest(refused.method, refused.url, nil)
+		if rr := executeRequest(req); rr.Header().Get("X-Frame-Options") != "DENY" {
+			t.Errorf("Expected the security headers on %s %s refused with %d. Got %v",
+				refused.method, refused.url, rr.Code, rr.Header())
+		}
+	}
+
+	req.Header.Set("X-Forwarded-Proto", "https")
+	response = executeRequest(req)
+	if hsts := response.Header().Get("Strict-Transport-Security"); hsts == "" {
+		t.Errorf("Expected Strict-Transport-Security over TLS")
+	}
+
+	names, err := ParseSecurityHeaders(" x-content-type-options ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trimmed := newTestServer(t, func(x *Server) {
+		x.SecurityHeaders = names
+	})
+	rr := executeOn(trimmed, req)
+	if rr.Header().Get("X-Content-Type-Options") != "nosniff" ||
+		rr.Header().Get("X-Frame-Options") != "" || rr.Header().Get("Strict-Transport-Security") != "" {
+		t.Errorf("Expected only X-Content-Type-Options. Got %v", rr.Header())
+	}
+
+	if names, err := ParseSecurityHeaders("none"); err != nil || names == nil || len(names) != 0 {
+		t.Errorf("Expected none to select no headers. Got %v, %v", names, err)
+	}
+	if _, err := ParseSecurityHeaders("X-Powered-By"); err == nil {
+		t.Errorf("Expected an unknown security header to be refused")
+	}
+}
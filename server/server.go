@@ -0,0 +1,2130 @@
+// Package server is the payment server as a library: a marshalling
+// interface for Gorilla router, dispatcher and integrator for the
+// backing MongoDB database, which programs may embed (see New) and
+// serve under their own routers (see Server.Handler).
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"gopkg.in/mgo.v2"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Config is the configuration of a Server (see New). Fields that are
+// not set take the defaults described on them.
+type Config struct {
+	// MongoURI reaches the backing database: a host such as
+	// "localhost:27017", the default, or a MongoDB connection URI (see
+	// mongoDialInfo).
+	MongoURI string
+	// Database holds the payments, by default the database named by
+	// the URI, or "payments_v1".
+	Database string
+	// Collection holds the payments, "payments" by default.
+	Collection string
+	// AdminKey enables the administrative endpoints, which clients
+	// must present it in the X-API-Key header to use.
+	AdminKey string
+	// PurgeEndpoint further enables the purge of the whole collection.
+	PurgeEndpoint bool
+	// APIKeys, if any, must be presented in the X-API-Key header to
+	// use the payment endpoints, and restrict clients to the payment
+	// records of the key's organisation.
+	APIKeys map[string]APIKey
+	// CacheSize enables the cache of single payment records in
+	// memory, each cached for no longer than CacheTTL.
+	CacheSize int
+	CacheTTL  time.Duration
+	// DuplicateCheck refuses payments that duplicate the details of an
+	// existing payment record.
+	DuplicateCheck bool
+	// UniqueSchemePaymentID refuses payments with the payment_id of an
+	// existing payment record of their organisation, which a unique
+	// index of the database enforces.
+	UniqueSchemePaymentID bool
+	// RejectPastDates and MaxFutureDays restrict new payments to
+	// processing dates from today and to no more than that many days
+	// ahead.
+	RejectPastDates bool
+	MaxFutureDays   int
+	// AmountLimits caps payment amounts per currency (see
+	// checkAmountLimit).
+	AmountLimits map[string]Amount
+	// DebugEndpoints enables the profiling and runtime debug endpoints,
+	// provided AdminKey is set.
+	DebugEndpoints bool
+	// DocsUI enables the Swagger UI rendering the OpenAPI document,
+	// which is always served. Its assets are served from DocsAssetsDir
+	// if set and otherwise loaded from a pinned release on unpkg.
+	DocsUI        bool
+	DocsAssetsDir string
+	// StorageRetries is how many times idempotent storage operations
+	// failing with a transient error are retried.
+	StorageRetries int
+	// ConsistencyMode is the consistency mode of the database session
+	// (see parseConsistencyMode).
+	ConsistencyMode string
+	// MongoAuth holds the credentials and TLS settings of the database
+	// session.
+	MongoAuth MongoAuth
+	// ProblemDetails emits every error as RFC 7807 problem details,
+	// rather than only to clients accepting ProblemMediaType.
+	ProblemDetails bool
+	// Timezone is the time zone of dates such as today's, UTC by
+	// default.
+	Timezone *time.Location
+	// HTTPTimeouts bounds the time the web server allows clients.
+	HTTPTimeouts HTTPTimeouts
+	// Clock is read for the current time, the system clock by default.
+	Clock Clock
+	// MaxInFlight refuses requests beyond that many at once, as
+	// MaxInFlightReads and MaxInFlightWrites do reads and writes, once
+	// none completes within InFlightWait (see limitRequests).
+	MaxInFlight       int
+	MaxInFlightReads  int
+	MaxInFlightWrites int
+	InFlightWait      time.Duration
+	// MaxSubscriptions bounds the WebSocket subscriptions, which are
+	// not counted as requests in flight.
+	MaxSubscriptions int
+	// BreakerFailures refuses storage operations for BreakerCooldown
+	// once that many fail in a row (see circuitBreaker).
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	// LogMaskedFields are masked in the logs along with the values
+	// masked by default (see logMasker).
+	LogMaskedFields []string
+	// EncryptionKey encrypts the stored account numbers (see
+	// AccountNumber). Those encrypted with RetiredEncryptionKeys are
+	// still read until they are re-encrypted (see reencryptPayments).
+	EncryptionKey         string
+	RetiredEncryptionKeys []string
+	// GRPCAddr is the address the gRPC PaymentService is served on, if
+	// set.
+	GRPCAddr string
+	// DefaultPageSize is the number of items a page of a paged
+	// collection holds, unless clients ask for up to MaxPageSize (see
+	// pageSizes).
+	DefaultPageSize int
+	MaxPageSize     int
+	// SchemeTypes and SchemeSubTypes are the scheme payment types and
+	// sub types payments may have, the defaults if they are not set
+	// (see schemePaymentTypes).
+	SchemeTypes    []string
+	SchemeSubTypes []string
+	// MaxBodySize bounds the bodies of requests, in bytes, including
+	// those compressed with gzip once decompressed (see limitBodies and
+	// acceptGzip).
+	MaxBodySize int64
+	// MaxTextLength bounds the free text attributes of payment
+	// records, in characters (see checkTextAttributes).
+	MaxTextLength int
+	// NormalisedFields are the free text attributes whose whitespace is
+	// normalised (see normalisedFields).
+	NormalisedFields []string
+	// Logger is logged to, defaultLogger by default (see logRequests).
+	Logger *zerolog.Logger
+	// IDGenerator gives payments created without a Payment ID one, the
+	// generator of IDFormat by default. They are refused if neither is
+	// set (see assignID).
+	IDGenerator IDGenerator
+	IDFormat    string
+	// SecurityHeaders are the security headers responses carry, all of
+	// them if it is nil (see addSecurityHeaders).
+	SecurityHeaders []string
+	// LegacySunset is announced as the time the deprecated URLs of the
+	// web API without its /v1 prefix will be withdrawn, if it is set
+	// (see deprecateUnversioned).
+	LegacySunset time.Time
+	// SlowQueryThreshold is how long storage operations may take before
+	// they are logged and counted, 500ms if it is zero, and none are if
+	// it is negative (see watchStorage).
+	SlowQueryThreshold time.Duration
+	// ChangeFeedLag is how long ago the payment records the change feed
+	// reports must have been written, 5s if it is zero, and at once if
+	// it is negative (see getChanges).
+	ChangeFeedLag time.Duration
+	// ReleaseInterval is how often the scheduled payment records whose
+	// processing date has arrived are released, a minute if it is zero
+	// (see runReleases).
+	ReleaseInterval time.Duration
+	// RetentionDays, if positive, removes the payment records with a
+	// processing date more than that many days ago every
+	// RetentionInterval, an hour if it is zero, deleted or archived as
+	// RetentionAction says (see runRetention).
+	RetentionDays     int
+	RetentionInterval time.Duration
+	RetentionAction   string
+}
+
+// Server is a payment server, consisting of its Config, a Dispatcher,
+// a database session and a database object, and the paymentStore its
+// handlers of single payment records use. Servers are created by New,
+// and their Handler may be mounted under any router.
+type Server struct {
+	Config
+	Dispatch     *mux.Router
+	Session      *mgo.Session
+	DB           *mgo.Database
+	mongo        *mongoStore
+	store        paymentStore
+	keys         *accountKeyring
+	mongoStats   bool
+	cache        *paymentCache
+	retry        *retryPolicy
+	limiter      *requestLimiter
+	readLimiter  *requestLimiter
+	writeLimiter *requestLimiter
+	subscribers  *requestLimiter
+	breaker      *circuitBreaker
+	masker       *logMasker
+	events       *eventHub
+	lastDeletion *int64
+	normalised   map[string]bool
+}
+
+// HTTPTimeouts bound the time the web server allows clients: to send
+// the headers of a request with ReadHeader, the whole request with
+// Read, and to receive the response with Write, timed from the end of
+// the request headers. Idle bounds how long a kept alive connection
+// waits for the next request. Timeouts that are not set take the
+// default of defaultHTTPTimeouts.
+type HTTPTimeouts struct {
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
+// defaultHTTPTimeouts are the timeouts of the web server unless
+// configured otherwise. Write allows for exports of large collections.
+var defaultHTTPTimeouts = HTTPTimeouts{
+	ReadHeader: 5 * time.Second,
+	Read:       30 * time.Second,
+	Write:      2 * time.Minute,
+	Idle:       2 * time.Minute,
+}
+
+// withDefaults returns the HTTPTimeouts with those not set replaced by
+// the defaultHTTPTimeouts.
+func (timeouts HTTPTimeouts) withDefaults() HTTPTimeouts {
+	if timeouts.ReadHeader <= 0 {
+		timeouts.ReadHeader = defaultHTTPTimeouts.ReadHeader
+	}
+	if timeouts.Read <= 0 {
+		timeouts.Read = defaultHTTPTimeouts.Read
+	}
+	if timeouts.Write <= 0 {
+		timeouts.Write = defaultHTTPTimeouts.Write
+	}
+	if timeouts.Idle <= 0 {
+		timeouts.Idle = defaultHTTPTimeouts.Idle
+	}
+	return timeouts
+}
+
+// The time allowed to connect to the backing database, and for each
+// operation on it, as mgo.Dial allows.
+const (
+	mongoDialTimeout      = 10 * time.Second
+	mongoOperationTimeout = time.Minute
+)
+
+// consistencyModes maps the names of the consistency modes the
+// database session may be set to to their mgo modes.
+var consistencyModes = map[string]mgo.Mode{
+	"strong":    mgo.Strong,
+	"monotonic": mgo.Monotonic,
+	"eventual":  mgo.Eventual,
+}
+
+// EnvelopeMediaType is the media type clients list in their Accept
+// header to receive single payment records wrapped in a
+// PaymentEnvelope rather than as a bare Payment.
+const EnvelopeMediaType = "application/vnd.payments.v2+json"
+
+// The database and collection of servers configured with neither.
+const (
+	defaultMongoURI   = "localhost:27017"
+	defaultDatabase   = "payments_v1"
+	defaultCollection = "payments"
+)
+
+// New returns a new Server of config, connected to its backing
+// database and with its dispatcher set up. Please note that the
+// backing database should be already started outside of this program.
+// Pending migrations of the backing database are applied before the
+// dispatcher is set up (see migrate). Each Server of a program has the
+// Collection and encryption keys of its own Config, and nothing shared
+// with the others changes unless New succeeds. The Server must be
+// closed once done with (see Close).
+func New(config Config) (*Server, error) {
+	server := &Server{Config: config}
+	info, mode, err := server.configure()
+	if err != nil {
+		return nil, err
+	}
+	logger := server.logger()
+	logger.Info().Str("address", redactMongoURI(server.MongoURI)).Msg("Connecting to the database")
+	session, err := dialMongo(info)
+	if err != nil {
+		return nil, err
+	}
+	server.useSession(session, mode)
+	if err := modelEnsureIndexes(server.mongo); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("Cannot create the indexes of the database: %s", err)
+	}
+	if err := migrate(server.mongo, logger); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("Cannot migrate the database: %s", err)
+	}
+	server.cache = newPaymentCache(server.CacheSize, server.CacheTTL)
+	if server.cache != nil {
+		server.cache.timeSource = server.now
+	}
+	server.retry = newRetryPolicy(server.StorageRetries, session.Refresh)
+	server.lastDeletion = new(int64)
+	server.limiter = newRequestLimiter("all", server.MaxInFlight, server.InFlightWait)
+	server.readLimiter = newRequestLimiter("reads", server.MaxInFlightReads, server.InFlightWait)
+	server.writeLimiter = newRequestLimiter("writes", server.MaxInFlightWrites, server.InFlightWait)
+	server.subscribers = newRequestLimiter("subscriptions", server.MaxSubscriptions, 0)
+	server.masker = newLogMasker(server.LogMaskedFields)
+	server.events = newEventHub()
+	server.breaker = newCircuitBreaker(server.BreakerFailures, server.BreakerCooldown)
+	if server.breaker != nil {
+		server.breaker.timeSource = server.now
+	}
+	if server.DebugEndpoints {
+		mgo.SetStats(true)
+		server.mongoStats = true
+	}
+	server.Dispatch = mux.NewRouter()
+	server.initializeRoutes()
+	return server, nil
+}
+
+// configure fills in the defaults of the configuration of the server
+// and returns the details of the connection to its backing database
+// and the consistency mode of its session, or an error describing the
+// first invalid setting. Nothing shared with other Servers is changed.
+func (server *Server) configure() (*mgo.DialInfo, mgo.Mode, error) {
+	if server.MongoURI == "" {
+		server.MongoURI = defaultMongoURI
+	}
+	if server.Collection == "" {
+		server.Collection = defaultCollection
+	}
+	info, err := mongoDialInfo(server.MongoURI, server.MongoAuth)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid database address: %s", err)
+	}
+	if server.Database == "" {
+		server.Database = info.Database
+	}
+	if server.Database == "" {
+		server.Database = defaultDatabase
+	}
+
+	mode, err := parseConsistencyMode(server.ConsistencyMode)
+	if err != nil {
+		return nil, 0, err
+	}
+	if server.keys, err = newAccountKeyring(server.EncryptionKey, server.RetiredEncryptionKeys); err != nil {
+		return nil, 0, err
+	}
+	if err = checkRetentionAction(server.RetentionAction); err != nil {
+		return nil, 0, err
+	}
+	if server.IDGenerator == nil {
+		if server.IDGenerator, err = newIDGenerator(server.IDFormat, server.now); err != nil {
+			return nil, 0, err
+		}
+	}
+	if server.normalised, err = server.normalisedFields(); err != nil {
+		return nil, 0, err
+	}
+	return info, mode, nil
+}
+
+// useSession has the server use the database session in session, in the
+// consistency mode in mode, for its backing database and collection,
+// sealed with its encryption keys.
+func (server *Server) useSession(session *mgo.Session, mode mgo.Mode) {
+	session.SetSyncTimeout(mongoOperationTimeout)
+	session.SetSocketTimeout(mongoOperationTimeout)
+	session.SetMode(mode, true)
+	server.Session = session
+	server.DB = session.DB(server.Database)
+	server.mongo = &mongoStore{Database: server.DB, collection: server.Collection, keys: server.keys,
+		uniqueSchemePaymentIDs: server.UniqueSchemePaymentID}
+	server.store = server.mongo
+}
+
+// Handler returns the handler serving the web API of the server, to
+// be mounted under any router or served directly, as by Run. Stray
+// slashes are taken out of the paths of requests before they are
+// routed (see normalisePath).
+func (server *Server) Handler() http.Handler {
+	return server.normalisePath(server.Dispatch)
+}
+
+// Close closes the WebSocket subscriptions to the changes to payments
+// and the database session of the server. The server must not be used
+// once closed.
+func (server *Server) Close() {
+	server.events.close()
+	server.Session.Close()
+}
+
+// parseConsistencyMode returns the mgo mode named by mode, one of
+// strong, monotonic or eventual, ignoring case. An empty mode is
+// monotonic.
+func parseConsistencyMode(mode string) (mgo.Mode, error) {
+	if mode == "" {
+		return mgo.Monotonic, nil
+	}
+	if parsed, ok := consistencyModes[strings.ToLower(mode)]; ok {
+		return parsed, nil
+	}
+	return mgo.Monotonic, fmt.Errorf(
+		"Unknown consistency mode %q, use strong, monotonic or eventual", mode)
+}
+
+// initializeRoutes is a dispatcher for the various RESTFUL methods of
+// input and output for the web server. It sets up the routes of each
+// version of the web API, under the /v1 prefix and, deprecated,
+// without it (see initializeVersionedRoutes and initializeV1Routes).
+// The OpenAPI, version and health URLs are set up regardless, without
+// a version prefix, as are the debug URLs if DebugEndpoints is set as
+// well as AdminKey, and requests for any other URL, or with a method
+// it does not accept, are refused in JSON (see routeNotFound). Every
+// request is traced (see traceRequests) and logged (see logRequests),
+// given security headers (see addSecurityHeaders), its responses
+// encoded in the media type it accepts (see negotiateContent), its
+// errors emitted as problem details when called for (see
+// problemDetails), its body bounded in size (see limitBodies), and
+// request bodies of an unsupported content type are refused (see
+// requireContentType). The middleware does not run for the requests
+// the router refuses, which are given security headers separately.
+func (server *Server) initializeRoutes() {
+	server.Dispatch.Use(traceRequests)
+	server.Dispatch.Use(server.logRequests)
+	server.Dispatch.Use(server.addSecurityHeaders)
+	server.Dispatch.Use(negotiateContent)
+	server.Dispatch.Use(server.problemDetails)
+	server.Dispatch.Use(server.limitRequests)
+	server.Dispatch.Use(server.limitBodies)
+	server.Dispatch.Use(requireContentType)
+	server.initializeVersionedRoutes()
+
+	if server.AdminKey != "" && server.DebugEndpoints {
+		server.initializeDebugRoutes()
+	}
+	server.initializeOpenAPIRoutes()
+	server.Dispatch.HandleFunc("/version", getVersion).Methods("GET")
+	server.Dispatch.HandleFunc("/health", server.getHealth).Methods("GET")
+
+	server.initializeOptionsRoutes()
+	server.Dispatch.NotFoundHandler = server.addSecurityHeaders(http.HandlerFunc(routeNotFound))
+	server.Dispatch.MethodNotAllowedHandler = server.addSecurityHeaders(
+		http.HandlerFunc(methodNotAllowed))
+}
+
+// initializeV1Routes sets up the routes of version 1 of the web API on
+// router. It sets up the payment/payments URL and defines GET, POST,
+// PUT, PATCH and DELETE for the payment URL, a POST for the payment
+// anonymisation URL, a GET for the converted payment, payments,
+// payment subscription, due payments, organisations, organisation
+// export and organisation summary URLs and a POST for the search and
+// reconciliation URLs, along with the batch and payment notes URLs,
+// which require an API key if any are configured. If an AdminKey is
+// configured a DELETE for the payments URL and the admin URLs are also
+// set up, along with the admin payments URL if PurgeEndpoint is set.
+// The bodies of the create and import URLs may be compressed with gzip
+// (see acceptGzip).
+func (server *Server) initializeV1Routes(router *mux.Router) {
+	router.HandleFunc("/payments",
+		server.authenticate(server.getPayments)).Methods("GET")
+	router.HandleFunc("/payments/search",
+		server.authenticate(server.searchPayments)).Methods("POST")
+	router.HandleFunc("/payments/reconcile",
+		server.authenticate(server.reconcilePayments)).Methods("POST")
+	router.HandleFunc(subscriptionPath,
+		server.authenticate(server.subscribePayments)).Methods("GET")
+	router.HandleFunc("/payments/due",
+		server.authenticate(server.getDuePayments)).Methods("GET")
+	router.HandleFunc("/payments/changes",
+		server.authenticate(server.getChanges)).Methods("GET")
+	router.HandleFunc("/organisations",
+		server.authenticate(server.getOrganisations)).Methods("GET")
+	router.HandleFunc("/organisations/{org}/export",
+		server.authenticate(server.exportOrganisation)).Methods("GET")
+	router.HandleFunc("/organisations/{org}/summary",
+		server.authenticate(server.summariseOrganisation)).Methods("GET")
+	router.HandleFunc("/payment",
+		server.authenticate(server.acceptGzip(server.createPayment))).Methods("POST")
+	router.HandleFunc("/payment/{id}",
+		server.authenticate(server.getPayment)).Methods("GET")
+	router.HandleFunc("/payment/{id}",
+		server.authenticate(server.updatePayment)).Methods("PUT")
+	router.HandleFunc("/payment/{id}",
+		server.authenticate(server.patchPayment)).Methods("PATCH")
+	router.HandleFunc("/payment/{id}",
+		server.authenticate(server.deletePayment)).Methods("DELETE")
+	router.HandleFunc("/payment/{id}/anonymise",
+		server.authenticate(server.anonymisePaymentRecord)).Methods("POST")
+	router.HandleFunc("/payment/{id}/converted",
+		server.authenticate(server.getConvertedPayment)).Methods("GET")
+	router.HandleFunc("/payment/{id}/release",
+		server.authenticate(server.releasePayment)).Methods("POST")
+	server.initializeNoteRoutes(router)
+	server.initializeLockRoutes(router)
+
+	if server.AdminKey != "" {
+		router.HandleFunc("/payments",
+			server.requireAdmin(server.deletePayments)).Methods("DELETE")
+		if server.PurgeEndpoint {
+			router.HandleFunc("/admin/payments",
+				server.requireAdmin(server.purgePayments)).Methods("DELETE")
+		}
+		router.HandleFunc("/admin/archive",
+			server.requireAdmin(server.archivePayments)).Methods("POST")
+		router.HandleFunc("/admin/reencrypt",
+			server.requireAdmin(server.reencryptPayments)).Methods("POST")
+		router.HandleFunc("/admin/migrations",
+			server.requireAdmin(server.getMigrations)).Methods("GET")
+		router.HandleFunc("/admin/import",
+			server.requireAdmin(server.acceptGzip(server.importPayments))).Methods("POST")
+		router.HandleFunc("/admin/export",
+			server.requireAdmin(server.exportPayments)).Methods("GET")
+		router.HandleFunc("/admin/integrity",
+			server.requireAdmin(server.checkIntegrity)).Methods("GET")
+	}
+	server.initializeBatchRoutes(router)
+}
+
+// shutdownTimeout bounds how long requests in flight may take to
+// complete once the servers are shut down.
+const shutdownTimeout = 30 * time.Second
+
+// Run is the main event loop and starts the web server to listening on
+// the defined port for input, and the gRPC server on GRPCAddr if it is
+// set. Both are shut down gracefully on SIGINT or SIGTERM (see serve).
+func (server *Server) Run(addr string) {
+	defer server.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger := server.logger()
+	web, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Fatal().Err(err).Str("address", addr).Msg("Cannot listen for requests")
+	}
+	var rpc net.Listener
+	if server.GRPCAddr != "" {
+		if rpc, err = net.Listen("tcp", server.GRPCAddr); err != nil {
+			logger.Fatal().Err(err).Str("address", server.GRPCAddr).Msg("Cannot listen for gRPC calls")
+		}
+	}
+	if err := server.serve(ctx, web, rpc); err != nil {
+		logger.Fatal().Err(err).Msg("Serving failed")
+	}
+}
+
+// serve serves the dispatcher on the listener in web and, unless rpc is
+// nil, the gRPC PaymentService on rpc, releasing the scheduled payment
+// records as they fall due (see runReleases) and removing those past
+// the retention period (see runRetention), until ctx is done or either
+// server fails. Both servers are then shut down together, stopping
+// accepting connections and allowing the requests in flight
+// shutdownTimeout to complete. The error of the failed server, if any,
+// is returned.
+func (server *Server) serve(ctx context.Context, web net.Listener, rpc net.Listener) error {
+	httpServer := server.httpServer(web.Addr().String())
+	workers, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	go server.runReleases(workers)
+	go server.runRetention(workers)
+	failed := make(chan error, 2)
+	go func() { failed <- httpServer.Serve(web) }()
+	var grpcServer *grpc.Server
+	if rpc != nil {
+		grpcServer = server.grpcServer()
+		go func() { failed <- grpcServer.Serve(rpc) }()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-failed:
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// Subscriptions outlive the requests the web server waits for.
+	server.events.close()
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		defer func() {
+			select {
+			case <-stopped:
+			case <-shutdown.Done():
+				grpcServer.Stop()
+			}
+		}()
+	}
+	if shutdownErr := httpServer.Shutdown(shutdown); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// httpServer returns the web server listening on addr for the
+// dispatcher, bounded by the HTTPTimeouts of the server.
+func (server *Server) httpServer(addr string) *http.Server {
+	timeouts := server.HTTPTimeouts.withDefaults()
+	return &http.Server{
+		Addr:              addr,
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+	}
+}
+
+// getPayments is the entry-point dispatcher for the collection of
+// returned payment records. It responds to the URL payments and an
+// appropriate GET request with a page of the payment records matched
+// by its query parameters, described in the OpenAPI document, and
+// restricted to the organisation of the API key if any. The payment
+// records are sorted finally by Payment ID, so that pages never skip or
+// repeat a payment record of an unchanged collection, and link to the
+// next page if more follow (see newPageMeta). Unless ids are given, no
+// more than the payment records up to the end of the requested page are
+// read from the backing store, and from the archive. The Last-Modified
+// header is the latest modification of the returned payment records, or
+// of the last deletion made through this server if that is later, and
+// a 304 Not Modified is returned if nothing has changed since the
+// If-Modified-Since header.
+func (server *Server) getPayments(w http.ResponseWriter, r *http.Request) {
+	var payment []Payment
+	var paymentScope Payments
+
+	filter := PaymentFilter{
+		IDs:             requestedIDs(r.FormValue("ids")),
+		OrganisationID:  callerOrganisation(r),
+		Currency:        r.FormValue("currency"),
+		SchemePaymentID: r.FormValue("scheme_payment_id"),
+		AccountNumber:   r.FormValue("account_number"),
+		Status:          r.FormValue("status"),
+		Sort:            requestedIDs(r.FormValue("sort")),
+	}
+	filter.HideScheduled = filter.Status == "" && len(filter.IDs) == 0
+	if err := checkPaymentStatus(filter.Status); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(filter.IDs) > maxBatchSize {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("No more than %d ids may be requested", maxBatchSize))
+		return
+	}
+	if err := checkSortFields(filter.Sort); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, err := server.pageLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset := 0
+	if value := r.FormValue("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest,
+				fmt.Sprintf("Invalid offset %s", value))
+			return
+		}
+	}
+	if filter.MinAmount, err = amountBound(r, "min_amount"); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.MaxAmount, err = amountBound(r, "max_amount"); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := withQueryFilter(r.Context(), filter)
+	includeArchived := r.FormValue("include_archived") == "true"
+	paged := len(filter.IDs) == 0
+	var total int
+	err = server.storage(ctx, "getPayments", "", func() (err error) {
+		if paged && includeArchived {
+			payment, total, err = filter.modelGetPaymentsWithArchive(server.mongo, offset, limit)
+			return
+		} else if paged {
+			payment, total, err = filter.modelGetPaymentsPage(server.mongo, offset, limit)
+			return
+		}
+		payment, err = filter.modelGetPayments(server.mongo)
+		if err == nil {
+			total, err = filter.modelCountPayments(server.mongo)
+		}
+		if err == nil && includeArchived {
+			var archived []Payment
+			var archivedTotal int
+			archived, err = filter.modelGetArchivedPayments(server.mongo)
+			if err == nil {
+				archivedTotal, err = filter.modelCountArchivedPayments(server.mongo)
+			}
+			payment, total = append(payment, archived...), total+archivedTotal
+		}
+		return
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !paged {
+		sortPayments(payment, filter.Sort)
+	}
+
+	modified := server.lastModified(payment)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	}
+	if notModifiedSince(r.Header.Get("If-Modified-Since"), modified, server.now()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	paymentScope.P = payment
+	if len(filter.IDs) > 0 {
+		var ordered []Payment
+		ordered, paymentScope.Missing = orderByIDs(payment, filter.IDs)
+		if len(filter.Sort) == 0 {
+			paymentScope.P = ordered
+		}
+	}
+	if !paged {
+		start := min(offset, len(paymentScope.P))
+		paymentScope.P = paymentScope.P[start:min(start+limit, len(paymentScope.P))]
+	}
+	end := offset + len(paymentScope.P)
+	more := end < total
+	paymentScope.Meta = newPageMeta(limit, offset, total)
+	paymentScope.Links.Self = apiLink("/payments")
+	if more {
+		next := r.URL.Query()
+		next.Set("limit", strconv.Itoa(limit))
+		next.Set("offset", strconv.Itoa(end))
+		paymentScope.Links.Next = paymentScope.Links.Self + "?" + next.Encode()
+	}
+	respondWith(w, http.StatusOK, paymentScope, negotiatedType(w))
+}
+
+// maxBatchSize is the most Payment IDs, or payment records, a single
+// request may name or carry.
+const maxBatchSize = 100
+
+// requestedIDs is a convenience function that splits the comma
+// separated Payment IDs in ids, dropping blanks and repeats.
+func requestedIDs(ids string) []string {
+	var requested []string
+	seen := map[string]bool{}
+	for _, id := range strings.Split(ids, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			requested = append(requested, id)
+		}
+	}
+	return requested
+}
+
+// orderByIDs is a convenience function that returns the payment
+// records in payments in the order of the Payment IDs in ids, along
+// with the IDs of ids without a payment record.
+func orderByIDs(payments []Payment, ids []string) ([]Payment, []string) {
+	byID := map[string]Payment{}
+	for _, payment := range payments {
+		byID[payment.ID] = payment
+	}
+	ordered := []Payment{}
+	var missing []string
+	for _, id := range ids {
+		if payment, ok := byID[id]; ok {
+			ordered = append(ordered, payment)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return ordered, missing
+}
+
+// getOrganisations is the entry-point dispatcher for the distinct
+// organisations of the payment records. It responds to the URL
+// organisations and an appropriate GET request. The organisations are
+// returned sorted in ascending order, a page at a time: limit bounds
+// the size of the page and after, as given in the next link, resumes
+// after the last organisation of the previous page. With counts=true
+// the number of payment records of each organisation is included.
+// Requests scoped to an organisation only see that organisation.
+func (server *Server) getOrganisations(w http.ResponseWriter, r *http.Request) {
+	var page Organisations
+
+	limit, err := server.pageLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	counts := r.FormValue("counts") == "true"
+
+	var organisations []Organisation
+	var more bool
+	ctx := withQueryFilter(r.Context(), map[string]string{"organisation_id": callerOrganisation(r),
+		"after": r.FormValue("after")})
+	err = server.storage(ctx, "getOrganisations", "", func() (err error) {
+		organisations, more, err = modelGetOrganisations(server.mongo,
+			callerOrganisation(r), r.FormValue("after"), limit)
+		if err == nil && counts && len(organisations) > 0 {
+			err = modelCountOrganisationPayments(server.mongo, organisations)
+		}
+		return
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	page.O = organisations
+	page.Meta = &PageMeta{Limit: limit}
+	page.Links.Self = apiLink("/organisations")
+	if more {
+		next := url.Values{}
+		next.Set("after", organisations[len(organisations)-1].ID)
+		next.Set("limit", strconv.Itoa(limit))
+		if counts {
+			next.Set("counts", "true")
+		}
+		page.Links.Next = page.Links.Self + "?" + next.Encode()
+	}
+	respondWith(w, http.StatusOK, page, negotiatedType(w))
+}
+
+// OrganisationExport is the document exporting every payment record of
+// an organisation.
+type OrganisationExport struct {
+	OrganisationID string    `json:"organisation_id"`
+	ExportedAt     time.Time `json:"exported_at"`
+	P              []Payment `json:"data"`
+}
+
+// exportOrganisation is the entry-point dispatcher for the export of
+// every payment record of an organisation, such as for a data subject
+// access request. It responds to the URL organisations/{org}/export and
+// an appropriate GET request with an OrganisationExport, offered as an
+// attachment, that includes the archived payment records marked as
+// archived. The payment records are streamed as they are read, rather
+// than held in memory, so should the backing store fail once the
+// export is under way the response is aborted, and a truncated export
+// cannot be taken for a whole one. Requests scoped to another
+// organisation do not find it.
+func (server *Server) exportOrganisation(w http.ResponseWriter, r *http.Request) {
+	organisation := mux.Vars(r)["org"]
+	if caller := callerOrganisation(r); caller != "" && caller != organisation {
+		respondWithError(w, http.StatusNotFound, "Organisation not found")
+		return
+	}
+
+	// The export is written around its data, so that each payment
+	// record can be written as soon as it is read.
+	header, _ := json.Marshal(OrganisationExport{OrganisationID: organisation,
+		ExportedAt: server.now().UTC()})
+	header = bytes.TrimSuffix(header, []byte("null}"))
+	begin := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=%q", organisation+".json"))
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(header, '['))
+	}
+	written := 0
+	err := server.storage(r.Context(), "exportOrganisation", "", func() error {
+		for _, collection := range []string{server.Collection, server.mongo.archiveCollection()} {
+			iter := modelOrganisationPayments(server.mongo, collection, organisation)
+			var payment Payment
+			for iter.Next(&payment) {
+				if written == 0 {
+					begin()
+				} else {
+					w.Write([]byte(","))
+				}
+				payment.Archived = collection != server.Collection
+				record, _ := json.Marshal(payment)
+				w.Write(record)
+				written++
+				payment = Payment{}
+			}
+			if err := iter.Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && written > 0 {
+		panic(http.ErrAbortHandler)
+	} else if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if written == 0 {
+		begin()
+	}
+	w.Write([]byte("]}"))
+}
+
+// summariseOrganisation is the entry-point dispatcher for the summary
+// of the payment records of an organisation. It responds to the URL
+// organisations/{org}/summary and an appropriate GET request with an
+// OrganisationSummary of its payment records, restricted to those
+// processed from processing_date_from and to processing_date_to, both
+// inclusive YYYY-MM-DD dates, if given. An organisation without
+// payment records in the range is summarised with a count of zero and
+// no totals rather than not found, so that an empty quarter reads as
+// one. Requests scoped to another organisation do not find it.
+func (server *Server) summariseOrganisation(w http.ResponseWriter, r *http.Request) {
+	organisation := mux.Vars(r)["org"]
+	if caller := callerOrganisation(r); caller != "" && caller != organisation {
+		respondWithError(w, http.StatusNotFound, "Organisation not found")
+		return
+	}
+	filter := PaymentFilter{
+		OrganisationID:     organisation,
+		ProcessingDateFrom: r.FormValue("processing_date_from"),
+		ProcessingDateTo:   r.FormValue("processing_date_to"),
+	}
+	for _, date := range []string{filter.ProcessingDateFrom, filter.ProcessingDateTo} {
+		if _, err := time.Parse(ProcessingDateLayout, date); date != "" && err != nil {
+			respondWithError(w, http.StatusBadRequest,
+				fmt.Sprintf("Invalid processing date %q, use YYYY-MM-DD", date))
+			return
+		}
+	}
+
+	var summary OrganisationSummary
+	err := server.storage(r.Context(), "summariseOrganisation", "", func() (err error) {
+		summary, err = filter.modelSummarisePayments(server.mongo)
+		return
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	respondWith(w, http.StatusOK, summary, negotiatedType(w))
+}
+
+// createPayment is the entry-point dispatcher for the creation of
+// payment records to the backing store. It responds to the URL payment
+// and an appropriate POST request. The processing date must fall within
+// the window configured by RejectPastDates and MaxFutureDays, taking
+// today's date in UTC, the amount within AmountLimits and the scheme
+// payment types among those allowed. If DuplicateCheck is enabled a
+// payment with the same fingerprint as an existing payment record is
+// refused with StatusConflict and the existing Payment ID, unless the
+// request carries an X-Allow-Duplicate header of true. A payment for an
+// organisation other than that of the API key is refused with
+// StatusForbidden. A payment without a Payment ID is given one if the
+// server generates IDs, in which case the Payment IDs of clients must
+// be UUIDs or ULIDs (see assignID). With
+// hold_until_processing_date=true the payment record is scheduled until
+// its processing date arrives (see schedulePayment and runReleases).
+// The payment record may be sent in JSON or in MsgpackMediaType.
+func (server *Server) createPayment(w http.ResponseWriter, r *http.Request) {
+	var p Payment
+	defer r.Body.Close()
+
+	if err := decodePayload(r, &p); err != nil {
+		respondWithDecodeError(w, err, "Invalid payload request")
+		return
+	}
+	server.assignID(&p)
+	server.normaliseText(&p)
+	if code, err := server.checkNewPayment(r, &p); err != nil {
+		if duplicate, ok := err.(*DuplicatePaymentError); ok {
+			respondWithDuplicate(w, code, duplicate)
+			return
+		}
+		respondWithStorageError(w, r, code, err)
+		return
+	}
+
+	quota, err := server.reserveQuota(r)
+	if err == ErrQuotaExceeded {
+		respondWithQuotaExceeded(w, quota)
+		return
+	} else if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := server.addPayment(r.Context(), &p); err != nil {
+		server.releaseQuota(r, quota)
+		setQuotaHeaders(w, quota)
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	setQuotaHeaders(w, quota)
+
+	respondWithPayment(w, r, http.StatusCreated, p)
+}
+
+// checkNewPayment is a convenience function that subjects the new
+// payment record in p, sent with the request in r, to the checks of
+// createPayment. The error of the first check that fails is returned
+// along with the status it calls for, the problems found by the valid
+// checks being collected in a single ValidationErrors. The payment
+// record is given the status the request asks for (see
+// schedulePayment).
+func (server *Server) checkNewPayment(r *http.Request, p *Payment) (int, error) {
+	if err := paymentOrganisationError(r, p); err != nil {
+		return http.StatusForbidden, err
+	}
+	if server.IDGenerator != nil && p.ID != "" && !validID(p.ID) {
+		return http.StatusBadRequest, &PaymentIDError{
+			Reason: fmt.Sprintf("Invalid Payment ID %q, use a UUID or a ULID", p.ID)}
+	}
+
+	err := server.storage(r.Context(), "checkPayment", p.ID, func() error {
+		return server.store.createPaymentValidCheck(p)
+	})
+	if _, invalid := err.(*ValidationErrors); err != nil && !invalid {
+		return validCheckStatus(err, http.StatusBadRequest), err
+	}
+	err = collectValidationErrors(err,
+		checkProcessingDateWindow(p, server.now().UTC(), server.RejectPastDates, server.MaxFutureDays),
+		checkAmountLimit(p, server.AmountLimits),
+		server.checkSchemeTypes(p), server.checkText(p))
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+
+	if server.DuplicateCheck && r.Header.Get("X-Allow-Duplicate") != "true" {
+		err := server.storage(r.Context(), "findDuplicatePayment", p.ID, func() error {
+			return server.store.findDuplicatePayment(p)
+		})
+		if _, ok := err.(*DuplicatePaymentError); ok {
+			return http.StatusConflict, err
+		} else if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if server.UniqueSchemePaymentID {
+		err := server.storage(r.Context(), "findSchemePaymentID", p.ID, func() error {
+			return server.store.findSchemePaymentID(p)
+		})
+		if _, ok := err.(*DuplicatePaymentError); ok {
+			return http.StatusConflict, err
+		} else if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	server.schedulePayment(r, p)
+	return http.StatusOK, nil
+}
+
+// addPayment is a convenience function that writes the new payment
+// record in p, as checked by checkNewPayment, to the backing store for
+// the request of ctx and publishes its creation.
+func (server *Server) addPayment(ctx context.Context, p *Payment) error {
+	err := server.storage(ctx, "createPayment", p.ID, func() error {
+		return server.store.createPayment(p, server.now().UTC())
+	})
+	if err != nil {
+		return err
+	}
+	server.cache.invalidate(p.ID)
+	server.publishEvent(EventCreated, *p)
+	return nil
+}
+
+// schemePaymentTypes returns the scheme payment types and sub types
+// payments may have: the entries of SchemeTypes and SchemeSubTypes, or
+// defaultSchemePaymentTypes and defaultSchemePaymentSubTypes where they
+// have none. Empty entries, such as those of an unset environment
+// variable, are ignored.
+func (server *Server) schemePaymentTypes() ([]string, []string) {
+	allowed := func(configured []string, defaults []string) []string {
+		var values []string
+		for _, value := range configured {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			return defaults
+		}
+		return values
+	}
+	return allowed(server.SchemeTypes, defaultSchemePaymentTypes),
+		allowed(server.SchemeSubTypes, defaultSchemePaymentSubTypes)
+}
+
+// checkSchemeTypes is a convenience function that ascertains the scheme
+// payment type and sub type of the payment record in p are among those
+// allowed (see schemePaymentTypes).
+func (server *Server) checkSchemeTypes(p *Payment) error {
+	types, subTypes := server.schemePaymentTypes()
+	return checkSchemePaymentTypes(p, types, subTypes)
+}
+
+// getPayment is the entry-point dispatcher for the retrieval of
+// single payment records from the backing store. It responds to the URL
+// payment/{id} and an appropriate GET request. If caching is enabled
+// cached payment records are served without consulting the backing
+// store. A payment record of an organisation other than that of the
+// API key is not found. Every response carries
+// an ETag header and if the client's If-None-Match header matches the
+// current ETag a 304 Not Modified is returned with no body. Likewise
+// a Last-Modified header is emitted and, when no If-None-Match header
+// is sent, a 304 Not Modified is returned if the payment record has
+// not changed since the If-Modified-Since header. With
+// include_archived=true a payment record that is not found is looked
+// for in the archive, and returned marked as archived.
+func (server *Server) getPayment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	p := Payment{ID: id, OrganisationID: callerOrganisation(r)}
+
+	entry, cached := server.cache.get(id)
+	if cached && p.OrganisationID != "" && entry.payment.OrganisationID != p.OrganisationID {
+		respondWithError(w, http.StatusNotFound, ErrPaymentNotFound.Error())
+		return
+	}
+	if !cached {
+		count := -1 // a storage failure, unless the lookup runs
+		var payment Payment
+		gen := server.cache.generation()
+		err := server.storage(r.Context(), "getPayment", p.ID, func() (err error) {
+			count, payment, err = server.store.getPayment(&p)
+			return
+		})
+		if err != nil && count < 0 {
+			respondWithStorageError(w, r, http.StatusInternalServerError, err)
+			return
+		} else if err != nil && count == 0 && r.FormValue("include_archived") == "true" {
+			err = server.storage(r.Context(), "getArchivedPayment", p.ID, func() (err error) {
+				payment, err = server.store.getArchivedPayment(&p)
+				return
+			})
+			if err == mgo.ErrNotFound {
+				respondWithError(w, http.StatusNotFound, ErrPaymentNotFound.Error())
+				return
+			} else if err != nil {
+				respondWithStorageError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			entry = newCacheEntry(payment)
+		} else if err != nil && count == 0 {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		} else {
+			entry = newCacheEntry(payment)
+			server.cache.add(entry, gen)
+		}
+	}
+
+	payment, etag := entry.payment, entry.etag
+	w.Header().Set("ETag", etag)
+	if !payment.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", payment.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+	if r.Header.Get("If-None-Match") != "" {
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if notModifiedSince(r.Header.Get("If-Modified-Since"), payment.UpdatedAt,
+		server.now()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if acceptsMediaType(r, EnvelopeMediaType) || negotiatedType(w) != "application/json" {
+		respondWithPayment(w, r, http.StatusOK, payment)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.body)
+}
+
+// updatePayment is the entry-point dispatcher for the retrieval and
+// update of single payment records from the backing store. It
+// responds to the URL payment/{id} and an appropriate PUT request. The
+// amount must be within AmountLimits and the scheme payment types
+// among those allowed. The Payment ID cannot be changed, as by
+// patchPayment. Payment records of other
+// organisations than that of the API key are not found, and cannot be
+// moved to another organisation. The payment record may be sent in
+// JSON or in MsgpackMediaType. The status of the stored payment record
+// is kept, as only the server changes it (see schedulePayment). With
+// include_changes=true the updated payment record is emitted as
+// PaymentChanges, listing the changes the update made to the stored
+// one. A payment record locked by another client is refused with
+// StatusLocked (see checkLock).
+func (server *Server) updatePayment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	p := Payment{ID: vars["id"]}
+
+	if err := decodePayload(r, &p); err != nil {
+		respondWithDecodeError(w, err, "Invalid request payload")
+		return
+	}
+
+	defer r.Body.Close()
+
+	if p.ID != vars["id"] {
+		respondWithError(w, http.StatusBadRequest,
+			"Cannot change the Payment ID of a payment")
+		return
+	}
+	if code, err := server.checkUpdatedPayment(r, &p); err != nil {
+		respondWithStorageError(w, r, code, err)
+		return
+	}
+	stored, code, err := server.replacePayment(r.Context(), &p)
+	if err != nil {
+		respondWithStorageError(w, r, code, err)
+		return
+	}
+
+	if r.FormValue("include_changes") == "true" {
+		respondWith(w, http.StatusOK, PaymentChanges{Payment: p, Changes: paymentChanges(&stored, &p)},
+			negotiatedType(w))
+		return
+	}
+	respondWith(w, http.StatusOK, p, negotiatedType(w))
+}
+
+// checkUpdatedPayment is a convenience function that subjects the
+// payment record in p, sent with the request in r to replace the
+// stored one, to the checks of updatePayment. The error of the first
+// check that fails is returned along with the status it calls for, the
+// problems found by the valid checks being collected in a single
+// ValidationErrors. The free text attributes of p are normalised.
+func (server *Server) checkUpdatedPayment(r *http.Request, p *Payment) (int, error) {
+	if code, err := server.paymentVisibleError(r, p.ID); err != nil {
+		return code, err
+	}
+	if err := paymentOrganisationError(r, p); err != nil {
+		return http.StatusForbidden, err
+	}
+	if code, err := server.lockError(r, p.ID); err != nil {
+		return code, err
+	}
+	server.normaliseText(p)
+
+	err := server.storage(r.Context(), "checkPayment", p.ID, func() error {
+		return server.store.updatePaymentValidCheck(p)
+	})
+	if _, invalid := err.(*ValidationErrors); err != nil && !invalid {
+		return validCheckStatus(err, http.StatusNotFound), err
+	}
+	err = collectValidationErrors(err, checkAmountLimit(p, server.AmountLimits),
+		server.checkSchemeTypes(p), server.checkText(p))
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	return http.StatusOK, nil
+}
+
+// replacePayment is a convenience function that replaces the stored
+// payment record with the Payment ID of p by p, as checked by
+// checkUpdatedPayment, for the request of ctx and publishes its update.
+// The status of the stored payment record, which p is given, is kept.
+// The stored payment record is returned, or the error of the backing
+// store along with the status it calls for.
+func (server *Server) replacePayment(ctx context.Context, p *Payment) (Payment, int, error) {
+	count := -1 // a storage failure, unless the lookup runs
+	var stored Payment
+	err := server.storage(ctx, "getPayment", p.ID, func() (err error) {
+		count, stored, err = server.store.getPayment(&Payment{ID: p.ID})
+		return
+	})
+	if err != nil && count < 0 {
+		return stored, http.StatusInternalServerError, err
+	} else if err != nil {
+		return stored, http.StatusNotFound, err
+	}
+	p.Status = stored.Status
+
+	err = server.storage(ctx, "updatePayment", p.ID, func() error {
+		return server.store.updatePayment(p, server.now().UTC())
+	})
+	if err != nil {
+		return stored, http.StatusInternalServerError, err
+	}
+	server.cache.invalidate(p.ID)
+	server.publishEvent(EventUpdated, *p)
+	return stored, http.StatusOK, nil
+}
+
+// patchPayment is the entry-point dispatcher for the partial update of
+// single payment records in the backing store. It responds to the URL
+// payment/{id} and an appropriate PATCH request. The patch format is
+// selected by the Content-Type of the request, either
+// MergePatchMediaType or JSONPatchMediaType. The current payment record
+// is fetched, patched, checked (including against AmountLimits) and
+// persisted, and the patched record returned. A failed JSON Patch test
+// operation returns StatusConflict, and a JSON Patch modifying the
+// Payment ID, the status or the whole payment record
+// StatusUnprocessableEntity (see checkJSONPatchPaths). Payment records of other organisations than
+// that of the API key are not found, and cannot be moved to another
+// organisation. With include_changes=true the patched payment record is
+// emitted as PaymentChanges, as by updatePayment. A payment record
+// locked by another client is refused with StatusLocked.
+func (server *Server) patchPayment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	p := Payment{ID: vars["id"], OrganisationID: callerOrganisation(r)}
+	defer r.Body.Close()
+
+	var apply func(document []byte, patch []byte) ([]byte, error)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case MergePatchMediaType:
+		apply = applyMergePatch
+	case JSONPatchMediaType:
+		apply = applyJSONPatch
+	default:
+		respondWithError(w, http.StatusUnsupportedMediaType,
+			"Unsupported patch format, use "+MergePatchMediaType+
+				" or "+JSONPatchMediaType)
+		return
+	}
+
+	patch, err := io.ReadAll(r.Body)
+	if bodyTooLarge(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Request payload too large")
+		return
+	} else if err != nil || !json.Valid(patch) {
+		respondWithError(w, http.StatusBadRequest, errInvalidPatch.Error())
+		return
+	}
+	if mediaType == JSONPatchMediaType {
+		if err := checkJSONPatchPaths(patch, immutablePatchPaths); err != nil {
+			respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	count := -1 // a storage failure, unless the lookup runs
+	var current Payment
+	err = server.storage(r.Context(), "getPayment", p.ID, func() (err error) {
+		count, current, err = server.store.getPayment(&p)
+		return
+	})
+	if err != nil && count < 0 {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	} else if err != nil && count == 0 {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if !server.checkLock(w, r, p.ID) {
+		return
+	}
+
+	document, _ := json.Marshal(current)
+	document, err = apply(document, patch)
+	if err == errPatchTestFailed {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	} else if err == errInvalidPatch {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	var patched Payment
+	if err := json.Unmarshal(document, &patched); err != nil {
+		respondWithDecodeError(w, err, "Patched payment is not a valid payment")
+		return
+	}
+	if patched.ID != p.ID {
+		respondWithError(w, http.StatusBadRequest,
+			"Cannot change the Payment ID of a payment")
+		return
+	}
+	if !checkPaymentOrganisation(w, r, &patched) {
+		return
+	}
+	patched.Status = current.Status
+	server.normaliseText(&patched)
+	err = collectValidationErrors(checkPaymentValues(&patched),
+		checkAmountLimit(&patched, server.AmountLimits), server.checkSchemeTypes(&patched),
+		server.checkText(&patched))
+	if err != nil {
+		respondWithInvalid(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	err = server.storage(r.Context(), "updatePayment", patched.ID, func() error {
+		return server.store.updatePayment(&patched, server.now().UTC())
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	server.cache.invalidate(p.ID)
+	server.publishEvent(EventUpdated, patched)
+
+	if r.FormValue("include_changes") == "true" {
+		respondWith(w, http.StatusOK,
+			PaymentChanges{Payment: patched, Changes: paymentChanges(&current, &patched)},
+			negotiatedType(w))
+		return
+	}
+	respondWith(w, http.StatusOK, patched, negotiatedType(w))
+}
+
+// deletePayment is the entry-point dispatcher for the deletion of
+// a single payment record from the backing store. It responds to the URL
+// payment/{id} and an appropriate DELETE request. Payment records of
+// other organisations than that of the API key are not found.
+func (server *Server) deletePayment(w http.ResponseWriter, r *http.Request) {
+	if code, err := server.removePayment(r, mux.Vars(r)["id"]); err != nil {
+		respondWithStorageError(w, r, code, err)
+		return
+	}
+
+	respondWith(w, http.StatusOK, map[string]string{"result": "success"}, negotiatedType(w))
+}
+
+// removePayment is a convenience function that removes the payment
+// record with the Payment ID in id, and its notes, from the backing
+// store for the request in r and publishes its deletion. The payment
+// record must be visible to the request (see paymentVisibleError). The
+// error of the first check or storage operation that fails is returned
+// along with the status it calls for.
+func (server *Server) removePayment(r *http.Request, id string) (int, error) {
+	p := Payment{ID: id}
+	if code, err := server.paymentVisibleError(r, p.ID); err != nil {
+		return code, err
+	}
+	err := server.storage(r.Context(), "checkPayment", p.ID, func() error {
+		return server.store.deletePaymentValidCheck(&p)
+	})
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	attempt := 0
+	deleted := p
+	err = server.storage(r.Context(), "deletePayment", p.ID, func() error {
+		attempt++
+		removed, err := server.store.deletePayment(&p)
+		if err == mgo.ErrNotFound && attempt > 1 {
+			// An earlier attempt removed it, but its reply was lost or
+			// the removal of its notes failed.
+			return server.store.deleteNotes(&p)
+		}
+		deleted = removed
+		return err
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	server.cache.invalidate(p.ID)
+	server.noteDeletion()
+	server.publishEvent(EventDeleted, deleted)
+	return http.StatusOK, nil
+}
+
+// purgePayments is the entry-point dispatcher for the removal of all
+// payment records from the backing store. It responds to the URL
+// admin/payments and an appropriate DELETE request. The request must
+// carry confirm=true and may carry organisation_id to restrict the
+// removal to a single organisation. The deletion of each removed
+// payment record is published and their number returned.
+func (server *Server) purgePayments(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("confirm") != "true" {
+		respondWithError(w, http.StatusBadRequest,
+			"Purging payments must be confirmed with confirm=true")
+		return
+	}
+
+	p := Payment{OrganisationID: r.FormValue("organisation_id")}
+	var deleted []Payment
+	err := server.storage(r.Context(), "purgePayments", "", func() (err error) {
+		deleted, err = p.modelPurgePayments(server.mongo)
+		return
+	})
+	server.cache.purge()
+	server.noteDeletion()
+	for _, payment := range deleted {
+		server.publishEvent(EventDeleted, payment)
+	}
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondWith(w, http.StatusOK, map[string]int{"deleted": len(deleted)}, negotiatedType(w))
+}
+
+// archivePayments is the entry-point dispatcher for the archiving of
+// old payment records. It responds to the URL admin/archive and an
+// appropriate POST request carrying cutoff, a YYYY-MM-DD date. Payment
+// records with a processing date before cutoff, or without one created
+// before it, are moved from the backing store to the archive, where
+// they can only be retrieved with include_archived=true. Archiving can
+// be repeated safely. The number of moved payment records is returned.
+func (server *Server) archivePayments(w http.ResponseWriter, r *http.Request) {
+	cutoff := r.FormValue("cutoff")
+	before, err := time.Parse(ProcessingDateLayout, cutoff)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest,
+			"Archiving payments requires a cutoff date, use YYYY-MM-DD")
+		return
+	}
+
+	var archived int
+	err = server.storage(r.Context(), "archivePayments", "", func() (err error) {
+		archived, err = modelArchivePayments(server.mongo, cutoff, before)
+		return
+	})
+	server.cache.purge()
+	server.noteDeletion()
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondWith(w, http.StatusOK, map[string]int{"archived": archived}, negotiatedType(w))
+}
+
+// reencryptPayments is the entry-point dispatcher for the rotation of
+// the encryption key of account numbers. It responds to the URL
+// admin/reencrypt and an appropriate POST request by sealing the
+// account numbers of the payment records, live and archived, stored in
+// the clear or with a retired key with the current key (see
+// modelReencryptPayments), and returns the number of payment records
+// rewritten. Re-encryption can be repeated safely, and the retired keys
+// may be dropped once it completes. Without an encryption key
+// StatusConflict is returned.
+func (server *Server) reencryptPayments(w http.ResponseWriter, r *http.Request) {
+	if server.keys == nil {
+		respondWithError(w, http.StatusConflict, ErrNoEncryptionKey.Error())
+		return
+	}
+
+	reencrypted := 0
+	for _, collection := range []string{server.Collection, server.mongo.archiveCollection()} {
+		var rewritten int
+		err := server.storage(r.Context(), "reencryptPayments", "", func() (err error) {
+			rewritten, err = modelReencryptPayments(server.mongo, collection)
+			return
+		})
+		reencrypted += rewritten
+		if err != nil {
+			respondWithStorageError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	respondWith(w, http.StatusOK, map[string]int{"reencrypted": reencrypted}, negotiatedType(w))
+}
+
+// deletePayments is the entry-point dispatcher for the removal of the
+// payment records matching a filter from the backing store. It
+// responds to the URL payments and an appropriate DELETE request. The
+// request must carry organisation_id, processing_date_from or
+// processing_date_to (an inclusive range of YYYY-MM-DD dates), and a
+// request without any of them is refused with StatusBadRequest. With
+// dry_run=true the number of payment records that would be removed is
+// returned and nothing is removed, otherwise the deletion of each
+// removed payment record is published and their number returned.
+func (server *Server) deletePayments(w http.ResponseWriter, r *http.Request) {
+	filter := PaymentFilter{
+		OrganisationID:     r.FormValue("organisation_id"),
+		ProcessingDateFrom: r.FormValue("processing_date_from"),
+		ProcessingDateTo:   r.FormValue("processing_date_to"),
+	}
+	if filter.IsEmpty() {
+		respondWithError(w, http.StatusBadRequest,
+			"Deleting payments requires organisation_id or a processing_date range")
+		return
+	}
+	for _, date := range []string{filter.ProcessingDateFrom, filter.ProcessingDateTo} {
+		if _, err := time.Parse(ProcessingDateLayout, date); date != "" && err != nil {
+			respondWithError(w, http.StatusBadRequest,
+				"Invalid processing date "+date+", use YYYY-MM-DD")
+			return
+		}
+	}
+
+	if r.FormValue("dry_run") == "true" {
+		var count int
+		err := server.storage(r.Context(), "countPayments", "", func() (err error) {
+			count, err = filter.modelCountPayments(server.mongo)
+			return
+		})
+		if err != nil {
+			respondWithStorageError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		respondWith(w, http.StatusOK, map[string]int{"would_delete": count}, negotiatedType(w))
+		return
+	}
+
+	var deleted []Payment
+	err := server.storage(r.Context(), "deletePayments", "", func() (err error) {
+		deleted, err = filter.modelDeletePayments(server.mongo)
+		return
+	})
+	server.cache.purge()
+	server.noteDeletion()
+	for _, payment := range deleted {
+		server.publishEvent(EventDeleted, payment)
+	}
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondWith(w, http.StatusOK, map[string]int{"deleted": len(deleted)}, negotiatedType(w))
+}
+
+// importPayments is the entry-point dispatcher for the bulk creation
+// of payment records in the backing store. It responds to the URL
+// admin/import and an appropriate POST request. The payload is either
+// a payments collection or, with a Content-Type of
+// application/x-ndjson, one payment record per line. Each payment
+// record is given an ID and subjected to the checks of createPayment
+// (see checkNewPayment), then created and published as by
+// createPayment. Invalid records are reported as failures and
+// duplicate records are skipped, unless strict=true is given in which
+// case any duplicate aborts the whole import with StatusConflict. A
+// summary of the import is returned. The payload may be compressed
+// with gzip (see acceptGzip).
+func (server *Server) importPayments(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	records, err := decodeImportRecords(r)
+	if bodyTooLarge(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Import payload too large")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid import payload")
+		return
+	}
+
+	strict := r.FormValue("strict") == "true"
+	summary := ImportSummary{Failed: []ImportFailure{}}
+	var payments []Payment
+	var indexes []int
+	seen := map[string]bool{}
+	for index, record := range records {
+		var p Payment
+		if err := json.Unmarshal(record, &p); err != nil {
+			summary.Failed = append(summary.Failed,
+				ImportFailure{Index: index, Reason: err.Error()})
+			continue
+		}
+
+		server.assignID(&p)
+		server.normaliseText(&p)
+		_, err := server.checkNewPayment(r, &p)
+		if err == nil && seen[p.ID] {
+			err = ErrPaymentExists
+		}
+		if err == ErrPaymentExists && !strict {
+			summary.SkippedDuplicates++
+			continue
+		}
+		if err != nil {
+			err = publicError(r.Context(), err)
+			summary.Failed = append(summary.Failed,
+				ImportFailure{Index: index, ID: p.ID, Reason: err.Error()})
+			continue
+		}
+		seen[p.ID] = true
+		payments = append(payments, p)
+		indexes = append(indexes, index)
+	}
+
+	if strict {
+		for _, failure := range summary.Failed {
+			if failure.Reason == ErrPaymentExists.Error() {
+				respondWith(w, http.StatusConflict, summary, negotiatedType(w))
+				return
+			}
+		}
+	}
+
+	for i := range payments {
+		if err := server.addPayment(r.Context(), &payments[i]); err != nil {
+			err = publicError(r.Context(), err)
+			summary.Failed = append(summary.Failed, ImportFailure{
+				Index: indexes[i], ID: payments[i].ID, Reason: err.Error()})
+			continue
+		}
+		summary.Imported++
+	}
+	respondWith(w, http.StatusOK, summary, negotiatedType(w))
+}
+
+// exportPayments is the entry-point dispatcher for the retrieval of
+// every payment record in the backing store in a form accepted by
+// importPayments. It responds to the URL admin/export and an
+// appropriate GET request. A payments collection is returned unless
+// format=ndjson is given, in which case one payment record is
+// returned per line.
+func (server *Server) exportPayments(w http.ResponseWriter, r *http.Request) {
+	var p Payment
+	var paymentScope Payments
+
+	var payment []Payment
+	err := server.storage(r.Context(), "exportPayments", "", func() (err error) {
+		payment, err = p.modelGetPayments(server.mongo)
+		return
+	})
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if r.FormValue("format") != "ndjson" {
+		paymentScope.P = payment
+		paymentScope.Links.Self = apiLink("/payments")
+		respondWith(w, http.StatusOK, paymentScope, negotiatedType(w))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	for _, record := range payment {
+		encoder.Encode(record)
+	}
+}
+
+// amountBound is a convenience function that parses the amount in the
+// query parameter name of the request in r. A missing parameter is
+// nil, and an amount that cannot be held in minor units is refused.
+func amountBound(r *http.Request, name string) (*Amount, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return nil, nil
+	}
+	amount, err := ParseAmount(value)
+	if err != nil {
+		return nil, err
+	}
+	if amount.Decimals() > 2 {
+		return nil, &AmountError{Value: value, Reason: "more than two decimal places"}
+	}
+	if _, ok := amount.MinorUnits(); !ok {
+		return nil, &AmountError{Value: value, Reason: "too large"}
+	}
+	return &amount, nil
+}
+
+// decodeImportRecords is a convenience function that splits the body
+// of the import request in r into raw payment records. The body is
+// read as NDJSON when the Content-Type is application/x-ndjson and as
+// a payments collection otherwise.
+func decodeImportRecords(r *http.Request) ([]json.RawMessage, error) {
+	decoder := json.NewDecoder(r.Body)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-ndjson" {
+		var envelope struct {
+			P []json.RawMessage `json:"data"`
+		}
+		err := decoder.Decode(&envelope)
+		return envelope.P, err
+	}
+
+	var records []json.RawMessage
+	for {
+		var record json.RawMessage
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// requireAdmin wraps the handler in next so that it is only invoked
+// when the request carries the configured AdminKey in the X-API-Key
+// header. Otherwise StatusForbidden is returned.
+func (server *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if server.AdminKey == "" ||
+			subtle.ConstantTimeCompare([]byte(key), []byte(server.AdminKey)) != 1 {
+			respondWithError(w, http.StatusForbidden, "Admin access required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// paymentETag is a convenience function that computes a strong entity
+// tag for the payment record in payment. The tag is a SHA-1 digest of
+// the JSON representation of the record, so any modification of the
+// record results in a different tag.
+func paymentETag(payment Payment) string {
+	body, _ := json.Marshal(payment)
+	sum := sha1.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// etagMatch is a convenience function that returns true if the
+// If-None-Match header value contained in header matches the entity
+// tag in etag. The header may contain a comma separated list of tags,
+// weak tags (W/ prefixed) and the wildcard "*".
+func etagMatch(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedSince is a convenience function that returns true if the
+// modification time in modified is no later than the HTTP date in the
+// If-Modified-Since header value contained in header. HTTP dates only
+// have a resolution of one second so modified is truncated before the
+// comparison, and a modification within the current second never
+// matches as a further modification later in that second would carry
+// the same date. A missing or unparseable header, a header dated after
+// the current time in now (which a client with a skewed clock may
+// send), or an unknown modification time, never matches.
+func notModifiedSince(header string, modified time.Time, now time.Time) bool {
+	if header == "" || modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	if err != nil || since.After(now) || !modified.Before(now.Truncate(time.Second)) {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// lastModified returns the latest modification time of the payment
+// records in payments, or the time of the last deletion made through
+// the server if that is later, so that a collection that has only
+// shrunk is still seen as modified. Deletions made through other
+// servers sharing the backing store are not seen. The zero time is
+// returned if nothing is known to have been modified.
+func (server *Server) lastModified(payments []Payment) time.Time {
+	var modified time.Time
+	for _, payment := range payments {
+		if payment.UpdatedAt.After(modified) {
+			modified = payment.UpdatedAt
+		}
+	}
+	if server.lastDeletion != nil {
+		if nanos := atomic.LoadInt64(server.lastDeletion); nanos != 0 {
+			if deleted := time.Unix(0, nanos).UTC(); deleted.After(modified) {
+				modified = deleted
+			}
+		}
+	}
+	return modified.UTC()
+}
+
+// now returns the current time, from the Clock of the server if one
+// is set.
+func (server *Server) now() time.Time {
+	if server.Clock != nil {
+		return server.Clock.Now()
+	}
+	return systemClock{}.Now()
+}
+
+// today returns the current date in the Timezone of the server, in
+// ProcessingDateLayout.
+func (server *Server) today() string {
+	location := server.Timezone
+	if location == nil {
+		location = time.UTC
+	}
+	return server.now().In(location).Format(ProcessingDateLayout)
+}
+
+// noteDeletion records that payment records have just been removed
+// from the backing store, for lastModified.
+func (server *Server) noteDeletion() {
+	if server.lastDeletion != nil {
+		atomic.StoreInt64(server.lastDeletion, server.now().UnixNano())
+	}
+}
+
+// requireContentType is a middleware that refuses requests carrying a
+// body whose Content-Type is not among those accepted by their route
+// (see acceptedContentTypes) with StatusUnsupportedMediaType.
+// Parameters of the media type, such as charset, are ignored, and
+// requests without a body are passed on, leaving the handler to refuse
+// them if a body is required.
+func requireContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, _ := mux.CurrentRoute(r).GetPathTemplate()
+		contentTypes := acceptedContentTypes(r.Method, path)
+		if contentTypes == nil || r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		contentType := r.Header.Get("Content-Type")
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		for _, accepted := range contentTypes {
+			if err == nil && mediaType == accepted {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		message := fmt.Sprintf("Unsupported Content-Type %q", contentType)
+		if contentType == "" {
+			message = "Missing Content-Type"
+		}
+		respondWithError(w, http.StatusUnsupportedMediaType,
+			message+", use "+strings.Join(contentTypes, " or "))
+	})
+}
+
+// respondWithError is a convenience function that emits the status
+// specified in code with an error defined in message to the
+// http.ResponseWriter contained in w, as a Problem if the request
+// calls for problem details.
+func respondWithError(w http.ResponseWriter, code int, message string) {
+	if pw, ok := w.(*problemWriter); ok {
+		respondWithProblem(w, newProblem(code, message, pw.instance))
+		return
+	}
+	respondWith(w, code, map[string]string{"error": message}, negotiatedType(w))
+}
+
+// respondWithDuplicate is a convenience function that emits the status
+// specified in code with the DuplicatePaymentError in duplicate,
+// naming the existing payment record.
+func respondWithDuplicate(w http.ResponseWriter, code int, duplicate *DuplicatePaymentError) {
+	if pw, ok := w.(*problemWriter); ok {
+		problem := newProblem(code, duplicate.Error(), pw.instance)
+		problem.ID = duplicate.ID
+		respondWithProblem(w, problem)
+		return
+	}
+	respondWith(w, code, map[string]string{"error": duplicate.Error(), "id": duplicate.ID},
+		negotiatedType(w))
+}
+
+// respondWithInvalid is a convenience function that emits the status
+// specified in code with the error in err, listing each of the
+// problems of ValidationErrors in an errors array alongside the
+// message.
+func respondWithInvalid(w http.ResponseWriter, code int, err error) {
+	problems, ok := err.(*ValidationErrors)
+	if !ok {
+		respondWithError(w, code, err.Error())
+		return
+	}
+	if pw, ok := w.(*problemWriter); ok {
+		problem := newProblem(code, problems.Error(), pw.instance)
+		problem.Errors = problems.Errors
+		respondWithProblem(w, problem)
+		return
+	}
+	respondWith(w, code, struct {
+		Error  string       `json:"error"`
+		Errors []FieldError `json:"errors"`
+	}{problems.Error(), problems.Errors}, negotiatedType(w))
+}
+
+// respondWithDecodeError is a convenience function that emits the
+// error in err raised while decoding a request payload. Invalid
+// amounts are reported with StatusUnprocessableEntity and the reason,
+// a payload larger than acceptGzip allows with
+// StatusRequestEntityTooLarge, and any other decoding failure with
+// StatusBadRequest and the generic message in message.
+func respondWithDecodeError(w http.ResponseWriter, err error, message string) {
+	var amountErr *AmountError
+	if errors.As(err, &amountErr) {
+		respondWithError(w, http.StatusUnprocessableEntity, amountErr.Error())
+		return
+	}
+	if bodyTooLarge(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Request payload too large")
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, message)
+}
+
+// findPayment is a convenience function that returns the payment
+// record with the Payment ID in id, live or archived, for the
+// sub-resources of payment records. If there is no such payment record
+// visible to the request in r, StatusNotFound is emitted to w and
+// false returned.
+func (server *Server) findPayment(w http.ResponseWriter, r *http.Request, id string) (Payment, bool) {
+	p := Payment{ID: id, OrganisationID: callerOrganisation(r)}
+
+	count := -1 // a storage failure, unless the lookup runs
+	var payment Payment
+	err := server.storage(r.Context(), "getPayment", p.ID, func() (err error) {
+		count, payment, err = server.store.getPayment(&p)
+		return
+	})
+	if err != nil && count == 0 {
+		err = server.storage(r.Context(), "getArchivedPayment", p.ID, func() (err error) {
+			payment, err = server.store.getArchivedPayment(&p)
+			return
+		})
+		if err == mgo.ErrNotFound {
+			respondWithError(w, http.StatusNotFound, ErrPaymentNotFound.Error())
+			return payment, false
+		}
+	}
+	if err != nil {
+		respondWithStorageError(w, r, http.StatusInternalServerError, err)
+		return payment, false
+	}
+	return payment, true
+}
+
+// respondWithPayment is a convenience function that emits the payment
+// record in payment with the status defined in code. If the request in
+// r accepts EnvelopeMediaType the payment record is wrapped in a
+// PaymentEnvelope, otherwise it is emitted bare in the negotiated media
+// type (see negotiateContent).
+func respondWithPayment(w http.ResponseWriter, r *http.Request, code int, payment Payment) {
+	w.Header().Add("Vary", "Accept")
+	if !acceptsMediaType(r, EnvelopeMediaType) {
+		respondWith(w, code, payment, negotiatedType(w))
+		return
+	}
+
+	var envelope PaymentEnvelope
+	envelope.P = payment
+	envelope.Links.Self = apiLink("/payment/" + payment.ID)
+	response, _ := json.Marshal(envelope)
+	w.Header().Set("Content-Type", EnvelopeMediaType)
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+// acceptsMediaType is a convenience function that returns true if the
+// Accept header of the request in r lists the media type in
+// mediaType.
+func acceptsMediaType(r *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		candidate, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && candidate == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// validCheckStatus is a convenience function that returns the status
+// to respond with for the error in err raised by a valid check.
+// Semantically invalid payment records are reported with
+// StatusUnprocessableEntity, checks refused by the circuit breaker
+// with StatusServiceUnavailable and anything else with the status in
+// code.
+func validCheckStatus(err error, code int) int {
+	switch err.(type) {
+	case *MissingAttributesError, *AmountError, *ValidationError, *ValidationErrors:
+		return http.StatusUnprocessableEntity
+	case *CircuitOpenError:
+		return http.StatusServiceUnavailable
+	}
+	return code
+}
+
+// streamedPayments is the number of payment records beyond which a
+// collection is encoded straight to the client, rather than in full
+// before the response is begun, so that large exports are not held in
+// memory twice.
+const streamedPayments = 1000
+
+// newJSONEncoder is a convenience function that returns an encoder of
+// JSON to w that leaves <, > and & unescaped, as no response is meant
+// to be embedded in HTML.
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder
+}
+
+// respondWith is a convenience function that emits whatever payload
+// is in the payload interface, encoded in the media type in mediaType,
+// or in JSON if payloadEncoders has no encoder for it. It sets the
+// status defined in the code parameter, composes the headers and emits
+// the content to the http.ResponseWriter contained in w. The payload
+// is encoded before the response is begun, so that one that cannot be
+// is logged with the ID of the request and refused with
+// StatusInternalServerError rather than emitted as an empty success,
+// but for collections of more than streamedPayments payment records,
+// which are encoded straight to w.
+func respondWith(w http.ResponseWriter, code int, payload interface{}, mediaType string) {
+	encode, ok := payloadEncoders[mediaType]
+	if !ok {
+		mediaType, encode = "application/json", payloadEncoders["application/json"]
+	}
+	if payments, ok := payload.(Payments); ok && len(payments.P) > streamedPayments {
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(code)
+		if err := encode(w, payload); err != nil {
+			responseLogger(w).Error().Err(err).Msg("Encoding the response failed")
+		}
+		return
+	}
+
+	var response bytes.Buffer
+	if err := encode(&response, payload); err != nil {
+		responseLogger(w).Error().Err(err).Msg("Encoding the response failed")
+		respondWithError(w, http.StatusInternalServerError, "Cannot encode the response")
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(code)
+	w.Write(bytes.TrimSuffix(response.Bytes(), []byte("\n")))
+}
@@ -0,0 +1,90 @@
+// slowquery.go - The storage operations taking longer than they
+// should, logged and counted by operation.
+
+package server
+
+import (
+	"context"
+	"expvar"
+	"time"
+)
+
+// defaultSlowQueryThreshold is the time a storage operation may take
+// before it is logged as slow, unless configured otherwise.
+const defaultSlowQueryThreshold = 500 * time.Millisecond
+
+// slowQueryMetrics counts the slow storage operations by the name of
+// their operation, such as getPayments, published as the slow_queries
+// expvar.
+var slowQueryMetrics = expvar.NewMap("slow_queries")
+
+// slowQueryMaskedFields are the fields of the filters of slow storage
+// operations that are replaced by a short hash when logged, whatever
+// else is configured, as the free text searched for may hold the names
+// of parties.
+var slowQueryMaskedFields = []string{"text"}
+
+// queryFilterKey is the context key of the filter of a storage
+// operation.
+type queryFilterKey struct{}
+
+// withQueryFilter returns a copy of ctx carrying the filter in filter
+// of the storage operation invoked with it, such as a PaymentFilter,
+// to be logged along with the operation if it is slow.
+func withQueryFilter(ctx context.Context, filter interface{}) context.Context {
+	return context.WithValue(ctx, queryFilterKey{}, filter)
+}
+
+// slowQueryThreshold is a convenience function that returns the time a
+// storage operation may take before it is logged as slow:
+// SlowQueryThreshold, defaultSlowQueryThreshold if it is zero, or zero
+// if it is negative and slow operations are not logged.
+func (server *Server) slowQueryThreshold() time.Duration {
+	switch {
+	case server.SlowQueryThreshold < 0:
+		return 0
+	case server.SlowQueryThreshold == 0:
+		return defaultSlowQueryThreshold
+	}
+	return server.SlowQueryThreshold
+}
+
+// watchStorage invokes the storage operation in fn within a span of
+// the trace in ctx, as traceStorage does, and logs it as slow if it
+// takes longer than the slow query threshold of the server (see
+// logSlowQuery), retries and waits for the circuit breaker included.
+func (server *Server) watchStorage(ctx context.Context, operation string, id string,
+	fn func() error) error {
+	start := time.Now()
+	err := traceStorage(ctx, server.Collection, operation, id, fn)
+	if threshold := server.slowQueryThreshold(); threshold > 0 {
+		if elapsed := time.Since(start); elapsed > threshold {
+			server.logSlowQuery(ctx, operation, id, elapsed, err)
+		}
+	}
+	return err
+}
+
+// logSlowQuery logs the storage operation named by operation, which
+// took the time in elapsed and failed with err if it is not nil, at
+// warn level with the ID of its request, the Payment ID in id if it is
+// populated and its filter, if it was given one with withQueryFilter,
+// masked as anything logged is along with slowQueryMaskedFields. The
+// operation is counted in slowQueryMetrics.
+func (server *Server) logSlowQuery(ctx context.Context, operation string, id string,
+	elapsed time.Duration, err error) {
+	slowQueryMetrics.Add(operation, 1)
+	record := requestLogger(ctx).Warn().Str("operation", operation).
+		Dur("duration", elapsed).Dur("threshold", server.slowQueryThreshold())
+	if id != "" {
+		record = record.Str("payment_id", id)
+	}
+	if filter := ctx.Value(queryFilterKey{}); filter != nil {
+		fields := append(append([]string{}, server.LogMaskedFields...), slowQueryMaskedFields...)
+		record = record.Str("filter", newLogMasker(fields).mask(filter))
+	}
+	if err != nil {
+		record = record.Err(err)
+	}
+	record.Msg("Slow storage operation")
+}
@@ -0,0 +1,83 @@
+// slowquery_test.go
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"github.com/rs/zerolog"
+	"testing"
+	"time"
+)
+
+// slowQueryCount returns the value of the slow query metric of the
+// operation in operation.
+func slowQueryCount(operation string) int64 {
+	if count, ok := slowQueryMetrics.Get(operation).(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+// Test a storage operation slower than the threshold is logged with its
+// request ID, its duration and its filter, free text and masked fields
+// hashed, and counted, and a fast one is neither.
+func TestSlowQueryLogged(t *testing.T) {
+	var logged bytes.Buffer
+	logger := newLogger(&logged, zerolog.InfoLevel, LogFormatJSON)
+	slow := server
+	slow.Logger = &logger
+	slow.LogMaskedFields = []string{"organisation_ids"}
+	slow.SlowQueryThreshold = 20 * time.Millisecond
+
+	ctx, id := withRequestID(context.Background())
+	ctx = withQueryFilter(slow.withRequestLogger(ctx),
+		PaymentSearch{OrganisationIDs: []string{"acme"}, Text: "Jane Doe"})
+	before := slowQueryCount("slowSearch")
+	err := slow.storage(ctx, "slowSearch", "", func() error {
+		time.Sleep(40 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected the operation to succeed. Got %v", err)
+	}
+	if count := slowQueryCount("slowSearch") - before; count != 1 {
+		t.Errorf("Expected the slow operation to be counted once. Got %d", count)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(logged.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single slow query record. Got %q", logged.String())
+	}
+	if record["level"] != "warn" || record["operation"] != "slowSearch" ||
+		record["request_id"] != id {
+		t.Errorf("Expected a warning of slowSearch for request %s. Got %v", id, record)
+	}
+	if duration, _ := record["duration"].(float64); duration < 40 {
+		t.Errorf("Expected a duration of at least 40ms. Got %v", record["duration"])
+	}
+	var filter PaymentSearch
+	json.Unmarshal([]byte(record["filter"].(string)), &filter)
+	if filter.Text != maskHash("Jane Doe") || len(filter.OrganisationIDs) != 1 ||
+		filter.OrganisationIDs[0] != maskHash("acme") {
+		t.Errorf("Expected the text and organisation to be hashed. Got %v", record["filter"])
+	}
+
+	logged.Reset()
+	before = slowQueryCount("fastSearch")
+	slow.storage(ctx, "fastSearch", "", func() error { return nil })
+	if logged.Len() > 0 || slowQueryCount("fastSearch") != before {
+		t.Errorf("Expected a fast operation to be neither logged nor counted. Got %q",
+			logged.String())
+	}
+
+	slow.SlowQueryThreshold = -1
+	slow.storage(ctx, "slowSearch", "", func() error {
+		time.Sleep(40 * time.Millisecond)
+		return nil
+	})
+	if logged.Len() > 0 {
+		t.Errorf("Expected no slow queries to be logged when disabled. Got %q", logged.String())
+	}
+}
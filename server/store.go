@@ -0,0 +1,89 @@
+// store.go - The backing store of single payment records, as used by
+// the handlers reading and writing them.
+
+package server
+
+import (
+	"gopkg.in/mgo.v2"
+	"time"
+)
+
+// paymentStore is the backing store of the single payment records
+// read and written by the handlers of the payment URL, and of their
+// locks. Each method is the model function of the same name (see
+// modelGetPayment and the like) and reports the same errors, so that
+// the handlers can be exercised against another store in tests.
+type paymentStore interface {
+	getPayment(p *Payment) (int, Payment, error)
+	getArchivedPayment(p *Payment) (Payment, error)
+	createPaymentValidCheck(p *Payment) error
+	findDuplicatePayment(p *Payment) error
+	findSchemePaymentID(p *Payment) error
+	createPayment(p *Payment, now time.Time) error
+	updatePaymentValidCheck(p *Payment) error
+	updatePayment(p *Payment, now time.Time) error
+	deletePaymentValidCheck(p *Payment) error
+	deletePayment(p *Payment) (Payment, error)
+	deleteNotes(p *Payment) error
+	getLock(id string, now time.Time) (PaymentLock, error)
+}
+
+// mongoStore is the paymentStore of the backing MongoDB database: the
+// database, the name of the collection of its payment records, from
+// which those of the other collections are derived, the keys their
+// account numbers are sealed with, if any, and whether the payment_ids
+// of the payment records of each organisation are unique.
+type mongoStore struct {
+	*mgo.Database
+	collection             string
+	keys                   *accountKeyring
+	uniqueSchemePaymentIDs bool
+}
+
+func (db *mongoStore) getPayment(p *Payment) (int, Payment, error) {
+	return p.modelGetPayment(db)
+}
+
+func (db *mongoStore) getArchivedPayment(p *Payment) (Payment, error) {
+	return p.modelGetArchivedPayment(db)
+}
+
+func (db *mongoStore) createPaymentValidCheck(p *Payment) error {
+	return p.modelCreatePaymentValidCheck(db)
+}
+
+func (db *mongoStore) findDuplicatePayment(p *Payment) error {
+	return p.modelFindDuplicatePayment(db)
+}
+
+func (db *mongoStore) findSchemePaymentID(p *Payment) error {
+	return p.modelFindSchemePaymentID(db)
+}
+
+func (db *mongoStore) createPayment(p *Payment, now time.Time) error {
+	return p.modelCreatePayment(db, now)
+}
+
+func (db *mongoStore) updatePaymentValidCheck(p *Payment) error {
+	return p.modelUpdatePaymentValidCheck(db)
+}
+
+func (db *mongoStore) updatePayment(p *Payment, now time.Time) error {
+	return p.modelUpdatePayment(db, now)
+}
+
+func (db *mongoStore) deletePaymentValidCheck(p *Payment) error {
+	return p.modelDeletePaymentValidCheck(db)
+}
+
+func (db *mongoStore) deletePayment(p *Payment) (Payment, error) {
+	return p.modelDeletePayment(db)
+}
+
+func (db *mongoStore) deleteNotes(p *Payment) error {
+	return p.modelDeleteNotes(db)
+}
+
+func (db *mongoStore) getLock(id string, now time.Time) (PaymentLock, error) {
+	return modelGetLock(db, id, now)
+}
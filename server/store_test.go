@@ -0,0 +1,421 @@
+// store_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is a paymentStore holding its payment records, archived
+// payment records and locks in memory, for tests of the handlers that
+// need no database. The operations named in failures fail with their
+// error.
+type memoryStore struct {
+	mu       sync.Mutex
+	payments map[string]Payment
+	archived map[string]Payment
+	locks    map[string]PaymentLock
+	failures map[string]error
+}
+
+// newMemoryStore returns an empty memoryStore.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{payments: map[string]Payment{}, archived: map[string]Payment{},
+		locks: map[string]PaymentLock{}, failures: map[string]error{}}
+}
+
+// fail has the operation of the store in operation fail with err, or
+// succeed again if err is nil.
+func (store *memoryStore) fail(operation string, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.failures[operation] = err
+}
+
+// failure returns the error the operation in operation is to fail with.
+// The store must be locked.
+func (store *memoryStore) failure(operation string) error {
+	return store.failures[operation]
+}
+
+// clonePayment returns a copy of the payment record in p sharing none
+// of its parties, so that the store is not changed through the
+// payment records it returns.
+func clonePayment(p Payment) Payment {
+	var clone Payment
+	data, _ := json.Marshal(p)
+	json.Unmarshal(data, &clone)
+	clone.CreatedAt, clone.UpdatedAt = p.CreatedAt, p.UpdatedAt
+	clone.Fingerprint, clone.Status = p.Fingerprint, p.Status
+	return clone
+}
+
+func (store *memoryStore) getPayment(p *Payment) (int, Payment, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if checkEmptyPaymentID(p) {
+		return -1, Payment{}, &PaymentIDError{Reason: "No Payment ID specified"}
+	}
+	if err := store.failure("getPayment"); err != nil {
+		return -1, Payment{}, err
+	}
+	stored, ok := store.payments[p.ID]
+	if !ok || p.OrganisationID != "" && stored.OrganisationID != p.OrganisationID {
+		return 0, Payment{}, ErrPaymentNotFound
+	}
+	return 1, clonePayment(stored), nil
+}
+
+func (store *memoryStore) getArchivedPayment(p *Payment) (Payment, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.failure("getArchivedPayment"); err != nil {
+		return Payment{}, err
+	}
+	stored, ok := store.archived[p.ID]
+	if !ok || p.OrganisationID != "" && stored.OrganisationID != p.OrganisationID {
+		return Payment{}, mgo.ErrNotFound
+	}
+	stored = clonePayment(stored)
+	stored.Archived = true
+	return stored, nil
+}
+
+func (store *memoryStore) createPaymentValidCheck(p *Payment) error {
+	if err := checkNewPaymentValues(p); err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.failure("createPaymentValidCheck"); err != nil {
+		return err
+	}
+	if _, ok := store.payments[p.ID]; ok {
+		return ErrPaymentExists
+	}
+	return nil
+}
+
+func (store *memoryStore) findDuplicatePayment(p *Payment) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	fingerprint := paymentFingerprint(p)
+	for id, stored := range store.payments {
+		if id != p.ID && stored.OrganisationID == p.OrganisationID &&
+			stored.Fingerprint == fingerprint {
+			return &DuplicatePaymentError{ID: id}
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) findSchemePaymentID(p *Payment) error {
+	if p.Attributes.PaymentID == "" {
+		return nil
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for id, stored := range store.payments {
+		if id != p.ID && stored.OrganisationID == p.OrganisationID &&
+			stored.Attributes.PaymentID == p.Attributes.PaymentID {
+			return &DuplicatePaymentError{ID: id, SchemePaymentID: p.Attributes.PaymentID}
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) createPayment(p *Payment, now time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.failure("createPayment"); err != nil {
+		return err
+	}
+	p.CreatedAt = now
+	stampPayment(p, now)
+	store.payments[p.ID] = clonePayment(*p)
+	return nil
+}
+
+func (store *memoryStore) updatePaymentValidCheck(p *Payment) error {
+	if checkEmptyPaymentID(p) {
+		return &PaymentIDError{Reason: "Cannot update a payment without a Payment ID specified"}
+	}
+	if err := checkPaymentValues(p); err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.failure("updatePaymentValidCheck"); err != nil {
+		return err
+	}
+	if _, ok := store.payments[p.ID]; !ok {
+		return &PaymentIDError{Reason: "A payment with this Payment ID does not exist"}
+	}
+	return nil
+}
+
+func (store *memoryStore) updatePayment(p *Payment, now time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.failure("updatePayment"); err != nil {
+		return err
+	}
+	stored, ok := store.payments[p.ID]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	stampPayment(p, now)
+	updated := clonePayment(*p)
+	updated.CreatedAt, updated.Status = stored.CreatedAt, stored.Status
+	store.payments[p.ID] = updated
+	return nil
+}
+
+func (store *memoryStore) deletePaymentValidCheck(p *Payment) error {
+	if checkEmptyPaymentID(p) {
+		return &PaymentIDError{Reason: "Cannot delete a payment without a Payment ID specified"}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.failure("deletePaymentValidCheck"); err != nil {
+		return err
+	}
+	if _, ok := store.payments[p.ID]; !ok {
+		return &PaymentIDError{Reason: "A payment with this Payment ID doesn't exists"}
+	}
+	return nil
+}
+
+func (store *memoryStore) deletePayment(p *Payment) (Payment, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.failure("deletePayment"); err != nil {
+		return Payment{}, err
+	}
+	removed, ok := store.payments[p.ID]
+	if !ok {
+		return Payment{}, mgo.ErrNotFound
+	}
+	delete(store.payments, p.ID)
+	delete(store.locks, p.ID)
+	return removed, nil
+}
+
+func (store *memoryStore) deleteNotes(p *Payment) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.locks, p.ID)
+	return nil
+}
+
+func (store *memoryStore) getLock(id string, now time.Time) (PaymentLock, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.failure("getLock"); err != nil {
+		return PaymentLock{}, err
+	}
+	lock, ok := store.locks[id]
+	if !ok || !lock.ExpiresAt.After(now) {
+		return PaymentLock{}, mgo.ErrNotFound
+	}
+	return lock, nil
+}
+
+// newMemoryServer returns a server backed by the memoryStore in store
+// rather than the database, changed by configure unless it is nil.
+func newMemoryServer(t testing.TB, store *memoryStore, configure func(*Server)) *Server {
+	t.Helper()
+	x := &Server{Config: Config{AdminKey: adminKey}, store: store}
+	if configure != nil {
+		configure(x)
+	}
+	x.Dispatch = mux.NewRouter()
+	x.initializeRoutes()
+	return x
+}
+
+// Test the handlers of the payment URL against the memoryStore: a
+// payment record is created, but not twice, read, updated, keeping its
+// stored status, patched, refused to update while locked and deleted,
+// and each storage failure is reported as StatusInternalServerError
+// without changing the payment record.
+func TestPaymentHandlersWithMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+	x := newMemoryServer(t, store, nil)
+	url := "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	execute := func(method, url, contentType string, body []byte) *httptest.ResponseRecorder {
+		req, _ := newJSONRequest(method, url, bytes.NewBuffer(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return executeOn(x, req)
+	}
+	reference := func(response *httptest.ResponseRecorder) string {
+		var p Payment
+		json.Unmarshal(response.Body.Bytes(), &p)
+		return p.Attributes.Reference
+	}
+
+	checkResponseCode(t, http.StatusNotFound, execute("GET", url, "", nil).Code)
+	checkResponseCode(t, http.StatusCreated, execute("POST", "/v1/payment", "", payload).Code)
+	checkResponseCode(t, http.StatusBadRequest, execute("POST", "/v1/payment", "", payload).Code)
+	response := execute("GET", url, "", nil)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if reference(response) != "Payment for Em's piano lessons" {
+		t.Errorf("Expected the created payment. Got %s", response.Body.String())
+	}
+	if stored := store.payments["4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"]; stored.CreatedAt.IsZero() ||
+		stored.Fingerprint == "" {
+		t.Errorf("Expected the payment to be stamped when created. Got %+v", stored)
+	}
+
+	failure := errors.New("storage unavailable")
+	store.fail("getPayment", failure)
+	checkResponseCode(t, http.StatusInternalServerError, execute("GET", url, "", nil).Code)
+	checkResponseCode(t, http.StatusInternalServerError,
+		execute("PATCH", url, MergePatchMediaType, []byte(`{"attributes":{"reference":"Failed"}}`)).Code)
+	store.fail("getPayment", nil)
+	store.fail("updatePayment", failure)
+	checkResponseCode(t, http.StatusInternalServerError, execute("PUT", url, "", payload2).Code)
+	store.fail("updatePayment", nil)
+	if reference(execute("GET", url, "", nil)) != "Payment for Em's piano lessons" {
+		t.Errorf("Expected failed updates to leave the payment unchanged")
+	}
+
+	checkResponseCode(t, http.StatusOK, execute("PUT", url, "", payload2).Code)
+	scheduled := store.payments["4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"]
+	scheduled.Status = PaymentScheduled
+	store.payments[scheduled.ID] = scheduled
+	var sent Payment
+	json.Unmarshal(payload2, &sent)
+	sent.Status = PaymentPending
+	body, _ := json.Marshal(sent)
+	response = execute("PUT", url+"?include_changes=true", "", body)
+	var changes PaymentChanges
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	if response.Code != http.StatusOK || changes.Status != PaymentScheduled || len(changes.Changes) != 0 {
+		t.Errorf("Expected the stored status kept and no change reported. Got %s", response.Body.String())
+	}
+	response = execute("PATCH", url, MergePatchMediaType, []byte(`{"attributes":{"reference":"Patched"}}`))
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if reference(execute("GET", url, "", nil)) != "Patched" {
+		t.Errorf("Expected the patched payment. Got %s", response.Body.String())
+	}
+
+	store.locks["4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"] = PaymentLock{Token: "held",
+		ExpiresAt: time.Now().Add(time.Minute)}
+	checkResponseCode(t, http.StatusLocked, execute("PUT", url, "", payload2).Code)
+	delete(store.locks, "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43")
+
+	store.fail("deletePayment", failure)
+	checkResponseCode(t, http.StatusInternalServerError, execute("DELETE", url, "", nil).Code)
+	store.fail("deletePayment", nil)
+	checkResponseCode(t, http.StatusOK, execute("DELETE", url, "", nil).Code)
+	checkResponseCode(t, http.StatusNotFound, execute("GET", url, "", nil).Code)
+	checkResponseCode(t, http.StatusNotFound, execute("DELETE", url, "", nil).Code)
+}
+
+// Test importing payment records against the memoryStore: each record
+// is subjected to the checks of createPayment, a client-sent status is
+// not kept, and the creation of each imported payment record is
+// published.
+func TestAdminImportWithMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+	x := newMemoryServer(t, store, func(x *Server) { x.events = newEventHub() })
+	subscriber := x.events.subscribe("")
+
+	var scheduled, unknownType Payment
+	json.Unmarshal(payload, &scheduled)
+	scheduled.Status = PaymentScheduled
+	json.Unmarshal(payload2, &unknownType)
+	unknownType.ID = "216d4da9-e59a-4cc6-8df3-3da6e7580b77"
+	unknownType.Attributes.SchemePaymentType = "Unknown"
+	var body bytes.Buffer
+	for _, p := range []Payment{scheduled, unknownType} {
+		record, _ := json.Marshal(p)
+		body.Write(append(record, '\n'))
+	}
+
+	req, _ := newJSONRequest("POST", "/v1/admin/import", &body)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("X-API-Key", adminKey)
+	response := executeOn(x, req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var summary ImportSummary
+	json.Unmarshal(response.Body.Bytes(), &summary)
+	if summary.Imported != 1 || len(summary.Failed) != 1 || summary.Failed[0].Index != 1 {
+		t.Errorf("Expected the unknown scheme payment type to be refused. Got %s", response.Body.String())
+	}
+	if stored, ok := store.payments[scheduled.ID]; !ok || stored.Status != "" {
+		t.Errorf("Expected the imported payment without its client-sent status. Got %+v", stored)
+	}
+	if _, ok := store.payments[unknownType.ID]; ok {
+		t.Errorf("Expected the refused payment not to be imported")
+	}
+	select {
+	case event := <-subscriber.events:
+		if event.Type != EventCreated || event.ID != scheduled.ID {
+			t.Errorf("Expected the creation of the imported payment. Got %+v", event)
+		}
+	default:
+		t.Errorf("Expected the creation of the imported payment to be published")
+	}
+}
+
+// Test two servers in one program keep their own collection and
+// encryption keys: a payment created through each is stored in its own
+// collection, sealed only by the one with a key, and read back in the
+// clear by each, and a server that fails to be created changes neither.
+func TestServersKeepTheirOwnStores(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	other, err := New(Config{Database: "test_v1", Collection: "payments_other",
+		EncryptionKey: encryptionKey, AdminKey: adminKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, name := range []string{"payments_other", "payments_other_notes", "payments_other_locks"} {
+			server.DB.C(name).DropCollection()
+		}
+		other.Close()
+	}()
+	if _, err := New(Config{Database: "test_v1", Collection: "payments_failed",
+		EncryptionKey: "not base64!"}); err == nil {
+		t.Fatal("Expected a server with an invalid key not to be created")
+	}
+
+	url := "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+	for _, x := range []*Server{other, &server} {
+		req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+		checkResponseCode(t, http.StatusCreated, executeOn(x, req).Code)
+	}
+	for name, x := range map[string]*Server{"payments_other": other, server.Collection: &server} {
+		req, _ := http.NewRequest("GET", url, nil)
+		response := executeOn(x, req)
+		var p Payment
+		json.Unmarshal(response.Body.Bytes(), &p)
+		if response.Code != http.StatusOK || p.Attributes.DebtorParty == nil ||
+			p.Attributes.DebtorParty.AccountNumber != "GB29XABC10161234567801" {
+			t.Errorf("Expected the payment in the clear from %s. Got %s", name, response.Body.String())
+		}
+
+		var raw bson.M
+		server.DB.C(name).FindId("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43").One(&raw)
+		debtor, _ := raw["attributes"].(bson.M)["debtor_party"].(bson.M)
+		if _, sealed := debtor["account_number"].(bson.M); sealed != (x == other) {
+			t.Errorf("Expected the account number in %s to be sealed only with a key. Got %v",
+				name, debtor["account_number"])
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// text.go - The free text attributes of payment records, normalised,
+// bounded in length and refused with characters that do not render.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultMaxTextLength is the number of characters the free text
+// attributes of payment records are bounded to unless configured
+// otherwise, the four lines of 35 characters of a scheme address.
+const defaultMaxTextLength = 140
+
+// maxTextLength returns the number of characters the free text
+// attributes of payment records are bounded to, MaxTextLength or
+// defaultMaxTextLength if it is not set.
+func (server *Server) maxTextLength() int {
+	if server.MaxTextLength <= 0 {
+		return defaultMaxTextLength
+	}
+	return server.MaxTextLength
+}
+
+// textAttributes is a convenience function that returns every free
+// text attribute of Payment, mapped by its json name: the references
+// and purpose of the payment and the names and addresses of its
+// beneficiary and debtor parties, in that order.
+func textAttributes(p *Payment) ([]string, []*string) {
+	attributes := &p.Attributes
+	beneficiary, debtor := p.beneficiaryParty(), p.debtorParty()
+	return []string{"reference", "end_to_end_reference", "payment_purpose",
+			"beneficiary_party.name", "beneficiary_party.account_name",
+			"beneficiary_party.address", "debtor_party.name",
+			"debtor_party.account_name", "debtor_party.address"},
+		[]*string{&attributes.Reference, &attributes.EndToEndReference,
+			&attributes.PaymentPurpose, &beneficiary.Name, &beneficiary.AccountName,
+			&beneficiary.Address, &debtor.Name, &debtor.AccountName, &debtor.Address}
+}
+
+// checkTextAttributes is a convenience function that ascertains every
+// free text attribute of Payment is no longer than maxLength characters
+// and holds only characters that render, letters, marks, numbers,
+// punctuation, symbols and spaces, and none of the control or format
+// characters that break the records rendered from it. A
+// ValidationError is returned for each attribute that does not.
+func checkTextAttributes(p *Payment, maxLength int) error {
+	var errs []error
+	names, values := textAttributes(p)
+	for i, value := range values {
+		if length := utf8.RuneCountInString(*value); length > maxLength {
+			errs = append(errs, &ValidationError{Attribute: names[i],
+				Reason: fmt.Sprintf("%d characters exceed the limit of %d", length, maxLength)})
+			continue
+		}
+		for _, r := range *value {
+			if !unicode.IsGraphic(r) {
+				errs = append(errs, &ValidationError{Attribute: names[i],
+					Reason: fmt.Sprintf("the character %U is not allowed", r)})
+				break
+			}
+		}
+	}
+	return collectValidationErrors(errs...)
+}
+
+// checkText is a convenience function that subjects the free text
+// attributes of the payment record in p to checkTextAttributes, with
+// the maxTextLength of the server.
+func (server *Server) checkText(p *Payment) error {
+	return checkTextAttributes(p, server.maxTextLength())
+}
+
+// normaliseTextAttributes is a convenience function that trims the
+// outer whitespace of the free text attributes of Payment named in
+// fields, and collapses each run of whitespace within them to a single
+// space, so that names and references sent with stray spaces compare
+// equal to those sent without. No other attribute is touched.
+func normaliseTextAttributes(p *Payment, fields map[string]bool) {
+	names, values := textAttributes(p)
+	for i, value := range values {
+		if fields[names[i]] {
+			*value = strings.Join(strings.Fields(*value), " ")
+		}
+	}
+}
+
+// normalisedFields returns the set of the free text attributes of
+// payment records normalised (see normaliseTextAttributes): those in
+// NormalisedFields, every one of them if it has no entries, or none of
+// them if it is "none". Empty entries, such as those of an unset
+// environment variable, are ignored, and the names of other
+// attributes refused.
+func (server *Server) normalisedFields() (map[string]bool, error) {
+	names, _ := textAttributes(&Payment{})
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
+	fields := map[string]bool{}
+	for _, field := range server.NormalisedFields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		} else if strings.EqualFold(field, "none") {
+			return map[string]bool{}, nil
+		} else if !known[field] {
+			return nil, fmt.Errorf("Unknown normalised field %q", field)
+		}
+		fields[field] = true
+	}
+	if len(fields) == 0 {
+		return known, nil
+	}
+	return fields, nil
+}
+
+// normaliseText is a convenience function that normalises the free
+// text attributes of the payment record in p set up by New (see
+// normalisedFields) before it is checked and stored.
+func (server *Server) normaliseText(p *Payment) {
+	normaliseTextAttributes(p, server.normalised)
+}
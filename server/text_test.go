@@ -0,0 +1,110 @@
+// text_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test payments with an over-long reference, or a null byte in the name
+// of a party, are refused naming the attribute, while the bound on the
+// length of free text attributes may be configured.
+func TestTextAttributes(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	refused := func(t *testing.T, response *httptest.ResponseRecorder, field string) {
+		checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+		var m struct {
+			Errors []FieldError `json:"errors"`
+		}
+		json.Unmarshal(response.Body.Bytes(), &m)
+		if len(m.Errors) != 1 || m.Errors[0].Field != field || m.Errors[0].Code != FieldInvalid {
+			t.Errorf("Expected %s to be refused. Got %s", field, response.Body.String())
+		}
+	}
+	reference := []byte(`"reference":"Payment for Em's piano lessons"`)
+
+	long := bytes.Replace(payload, reference,
+		[]byte(`"reference":"`+strings.Repeat("x", defaultMaxTextLength+1)+`"`), 1)
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(long))
+	refused(t, executeRequest(req), "reference")
+
+	nul := bytes.Replace(payload, []byte(`"name":"Wilfred Jeremiah Owens"`),
+		[]byte(`"name":"Wilfred\u0000Owens"`), 1)
+	req, _ = newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(nul))
+	refused(t, executeRequest(req), "beneficiary_party.name")
+
+	bounded := newTestServer(t, func(x *Server) {
+		x.MaxTextLength = 33
+	})
+	long = bytes.Replace(payload, reference, []byte(`"reference":"`+strings.Repeat("x", 34)+`"`), 1)
+	req, _ = newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(long))
+	rr := executeOn(bounded, req)
+	refused(t, rr, "reference")
+
+	limit := bytes.Replace(payload, reference, []byte(`"reference":"`+strings.Repeat("x", 33)+`"`), 1)
+	req, _ = newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(limit))
+	rr = executeOn(bounded, req)
+	checkResponseCode(t, http.StatusCreated, rr.Code)
+}
+
+// Test the outer whitespace of free text attributes is trimmed and
+// inner runs of it collapsed on create and update, while a server
+// normalising only some attributes leaves the others untouched.
+func TestNormaliseTextAttributes(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	stored := func(t *testing.T) Payment {
+		req, _ := http.NewRequest("GET", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var p Payment
+		json.Unmarshal(response.Body.Bytes(), &p)
+		return p
+	}
+
+	spaced := bytes.Replace(payload, []byte(`"account_name":"W Owens"`),
+		[]byte(`"account_name":"  W Owens  "`), 1)
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(spaced))
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	if p := stored(t); p.Attributes.BeneficiaryParty.AccountName != "W Owens" ||
+		p.Attributes.Amount.String() != "100.21" {
+		t.Errorf("Expected \"W Owens\" to be stored. Got %q", p.Attributes.BeneficiaryParty.AccountName)
+	}
+
+	spaced = bytes.Replace(payload, []byte(`"reference":"Payment for Em's piano lessons"`),
+		[]byte(`"reference":" Payment for\t Em's  piano lessons "`), 1)
+	req, _ = newJSONRequest("PUT", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", bytes.NewBuffer(spaced))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	if p := stored(t); p.Attributes.Reference != "Payment for Em's piano lessons" {
+		t.Errorf("Expected the reference to be normalised. Got %q", p.Attributes.Reference)
+	}
+
+	clearTable()
+	partial := newTestServer(t, func(x *Server) {
+		x.NormalisedFields = []string{"reference", ""}
+		if x.normalised, _ = x.normalisedFields(); len(x.normalised) != 1 {
+			t.Fatalf("Expected only the reference to be normalised. Got %v", x.normalised)
+		}
+	})
+	spaced = bytes.Replace(spaced, []byte(`"account_name":"W Owens"`),
+		[]byte(`"account_name":"  W Owens  "`), 1)
+	req, _ = newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(spaced))
+	rr := executeOn(partial, req)
+	checkResponseCode(t, http.StatusCreated, rr.Code)
+	if p := stored(t); p.Attributes.Reference != "Payment for Em's piano lessons" ||
+		p.Attributes.BeneficiaryParty.AccountName != "  W Owens  " {
+		t.Errorf("Expected only the reference to be normalised. Got %q and %q",
+			p.Attributes.Reference, p.Attributes.BeneficiaryParty.AccountName)
+	}
+
+	partial.NormalisedFields = []string{"amount"}
+	if _, err := partial.normalisedFields(); err == nil {
+		t.Errorf("Expected an attribute that is not free text to be refused")
+	}
+}
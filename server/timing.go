@@ -0,0 +1,55 @@
+// timing.go - The Server-Timing of the storage operations of requests.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// serverTimingHeader is the response header reporting the time the
+// storage operations of the request took, as the db metric of the
+// Server-Timing specification, such as "db;dur=12.3" in milliseconds.
+const serverTimingHeader = "Server-Timing"
+
+// dbTiming accumulates the time taken by the storage operations of a
+// request, which may run concurrently. A nil dbTiming is valid and
+// records nothing.
+type dbTiming struct {
+	nanos      int64
+	operations int64
+}
+
+// dbTimingKey is the context key of the dbTiming of a request.
+type dbTimingKey struct{}
+
+// withDBTiming returns a copy of ctx carrying a new dbTiming for its
+// request.
+func withDBTiming(ctx context.Context) (context.Context, *dbTiming) {
+	timing := &dbTiming{}
+	return context.WithValue(ctx, dbTimingKey{}, timing), timing
+}
+
+// timeStorage records the time since start, when a storage operation
+// of the request of ctx began, in the dbTiming of the request if it
+// has one.
+func timeStorage(ctx context.Context, start time.Time) {
+	if timing, ok := ctx.Value(dbTimingKey{}).(*dbTiming); ok {
+		atomic.AddInt64(&timing.nanos, int64(time.Since(start)))
+		atomic.AddInt64(&timing.operations, 1)
+	}
+}
+
+// setHeader sets the Server-Timing header in header to the time taken
+// by the storage operations recorded so far, if there were any.
+func (timing *dbTiming) setHeader(header http.Header) {
+	if timing == nil || atomic.LoadInt64(&timing.operations) == 0 {
+		return
+	}
+	elapsed := time.Duration(atomic.LoadInt64(&timing.nanos))
+	milliseconds := float64(elapsed) / float64(time.Millisecond)
+	header.Set(serverTimingHeader, "db;dur="+strconv.FormatFloat(milliseconds, 'f', 1, 64))
+}
@@ -0,0 +1,213 @@
+// tracing.go - OpenTelemetry traces of requests and the storage
+// operations serving them.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// tracerName is the name of the instrumentation tracing the server.
+const tracerName = "github.com/DeltaPine/payment_server"
+
+// tracingEnvironment are the environment variables configuring the
+// endpoint of the OTLP exporter. Traces are exported only if one of
+// them is set.
+var tracingEnvironment = []string{
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+}
+
+// InitTracing exports the traces of the server over OTLP/HTTP to the
+// collector configured by the standard OTEL_EXPORTER_OTLP_* and
+// OTEL_SERVICE_NAME environment variables, and propagates W3C trace
+// context. If no endpoint is configured tracing is left disabled, at
+// no cost to requests. The spans are exported in batches, and the
+// returned function exports those still buffered and stops the
+// exporter, waiting no longer than its context allows; it must be
+// called once the server is done so that they are not lost.
+func InitTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	none := func(context.Context) error { return nil }
+
+	configured := false
+	for _, name := range tracingEnvironment {
+		configured = configured || os.Getenv(name) != ""
+	}
+	if !configured {
+		return none, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return none, fmt.Errorf("Cannot export traces: %s", err)
+	}
+	service, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "payment_server")),
+		resource.WithFromEnv())
+	if err != nil {
+		return none, fmt.Errorf("Cannot describe the traced service: %s", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(service))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracer is a convenience function that returns the tracer of the
+// server, from the tracer provider set last.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// requestIDHeader is the response header carrying the ID of the
+// request, which the server logs the failures of the request with.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the context key of the ID of a request.
+type requestIDKey struct{}
+
+// withRequestID returns a copy of ctx carrying the ID of its request:
+// the ID of its trace if it is traced, otherwise a random one.
+func withRequestID(ctx context.Context) (context.Context, string) {
+	id := ""
+	if span := trace.SpanContextFromContext(ctx); span.HasTraceID() {
+		id = span.TraceID().String()
+	} else {
+		random := make([]byte, 16)
+		rand.Read(random)
+		id = hex.EncodeToString(random)
+	}
+	return context.WithValue(ctx, requestIDKey{}, id), id
+}
+
+// requestID returns the ID of the request of ctx, or "-" if it has
+// none.
+func requestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// tracedWriter is the http.ResponseWriter of a traced request,
+// recording the status of the response and reporting the time its
+// storage operations took in the Server-Timing header. It carries the
+// logger of the request once it is logged (see responseLogger).
+type tracedWriter struct {
+	http.ResponseWriter
+	status int
+	timing *dbTiming
+	logger *zerolog.Logger
+}
+
+// WriteHeader records the status in code and emits it along with the
+// Server-Timing header.
+func (w *tracedWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.timing.setHeader(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write records the implicit StatusOK of a response written without a
+// status, and emits the data in data.
+func (w *tracedWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Hijack records StatusSwitchingProtocols and hands the connection of
+// the request over to the handler, such as for a WebSocket.
+func (w *tracedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// traceRequests is a middleware that serves every request within a
+// server span named by its method and route, continuing the trace of
+// the client if the request carries trace context. The span records
+// the status of the response, and is in error for server errors. The
+// ID of the request is returned in the X-Request-ID header, and the
+// time its storage operations took in the Server-Timing header (see
+// traceStorage).
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(),
+			propagation.HeaderCarrier(r.Header))
+		route, _ := mux.CurrentRoute(r).GetPathTemplate()
+		ctx, span := tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path)))
+		defer span.End()
+		ctx, id := withRequestID(ctx)
+		w.Header().Set(requestIDHeader, id)
+		ctx, timing := withDBTiming(ctx)
+
+		traced := &tracedWriter{ResponseWriter: w, timing: timing}
+		next.ServeHTTP(traced, r.WithContext(ctx))
+		if traced.status == 0 {
+			traced.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", traced.status))
+		if traced.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(traced.status))
+		}
+	})
+}
+
+// traceStorage invokes the storage operation in fn on the collection
+// named by collection within a client span of the trace in ctx named
+// by operation, recording the Payment ID in id if it is populated and
+// any error of fn. The time fn takes is added to the Server-Timing of
+// the request (see timeStorage).
+func traceStorage(ctx context.Context, collection string, operation string, id string,
+	fn func() error) error {
+	attributes := []attribute.KeyValue{
+		attribute.String("db.system", "mongodb"),
+		attribute.String("db.operation.name", operation),
+		attribute.String("db.collection.name", collection),
+	}
+	if id != "" {
+		attributes = append(attributes, attribute.String("payment.id", id))
+	}
+	_, span := tracer().Start(ctx, "mongodb "+operation,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+	defer span.End()
+
+	start := time.Now()
+	err := fn()
+	timeStorage(ctx, start)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+// tracing_test.go
+
+package server
+
+import (
+	"bytes"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// spanAttribute returns the value of the attribute of span named by
+// key, or an empty value if it has none.
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// Test a request is served within a server span continuing the trace
+// of the client, with a child span for each storage operation naming
+// the operation and the Payment ID.
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+	shutdown, err := InitTracing(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(t.Context())
+
+	clearTable()
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	recorder.Reset()
+
+	req, _ = http.NewRequest("GET", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected a storage span and a server span. Got %d spans", len(spans))
+	}
+	storage, request := spans[0], spans[1]
+	if request.Name() != "GET /v1/payment/{id}" || request.SpanKind() != trace.SpanKindServer ||
+		request.Parent().SpanID().String() != "b7ad6b7169203331" ||
+		request.SpanContext().TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("Expected the server span to continue the trace of the client. Got %s %s",
+			request.Name(), request.SpanContext().TraceID())
+	}
+	if status := spanAttribute(request, "http.response.status_code").AsInt64(); status != 200 {
+		t.Errorf("Expected the server span to record the status. Got %d", status)
+	}
+	if storage.Name() != "mongodb getPayment" ||
+		storage.Parent().SpanID() != request.SpanContext().SpanID() ||
+		spanAttribute(storage, "db.operation.name").AsString() != "getPayment" ||
+		spanAttribute(storage, "payment.id").AsString() != "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43" {
+		t.Errorf("Expected a child span for the lookup of the payment. Got %s %v",
+			storage.Name(), storage.Attributes())
+	}
+}
+
+// Test the time taken by the storage operations of a GET is reported
+// in the Server-Timing header, and that requests making none carry no
+// such header.
+func TestServerTiming(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	req, _ := newJSONRequest("POST", "/v1/payment", bytes.NewBuffer(payload))
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	timing := response.Header().Get("Server-Timing")
+	if !strings.HasPrefix(timing, "db;dur=") {
+		t.Fatalf("Expected the db duration in the Server-Timing header. Got %q", timing)
+	}
+	if _, err := strconv.ParseFloat(strings.TrimPrefix(timing, "db;dur="), 64); err != nil {
+		t.Errorf("Expected the db duration in milliseconds. Got %q", timing)
+	}
+
+	req, _ = http.NewRequest("GET", "/version", nil)
+	response = executeRequest(req)
+	if timing := response.Header().Get("Server-Timing"); timing != "" {
+		t.Errorf("Expected no Server-Timing header without storage operations. Got %q", timing)
+	}
+}
+
+// Test the spans still buffered when tracing is shut down are exported
+// to the collector rather than lost, and that shutting down tracing
+// that was never enabled does nothing.
+func TestTracingShutdown(t *testing.T) {
+	exported := make(chan struct{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			select {
+			case exported <- struct{}{}:
+			default:
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+
+	shutdown, err := InitTracing(t.Context())
+	if err != nil || shutdown(t.Context()) != nil {
+		t.Fatalf("Expected tracing to be left disabled. Got %v", err)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	if shutdown, err = InitTracing(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	_, span := tracer().Start(t.Context(), "buffered")
+	span.End()
+	select {
+	case <-exported:
+		t.Fatalf("Expected the span to be buffered until the batch is due")
+	default:
+	}
+	if err := shutdown(t.Context()); err != nil {
+		t.Fatalf("Cannot shut tracing down: %v", err)
+	}
+	select {
+	case <-exported:
+	default:
+		t.Errorf("Expected the buffered span to be exported on shutdown")
+	}
+}
@@ -0,0 +1,85 @@
+// transaction.go - Groups of related writes to the backing store that
+// take effect together or not at all.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// transaction groups the writes of related operations on the backing
+// store, so that if one fails those already made are undone. The mgo
+// driver predates the multi-document transactions of MongoDB 4.0, so
+// rather than running the writes in a database transaction every write
+// made through a transaction records a compensating write, and a
+// failed transaction applies them in reverse order. Unlike a database
+// transaction, other clients may observe the writes of a transaction
+// before it completes or is rolled back.
+type transaction struct {
+	db   *mongoStore
+	undo []func(db *mongoStore) error
+}
+
+// withTransaction invokes fn with a transaction on the backing data
+// store in db. If fn returns an error the writes made through the
+// transaction are rolled back and the error returned, noting any
+// failure to roll back.
+func withTransaction(db *mongoStore, fn func(tx *transaction) error) error {
+	tx := &transaction{db: db}
+	err := fn(tx)
+	if err == nil {
+		return nil
+	}
+	if rollbackErr := tx.rollback(); rollbackErr != nil {
+		return fmt.Errorf("%s, and rolling back failed: %s", err, rollbackErr)
+	}
+	return err
+}
+
+// createPayment creates the payment record in p at now within the
+// transaction (see modelCreatePayment), to be removed again on roll
+// back.
+func (tx *transaction) createPayment(p *Payment, now time.Time) error {
+	if err := p.modelCreatePayment(tx.db, now); err != nil {
+		return err
+	}
+	id := p.ID
+	tx.undo = append(tx.undo, func(db *mongoStore) error {
+		return db.C(db.collection).RemoveId(id)
+	})
+	return nil
+}
+
+// recordAnonymisation records the audit record of an anonymisation in
+// record within the transaction, to be removed again on roll back.
+func (tx *transaction) recordAnonymisation(record Anonymisation) error {
+	if err := tx.db.C(anonymisationsCollection).Insert(record); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func(db *mongoStore) error {
+		return db.C(anonymisationsCollection).RemoveId(record.ID)
+	})
+	return nil
+}
+
+// onRollback registers undo to be applied if the transaction is
+// rolled back, for a write made on behalf of the transaction but not
+// through it.
+func (tx *transaction) onRollback(undo func(db *mongoStore) error) {
+	tx.undo = append(tx.undo, undo)
+}
+
+// rollback undoes the writes made through the transaction, latest
+// first, and returns the first error met. Every write is undone even
+// if undoing another fails.
+func (tx *transaction) rollback() error {
+	var first error
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if err := tx.undo[i](tx.db); err != nil && first == nil {
+			first = err
+		}
+	}
+	tx.undo = nil
+	return first
+}
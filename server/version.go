@@ -0,0 +1,42 @@
+// version.go - The build of the server, reported to operators.
+
+package server
+
+import (
+	"net/http"
+)
+
+// The version, git commit and date of the build, injected at link time
+// with for example
+//
+//	pkg=github.com/DeltaPine/payment_server/server
+//	go build -ldflags "-X $pkg.buildVersion=1.4.0 \
+//		-X $pkg.buildCommit=$(git rev-parse HEAD) \
+//		-X $pkg.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// and dev for builds without them.
+var (
+	buildVersion = "dev"
+	buildCommit  = "dev"
+	buildDate    = "dev"
+)
+
+// Version describes the build of the server.
+type Version struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"build_date"`
+}
+
+// currentVersion returns the Version of the running build.
+func currentVersion() Version {
+	return Version{Version: buildVersion, Commit: buildCommit, Date: buildDate}
+}
+
+// getVersion is the entry-point dispatcher for the build of the
+// server. It responds to the URL version and an appropriate GET
+// request with the Version of the running build. No API key is
+// required.
+func getVersion(w http.ResponseWriter, r *http.Request) {
+	respondWith(w, http.StatusOK, currentVersion(), negotiatedType(w))
+}
@@ -0,0 +1,62 @@
+// versions.go - The versions of the web API, each served under the
+// path prefix of its own, and the deprecated URLs without a prefix.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiBaseURL is the URL the links of responses are relative to.
+const apiBaseURL = "https://api.test.form3.tech"
+
+// v1Prefix is the path prefix of the URLs of version 1 of the web API.
+const v1Prefix = "/v1"
+
+// apiLink is a convenience function that returns the URL of the path
+// in path of the current version of the web API, such as
+// /payment/{id}, to link to in responses.
+func apiLink(path string) string {
+	return apiBaseURL + v1Prefix + path
+}
+
+// unversionedPath is a convenience function that returns the path
+// template in path without the prefix of its version, if it has one,
+// as the routes are described in routeQueryParameters and
+// routeContentTypes and documented in openapi.json.
+func unversionedPath(path string) string {
+	if strings.HasPrefix(path, v1Prefix+"/") {
+		return strings.TrimPrefix(path, v1Prefix)
+	}
+	return path
+}
+
+// initializeVersionedRoutes sets up the routes of each version of the
+// web API under its own path prefix, with the handlers of that version,
+// and those of version 1 again without a prefix, as they were served
+// before the prefix was introduced, announcing their deprecation (see
+// deprecateUnversioned). A later version is added as a subrouter of
+// its own alongside version 1.
+func (server *Server) initializeVersionedRoutes() {
+	server.initializeV1Routes(server.Dispatch.PathPrefix(v1Prefix).Subrouter())
+	unversioned := server.Dispatch.NewRoute().Subrouter()
+	unversioned.Use(server.deprecateUnversioned)
+	server.initializeV1Routes(unversioned)
+}
+
+// deprecateUnversioned is a middleware that announces the deprecation
+// of the URLs without a version prefix in the Deprecation header of
+// their responses, linking to the URL of version 1 as their successor,
+// and the date the URLs will be withdrawn in the Sunset header of RFC
+// 8594 if LegacySunset is set.
+func (server *Server) deprecateUnversioned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", "<"+v1Prefix+r.URL.Path+`>; rel="successor-version"`)
+		if !server.LegacySunset.IsZero() {
+			w.Header().Set("Sunset", server.LegacySunset.UTC().Format(http.TimeFormat))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,61 @@
+// versions_test.go
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Test the URLs without the version prefix serve the same payment
+// records as those of version 1 but announce their deprecation, and
+// their withdrawal if a sunset is configured, while the URLs of
+// version 1 and the operational URLs do not, and links are to the URLs
+// of version 1.
+func TestUnversionedRoutes(t *testing.T) {
+	clearTable()
+	defer clearTable()
+	req, _ := newJSONRequest("POST", "/payment", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	if response.Header().Get("Deprecation") != "true" ||
+		response.Header().Get("Link") != `</v1/payment>; rel="successor-version"` ||
+		response.Header().Get("Sunset") != "" {
+		t.Errorf("Expected the deprecation of /payment without a sunset. Got %v", response.Header())
+	}
+
+	for _, path := range []string{"/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", "/health"} {
+		req, _ = http.NewRequest("GET", path, nil)
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if response.Header().Get("Deprecation") != "" {
+			t.Errorf("Expected %s not to be deprecated", path)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
+	req.Header.Set("Accept", EnvelopeMediaType)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var envelope PaymentEnvelope
+	json.Unmarshal(response.Body.Bytes(), &envelope)
+	if envelope.P.ID != "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43" ||
+		envelope.Links.Self != "https://api.test.form3.tech/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43" {
+		t.Errorf("Expected the payment linked at /v1. Got %s", response.Body.String())
+	}
+
+	sunset := newTestServer(t, func(x *Server) {
+		x.LegacySunset = time.Date(2027, 6, 30, 0, 0, 0, 0, time.UTC)
+	})
+	for _, method := range []string{"GET", "OPTIONS"} {
+		req, _ = http.NewRequest(method, "/payments", nil)
+		rr := executeOn(sunset, req)
+		if rr.Code >= 300 || rr.Header().Get("Deprecation") != "true" ||
+			rr.Header().Get("Sunset") != "Wed, 30 Jun 2027 00:00:00 GMT" {
+			t.Errorf("Expected %s /payments to announce its sunset. Got %d %v", method, rr.Code, rr.Header())
+		}
+	}
+}
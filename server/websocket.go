@@ -0,0 +1,198 @@
+// websocket.go - WebSocket subscriptions to the events of the changes
+// to payment records.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// wsWriteTimeout bounds the time a message to a subscriber may take to
+// be written. A subscriber is pinged every wsPingInterval and dropped
+// if it has sent nothing, not even a pong, for wsReadTimeout.
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsReadTimeout  = 2 * wsPingInterval
+)
+
+// wsUpgrader upgrades subscription requests to WebSocket connections.
+// Browsers may only connect from the origin of the server.
+var wsUpgrader = websocket.Upgrader{}
+
+// SubscriptionMessage is a message between a WebSocket subscriber and
+// the server other than a PaymentEvent. A subscriber sends a
+// "subscribe" message to receive only the events of OrganisationID, or
+// of every organisation it may see if OrganisationID is empty, and only
+// those of EventTypes, or of every type if it has none, and the server
+// confirms it with a "subscribed" message. A "ping" message is answered
+// with a "pong" message, and a message the server cannot act on with an
+// "error" message.
+type SubscriptionMessage struct {
+	Type           string   `json:"type"`
+	OrganisationID string   `json:"organisation_id,omitempty"`
+	EventTypes     []string `json:"event_types,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// errForeignSubscription is returned when a subscriber scoped to the
+// organisation of its API key filters its events to another one.
+var errForeignSubscription = errors.New(
+	"Only the events of the organisation of the API key may be subscribed to")
+
+// checkSubscription is a convenience function that ascertains a
+// subscriber scoped to the organisation in scope may filter its events
+// to those of the organisation in organisation and of the event types
+// in types. The error returned otherwise is returned along with the
+// status it calls for.
+func checkSubscription(scope string, organisation string, types []string) (int, error) {
+	if scope != "" && organisation != "" && organisation != scope {
+		return http.StatusForbidden, errForeignSubscription
+	}
+	for _, eventType := range types {
+		known := false
+		for _, candidate := range eventTypes {
+			known = known || eventType == candidate
+		}
+		if !known {
+			return http.StatusBadRequest, fmt.Errorf("Unknown event type %q, use %s",
+				eventType, strings.Join(eventTypes, ", "))
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// subscribePayments is the entry-point dispatcher for WebSocket
+// subscriptions to payment events. It responds to the URL payments/ws
+// and an appropriate GET request by upgrading the connection to a
+// WebSocket, on which every PaymentEvent of the organisation of the
+// API key, or of every organisation without one, is sent as a JSON
+// message until the subscriber filters them (see SubscriptionMessage).
+// The events may be filtered from the start to those of organisation_id
+// and of the comma separated event_types, an organisation other than
+// that of the API key being refused with StatusForbidden and an
+// unknown event type with StatusBadRequest.
+// A subscriber that falls behind by more than eventQueueSize events is
+// closed with a policy violation, and every subscriber is closed as
+// going away when the server shuts down. A subscription counts
+// towards MaxSubscriptions, rather than as a request in flight, for as
+// long as it lasts (see limitRequests).
+func (server *Server) subscribePayments(w http.ResponseWriter, r *http.Request) {
+	scope := callerOrganisation(r)
+	organisation, types := r.FormValue("organisation_id"), requestedIDs(r.FormValue("event_types"))
+	if code, err := checkSubscription(scope, organisation, types); err != nil {
+		respondWithError(w, code, err.Error())
+		return
+	}
+	subscriber := server.events.subscribe(scope)
+	if subscriber == nil {
+		respondWithError(w, http.StatusServiceUnavailable, "Subscriptions are not available")
+		return
+	}
+	defer server.events.unsubscribe(subscriber)
+	server.events.filter(subscriber, organisation, types)
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has responded with the error.
+		return
+	}
+	defer conn.Close()
+
+	replies := make(chan SubscriptionMessage)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	done := make(chan struct{})
+	go server.readSubscription(conn, subscriber, replies, stopped, done)
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		var message interface{}
+		select {
+		case event, ok := <-subscriber.events:
+			if !ok {
+				closeSubscription(conn, subscriber)
+				return
+			}
+			message = event
+		case reply := <-replies:
+			message = reply
+		case <-ping.C:
+			if conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(wsWriteTimeout)) != nil {
+				return
+			}
+			continue
+		case <-done:
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if conn.WriteJSON(message) != nil {
+			return
+		}
+	}
+}
+
+// readSubscription reads the messages of the subscriber on conn until
+// the connection fails or closes, and then closes done. Subscribe
+// messages filter the events of subscriber, restricted to the
+// organisation the subscriber is scoped to, and the replies are handed
+// to the writer of the connection through replies until it has
+// stopped.
+func (server *Server) readSubscription(conn *websocket.Conn, subscriber *eventSubscriber,
+	replies chan<- SubscriptionMessage, stopped <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var message SubscriptionMessage
+		json.Unmarshal(data, &message)
+		conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+
+		reply := SubscriptionMessage{Type: "error", Error: "Unknown message, use subscribe or ping"}
+		switch message.Type {
+		case "subscribe":
+			_, err := checkSubscription(subscriber.scope, message.OrganisationID, message.EventTypes)
+			if err != nil {
+				reply.Error = err.Error()
+				break
+			}
+			server.events.filter(subscriber, message.OrganisationID, message.EventTypes)
+			reply = SubscriptionMessage{Type: "subscribed", OrganisationID: message.OrganisationID,
+				EventTypes: message.EventTypes}
+		case "ping":
+			reply = SubscriptionMessage{Type: "pong"}
+		}
+		select {
+		case replies <- reply:
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// closeSubscription is a convenience function that closes the
+// WebSocket connection in conn of the subscriber in subscriber, whose
+// events have been closed, stating why: it fell behind, or the server
+// is going away.
+func closeSubscription(conn *websocket.Conn, subscriber *eventSubscriber) {
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "The server is shutting down")
+	if subscriber.evicted {
+		message = websocket.FormatCloseMessage(websocket.ClosePolicyViolation,
+			"Too slow to keep up with the events")
+	}
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(wsWriteTimeout))
+}
@@ -0,0 +1,241 @@
+// websocket_test.go
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startSubscriptions is a convenience function that serves a test
+// server, changed by configure unless it is nil, on a local port until
+// the returned function is called, which returns the error serve
+// returned.
+func startSubscriptions(t *testing.T, configure func(*Server)) (*Server, string, func() error) {
+	x := newTestServer(t, func(x *Server) {
+		x.events = newEventHub()
+		if configure != nil {
+			configure(x)
+		}
+	})
+	web, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- x.serve(ctx, web, nil) }()
+	return x, web.Addr().String(), func() error {
+		stop()
+		return <-served
+	}
+}
+
+// dialSubscription is a convenience function that subscribes to the
+// payment events at addr with the API key in key.
+func dialSubscription(t *testing.T, addr string, key string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/v1/payments/ws",
+		http.Header{"X-API-Key": {key}})
+	if err != nil {
+		t.Fatalf("Expected to subscribe to the payment events. Got %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+// Test subscribers are sent the events of the organisations they
+// subscribe to, within the organisation of their API key, have their
+// pings answered and are closed as going away on shutdown.
+func TestPaymentSubscriptions(t *testing.T) {
+	_, addr, stop := startSubscriptions(t, func(x *Server) {
+		x.APIKeys = map[string]APIKey{
+			"key-all":    {},
+			"key-scoped": {OrganisationID: "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"},
+		}
+	})
+	clearTable()
+
+	all := dialSubscription(t, addr, "key-all")
+	defer all.Close()
+	scoped := dialSubscription(t, addr, "key-scoped")
+	defer scoped.Close()
+
+	var reply SubscriptionMessage
+	all.WriteJSON(SubscriptionMessage{Type: "subscribe", OrganisationID: "org-b"})
+	if all.ReadJSON(&reply); reply.Type != "subscribed" || reply.OrganisationID != "org-b" {
+		t.Errorf("Expected the subscription to org-b. Got %+v", reply)
+	}
+	scoped.WriteJSON(SubscriptionMessage{Type: "subscribe", OrganisationID: "org-b"})
+	if scoped.ReadJSON(&reply); reply.Type != "error" {
+		t.Errorf("Expected a scoped key not to subscribe to org-b. Got %+v", reply)
+	}
+	scoped.WriteJSON(SubscriptionMessage{Type: "ping"})
+	if scoped.ReadJSON(&reply); reply.Type != "pong" {
+		t.Errorf("Expected the ping to be answered. Got %+v", reply)
+	}
+
+	other := bytes.Replace(payload2, []byte("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"),
+		[]byte("216d4da9-e59a-4cc6-8df3-3da6e7580b77"), 1)
+	other = bytes.Replace(other, []byte("743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"), []byte("org-b"), 1)
+	for _, body := range [][]byte{payload, other} {
+		req, _ := newJSONRequest("POST", "http://"+addr+"/v1/payment", bytes.NewReader(body))
+		req.Header.Set("X-API-Key", "key-all")
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		checkResponseCode(t, http.StatusCreated, response.StatusCode)
+	}
+	req, _ := http.NewRequest("DELETE", "http://"+addr+"/v1/payment/216d4da9-e59a-4cc6-8df3-3da6e7580b77", nil)
+	req.Header.Set("X-API-Key", "key-all")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	var event PaymentEvent
+	for _, expected := range []string{EventCreated, EventDeleted} {
+		if err := all.ReadJSON(&event); err != nil || event.Type != expected ||
+			event.ID != "216d4da9-e59a-4cc6-8df3-3da6e7580b77" || event.OrganisationID != "org-b" ||
+			event.Payment == nil || event.Payment.Attributes.Amount.String() != "121.00" {
+			t.Errorf("Expected the org-b payment to be %s. Got %+v, %v", expected, event, err)
+		}
+	}
+	if err := scoped.ReadJSON(&event); err != nil || event.Type != EventCreated ||
+		event.ID != "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43" {
+		t.Errorf("Expected only the payment of the organisation of the key. Got %+v, %v", event, err)
+	}
+
+	if err := stop(); err != nil {
+		t.Errorf("Expected the server to shut down cleanly. Got %v", err)
+	}
+	for name, conn := range map[string]*websocket.Conn{"all": all, "scoped": scoped} {
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("Expected the %s subscriber to be closed as going away. Got %v", name, err)
+		}
+	}
+}
+
+// Test a subscriber falling too far behind is evicted, without holding
+// up the others, and closed with a policy violation.
+func TestSlowSubscriberEviction(t *testing.T) {
+	x, addr, stop := startSubscriptions(t, nil)
+	defer stop()
+
+	slow := dialSubscription(t, addr, "")
+	defer slow.Close()
+	prompt := x.events.subscribe("")
+	subscribed := func() bool {
+		x.events.mu.Lock()
+		defer x.events.mu.Unlock()
+		return len(x.events.subscribers) == 2
+	}
+
+	var p Payment
+	json.Unmarshal(payload, &p)
+	published := 0
+	for ; published < 100000 && subscribed(); published++ {
+		x.publishEvent(EventUpdated, p)
+		<-prompt.events
+	}
+	if subscribed() {
+		t.Fatalf("Expected the subscriber to be evicted after %d events", published)
+	}
+	x.events.mu.Lock()
+	if !x.events.subscribers[prompt] {
+		t.Error("Expected the subscriber keeping up to stay subscribed")
+	}
+	x.events.mu.Unlock()
+
+	// The events written before the eviction are still delivered.
+	slow.SetReadDeadline(time.Now().Add(30 * time.Second))
+	received := 0
+	var err error
+	for err == nil {
+		var event PaymentEvent
+		if err = slow.ReadJSON(&event); err == nil {
+			received++
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) || received >= published {
+		t.Errorf("Expected the slow subscriber to be closed for its policy violation after fewer than %d events. Got %d, %v",
+			published, received, err)
+	}
+}
+
+// Test subscribers filtering by event type, from the query of their
+// handshake or with a subscribe message, are sent only the events of
+// those types, while an unknown type, or an organisation other than
+// that of a scoped API key, is refused.
+func TestSubscriptionEventTypes(t *testing.T) {
+	_, addr, stop := startSubscriptions(t, func(x *Server) {
+		x.APIKeys = map[string]APIKey{
+			"key-all":    {},
+			"key-scoped": {OrganisationID: "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"},
+		}
+	})
+	defer stop()
+	clearTable()
+	defer clearTable()
+
+	for query, expected := range map[string]int{
+		"event_types=created,moved": http.StatusBadRequest,
+		"organisation_id=org-b":     http.StatusForbidden,
+	} {
+		_, response, err := websocket.DefaultDialer.Dial("ws://"+addr+"/v1/payments/ws?"+query,
+			http.Header{"X-API-Key": {"key-scoped"}})
+		if err == nil || response == nil || response.StatusCode != expected {
+			t.Errorf("Expected a subscription with %s to be refused with %d. Got %v", query, expected, err)
+		}
+	}
+
+	deletions, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/v1/payments/ws?event_types=deleted",
+		http.Header{"X-API-Key": {"key-all"}})
+	if err != nil {
+		t.Fatalf("Expected to subscribe to the deletions. Got %v", err)
+	}
+	defer deletions.Close()
+	deletions.SetReadDeadline(time.Now().Add(10 * time.Second))
+	creations := dialSubscription(t, addr, "key-all")
+	defer creations.Close()
+	var reply SubscriptionMessage
+	creations.WriteJSON(SubscriptionMessage{Type: "subscribe", EventTypes: []string{"moved"}})
+	if creations.ReadJSON(&reply); reply.Type != "error" {
+		t.Errorf("Expected an unknown event type to be refused. Got %+v", reply)
+	}
+	creations.WriteJSON(SubscriptionMessage{Type: "subscribe", EventTypes: []string{EventCreated}})
+	if creations.ReadJSON(&reply); reply.Type != "subscribed" || len(reply.EventTypes) != 1 {
+		t.Errorf("Expected the subscription to the created events. Got %+v", reply)
+	}
+
+	send := func(method string, url string, body []byte) {
+		req, _ := newJSONRequest(method, "http://"+addr+url, bytes.NewReader(body))
+		req.Header.Set("X-API-Key", "key-all")
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+	send("POST", "/v1/payment", payload)
+	send("DELETE", "/v1/payment/4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43", nil)
+	send("POST", "/v1/payment", payload)
+
+	var event PaymentEvent
+	if err := deletions.ReadJSON(&event); err != nil || event.Type != EventDeleted {
+		t.Errorf("Expected only the deletion. Got %+v, %v", event, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := creations.ReadJSON(&event); err != nil || event.Type != EventCreated {
+			t.Errorf("Expected only the creations. Got %+v, %v", event, err)
+		}
+	}
+}